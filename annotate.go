@@ -0,0 +1,106 @@
+package forward
+
+import (
+	"net"
+
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// annotation configures debug_upstream: naming the upstreams that contributed to a reply in the reply
+// itself, in an EDE option or a TXT record.
+type annotation struct {
+	txt     bool         // add a TXT record instead of an EDE option
+	clients []*net.IPNet // only annotate replies to these clients, all if empty
+}
+
+// annotationName is the owner name of the TXT records added by debug_upstream.
+const annotationName = "upstream.forward."
+
+// annotate adds the addresses of the upstreams that contributed to ret to it, if f annotates replies to
+// the client of state.
+func (f *Forward) annotate(state request.Request, ret *dns.Msg, resps []fwdResp) {
+	a := f.annotation
+	if a == nil || !a.match(state) {
+		return
+	}
+	addrs := proxyAddrs(contributors(ret, resps))
+	if !a.txt {
+		addEDE(ret, edeOther, "answered by "+addrs)
+		return
+	}
+	txt := &dns.TXT{
+		Hdr: dns.RR_Header{Name: annotationName, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS},
+		Txt: []string{addrs},
+	}
+	// Keep the OPT record last.
+	extra := make([]dns.RR, 0, len(ret.Extra)+1)
+	for _, rr := range ret.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	extra = append(extra, txt)
+	if opt := ret.IsEdns0(); opt != nil {
+		extra = append(extra, opt)
+	}
+	ret.Extra = extra
+}
+
+func (a *annotation) match(state request.Request) bool {
+	if len(a.clients) == 0 {
+		return true
+	}
+	ip := net.ParseIP(state.IP())
+	for _, n := range a.clients {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// contributors returns the proxies whose response made it into ret: the one that gave us ret, or, for a
+// merged answer, all whose addresses are in it.
+func contributors(ret *dns.Msg, resps []fwdResp) []*Proxy {
+	for _, resp := range resps {
+		if resp.ret == ret {
+			return []*Proxy{resp.proxy}
+		}
+	}
+
+	in := map[string]bool{}
+	for _, rr := range ret.Answer {
+		in[addrKey(rr)] = true
+	}
+	var ps []*Proxy
+Resps:
+	for i := range resps {
+		if resps[i].ret == nil {
+			continue
+		}
+		set := newAddrSet(&resps[i])
+		if len(set.rrs) == 0 {
+			continue
+		}
+		for _, rr := range set.rrs {
+			if !in[addrKey(rr)] {
+				continue Resps
+			}
+		}
+		ps = append(ps, resps[i].proxy)
+	}
+	return ps
+}
+
+// addrKey returns the address of an A or AAAA record and the empty string for others.
+func addrKey(rr dns.RR) string {
+	switch x := rr.(type) {
+	case *dns.A:
+		return x.A.String()
+	case *dns.AAAA:
+		return x.AAAA.String()
+	}
+	return ""
+}
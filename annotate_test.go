@@ -0,0 +1,92 @@
+package forward
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+func TestAnnotate(t *testing.T) {
+	f := New()
+	f.p = &sequential{}
+	for _, addr := range []string{"127.0.0.1", "127.0.0.2"} {
+		rr := test.A("example.org. IN A " + addr)
+		p := NewProxy(addr+":53", transport.DNS)
+		p.SetTransport(&fakeTransport{exchange: func(m *dns.Msg, proto string) (*dns.Msg, error) {
+			ret := new(dns.Msg)
+			ret.SetReply(m)
+			ret.Answer = append(ret.Answer, rr)
+			return ret, nil
+		}})
+		f.SetProxy(p)
+	}
+	defer f.OnShutdown()
+
+	query := func() *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", dns.TypeA)
+		m.SetEdns0(4096, false)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{}) // client is 10.240.0.1
+		if _, err := f.ServeDNS(context.TODO(), rec, m); err != nil {
+			t.Fatalf("Expected to receive reply, but got: %s", err)
+		}
+		if n := len(m.IsEdns0().Option); n != 0 {
+			t.Errorf("Expected the request's OPT record to be left as is, got %d options", n)
+		}
+		return rec.Msg
+	}
+
+	f.annotation = &annotation{}
+	ret := query()
+	opt := ret.IsEdns0()
+	if opt == nil || len(opt.Option) != 1 {
+		t.Fatalf("Expected an EDE option, got %v", ret)
+	}
+	ede := opt.Option[0].(*dns.EDNS0_LOCAL)
+	if text := string(ede.Data[2:]); ede.Code != optionEDE || !strings.Contains(text, "127.0.0.1:53") || !strings.Contains(text, "127.0.0.2:53") {
+		t.Errorf("Expected an EDE naming both upstreams, got %v", ede)
+	}
+
+	f.annotation = &annotation{txt: true}
+	ret = query()
+	if len(ret.Extra) != 2 {
+		t.Fatalf("Expected a TXT and an OPT record, got %v", ret.Extra)
+	}
+	if txt, ok := ret.Extra[0].(*dns.TXT); !ok || !strings.Contains(txt.Txt[0], "127.0.0.1:53") || !strings.Contains(txt.Txt[0], "127.0.0.2:53") {
+		t.Errorf("Expected a TXT naming both upstreams, got %v", ret.Extra[0])
+	}
+	if _, ok := ret.Extra[1].(*dns.OPT); !ok {
+		t.Errorf("Expected the OPT record last, got %v", ret.Extra[1])
+	}
+
+	_, n, _ := net.ParseCIDR("192.168.0.0/16")
+	f.annotation = &annotation{clients: []*net.IPNet{n}}
+	if ret = query(); len(ret.IsEdns0().Option) != 0 {
+		t.Errorf("Expected no annotation for other clients, got %v", ret)
+	}
+}
+
+func TestContributors(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	p1, p2, p3 := NewProxy("10.0.0.1:53", "dns"), NewProxy("10.0.0.2:53", "dns"), NewProxy("10.0.0.3:53", "dns")
+	resps := []fwdResp{
+		{proxy: p1, ret: answer(req, false, test.A("example.org. IN A 127.0.0.1"))},
+		{proxy: p2, ret: answer(req, false, test.A("example.org. IN A 127.0.0.2"))},
+		{proxy: p3, ret: answer(req, false)},
+	}
+	if ps := contributors(resps[2].ret, resps); len(ps) != 1 || ps[0] != p3 {
+		t.Errorf("Expected the upstream whose reply was used, got %v", proxyAddrs(ps))
+	}
+	merged := answer(req, false, test.A("example.org. IN A 127.0.0.2"))
+	if ps := contributors(merged, resps); len(ps) != 1 || ps[0] != p2 {
+		t.Errorf("Expected the upstream whose addresses were used, got %v", proxyAddrs(ps))
+	}
+}
@@ -0,0 +1,51 @@
+package forward
+
+import "github.com/miekg/dns"
+
+const (
+	// anonUDPSize is the EDNS0 payload of anonymized queries, the client's own would tell about it.
+	anonUDPSize = defaultMaxUDPSize
+
+	// padBlock is the block size queries are padded to, as recommended by RFC 8467.
+	padBlock = 128
+)
+
+// anonymizeExtra returns the additional section of a query without anything that tells about the client: of
+// an OPT record only the DO bit is kept, in a fresh record with the payload of anonUDPSize. ECS, cookies and
+// all other options are dropped, as are the other records, e.g. TSIG.
+func anonymizeExtra(extra []dns.RR) []dns.RR {
+	for _, rr := range extra {
+		if opt, ok := rr.(*dns.OPT); ok {
+			o := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+			o.SetUDPSize(anonUDPSize)
+			o.SetDo(opt.Do())
+			return []dns.RR{o}
+		}
+	}
+	return nil
+}
+
+// padQuery pads m to a multiple of padBlock octets. m's OPT record must be its own, as Connect makes it; a
+// query without one gets one, with a payload of udpSize.
+func padQuery(m *dns.Msg, udpSize uint16) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		opt = &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+		opt.SetUDPSize(udpSize)
+		m.Extra = append(m.Extra, opt)
+	}
+	// The option itself takes 4 octets for its code and length.
+	n := (padBlock - (m.Len()+4)%padBlock) % padBlock
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, n)})
+}
+
+// withoutOPT returns extra without its OPT record, for the reply to a client that didn't send one.
+func withoutOPT(extra []dns.RR) []dns.RR {
+	out := extra[:0:0]
+	for _, rr := range extra {
+		if _, ok := rr.(*dns.OPT); !ok {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
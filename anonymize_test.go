@@ -0,0 +1,95 @@
+package forward
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/caddyserver/caddy"
+	"github.com/miekg/dns"
+)
+
+func TestAnonymize(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		seen *dns.Msg
+	)
+	// last returns the last query asked, health checks aside.
+	last := func() *dns.Msg {
+		mu.Lock()
+		defer mu.Unlock()
+		return seen
+	}
+	s := newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		if r.Question[0].Name != "." {
+			mu.Lock()
+			seen = r
+			mu.Unlock()
+		}
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		if opt := r.IsEdns0(); opt != nil {
+			ret.SetEdns0(opt.UDPSize(), opt.Do())
+		}
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	c := caddy.NewTestController("dns", "forward . "+s.Addr+" {\nanonymize pad\n}\n")
+	f, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	f.OnStartup()
+	defer f.OnShutdown()
+
+	m := new(dns.Msg)
+	m.SetQuestion("ExAmPlE.oRg.", dns.TypeA)
+	m.SetEdns0(4096, true)
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option,
+		&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("192.0.2.0").To4()},
+		&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0123456789abcdef"})
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := f.ServeDNS(context.TODO(), rec, m); err != nil {
+		t.Fatalf("Expected to receive reply, but got: %s", err)
+	}
+	asked := last()
+	if asked.Question[0].Name != "example.org." {
+		t.Errorf("Expected the name in lower case, got %s", asked.Question[0].Name)
+	}
+	aopt := asked.IsEdns0()
+	if aopt == nil || !aopt.Do() || aopt.UDPSize() != anonUDPSize {
+		t.Fatalf("Expected an OPT record with DO and a payload of %d, got %v", anonUDPSize, aopt)
+	}
+	for _, o := range aopt.Option {
+		if o.Option() != dns.EDNS0PADDING {
+			t.Errorf("Expected only padding, got option %d", o.Option())
+		}
+	}
+	if n := asked.Len(); n%padBlock != 0 {
+		t.Errorf("Expected the query padded to a multiple of %d, got %d octets", padBlock, n)
+	}
+	if len(opt.Option) != 2 {
+		t.Errorf("Expected the client's query to be left alone, got %d options", len(opt.Option))
+	}
+
+	// Without EDNS0 the query gets an OPT record for the padding, the reply mustn't have one.
+	m = new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	rec = dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := f.ServeDNS(context.TODO(), rec, m); err != nil {
+		t.Fatalf("Expected to receive reply, but got: %s", err)
+	}
+	asked = last()
+	if asked.IsEdns0() == nil || asked.Len()%padBlock != 0 {
+		t.Errorf("Expected a padded query with EDNS0, got %d octets", asked.Len())
+	}
+	if rec.Msg.IsEdns0() != nil {
+		t.Errorf("Expected no OPT record in the reply to a client without EDNS0")
+	}
+}
@@ -0,0 +1,87 @@
+package forward
+
+import (
+	"fmt"
+
+	"github.com/coredns/coredns/plugin"
+)
+
+// authority is a single authoritative line: the answers of proxies override those of the other upstreams
+// for names in zones.
+type authority struct {
+	zones   []string
+	proxies []*Proxy
+}
+
+// parseAuthority parses the arguments of authoritative: ZONE... from TO...; TO must be configured upstreams.
+func (f *Forward) parseAuthority(args []string) (authority, error) {
+	a := authority{}
+	i := 0
+	for ; i < len(args) && args[i] != "from"; i++ {
+		a.zones = append(a.zones, normalizeHost(args[i]))
+	}
+	if len(a.zones) == 0 {
+		return a, fmt.Errorf("authoritative needs at least one zone")
+	}
+	if i+1 >= len(args) {
+		return a, fmt.Errorf("authoritative needs from and at least one upstream")
+	}
+	proxies, err := f.matchProxies(args[i+1:])
+	if err != nil {
+		return a, err
+	}
+	a.proxies = proxies
+	return a, nil
+}
+
+// hasAuthority returns true if some upstream is authoritative for name.
+func (f *Forward) hasAuthority(name string) bool {
+	for i := range f.authorities {
+		if f.authorities[i].covers(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAuthoritative returns true if p is authoritative for name.
+func (f *Forward) isAuthoritative(name string, p *Proxy) bool {
+	for i := range f.authorities {
+		if !f.authorities[i].covers(name) {
+			continue
+		}
+		for _, ap := range f.authorities[i].proxies {
+			if ap == p {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (a *authority) covers(name string) bool {
+	for _, z := range a.zones {
+		if plugin.Name(z).Matches(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// authoritativeResps returns the responses of the upstreams authoritative for name, or resps if none of them
+// replied.
+func (f *Forward) authoritativeResps(name string, resps []fwdResp) []fwdResp {
+	if !f.hasAuthority(name) {
+		return resps
+	}
+	auth := make([]fwdResp, 0, len(resps))
+	for _, resp := range resps {
+		if resp.ret != nil && f.isAuthoritative(name, resp.proxy) {
+			auth = append(auth, resp)
+		}
+	}
+	if len(auth) == 0 {
+		return resps
+	}
+	return auth
+}
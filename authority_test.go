@@ -0,0 +1,62 @@
+package forward
+
+import (
+	"testing"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+func TestReplyAuthoritative(t *testing.T) {
+	f := New()
+	rec, auth := NewProxy("10.0.0.1:53", "dns"), NewProxy("10.0.0.2:53", "dns")
+	f.proxies = []*Proxy{rec, auth}
+	f.authorities = []authority{{zones: []string{"corp.example.org."}, proxies: []*Proxy{auth}}}
+
+	tests := []struct {
+		qname    string
+		authResp *dns.Msg // nil if the authoritative upstream didn't reply
+		expected int      // answers
+		rcode    int
+	}{
+		// Outside the zone, merged as usual.
+		{"www.example.org.", nil, 1, dns.RcodeSuccess},
+		{"www.example.org.", &dns.Msg{}, 2, dns.RcodeSuccess},
+		// Inside the zone only the authoritative answer counts, even if it's NXDOMAIN.
+		{"www.corp.example.org.", &dns.Msg{}, 1, dns.RcodeSuccess},
+		{"gone.corp.example.org.", &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeNameError}}, 0, dns.RcodeNameError},
+		// Unless it didn't reply.
+		{"www.corp.example.org.", nil, 1, dns.RcodeSuccess},
+	}
+
+	for i, tc := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(tc.qname, dns.TypeA)
+		state := request.Request{W: &test.ResponseWriter{}, Req: req}
+
+		resps := []fwdResp{{proxy: rec, ret: answer(req, false, test.A(tc.qname+" IN A 127.0.0.1"))}}
+		if tc.authResp != nil {
+			ret := answer(req, false)
+			ret.Rcode = tc.authResp.Rcode
+			if ret.Rcode == dns.RcodeSuccess {
+				ret.Answer = append(ret.Answer, test.A(tc.qname+" IN A 127.0.0.2"))
+			}
+			resps = append(resps, fwdResp{proxy: auth, ret: ret})
+		} else {
+			resps = append(resps, fwdResp{proxy: auth, upstreamErr: ErrTimeout})
+		}
+
+		ret, err := f.reply(state, resps)
+		if err != nil {
+			t.Fatalf("Test %d: expected no error, got %s", i, err)
+		}
+		if len(ret.Answer) != tc.expected || ret.Rcode != tc.rcode {
+			t.Errorf("Test %d: expected %d answers with rcode %d, got %v", i, tc.expected, tc.rcode, ret)
+		}
+		if tc.qname == "www.corp.example.org." && tc.authResp != nil && ret.Answer[0].(*dns.A).A.String() != "127.0.0.2" {
+			t.Errorf("Test %d: expected the authoritative answer, got %v", i, ret.Answer)
+		}
+	}
+}
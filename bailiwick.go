@@ -0,0 +1,150 @@
+package forward
+
+import (
+	"strings"
+
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// What bailiwick does with records outside of it.
+const (
+	bailiwickStrip  = "strip"  // remove them from the reply
+	bailiwickRefuse = "refuse" // don't use the reply, as if it didn't match the question
+)
+
+// bailiwick is what a reply to a query may carry records for.
+type bailiwick struct {
+	names []string        // the query name and the targets of the CNAME and DNAME chain from it
+	zones []string        // owners of SOA and NS records in the authority section that are above a name
+	glue  map[string]bool // targets of NS, MX and SRV records, allowed in the additional section
+}
+
+// newBailiwick returns the bailiwick of ret, the reply to a query for qname.
+func newBailiwick(qname string, ret *dns.Msg) *bailiwick {
+	b := &bailiwick{names: []string{qname}, glue: map[string]bool{}}
+	// The chain can come in any order, so go over it until no name is added.
+	for added := true; added; {
+		added = false
+		for _, rr := range ret.Answer {
+			var target string
+			switch rr := rr.(type) {
+			case *dns.CNAME:
+				if b.isName(rr.Hdr.Name) {
+					target = rr.Target
+				}
+			case *dns.DNAME:
+				for _, name := range b.names {
+					if dns.IsSubDomain(rr.Hdr.Name, name) && !strings.EqualFold(name, rr.Hdr.Name) {
+						target = name[:len(name)-len(rr.Hdr.Name)] + rr.Target
+						break
+					}
+				}
+			}
+			if target != "" && !b.isName(target) {
+				b.names = append(b.names, dns.CanonicalName(target))
+				added = true
+			}
+		}
+	}
+	for _, rr := range ret.Ns {
+		if t := rr.Header().Rrtype; (t == dns.TypeSOA || t == dns.TypeNS) && b.isAbove(rr.Header().Name) {
+			b.zones = append(b.zones, dns.CanonicalName(rr.Header().Name))
+		}
+	}
+	for _, rrs := range [][]dns.RR{ret.Answer, ret.Ns} {
+		for _, rr := range rrs {
+			if !b.inAnswer(rr) && !b.inAuthority(rr) {
+				continue
+			}
+			switch rr := rr.(type) {
+			case *dns.NS:
+				b.glue[dns.CanonicalName(rr.Ns)] = true
+			case *dns.MX:
+				b.glue[dns.CanonicalName(rr.Mx)] = true
+			case *dns.SRV:
+				b.glue[dns.CanonicalName(rr.Target)] = true
+			}
+		}
+	}
+	return b
+}
+
+func (b *bailiwick) isName(name string) bool {
+	for _, n := range b.names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAbove returns true if zone is one of b.names or an ancestor of one.
+func (b *bailiwick) isAbove(zone string) bool {
+	for _, n := range b.names {
+		if dns.IsSubDomain(zone, n) {
+			return true
+		}
+	}
+	return false
+}
+
+// inAnswer returns true if rr may be in the answer section: it's owned by a name of the chain, or is a DNAME
+// above one.
+func (b *bailiwick) inAnswer(rr dns.RR) bool {
+	if rr.Header().Rrtype == dns.TypeDNAME {
+		return b.isAbove(rr.Header().Name)
+	}
+	return b.isName(rr.Header().Name)
+}
+
+// inAuthority returns true if rr may be in the authority section: an SOA or NS above a name of the chain, or
+// another record, e.g. the NSEC proving a name doesn't exist, in one of those zones.
+func (b *bailiwick) inAuthority(rr dns.RR) bool {
+	name := rr.Header().Name
+	if t := rr.Header().Rrtype; t == dns.TypeSOA || t == dns.TypeNS {
+		return b.isAbove(name)
+	}
+	for _, z := range b.zones {
+		if dns.IsSubDomain(z, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// inAdditional returns true if rr may be in the additional section: the OPT record, or a record of a name of
+// the chain or of the targets of its NS, MX and SRV records.
+func (b *bailiwick) inAdditional(rr dns.RR) bool {
+	if rr.Header().Rrtype == dns.TypeOPT {
+		return true
+	}
+	return b.glue[dns.CanonicalName(rr.Header().Name)] || b.isName(rr.Header().Name)
+}
+
+// checkBailiwick counts the records of ret from p outside the bailiwick of the query in OutOfBailiwickCount,
+// and with bailiwick strip removes them. It returns the number of records outside of it.
+func (f *Forward) checkBailiwick(p *Proxy, state request.Request, ret *dns.Msg) int {
+	b := newBailiwick(state.Name(), ret)
+	n := 0
+	filter := func(rrs []dns.RR, in func(dns.RR) bool, section string) []dns.RR {
+		kept := rrs[:0:0]
+		for _, rr := range rrs {
+			if in(rr) {
+				kept = append(kept, rr)
+				continue
+			}
+			n++
+			OutOfBailiwickCount.WithLabelValues(p.addr, section).Add(1)
+		}
+		if f.bailiwick == bailiwickStrip {
+			return kept
+		}
+		return rrs
+	}
+	ret.Answer = filter(ret.Answer, b.inAnswer, "answer")
+	ret.Ns = filter(ret.Ns, b.inAuthority, "authority")
+	ret.Extra = filter(ret.Extra, b.inAdditional, "additional")
+	return n
+}
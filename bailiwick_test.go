@@ -0,0 +1,102 @@
+package forward
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/caddyserver/caddy"
+	"github.com/miekg/dns"
+)
+
+func TestCheckBailiwick(t *testing.T) {
+	tests := []struct {
+		answer, ns, extra []dns.RR
+		expected          int // records outside the bailiwick
+		kept              [3]int
+	}{
+		{
+			answer:   []dns.RR{test.A("www.example.org. IN A 127.0.0.1")},
+			expected: 0, kept: [3]int{1, 0, 0},
+		},
+		{
+			// Out of order chain, and a record for a name nobody asked about.
+			answer: []dns.RR{test.A("web.example.net. IN A 127.0.0.1"), test.CNAME("www.example.org. IN CNAME Web.example.net."),
+				test.A("bank.example. IN A 10.0.0.1")},
+			expected: 1, kept: [3]int{2, 0, 0},
+		},
+		{
+			answer: []dns.RR{&dns.DNAME{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeDNAME, Class: dns.ClassINET}, Target: "example.com."},
+				test.CNAME("www.example.org. IN CNAME www.example.com."), test.A("www.example.com. IN A 127.0.0.1")},
+			expected: 0, kept: [3]int{3, 0, 0},
+		},
+		{
+			// NXDOMAIN with an NSEC proof, and a bogus NS for another zone.
+			ns: []dns.RR{test.SOA("example.org. IN SOA ns.example.org. hostmaster.example.org. 1 2 3 4 5"),
+				test.NSEC("a.example.org. IN NSEC z.example.org. A"), test.NS("example.com. IN NS ns.evil.example.")},
+			expected: 1, kept: [3]int{0, 2, 0},
+		},
+		{
+			answer:   []dns.RR{test.MX("www.example.org. IN MX 10 mx.example.net.")},
+			extra:    []dns.RR{test.A("mx.example.net. IN A 127.0.0.1"), test.A("ns.evil.example. IN A 10.0.0.1"), test.OPT(4096, false)},
+			expected: 1, kept: [3]int{1, 0, 2},
+		},
+	}
+
+	f := New()
+	f.bailiwick = bailiwickStrip
+	p := NewProxy("10.0.0.1:53", "dns")
+	for i, tc := range tests {
+		m := new(dns.Msg)
+		m.SetQuestion("www.example.org.", dns.TypeA)
+		ret := new(dns.Msg)
+		ret.SetReply(m)
+		ret.Answer, ret.Ns, ret.Extra = tc.answer, tc.ns, tc.extra
+
+		n := f.checkBailiwick(p, request.Request{W: &test.ResponseWriter{}, Req: m}, ret)
+		if n != tc.expected {
+			t.Errorf("Test %d: expected %d records outside the bailiwick, got %d", i, tc.expected, n)
+		}
+		if kept := [3]int{len(ret.Answer), len(ret.Ns), len(ret.Extra)}; kept != tc.kept {
+			t.Errorf("Test %d: expected %v records kept, got %v", i, tc.kept, kept)
+		}
+	}
+}
+
+func TestBailiwickRefuse(t *testing.T) {
+	junk := newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"), test.A("bank.example. IN A 10.0.0.1"))
+		w.WriteMsg(ret)
+	})
+	defer junk.Close()
+	clean := newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.2"))
+		w.WriteMsg(ret)
+	})
+	defer clean.Close()
+
+	c := caddy.NewTestController("dns", "forward . "+junk.Addr+" "+clean.Addr+" {\npolicy sequential\nbailiwick refuse\nfanout_max 1\n}\n")
+	f, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	f.OnStartup()
+	defer f.OnShutdown()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := f.ServeDNS(context.TODO(), rec, m); err != nil {
+		t.Fatalf("Expected to receive reply, but got: %s", err)
+	}
+	if len(rec.Msg.Answer) != 1 || rec.Msg.Answer[0].(*dns.A).A.String() != "127.0.0.2" {
+		t.Errorf("Expected the answer of the clean upstream, got %v", rec.Msg.Answer)
+	}
+}
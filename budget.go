@@ -0,0 +1,34 @@
+package forward
+
+import (
+	"context"
+	"time"
+)
+
+type budgetKey struct{}
+
+// WithBudget returns a copy of ctx that gives the query d to be answered in, counting from now. A plugin
+// before forward sets it when its client waits a known time, so forward shortens its dial, write and read
+// timeouts to fit and answers, or fails, before the client gives up.
+func WithBudget(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, budgetKey{}, time.Now().Add(d))
+}
+
+// budgetDeadline returns the deadline set with WithBudget, if any.
+func budgetDeadline(ctx context.Context) (time.Time, bool) {
+	d, ok := ctx.Value(budgetKey{}).(time.Time)
+	return d, ok
+}
+
+// withBudget returns ctx with the deadline of its budget, if it has one that ends before its own deadline.
+// Cancel is nil if ctx is returned as is.
+func withBudget(ctx context.Context) (context.Context, context.CancelFunc) {
+	d, ok := budgetDeadline(ctx)
+	if !ok {
+		return ctx, nil
+	}
+	if cur, ok := ctx.Deadline(); ok && !d.Before(cur) {
+		return ctx, nil
+	}
+	return context.WithDeadline(ctx, d)
+}
@@ -0,0 +1,215 @@
+package forward
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/reuseport"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// capture keeps a sample of forwarded exchanges in a ring buffer and serves them over HTTP on
+// /debug/forward/capture, as JSON by default or in wireformat with ?format=wire. A POST to
+// /debug/forward/capture/replay sends the captured queries to their upstreams again, see replay.
+type capture struct {
+	ratio   float64 // fraction of exchanges to capture
+	unicode bool    // qnames in the JSON in Unicode, see idn_display
+	addr    string  // address the HTTP endpoint listens on
+
+	mu   sync.Mutex
+	ring []captured
+	next int
+	full bool
+
+	ln  net.Listener
+	srv *http.Server
+}
+
+// captured is a single captured exchange.
+type captured struct {
+	Time     time.Time     `json:"time"`
+	Upstream string        `json:"upstream"`
+	Duration time.Duration `json:"duration"`
+	Qname    string        `json:"qname"`
+	Qtype    string        `json:"qtype"`
+	Rcode    string        `json:"rcode,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Query    []byte        `json:"query"`
+	Reply    []byte        `json:"reply,omitempty"`
+}
+
+func newCapture(ratio float64, size int, addr string) *capture {
+	return &capture{ratio: ratio, addr: addr, ring: make([]captured, size)}
+}
+
+// record stores the exchange with upstream if it is sampled.
+func (c *capture) record(upstream string, start time.Time, req, ret *dns.Msg, err error) {
+	if rand.Float64() >= c.ratio {
+		return
+	}
+
+	x := captured{Time: start, Upstream: upstream, Duration: time.Since(start)}
+	if len(req.Question) > 0 {
+		x.Qname = displayName(req.Question[0].Name, c.unicode)
+		x.Qtype = dns.Type(req.Question[0].Qtype).String()
+	}
+	x.Query, _ = req.Pack()
+	if ret != nil {
+		x.Rcode = dns.RcodeToString[ret.Rcode]
+		x.Reply, _ = ret.Pack()
+	}
+	if err != nil {
+		x.Error = err.Error()
+	}
+
+	c.mu.Lock()
+	c.ring[c.next] = x
+	c.next = (c.next + 1) % len(c.ring)
+	if c.next == 0 {
+		c.full = true
+	}
+	c.mu.Unlock()
+}
+
+// captures returns the captured exchanges, oldest first.
+func (c *capture) captures() []captured {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.full {
+		return append([]captured(nil), c.ring[:c.next]...)
+	}
+	return append(append([]captured(nil), c.ring[c.next:]...), c.ring[:c.next]...)
+}
+
+// replayed is a captured exchange and the result of sending its query again.
+type replayed struct {
+	Upstream    string        `json:"upstream"`
+	Qname       string        `json:"qname"`
+	Qtype       string        `json:"qtype"`
+	Rcode       string        `json:"rcode,omitempty"`
+	Error       string        `json:"error,omitempty"`
+	Duration    time.Duration `json:"duration"`
+	ReplayRcode string        `json:"replay_rcode,omitempty"`
+	ReplayError string        `json:"replay_error,omitempty"`
+}
+
+// replay sends the captured queries, for qname if not empty, to the upstreams of f they were sent to before,
+// one by one and oldest first, so an intermittent failure can be reproduced. The replies aren't captured, nor
+// used for anything else.
+func (c *capture) replay(ctx context.Context, f *Forward, qname string) []replayed {
+	proxies := map[string]*Proxy{}
+	for _, p := range f.upstreams() {
+		if _, ok := proxies[p.addr]; !ok {
+			proxies[p.addr] = p
+		}
+	}
+	rs := []replayed{}
+	for _, x := range c.captures() {
+		req := new(dns.Msg)
+		if err := req.Unpack(x.Query); err != nil || len(req.Question) == 0 {
+			continue
+		}
+		if qname != "" && !strings.EqualFold(req.Question[0].Name, dns.Fqdn(qname)) {
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		r := replayed{Upstream: x.Upstream, Qname: x.Qname, Qtype: x.Qtype, Rcode: x.Rcode, Error: x.Error}
+		p, ok := proxies[x.Upstream]
+		if !ok {
+			r.ReplayError = "upstream is no longer configured"
+			rs = append(rs, r)
+			continue
+		}
+		req.Id = dns.Id()
+		start := time.Now()
+		ret, err := p.Connect(ctx, request.Request{W: &exchangeWriter{}, Req: req}, f.opts)
+		r.Duration = time.Since(start)
+		if ret != nil {
+			r.ReplayRcode = dns.RcodeToString[ret.Rcode]
+		}
+		if err != nil {
+			r.ReplayError = err.Error()
+		}
+		rs = append(rs, r)
+	}
+	return rs
+}
+
+// replayHandler returns the handler of /debug/forward/capture/replay, which replays the captures, those for
+// ?qname= if given, against the upstreams of f and returns the results as JSON.
+func (c *capture) replayHandler(f *Forward) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "replay needs a POST", http.StatusMethodNotAllowed)
+			return
+		}
+		rs := c.replay(r.Context(), f, r.URL.Query().Get("qname"))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rs)
+	})
+}
+
+// ServeHTTP implements http.Handler. The wireformat is a stream of messages framed as on TCP (RFC 1035,
+// section 4.2.2): every query is followed by its reply, a reply of length zero means there was none.
+func (c *capture) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	xs := c.captures()
+	if r.URL.Query().Get("format") != "wire" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(xs)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	l := make([]byte, 2)
+	for _, x := range xs {
+		for _, buf := range [][]byte{x.Query, x.Reply} {
+			binary.BigEndian.PutUint16(l, uint16(len(buf)))
+			w.Write(l)
+			w.Write(buf)
+		}
+	}
+}
+
+// start starts the HTTP endpoint, replays go to the upstreams of f.
+func (c *capture) start(f *Forward) error {
+	ln, err := reuseport.Listen("tcp", c.addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/debug/forward/capture", c)
+	mux.Handle("/debug/forward/capture/replay", c.replayHandler(f))
+
+	c.ln = ln
+	c.srv = &http.Server{Handler: mux}
+	go c.srv.Serve(ln)
+	return nil
+}
+
+// stop stops the HTTP endpoint.
+func (c *capture) stop() error {
+	if c.srv == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return c.srv.Shutdown(ctx)
+}
+
+const (
+	defaultCaptureSize = 1000
+	defaultCaptureAddr = "localhost:9155"
+)
@@ -0,0 +1,107 @@
+package forward
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+func TestCapture(t *testing.T) {
+	c := newCapture(1, 2, defaultCaptureAddr)
+
+	for _, name := range []string{"a.example.org.", "b.example.org.", "c.example.org."} {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		ret := new(dns.Msg)
+		ret.SetReply(req)
+		c.record("127.0.0.1:53", time.Now(), req, ret, nil)
+	}
+
+	xs := c.captures()
+	if len(xs) != 2 {
+		t.Fatalf("Expected 2 captured exchanges, got %d", len(xs))
+	}
+	if xs[0].Qname != "b.example.org." || xs[1].Qname != "c.example.org." {
+		t.Errorf("Expected the last two exchanges oldest first, got %s and %s", xs[0].Qname, xs[1].Qname)
+	}
+
+	rec := httptest.NewRecorder()
+	c.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/forward/capture", nil))
+	var got []captured
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Expected JSON, got error: %s", err)
+	}
+	if len(got) != 2 || got[1].Rcode != "NOERROR" {
+		t.Errorf("Unexpected JSON captures: %+v", got)
+	}
+
+	rec = httptest.NewRecorder()
+	c.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/forward/capture?format=wire", nil))
+	buf := rec.Body.Bytes()
+	msgs := 0
+	for len(buf) >= 2 {
+		l := int(buf[0])<<8 | int(buf[1])
+		m := new(dns.Msg)
+		if err := m.Unpack(buf[2 : 2+l]); err != nil {
+			t.Fatalf("Failed to unpack captured message %d: %s", msgs, err)
+		}
+		buf = buf[2+l:]
+		msgs++
+	}
+	if msgs != 4 {
+		t.Errorf("Expected 4 messages in wireformat, got %d", msgs)
+	}
+}
+
+func TestCaptureReplay(t *testing.T) {
+	var fail int32
+	s := newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetRcode(r, dns.RcodeSuccess)
+		if atomic.LoadInt32(&fail) == 1 {
+			ret.Rcode = dns.RcodeServerFailure
+		}
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	f := New()
+	f.capture = newCapture(1, 10, defaultCaptureAddr)
+	f.SetProxy(NewProxy(s.Addr, transport.DNS))
+	defer f.OnShutdown()
+
+	for _, name := range []string{"a.example.org.", "b.example.org."} {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		f.ServeDNS(context.TODO(), dnstest.NewRecorder(&test.ResponseWriter{}), m)
+	}
+	atomic.StoreInt32(&fail, 1)
+
+	rec := httptest.NewRecorder()
+	f.capture.replayHandler(f).ServeHTTP(rec, httptest.NewRequest("POST", "/debug/forward/capture/replay?qname=B.example.org", nil))
+	var rs []replayed
+	if err := json.Unmarshal(rec.Body.Bytes(), &rs); err != nil {
+		t.Fatalf("Expected JSON, got error: %s", err)
+	}
+	if len(rs) != 1 || rs[0].Qname != "b.example.org." || rs[0].Rcode != "NOERROR" || rs[0].ReplayRcode != "SERVFAIL" {
+		t.Errorf("Expected b.example.org. replayed to SERVFAIL, got %+v", rs)
+	}
+	if n := len(f.capture.captures()); n != 2 {
+		t.Errorf("Expected replays not to be captured, got %d captures", n)
+	}
+
+	rec = httptest.NewRecorder()
+	f.capture.replayHandler(f).ServeHTTP(rec, httptest.NewRequest("GET", "/debug/forward/capture/replay", nil))
+	if rec.Code != 405 {
+		t.Errorf("Expected a GET to be refused, got status %d", rec.Code)
+	}
+}
@@ -0,0 +1,37 @@
+package forward
+
+import (
+	"context"
+
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// retryCD retries the SERVFAIL ret once with the CD bit set on the cd_retry upstream, for validators that
+// fail names with broken DNSSEC. Its answer, if it has one, replaces ret, without AD and with an EDE saying
+// that it wasn't validated.
+func (f *Forward) retryCD(ctx context.Context, state request.Request, ret *dns.Msg) *dns.Msg {
+	r := state.Req.Copy()
+	r.CheckingDisabled = true
+	resp := f.forward(ctx, request.Request{W: state.W, Req: r}, []*Proxy{f.cdRetry}, 0)
+
+	tr := traceFrom(ctx)
+	if resp.ret == nil || resp.ret.Rcode == dns.RcodeServerFailure {
+		CDRetryCount.WithLabelValues(f.cdRetry.addr, "fail").Add(1)
+		tr.logf("retry with CD on %s failed: %s", f.cdRetry.addr, resp)
+		return ret
+	}
+	CDRetryCount.WithLabelValues(f.cdRetry.addr, "answer").Add(1)
+	tr.logf("retry with CD on %s: rcode %s", f.cdRetry.addr, dns.RcodeToString[resp.ret.Rcode])
+	log.Debugf("Answered %s %s with CD set by %s", displayName(state.Name(), f.idnDisplay), state.Type(), f.cdRetry.addr)
+
+	m := resp.ret
+	m.CheckingDisabled = false
+	m.AuthenticatedData = false
+	if m.IsEdns0() == nil {
+		setEdns0(state, m)
+	}
+	addEDE(m, edeOther, "DNSSEC validation failed, answered with checking disabled")
+	return m
+}
@@ -0,0 +1,75 @@
+package forward
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/caddyserver/caddy"
+	"github.com/miekg/dns"
+)
+
+func TestCDRetry(t *testing.T) {
+	validator := newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetRcode(r, dns.RcodeServerFailure)
+		w.WriteMsg(ret)
+	})
+	defer validator.Close()
+	permissive := newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		if r.CheckingDisabled {
+			ret.AuthenticatedData = true
+			ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"))
+		} else {
+			ret.Rcode = dns.RcodeServerFailure
+		}
+		w.WriteMsg(ret)
+	})
+	defer permissive.Close()
+
+	c := caddy.NewTestController("dns", "forward . "+validator.Addr+" {\ncd_retry "+permissive.Addr+"\n}\n")
+	f, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	f.OnStartup()
+	defer f.OnShutdown()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	m.SetEdns0(4096, true)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := f.ServeDNS(context.TODO(), rec, m); err != nil {
+		t.Fatalf("Expected to receive reply, but got: %s", err)
+	}
+	if rec.Msg.Rcode != dns.RcodeSuccess || len(rec.Msg.Answer) != 1 {
+		t.Fatalf("Expected the permissive upstream's answer, got %v", rec.Msg)
+	}
+	if rec.Msg.AuthenticatedData || rec.Msg.CheckingDisabled {
+		t.Errorf("Expected neither AD nor CD in the answer")
+	}
+	found := false
+	for _, o := range rec.Msg.IsEdns0().Option {
+		if code, _, ok := parseEDE(o); ok && code == edeOther {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected an EDE marking the answer as unvalidated")
+	}
+	if len(m.IsEdns0().Option) != 0 {
+		t.Errorf("Expected the request's OPT record to be left as is, got %v", m.IsEdns0())
+	}
+
+	// A query with CD set already got its chance.
+	m.CheckingDisabled = true
+	rec = dnstest.NewRecorder(&test.ResponseWriter{})
+	f.ServeDNS(context.TODO(), rec, m)
+	if rec.Msg.Rcode != dns.RcodeServerFailure {
+		t.Errorf("Expected the validator's SERVFAIL, got %s", dns.RcodeToString[rec.Msg.Rcode])
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"math/rand"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+
+	forward "github.com/microdog/pforward"
+)
+
+// loadConfig configures a synthetic load test, see load.
+type loadConfig struct {
+	Strategy    string        // "fanout" (merge all answers, the default), "race" (early_response), "quorum" or "sequential"
+	Upstreams   int           // number of fake upstreams, default 3
+	Delay       time.Duration // time every fake upstream takes to answer
+	Jitter      time.Duration // random extra delay, up to Jitter
+	Queries     int           // number of queries to send, default 10000
+	Concurrency int           // queries in flight, default 1
+}
+
+// loadResult is the result of load.
+type loadResult struct {
+	Queries        int
+	Errors         int // queries ServeDNS returned an error for
+	Elapsed        time.Duration
+	P50, P99       time.Duration // latency percentiles of ServeDNS
+	AllocsPerQuery float64       // heap allocations per query, including the fake upstreams'
+	BytesPerQuery  float64
+}
+
+// String returns r as a single line, like go test -bench does.
+func (r loadResult) String() string {
+	qps := float64(r.Queries) / r.Elapsed.Seconds()
+	return fmt.Sprintf("%d queries %d errors %.0f qps p50 %s p99 %s %.1f allocs/query %.0f B/query",
+		r.Queries, r.Errors, qps, r.P50, r.P99, r.AllocsPerQuery, r.BytesPerQuery)
+}
+
+// load drives cfg.Queries queries through ServeDNS of a Forward with in-memory fake upstreams, which answer
+// every query with an A record after cfg.Delay. Every upstream has its own address, except with quorum where
+// they have to agree. No network is involved, so the result measures the fan-out and merge path itself.
+func load(cfg loadConfig) (loadResult, error) {
+	f, err := newLoadForward(cfg)
+	if err != nil {
+		return loadResult{}, err
+	}
+	defer f.OnShutdown()
+
+	if cfg.Queries <= 0 {
+		cfg.Queries = 10000
+	}
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = 1
+	}
+
+	latencies := make([]time.Duration, cfg.Queries)
+	errs := make([]bool, cfg.Queries)
+	next := make(chan int)
+	var wg sync.WaitGroup
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+
+	for i := 0; i < cfg.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := &test.ResponseWriter{}
+			for i := range next {
+				m := new(dns.Msg)
+				m.SetQuestion("example.org.", dns.TypeA)
+				qstart := time.Now()
+				_, err := f.ServeDNS(context.Background(), w, m)
+				latencies[i] = time.Since(qstart)
+				errs[i] = err != nil
+			}
+		}()
+	}
+	for i := 0; i < cfg.Queries; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	r := loadResult{Queries: cfg.Queries, Elapsed: time.Since(start)}
+	runtime.ReadMemStats(&after)
+	r.AllocsPerQuery = float64(after.Mallocs-before.Mallocs) / float64(cfg.Queries)
+	r.BytesPerQuery = float64(after.TotalAlloc-before.TotalAlloc) / float64(cfg.Queries)
+
+	for _, e := range errs {
+		if e {
+			r.Errors++
+		}
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	r.P50 = latencies[len(latencies)/2]
+	r.P99 = latencies[len(latencies)*99/100]
+	return r, nil
+}
+
+// newLoadForward returns a started Forward with the fake upstreams of cfg.
+func newLoadForward(cfg loadConfig) (*forward.Forward, error) {
+	if cfg.Upstreams <= 0 {
+		cfg.Upstreams = 3
+	}
+
+	// The upstreams' addresses are made up, their transports are replaced by fakes. With max_fails 0 the
+	// failing health checks of the addresses don't take them down.
+	noFails := 0
+	c := forward.Config{From: ".", MaxFails: &noFails}
+	switch cfg.Strategy {
+	case "", "fanout":
+	case "race":
+		c.EarlyResponse = true
+	case "quorum":
+		c.Quorum = cfg.Upstreams/2 + 1
+	case "sequential":
+		c.Policy = "sequential"
+		c.FanoutMax = 1
+	default:
+		return nil, fmt.Errorf("unknown strategy: %s", cfg.Strategy)
+	}
+	for i := 0; i < cfg.Upstreams; i++ {
+		c.To = append(c.To, "127.0.0.1:"+strconv.Itoa(10000+i))
+	}
+	f, err := forward.FromConfig(c)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, p := range f.List() {
+		lt := &loadTransport{delay: cfg.Delay, jitter: cfg.Jitter}
+		if cfg.Strategy != "quorum" {
+			// Distinct answers, so merging has some work to do.
+			lt.rr = test.A("example.org. IN A 127.0.0." + strconv.Itoa(i+1))
+		} else {
+			lt.rr = test.A("example.org. IN A 127.0.0.1")
+		}
+		p.SetTransport(lt)
+	}
+	if err := f.OnStartup(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// loadTransport is the Transport of the fake upstreams used by load.
+type loadTransport struct {
+	delay  time.Duration
+	jitter time.Duration
+	rr     dns.RR
+}
+
+func (t *loadTransport) Exchange(ctx context.Context, m *dns.Msg, proto string, udpSize uint16) (*dns.Msg, forward.ExchangeInfo, error) {
+	if d := t.delay + jitter(t.jitter); d > 0 {
+		timer := time.NewTimer(d)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, forward.ExchangeInfo{Proto: proto}, ctx.Err()
+		}
+	}
+	ret := new(dns.Msg)
+	ret.SetReply(m)
+	ret.Answer = append(ret.Answer, dns.Copy(t.rr))
+	return ret, forward.ExchangeInfo{Proto: proto}, nil
+}
+
+func (t *loadTransport) Start()                         {}
+func (t *loadTransport) Close()                         {}
+func (t *loadTransport) SetTLSConfig(cfg *tls.Config)   {}
+func (t *loadTransport) SetExpire(expire time.Duration) {}
+
+func jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+func TestLoad(t *testing.T) {
+	for _, strategy := range []string{"fanout", "race", "quorum", "sequential"} {
+		r, err := load(loadConfig{Strategy: strategy, Queries: 200, Concurrency: 4, Jitter: time.Millisecond})
+		if err != nil {
+			t.Fatalf("Failed to run %s load: %s", strategy, err)
+		}
+		if r.Queries != 200 || r.Errors != 0 {
+			t.Errorf("Expected 200 queries without errors for %s, got %s", strategy, r)
+		}
+		if r.P50 > r.P99 {
+			t.Errorf("Expected p50 <= p99 for %s, got %s", strategy, r)
+		}
+	}
+	if _, err := load(loadConfig{Strategy: "round-robin"}); err == nil {
+		t.Errorf("Expected error for an unknown strategy")
+	}
+}
+
+func BenchmarkServeDNS(b *testing.B) {
+	for _, strategy := range []string{"fanout", "race", "quorum", "sequential"} {
+		b.Run(strategy, func(b *testing.B) {
+			f, err := newLoadForward(loadConfig{Strategy: strategy})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer f.OnShutdown()
+
+			w := &test.ResponseWriter{}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				m := new(dns.Msg)
+				m.SetQuestion("example.org.", dns.TypeA)
+				f.ServeDNS(context.Background(), w, m)
+			}
+		})
+	}
+}
+
+func BenchmarkServeDNSParallel(b *testing.B) {
+	for _, strategy := range []string{"fanout", "race", "quorum", "sequential"} {
+		b.Run(strategy, func(b *testing.B) {
+			f, err := newLoadForward(loadConfig{Strategy: strategy, Jitter: 100 * time.Microsecond})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer f.OnShutdown()
+
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				w := &test.ResponseWriter{}
+				for pb.Next() {
+					m := new(dns.Msg)
+					m.SetQuestion("example.org.", dns.TypeA)
+					f.ServeDNS(context.Background(), w, m)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,29 @@
+// Command pforward-bench drives synthetic query load through the forward plugin with in-memory fake
+// upstreams and prints latency percentiles and allocations, e.g.
+//
+//	pforward-bench -strategy race -upstreams 4 -delay 1ms -jitter 5ms -concurrency 64
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+func main() {
+	var cfg loadConfig
+	flag.StringVar(&cfg.Strategy, "strategy", "fanout", "fanout, race, quorum or sequential")
+	flag.IntVar(&cfg.Upstreams, "upstreams", 3, "number of fake upstreams")
+	flag.DurationVar(&cfg.Delay, "delay", 0, "time every upstream takes to answer")
+	flag.DurationVar(&cfg.Jitter, "jitter", 0, "random extra upstream delay, up to this")
+	flag.IntVar(&cfg.Queries, "queries", 10000, "number of queries")
+	flag.IntVar(&cfg.Concurrency, "concurrency", 1, "queries in flight")
+	flag.Parse()
+
+	r, err := load(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "pforward-bench: %s\n", err)
+		os.Exit(2)
+	}
+	fmt.Printf("%s: %s\n", cfg.Strategy, r)
+}
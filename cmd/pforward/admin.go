@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	forward "github.com/microdog/pforward"
+)
+
+// control holds the Config f serves, so the admin API can change it and reload f. A reload from the files
+// replaces it, and with it the changes made over the API.
+type control struct {
+	f     *forward.Forward
+	files []string
+
+	mu  sync.Mutex
+	cfg forward.Config
+}
+
+// reload loads the Config from the files again and reloads f with it.
+func (c *control) reload() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cfg, err := loadConfig(c.files)
+	if err == nil {
+		err = c.f.Reload(cfg)
+	}
+	if err != nil {
+		log.Printf("[ERROR] Not reloaded: %s", err)
+		return
+	}
+	c.cfg = cfg
+	log.Printf("[INFO] Reloaded %s", strings.Join(c.files, ", "))
+}
+
+// update reloads f with the Config changed by fn. If fn or the reload fails, f and the Config are left
+// as they were.
+func (c *control) update(fn func(cfg *forward.Config) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cfg := c.cfg
+	cfg.To = append([]string(nil), c.cfg.To...)
+	if err := fn(&cfg); err != nil {
+		return err
+	}
+	if err := c.f.Reload(cfg); err != nil {
+		return err
+	}
+	c.cfg = cfg
+	return nil
+}
+
+// adminConfig is the admin API's part of the command line.
+type adminConfig struct {
+	addr      string
+	tokenFile string // file with the bearer token
+	cert, key string // server certificate, for HTTPS
+	clientCA  string // CAs of the client certificates, for mTLS
+}
+
+// adminServer returns the server of the admin API of c. It must be secured, by a token or client
+// certificates or both.
+func adminServer(c *control, ac adminConfig) (*http.Server, error) {
+	if ac.tokenFile == "" && ac.clientCA == "" {
+		return nil, errors.New("the admin API needs -admin-token or -admin-client-ca")
+	}
+	if ac.clientCA != "" && ac.cert == "" {
+		return nil, errors.New("-admin-client-ca needs -admin-cert and -admin-key")
+	}
+	token := ""
+	if ac.tokenFile != "" {
+		b, err := ioutil.ReadFile(ac.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		if token = strings.TrimSpace(string(b)); token == "" {
+			return nil, fmt.Errorf("%s: empty token", ac.tokenFile)
+		}
+	}
+	s := &http.Server{Addr: ac.addr, Handler: adminHandler(c, token)}
+	if ac.cert == "" {
+		return s, nil
+	}
+	cert, err := tls.LoadX509KeyPair(ac.cert, ac.key)
+	if err != nil {
+		return nil, err
+	}
+	s.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if ac.clientCA != "" {
+		b, err := ioutil.ReadFile(ac.clientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("%s: no certificates", ac.clientCA)
+		}
+		s.TLSConfig.ClientCAs = pool
+		s.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return s, nil
+}
+
+// adminHandler returns the handler of the admin API of c, which requires token as a bearer token if set.
+func adminHandler(c *control, token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/upstreams", c.serveUpstreams)
+	mux.HandleFunc("/v1/upstreams/drain", c.serveDrain)
+	mux.HandleFunc("/v1/policy", c.servePolicy)
+	mux.HandleFunc("/v1/cache/flush", c.serveFlush)
+	if token == "" {
+		return mux
+	}
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// adminRequest is the body of the requests that change the Config.
+type adminRequest struct {
+	To     string `json:"to,omitempty"`
+	Policy string `json:"policy,omitempty"`
+}
+
+// serveUpstreams lists the upstreams with their statistics on GET, adds the upstream in the body to the
+// Config's To on POST and removes the one of ?to= on DELETE. To is matched as written in the Config.
+func (c *control) serveUpstreams(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, c.f.Stats().Proxies)
+	case http.MethodPost:
+		req, ok := readRequest(w, r)
+		if !ok {
+			return
+		}
+		if req.To == "" {
+			http.Error(w, "no upstream given", http.StatusBadRequest)
+			return
+		}
+		c.respond(w, c.update(func(cfg *forward.Config) error {
+			for _, to := range cfg.To {
+				if to == req.To {
+					return fmt.Errorf("already an upstream: %s", req.To)
+				}
+			}
+			cfg.To = append(cfg.To, req.To)
+			return nil
+		}))
+	case http.MethodDelete:
+		to := r.URL.Query().Get("to")
+		c.respond(w, c.update(func(cfg *forward.Config) error {
+			for i := range cfg.To {
+				if cfg.To[i] == to {
+					cfg.To = append(cfg.To[:i], cfg.To[i+1:]...)
+					return nil
+				}
+			}
+			return fmt.Errorf("not an upstream: %s", to)
+		}))
+	default:
+		notAllowed(w, http.MethodGet, http.MethodPost, http.MethodDelete)
+	}
+}
+
+// serveDrain puts the upstream ?addr=, its address as listed, in drain on POST, or takes it out with
+// ?draining=false.
+func (c *control) serveDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		notAllowed(w, http.MethodPost)
+		return
+	}
+	q := r.URL.Query()
+	c.respond(w, c.f.SetUpstreamDraining(q.Get("addr"), q.Get("draining") != "false"))
+}
+
+// servePolicy sets the policy in the body on PUT.
+func (c *control) servePolicy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		notAllowed(w, http.MethodPut)
+		return
+	}
+	req, ok := readRequest(w, r)
+	if !ok {
+		return
+	}
+	c.respond(w, c.update(func(cfg *forward.Config) error {
+		cfg.Policy = req.Policy
+		return nil
+	}))
+}
+
+// serveFlush removes the names of ?name= from the cache on POST, all of them without it, and returns the
+// number of entries removed. The name is a pattern of Forward.FlushCache, a plain name flushes its zone.
+func (c *control) serveFlush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		notAllowed(w, http.MethodPost)
+		return
+	}
+	n, err := c.f.FlushCache(r.URL.Query().Get("name"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, map[string]int{"flushed": n})
+}
+
+// respond answers a change with the upstreams after it, or with err.
+func (c *control) respond(w http.ResponseWriter, err error) {
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, c.f.Stats().Proxies)
+}
+
+func readRequest(w http.ResponseWriter, r *http.Request) (adminRequest, bool) {
+	var req adminRequest
+	d := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16))
+	d.DisallowUnknownFields()
+	if err := d.Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return req, false
+	}
+	return req, true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func notAllowed(w http.ResponseWriter, methods ...string) {
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+}
@@ -0,0 +1,236 @@
+// Command pforward runs the forward plugin as a standalone DNS server, without a CoreDNS build, e.g. as a
+// sidecar. It serves the Config in a JSON or YAML file over UDP and TCP and, when asked, the plugin's metrics
+// over HTTP:
+//
+//	pforward -config forward.yaml -listen :53 -metrics :9153
+//
+// On SIGHUP, or when -watch is set and the file changed, the Config is read again and swapped in with
+// Forward.Reload, without dropping queries. A Config that doesn't load is logged and the running one kept.
+//
+// With -resolv-conf the name servers and search domains of a resolv.conf, e.g. one written by DHCP or a
+// VPN client, are added to the Config with Config.WithResolvConf. That file is watched like the Config.
+//
+// With -admin a REST API to list, add and remove upstreams, set the policy, drain single upstreams and flush
+// the cache is served, secured by a bearer token, client certificates or both:
+//
+//	pforward -config forward.yaml -admin :8053 -admin-token token.txt
+//
+// Started by systemd with socket activation, pforward serves the sockets it's passed instead of -listen.
+// With Type=notify it reports READY=1 once an upstream passed a health check or answered a query.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	forward "github.com/microdog/pforward"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gopkg.in/yaml.v2"
+)
+
+func main() {
+	config := flag.String("config", "", "JSON or YAML file with the Config to serve")
+	listen := flag.String("listen", ":53", "address to serve DNS on, over UDP and TCP")
+	metrics := flag.String("metrics", "", "address to serve Prometheus metrics on, at /metrics")
+	resolvConf := flag.String("resolv-conf", "", "resolv.conf file with name servers and search domains to add")
+	watch := flag.Duration("watch", 0, "how often to check the config files for changes, never if 0")
+	var ac adminConfig
+	flag.StringVar(&ac.addr, "admin", "", "address to serve the admin API on")
+	flag.StringVar(&ac.tokenFile, "admin-token", "", "file with the bearer token of the admin API")
+	flag.StringVar(&ac.cert, "admin-cert", "", "certificate of the admin API, to serve it over HTTPS")
+	flag.StringVar(&ac.key, "admin-key", "", "key of -admin-cert")
+	flag.StringVar(&ac.clientCA, "admin-client-ca", "", "CAs clients of the admin API need a certificate of")
+	flag.Parse()
+
+	if err := run(*config, *resolvConf, *listen, *metrics, *watch, ac); err != nil {
+		fmt.Fprintf(os.Stderr, "pforward: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// run serves the Config in the file config until SIGINT or SIGTERM, or until a listener fails.
+func run(config, resolvConf, listen, metrics string, watch time.Duration, ac adminConfig) error {
+	if config == "" {
+		return errors.New("no -config given")
+	}
+	files := []string{config}
+	if resolvConf != "" {
+		files = append(files, resolvConf)
+	}
+	c, err := loadConfig(files)
+	if err != nil {
+		return err
+	}
+	f, err := forward.FromConfig(c)
+	if err != nil {
+		return fmt.Errorf("%s: %s", config, err)
+	}
+	if err := f.OnStartup(); err != nil {
+		return err
+	}
+	defer f.OnShutdown()
+	ctl := &control{f: f, files: files, cfg: c}
+
+	h := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) { serve(f, w, r) })
+	ls, pcs, err := activated()
+	if err != nil {
+		return err
+	}
+	var servers []*dns.Server
+	for _, l := range ls {
+		servers = append(servers, &dns.Server{Listener: l, Handler: h})
+	}
+	for _, pc := range pcs {
+		servers = append(servers, &dns.Server{PacketConn: pc, Handler: h})
+	}
+	if len(servers) == 0 {
+		servers = []*dns.Server{{Addr: listen, Net: "udp", Handler: h}, {Addr: listen, Net: "tcp", Handler: h}}
+	}
+	errc := make(chan error, len(servers)+1)
+	for _, s := range servers {
+		go func(s *dns.Server) {
+			if s.Addr == "" {
+				errc <- s.ActivateAndServe()
+				return
+			}
+			errc <- s.ListenAndServe()
+		}(s)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go notifyReady(f, done)
+	if metrics != "" {
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(prometheus.NewGoCollector(), prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+		reg.MustRegister(forward.Collectors()...)
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+		hs := &http.Server{Addr: metrics, Handler: mux}
+		go func() { errc <- hs.ListenAndServe() }()
+		defer hs.Close()
+	}
+	if ac.addr != "" {
+		as, err := adminServer(ctl, ac)
+		if err != nil {
+			return err
+		}
+		go func() {
+			if as.TLSConfig != nil {
+				errc <- as.ListenAndServeTLS("", "")
+				return
+			}
+			errc <- as.ListenAndServe()
+		}()
+		defer as.Close()
+	}
+
+	var changed <-chan time.Time
+	if watch > 0 {
+		t := time.NewTicker(watch)
+		defer t.Stop()
+		changed = t.C
+	}
+	mtime := stamp(files)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+loop:
+	for {
+		select {
+		case err = <-errc:
+			break loop
+		case s := <-sig:
+			if s != syscall.SIGHUP {
+				break loop
+			}
+			mtime = stamp(files)
+			ctl.reload()
+		case <-changed:
+			if m := stamp(files); m != mtime {
+				mtime = m
+				ctl.reload()
+			}
+		}
+	}
+	notify("STOPPING=1")
+	for _, s := range servers {
+		s.Shutdown()
+	}
+	return err
+}
+
+// stamp returns the modification times of files, to tell when one of them changed. A file that can't be
+// read has time zero.
+func stamp(files []string) string {
+	var b strings.Builder
+	for _, name := range files {
+		var mtime time.Time
+		if fi, err := os.Stat(name); err == nil {
+			mtime = fi.ModTime()
+		}
+		fmt.Fprintf(&b, "%d ", mtime.UnixNano())
+	}
+	return b.String()
+}
+
+// loadConfig reads the Config in files[0], with the resolv.conf files[1] added if there is one.
+func loadConfig(files []string) (forward.Config, error) {
+	c, err := readConfig(files[0])
+	if err != nil || len(files) == 1 {
+		return c, err
+	}
+	return c.WithResolvConf(files[1])
+}
+
+// readConfig reads a Config from the file name, as YAML if it's named so, else as JSON. Unknown keys are an
+// error, they're likely misspelt properties.
+func readConfig(name string) (forward.Config, error) {
+	var c forward.Config
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return c, err
+	}
+	switch filepath.Ext(name) {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(b, &c)
+	default:
+		d := json.NewDecoder(bytes.NewReader(b))
+		d.DisallowUnknownFields()
+		err = d.Decode(&c)
+	}
+	if err != nil {
+		return c, fmt.Errorf("%s: %s", name, err)
+	}
+	return c, nil
+}
+
+// serve answers r with f, like a CoreDNS server with forward as its only plugin: when f didn't write a reply
+// the client gets one with the rcode it returned.
+func serve(f *forward.Forward, w dns.ResponseWriter, r *dns.Msg) {
+	rcode, err := f.ServeDNS(context.Background(), w, r)
+	if err != nil {
+		log.Printf("[ERROR] %s %s: %s", r.Question[0].Name, dns.TypeToString[r.Question[0].Qtype], err)
+	}
+	if !plugin.ClientWrite(rcode) {
+		m := new(dns.Msg)
+		m.SetRcode(r, rcode)
+		w.WriteMsg(m)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	forward "github.com/microdog/pforward"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd, see sd_listen_fds(3).
+const listenFdsStart = 3
+
+// activated returns the sockets systemd passed to this process with socket activation, as listeners for
+// stream sockets and packet connections for datagram ones. It returns none when the process wasn't
+// activated. The environment variables of the protocol are unset, so children don't inherit them.
+func activated() ([]net.Listener, []net.PacketConn, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil, nil
+	}
+
+	var (
+		ls  []net.Listener
+		pcs []net.PacketConn
+	)
+	for fd := listenFdsStart; fd < listenFdsStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		if l, err := net.FileListener(f); err == nil {
+			ls = append(ls, l)
+		} else if pc, err := net.FilePacketConn(f); err == nil {
+			pcs = append(pcs, pc)
+		} else {
+			return nil, nil, fmt.Errorf("socket %d from systemd: %s", fd, err)
+		}
+		f.Close()
+	}
+	return ls, pcs, nil
+}
+
+// notify sends state to the service manager, if the process has one. See sd_notify(3).
+func notify(state string) error {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return nil
+	}
+	if name[0] == '@' {
+		name = "\x00" + name[1:]
+	}
+	c, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	_, err = c.Write([]byte(state))
+	return err
+}
+
+// notifyReady tells the service manager f is ready once f is, i.e. an upstream passed a health check or
+// answered. It gives up when done is closed.
+func notifyReady(f *forward.Forward, done <-chan struct{}) {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+	t := time.NewTicker(100 * time.Millisecond)
+	defer t.Stop()
+	for !f.Ready() {
+		select {
+		case <-t.C:
+		case <-done:
+			return
+		}
+	}
+	if err := notify("READY=1"); err != nil {
+		log.Printf("[ERROR] Failed to notify systemd: %s", err)
+	}
+}
@@ -0,0 +1,625 @@
+package forward
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy"
+)
+
+// Config is the declarative form of a forward stanza, for control planes that don't write Corefiles. Every
+// field is the property of the same name, see the README, and a zero field leaves its property out.
+// FromConfig compiles a Config to the stanza it stands for and parses that, so a Config is validated exactly
+// like a Corefile is.
+type Config struct {
+	From string   `json:"from" yaml:"from"`
+	To   []string `json:"to" yaml:"to"`
+
+	Labels          []LabelConfig           `json:"label,omitempty" yaml:"label,omitempty"`
+	Except          []ExceptConfig          `json:"except,omitempty" yaml:"except,omitempty"`
+	Reverse         []ReverseConfig         `json:"reverse,omitempty" yaml:"reverse,omitempty"`
+	Authoritative   []AuthoritativeConfig   `json:"authoritative,omitempty" yaml:"authoritative,omitempty"`
+	MaxFails        *int                    `json:"max_fails,omitempty" yaml:"max_fails,omitempty"`
+	FailDecay       Duration                `json:"fail_decay,omitempty" yaml:"fail_decay,omitempty"`
+	RetryUpstream   string                  `json:"retry_upstream,omitempty" yaml:"retry_upstream,omitempty"` // same or next
+	MaxRetries      *int                    `json:"max_retries,omitempty" yaml:"max_retries,omitempty"`
+	HealthCheck     *HealthCheckConfig      `json:"health_check,omitempty" yaml:"health_check,omitempty"`
+	HealthSource    []HealthSourceConfig    `json:"health_check_source,omitempty" yaml:"health_check_source,omitempty"`
+	SOMark          []SOMarkConfig          `json:"so_mark,omitempty" yaml:"so_mark,omitempty"`
+	DSCP            []DSCPConfig            `json:"dscp,omitempty" yaml:"dscp,omitempty"`
+	ForceTCP        bool                    `json:"force_tcp,omitempty" yaml:"force_tcp,omitempty"`
+	PreferUDP       bool                    `json:"prefer_udp,omitempty" yaml:"prefer_udp,omitempty"`
+	LowercaseQname  bool                    `json:"lowercase_qname,omitempty" yaml:"lowercase_qname,omitempty"`
+	Anonymize       *AnonymizeConfig        `json:"anonymize,omitempty" yaml:"anonymize,omitempty"`
+	IDNDisplay      bool                    `json:"idn_display,omitempty" yaml:"idn_display,omitempty"`
+	LogSample       int                     `json:"log_sample,omitempty" yaml:"log_sample,omitempty"`
+	LogErrors       *LogErrorsConfig        `json:"log_errors,omitempty" yaml:"log_errors,omitempty"`
+	SameTransport   bool                    `json:"same_transport,omitempty" yaml:"same_transport,omitempty"`
+	AvoidFragment   *AvoidFragmentConfig    `json:"avoid_fragmentation,omitempty" yaml:"avoid_fragmentation,omitempty"`
+	ShareUpstreams  bool                    `json:"share_upstreams,omitempty" yaml:"share_upstreams,omitempty"`
+	ClearAD         bool                    `json:"clear_ad,omitempty" yaml:"clear_ad,omitempty"`
+	RcodeMap        map[string]string       `json:"rcode_map,omitempty" yaml:"rcode_map,omitempty"` // e.g. REFUSED: NXDOMAIN
+	Trace           *EndpointConfig         `json:"trace,omitempty" yaml:"trace,omitempty"`
+	Expvar          *EndpointConfig         `json:"expvar,omitempty" yaml:"expvar,omitempty"`
+	PprofLabels     bool                    `json:"pprof_labels,omitempty" yaml:"pprof_labels,omitempty"`
+	SelfTest        *SelfTestConfig         `json:"self_test,omitempty" yaml:"self_test,omitempty"`
+	DebugUpstream   *DebugUpstreamConfig    `json:"debug_upstream,omitempty" yaml:"debug_upstream,omitempty"`
+	MergeDomains    []string                `json:"merge_domains,omitempty" yaml:"merge_domains,omitempty"`
+	FanoutMax       int                     `json:"fanout_max,omitempty" yaml:"fanout_max,omitempty"`
+	EarlyResponse   bool                    `json:"early_response,omitempty" yaml:"early_response,omitempty"`
+	Conflict        string                  `json:"conflict,omitempty" yaml:"conflict,omitempty"` // merge, majority, first or log
+	Quorum          int                     `json:"quorum,omitempty" yaml:"quorum,omitempty"`
+	Shadow          string                  `json:"shadow,omitempty" yaml:"shadow,omitempty"`
+	CDRetry         string                  `json:"cd_retry,omitempty" yaml:"cd_retry,omitempty"`
+	Mirror          *MirrorConfig           `json:"mirror,omitempty" yaml:"mirror,omitempty"`
+	Fault           []FaultConfig           `json:"fault,omitempty" yaml:"fault,omitempty"`
+	Capture         *CaptureConfig          `json:"capture,omitempty" yaml:"capture,omitempty"`
+	MaxResponseSize []MaxResponseSizeConfig `json:"max_response_size,omitempty" yaml:"max_response_size,omitempty"`
+	RequireRA       *UpstreamsConfig        `json:"require_ra,omitempty" yaml:"require_ra,omitempty"`
+	RD              []RDConfig              `json:"recursion_desired,omitempty" yaml:"recursion_desired,omitempty"`
+	QtypeAllow      []QtypesConfig          `json:"qtype_allow,omitempty" yaml:"qtype_allow,omitempty"`
+	QtypeDeny       []QtypesConfig          `json:"qtype_deny,omitempty" yaml:"qtype_deny,omitempty"`
+	Alternate       []AlternateConfig       `json:"alternate,omitempty" yaml:"alternate,omitempty"`
+	Rotate          *RotateConfig           `json:"rotate,omitempty" yaml:"rotate,omitempty"`
+	Prewarm         int                     `json:"prewarm,omitempty" yaml:"prewarm,omitempty"`
+	UDPPool         int                     `json:"udp_pool,omitempty" yaml:"udp_pool,omitempty"`
+	AsyncWrite      *AsyncWriteConfig       `json:"async_write,omitempty" yaml:"async_write,omitempty"`
+	TLS             *TLSConfig              `json:"tls,omitempty" yaml:"tls,omitempty"`
+	TLSServerName   string                  `json:"tls_servername,omitempty" yaml:"tls_servername,omitempty"`
+	TLSSessionCache *TLSSessionCacheConfig  `json:"tls_session_cache,omitempty" yaml:"tls_session_cache,omitempty"`
+	TLSALPN         []TLSALPNConfig         `json:"tls_alpn,omitempty" yaml:"tls_alpn,omitempty"`
+	TLSVersion      []TLSVersionConfig      `json:"tls_version,omitempty" yaml:"tls_version,omitempty"`
+	TLSECH          []TLSECHConfig          `json:"tls_ech,omitempty" yaml:"tls_ech,omitempty"`
+	TLSKeyLog       string                  `json:"tls_keylog,omitempty" yaml:"tls_keylog,omitempty"`
+	Expire          Duration                `json:"expire,omitempty" yaml:"expire,omitempty"`
+	ExpireProto     map[string]Duration     `json:"expire_proto,omitempty" yaml:"expire_proto,omitempty"` // keyed by udp, tcp or tls
+	Policy          string                  `json:"policy,omitempty" yaml:"policy,omitempty"`
+	LeastBad        bool                    `json:"least_bad,omitempty" yaml:"least_bad,omitempty"`
+	PreferLabel     string                  `json:"prefer_label,omitempty" yaml:"prefer_label,omitempty"` // KEY=VALUE
+	PinOption       *PinOptionConfig        `json:"pin_option,omitempty" yaml:"pin_option,omitempty"`
+	LocalZone       *LocalZoneConfig        `json:"local_zone,omitempty" yaml:"local_zone,omitempty"`
+	Bailiwick       string                  `json:"bailiwick,omitempty" yaml:"bailiwick,omitempty"` // strip or refuse
+	Hosts           *HostsConfig            `json:"hosts,omitempty" yaml:"hosts,omitempty"`
+	NXDomainCache   *NXDomainCacheConfig    `json:"nxdomain_cache,omitempty" yaml:"nxdomain_cache,omitempty"`
+	RandomSubdomain *RandomSubdomainConfig  `json:"random_subdomain,omitempty" yaml:"random_subdomain,omitempty"`
+	ServfailAlert   *ServfailAlertConfig    `json:"servfail_alert,omitempty" yaml:"servfail_alert,omitempty"`
+}
+
+// ServfailAlertConfig is the servfail_alert property, a zero Window or Min is the default.
+type ServfailAlertConfig struct {
+	Ratio  float64  `json:"ratio" yaml:"ratio"`
+	Window Duration `json:"window,omitempty" yaml:"window,omitempty"`
+	Min    int      `json:"min,omitempty" yaml:"min,omitempty"`
+}
+
+// RandomSubdomainConfig is the random_subdomain property, a zero Window or Hold is the default.
+type RandomSubdomainConfig struct {
+	Threshold int      `json:"threshold" yaml:"threshold"`
+	Window    Duration `json:"window,omitempty" yaml:"window,omitempty"`
+	Hold      Duration `json:"hold,omitempty" yaml:"hold,omitempty"`
+}
+
+// NXDomainCacheConfig is the nxdomain_cache property, a zero Size or TTL is the default. File is the
+// nxdomain_cache_file property.
+type NXDomainCacheConfig struct {
+	Size int      `json:"size,omitempty" yaml:"size,omitempty"`
+	TTL  Duration `json:"ttl,omitempty" yaml:"ttl,omitempty"`
+	File string   `json:"file,omitempty" yaml:"file,omitempty"`
+}
+
+// HostsConfig is the hosts property, a zero Reload is the default.
+type HostsConfig struct {
+	File   string   `json:"file" yaml:"file"`
+	Reload Duration `json:"reload,omitempty" yaml:"reload,omitempty"`
+}
+
+// PinOptionConfig is the pin_option property.
+type PinOptionConfig struct {
+	Code    uint16   `json:"code" yaml:"code"`
+	Trusted []string `json:"trusted" yaml:"trusted"`
+}
+
+// LocalZoneConfig is the local_zone property, an empty Label is the zone label.
+type LocalZoneConfig struct {
+	Zone  string `json:"zone" yaml:"zone"`
+	Label string `json:"label,omitempty" yaml:"label,omitempty"`
+}
+
+// LabelConfig is a label line, an empty To is all upstreams. To may select upstreams by label:KEY=VALUE too.
+type LabelConfig struct {
+	Labels map[string]string `json:"labels" yaml:"labels"`
+	To     []string          `json:"to,omitempty" yaml:"to,omitempty"`
+}
+
+// ExceptConfig is an except line. Action is next, nxdomain or refused, or empty with To.
+type ExceptConfig struct {
+	Domains []string `json:"domains" yaml:"domains"`
+	Action  string   `json:"action,omitempty" yaml:"action,omitempty"`
+	To      []string `json:"to,omitempty" yaml:"to,omitempty"`
+}
+
+// ReverseConfig is a reverse line.
+type ReverseConfig struct {
+	CIDRs []string `json:"cidrs" yaml:"cidrs"`
+	To    []string `json:"to" yaml:"to"`
+}
+
+// AuthoritativeConfig is an authoritative line.
+type AuthoritativeConfig struct {
+	Zones []string `json:"zones" yaml:"zones"`
+	From  []string `json:"from" yaml:"from"`
+}
+
+// HealthCheckConfig is the health_check property.
+type HealthCheckConfig struct {
+	Interval Duration `json:"interval" yaml:"interval"`
+	NoRec    bool     `json:"no_rec,omitempty" yaml:"no_rec,omitempty"`
+	Domain   string   `json:"domain,omitempty" yaml:"domain,omitempty"`
+	Minimize bool     `json:"minimize,omitempty" yaml:"minimize,omitempty"`
+	DNSSEC   bool     `json:"dnssec,omitempty" yaml:"dnssec,omitempty"`
+	CD       bool     `json:"cd,omitempty" yaml:"cd,omitempty"`
+}
+
+// SOMarkConfig is an so_mark line, an empty To is all upstreams.
+type SOMarkConfig struct {
+	Mark uint32   `json:"mark" yaml:"mark"`
+	To   []string `json:"to,omitempty" yaml:"to,omitempty"`
+}
+
+// DSCPConfig is a dscp line, an empty To is all upstreams. DSCP is a number or a class name like AF41.
+type DSCPConfig struct {
+	DSCP string   `json:"dscp" yaml:"dscp"`
+	To   []string `json:"to,omitempty" yaml:"to,omitempty"`
+}
+
+// HealthSourceConfig is a health_check_source line, an empty To is all upstreams.
+type HealthSourceConfig struct {
+	Addr string   `json:"addr" yaml:"addr"`
+	To   []string `json:"to,omitempty" yaml:"to,omitempty"`
+}
+
+// AvoidFragmentConfig is the avoid_fragmentation property, a zero Size is the default size.
+type AvoidFragmentConfig struct {
+	Size int `json:"size,omitempty" yaml:"size,omitempty"`
+}
+
+// AnonymizeConfig is the anonymize property.
+type AnonymizeConfig struct {
+	Pad bool `json:"pad,omitempty" yaml:"pad,omitempty"`
+}
+
+// LogErrorsConfig is the log_errors property, a zero Interval is the default interval.
+type LogErrorsConfig struct {
+	Interval Duration `json:"interval,omitempty" yaml:"interval,omitempty"`
+}
+
+// TLSSessionCacheConfig is the tls_session_cache property, a zero Size is the default size.
+type TLSSessionCacheConfig struct {
+	Size int `json:"size,omitempty" yaml:"size,omitempty"`
+}
+
+// EndpointConfig is a property that serves HTTP, an empty Addr is the property's default address.
+type EndpointConfig struct {
+	Addr string `json:"addr,omitempty" yaml:"addr,omitempty"`
+}
+
+// SelfTestConfig is the self_test property, a zero Min is 1.
+type SelfTestConfig struct {
+	Min  int  `json:"min,omitempty" yaml:"min,omitempty"`
+	Warn bool `json:"warn,omitempty" yaml:"warn,omitempty"`
+}
+
+// DebugUpstreamConfig is the debug_upstream property. Format is ede, the default, or txt.
+type DebugUpstreamConfig struct {
+	Format  string   `json:"format,omitempty" yaml:"format,omitempty"`
+	Clients []string `json:"clients,omitempty" yaml:"clients,omitempty"`
+}
+
+// MirrorConfig is the mirror property.
+type MirrorConfig struct {
+	Percent float64  `json:"percent" yaml:"percent"`
+	To      []string `json:"to" yaml:"to"`
+}
+
+// FaultConfig is a fault property. Fault is drop, corrupt, delay or rcode, Value the duration or rcode of
+// the last two.
+type FaultConfig struct {
+	Percent float64 `json:"percent" yaml:"percent"`
+	Fault   string  `json:"fault" yaml:"fault"`
+	Value   string  `json:"value,omitempty" yaml:"value,omitempty"`
+}
+
+// CaptureConfig is the capture property, zero Size and empty Addr are the defaults.
+type CaptureConfig struct {
+	Ratio float64 `json:"ratio" yaml:"ratio"`
+	Size  int     `json:"size,omitempty" yaml:"size,omitempty"`
+	Addr  string  `json:"addr,omitempty" yaml:"addr,omitempty"`
+}
+
+// MaxResponseSizeConfig is a max_response_size line, an empty To is all upstreams.
+type MaxResponseSizeConfig struct {
+	Size int      `json:"size" yaml:"size"`
+	To   []string `json:"to,omitempty" yaml:"to,omitempty"`
+}
+
+// UpstreamsConfig is a property that applies to upstreams To, an empty To is all upstreams.
+type UpstreamsConfig struct {
+	To []string `json:"to,omitempty" yaml:"to,omitempty"`
+}
+
+// RDConfig is a recursion_desired line, an empty To is all upstreams.
+type RDConfig struct {
+	On bool     `json:"on" yaml:"on"`
+	To []string `json:"to,omitempty" yaml:"to,omitempty"`
+}
+
+// QtypesConfig is a qtype_allow or qtype_deny line, an empty To is all upstreams.
+type QtypesConfig struct {
+	Types []string `json:"types" yaml:"types"`
+	To    []string `json:"to,omitempty" yaml:"to,omitempty"`
+}
+
+// TLSALPNConfig is a tls_alpn line, an empty To is all upstreams.
+type TLSALPNConfig struct {
+	Protocols []string `json:"protocols" yaml:"protocols"`
+	To        []string `json:"to,omitempty" yaml:"to,omitempty"`
+}
+
+// TLSVersionConfig is a tls_version line: versions like "1.2", an empty Max and To are no maximum and all
+// upstreams.
+type TLSVersionConfig struct {
+	Min string   `json:"min" yaml:"min"`
+	Max string   `json:"max,omitempty" yaml:"max,omitempty"`
+	To  []string `json:"to,omitempty" yaml:"to,omitempty"`
+}
+
+// TLSECHConfig is a tls_ech line: a file, a base64 ECHConfigList or dns://ADDRESS, an empty To is all
+// upstreams.
+type TLSECHConfig struct {
+	Config string   `json:"config" yaml:"config"`
+	To     []string `json:"to,omitempty" yaml:"to,omitempty"`
+}
+
+// AlternateConfig is an alternate line.
+type AlternateConfig struct {
+	To   string `json:"to" yaml:"to"`
+	Addr string `json:"addr" yaml:"addr"`
+}
+
+// RotateConfig is the rotate property.
+type RotateConfig struct {
+	Queries int      `json:"queries,omitempty" yaml:"queries,omitempty"`
+	Age     Duration `json:"age,omitempty" yaml:"age,omitempty"`
+}
+
+// AsyncWriteConfig is the async_write property, a nil Queue is the default queue.
+type AsyncWriteConfig struct {
+	Workers int  `json:"workers" yaml:"workers"`
+	Queue   *int `json:"queue,omitempty" yaml:"queue,omitempty"`
+}
+
+// TLSConfig is the tls property, as in the official forward plugin: either only CA, or Cert and Key, or all.
+type TLSConfig struct {
+	Cert string `json:"cert,omitempty" yaml:"cert,omitempty"`
+	Key  string `json:"key,omitempty" yaml:"key,omitempty"`
+	CA   string `json:"ca,omitempty" yaml:"ca,omitempty"`
+}
+
+// Duration is a time.Duration that is (un)marshaled as a string like "5s", in JSON and YAML alike.
+type Duration time.Duration
+
+// String returns d like time.Duration does.
+func (d Duration) String() string { return time.Duration(d).String() }
+
+// MarshalText implements encoding.TextMarshaler.
+func (d Duration) MarshalText() ([]byte, error) { return []byte(time.Duration(d).String()), nil }
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (d *Duration) UnmarshalText(text []byte) error {
+	dur, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(dur)
+	return nil
+}
+
+// Validate returns the error FromConfig would return for c, without keeping the Forward.
+func (c Config) Validate() error {
+	_, err := FromConfig(c)
+	return err
+}
+
+// FromConfig returns a Forward configured by c. Like a Forward set up from a Corefile, it has to be started
+// with OnStartup and stopped with OnShutdown.
+func FromConfig(c Config) (*Forward, error) {
+	stanza, err := c.Corefile()
+	if err != nil {
+		return nil, err
+	}
+	f, err := parseForward(caddy.NewTestController("dns", stanza))
+	if err != nil {
+		return nil, err
+	}
+	if f.Len() > max {
+		return nil, fmt.Errorf("more than %d TOs configured: %d", max, f.Len())
+	}
+	return f, nil
+}
+
+// Corefile returns c as a forward stanza of a Corefile.
+func (c Config) Corefile() (string, error) {
+	s := &stanza{}
+	if c.From == "" {
+		s.err = fmt.Errorf("from is required")
+	}
+	s.line("forward", append([]string{c.From}, c.To...)...)
+
+	// Labels first, the upstreams of the other properties may be selected by them.
+	for _, l := range c.Labels {
+		labels := make([]string, 0, len(l.Labels))
+		for k, v := range l.Labels {
+			labels = append(labels, k+"="+v)
+		}
+		sort.Strings(labels)
+		s.prop("label", append(labels, l.To...)...)
+	}
+	for _, e := range c.Except {
+		args := e.Domains
+		switch {
+		case len(e.To) > 0:
+			args = append(append(args[:len(args):len(args)], "to"), e.To...)
+		case e.Action != "":
+			args = append(args[:len(args):len(args)], e.Action)
+		}
+		s.prop("except", args...)
+	}
+	for _, r := range c.Reverse {
+		s.prop("reverse", append(append(append([]string{}, r.CIDRs...), "to"), r.To...)...)
+	}
+	for _, a := range c.Authoritative {
+		s.prop("authoritative", append(append(a.Zones[:len(a.Zones):len(a.Zones)], "from"), a.From...)...)
+	}
+	if c.MaxFails != nil {
+		s.prop("max_fails", strconv.Itoa(*c.MaxFails))
+	}
+	s.propIf(c.FailDecay != 0, "fail_decay", c.FailDecay.String())
+	s.propIf(c.RetryUpstream != "", "retry_upstream", c.RetryUpstream)
+	if c.MaxRetries != nil {
+		s.prop("max_retries", strconv.Itoa(*c.MaxRetries))
+	}
+	if hc := c.HealthCheck; hc != nil {
+		args := []string{hc.Interval.String()}
+		args = appendIf(args, hc.NoRec, "no_rec")
+		args = appendIf(args, hc.Domain != "", "domain", hc.Domain)
+		args = appendIf(args, hc.Minimize, "minimize")
+		args = appendIf(args, hc.DNSSEC, "dnssec")
+		args = appendIf(args, hc.CD, "cd")
+		s.prop("health_check", args...)
+	}
+	for _, hs := range c.HealthSource {
+		s.prop("health_check_source", append([]string{hs.Addr}, hs.To...)...)
+	}
+	for _, m := range c.SOMark {
+		s.prop("so_mark", append([]string{strconv.FormatUint(uint64(m.Mark), 10)}, m.To...)...)
+	}
+	for _, d := range c.DSCP {
+		s.prop("dscp", append([]string{d.DSCP}, d.To...)...)
+	}
+	s.propIf(c.ForceTCP, "force_tcp")
+	s.propIf(c.PreferUDP, "prefer_udp")
+	s.propIf(c.LowercaseQname, "lowercase_qname")
+	if c.Anonymize != nil {
+		s.prop("anonymize", appendIf(nil, c.Anonymize.Pad, "pad")...)
+	}
+	s.propIf(c.IDNDisplay, "idn_display")
+	s.propIf(c.LogSample != 0, "log_sample", strconv.Itoa(c.LogSample))
+	if c.LogErrors != nil {
+		s.prop("log_errors", appendIf(nil, c.LogErrors.Interval != 0, c.LogErrors.Interval.String())...)
+	}
+	s.propIf(c.SameTransport, "same_transport")
+	if c.AvoidFragment != nil {
+		s.prop("avoid_fragmentation", appendIf(nil, c.AvoidFragment.Size != 0, strconv.Itoa(c.AvoidFragment.Size))...)
+	}
+	s.propIf(c.ShareUpstreams, "share_upstreams")
+	s.propIf(c.ClearAD, "clear_ad")
+	from := make([]string, 0, len(c.RcodeMap))
+	for rc := range c.RcodeMap {
+		from = append(from, rc)
+	}
+	sort.Strings(from)
+	for _, rc := range from {
+		s.prop("rcode_map", rc, c.RcodeMap[rc])
+	}
+	if c.Trace != nil {
+		s.prop("trace", appendIf(nil, c.Trace.Addr != "", c.Trace.Addr)...)
+	}
+	if c.Expvar != nil {
+		s.prop("expvar", appendIf(nil, c.Expvar.Addr != "", c.Expvar.Addr)...)
+	}
+	s.propIf(c.PprofLabels, "pprof_labels")
+	if st := c.SelfTest; st != nil {
+		args := appendIf(nil, st.Min != 0, strconv.Itoa(st.Min))
+		s.prop("self_test", appendIf(args, st.Warn, "warn")...)
+	}
+	if du := c.DebugUpstream; du != nil {
+		s.prop("debug_upstream", append(appendIf(nil, du.Format != "", du.Format), du.Clients...)...)
+	}
+	s.propIf(len(c.MergeDomains) > 0, "merge_domains", c.MergeDomains...)
+	s.propIf(c.FanoutMax != 0, "fanout_max", strconv.Itoa(c.FanoutMax))
+	s.propIf(c.EarlyResponse, "early_response")
+	s.propIf(c.Conflict != "", "conflict", c.Conflict)
+	s.propIf(c.Quorum != 0, "quorum", strconv.Itoa(c.Quorum))
+	s.propIf(c.Shadow != "", "shadow", c.Shadow)
+	s.propIf(c.CDRetry != "", "cd_retry", c.CDRetry)
+	if m := c.Mirror; m != nil {
+		s.prop("mirror", append([]string{strconv.FormatFloat(m.Percent, 'f', -1, 64)}, m.To...)...)
+	}
+	for _, fc := range c.Fault {
+		args := []string{strconv.FormatFloat(fc.Percent, 'f', -1, 64), fc.Fault}
+		if fc.Value != "" {
+			args = append(args, fc.Value)
+		}
+		s.prop("fault", args...)
+	}
+	if cp := c.Capture; cp != nil {
+		args := []string{strconv.FormatFloat(cp.Ratio, 'f', -1, 64)}
+		args = appendIf(args, cp.Size != 0, strconv.Itoa(cp.Size))
+		s.prop("capture", appendIf(args, cp.Addr != "", cp.Addr)...)
+	}
+	for _, m := range c.MaxResponseSize {
+		s.prop("max_response_size", append([]string{strconv.Itoa(m.Size)}, m.To...)...)
+	}
+	if c.RequireRA != nil {
+		s.prop("require_ra", c.RequireRA.To...)
+	}
+	for _, rd := range c.RD {
+		on := "off"
+		if rd.On {
+			on = "on"
+		}
+		s.prop("recursion_desired", append([]string{on}, rd.To...)...)
+	}
+	for _, q := range c.QtypeAllow {
+		s.prop("qtype_allow", append(append([]string{}, q.Types...), q.To...)...)
+	}
+	for _, q := range c.QtypeDeny {
+		s.prop("qtype_deny", append(append([]string{}, q.Types...), q.To...)...)
+	}
+	for _, a := range c.Alternate {
+		s.prop("alternate", a.To, a.Addr)
+	}
+	if r := c.Rotate; r != nil {
+		args := appendIf(nil, r.Queries != 0, "queries", strconv.Itoa(r.Queries))
+		s.prop("rotate", appendIf(args, r.Age != 0, "age", r.Age.String())...)
+	}
+	s.propIf(c.Prewarm != 0, "prewarm", strconv.Itoa(c.Prewarm))
+	s.propIf(c.UDPPool != 0, "udp_pool", strconv.Itoa(c.UDPPool))
+	if aw := c.AsyncWrite; aw != nil {
+		args := []string{strconv.Itoa(aw.Workers)}
+		if aw.Queue != nil {
+			args = append(args, strconv.Itoa(*aw.Queue))
+		}
+		s.prop("async_write", args...)
+	}
+	if t := c.TLS; t != nil {
+		args := appendIf(nil, t.Cert != "" || t.Key != "", t.Cert, t.Key)
+		s.prop("tls", appendIf(args, t.CA != "", t.CA)...)
+	}
+	s.propIf(c.TLSServerName != "", "tls_servername", c.TLSServerName)
+	for _, a := range c.TLSALPN {
+		s.prop("tls_alpn", append([]string{strings.Join(a.Protocols, ",")}, a.To...)...)
+	}
+	for _, v := range c.TLSVersion {
+		s.prop("tls_version", append(appendIf([]string{v.Min}, v.Max != "", v.Max), v.To...)...)
+	}
+	for _, e := range c.TLSECH {
+		s.prop("tls_ech", append([]string{e.Config}, e.To...)...)
+	}
+	if sc := c.TLSSessionCache; sc != nil {
+		s.prop("tls_session_cache", appendIf(nil, sc.Size != 0, strconv.Itoa(sc.Size))...)
+	}
+	s.propIf(c.TLSKeyLog != "", "tls_keylog", c.TLSKeyLog)
+	s.propIf(c.Expire != 0, "expire", c.Expire.String())
+	protos := make([]string, 0, len(c.ExpireProto))
+	for proto := range c.ExpireProto {
+		protos = append(protos, proto)
+	}
+	sort.Strings(protos)
+	for _, proto := range protos {
+		s.prop("expire", c.ExpireProto[proto].String(), proto)
+	}
+	if c.Policy != "" || c.LeastBad {
+		policy := c.Policy
+		if policy == "" {
+			policy = "random"
+		}
+		s.prop("policy", appendIf([]string{policy}, c.LeastBad, "least_bad")...)
+	}
+	s.propIf(c.PreferLabel != "", "prefer_label", c.PreferLabel)
+	if po := c.PinOption; po != nil {
+		s.prop("pin_option", append([]string{strconv.Itoa(int(po.Code))}, po.Trusted...)...)
+	}
+	s.propIf(c.Bailiwick != "", "bailiwick", c.Bailiwick)
+	if z := c.LocalZone; z != nil {
+		s.prop("local_zone", appendIf([]string{z.Zone}, z.Label != "", z.Label)...)
+	}
+	if h := c.Hosts; h != nil {
+		s.prop("hosts", appendIf([]string{h.File}, h.Reload != 0, h.Reload.String())...)
+	}
+	if nc := c.NXDomainCache; nc != nil {
+		size := nc.Size
+		if size == 0 && nc.TTL != 0 {
+			size = defaultNXCacheSize
+		}
+		args := appendIf(nil, size != 0, strconv.Itoa(size))
+		s.prop("nxdomain_cache", appendIf(args, nc.TTL != 0, nc.TTL.String())...)
+		s.propIf(nc.File != "", "nxdomain_cache_file", nc.File)
+	}
+	if rs := c.RandomSubdomain; rs != nil {
+		window := rs.Window
+		if window == 0 && rs.Hold != 0 {
+			window = Duration(defaultRandomSubWindow)
+		}
+		args := appendIf([]string{strconv.Itoa(rs.Threshold)}, window != 0, window.String())
+		s.prop("random_subdomain", appendIf(args, rs.Hold != 0, rs.Hold.String())...)
+	}
+	if sa := c.ServfailAlert; sa != nil {
+		window := sa.Window
+		if window == 0 && sa.Min != 0 {
+			window = Duration(defaultServfailWindow)
+		}
+		args := appendIf([]string{strconv.FormatFloat(sa.Ratio, 'g', -1, 64)}, window != 0, window.String())
+		s.prop("servfail_alert", appendIf(args, sa.Min != 0, strconv.Itoa(sa.Min))...)
+	}
+
+	if s.err != nil {
+		return "", s.err
+	}
+	return s.String() + "}\n", nil
+}
+
+// stanza builds the text of a forward stanza, one property per line.
+type stanza struct {
+	strings.Builder
+	err error
+}
+
+func (s *stanza) line(name string, args ...string) {
+	for _, arg := range args {
+		// Corefile tokens are separated by white space, and we don't quote them.
+		if arg == "" || arg == "{" || arg == "}" || strings.HasPrefix(arg, "#") || strings.ContainsAny(arg, " \t\r\n\"") {
+			if s.err == nil {
+				s.err = fmt.Errorf("%s: invalid argument %q", strings.TrimSpace(name), arg)
+			}
+		}
+	}
+	s.WriteString(name)
+	for _, arg := range args {
+		s.WriteByte(' ')
+		s.WriteString(arg)
+	}
+	if name == "forward" {
+		s.WriteString(" {")
+	}
+	s.WriteByte('\n')
+}
+
+func (s *stanza) prop(name string, args ...string) { s.line("\t"+name, args...) }
+
+func (s *stanza) propIf(ok bool, name string, args ...string) {
+	if ok {
+		s.prop(name, args...)
+	}
+}
+
+// appendIf appends args to s if ok.
+func appendIf(s []string, ok bool, args ...string) []string {
+	if ok {
+		return append(s, args...)
+	}
+	return s
+}
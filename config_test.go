@@ -0,0 +1,96 @@
+package forward
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfig(t *testing.T) {
+	const js = `{
+		"from": "example.org",
+		"to": ["127.0.0.1", "127.0.0.2:1053"],
+		"except": [{"domains": ["a.example.org"], "action": "nxdomain"}, {"domains": ["b.example.org"], "to": ["127.0.0.3"]}],
+		"max_fails": 0,
+		"health_check": {"interval": "1s", "domain": "example.net", "no_rec": true},
+		"quorum": 2,
+		"rotate": {"queries": 100, "age": "1m"},
+		"expire": "30s",
+		"expire_proto": {"tls": "5m", "udp": "2s"},
+		"policy": "sequential",
+		"least_bad": true
+	}`
+	var c Config
+	if err := json.Unmarshal([]byte(js), &c); err != nil {
+		t.Fatalf("Failed to decode config: %s", err)
+	}
+
+	stanza, err := c.Corefile()
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	expected := `forward example.org 127.0.0.1 127.0.0.2:1053 {
+	except a.example.org nxdomain
+	except b.example.org to 127.0.0.3
+	max_fails 0
+	health_check 1s no_rec domain example.net
+	quorum 2
+	rotate queries 100 age 1m0s
+	expire 30s
+	expire 5m0s tls
+	expire 2s udp
+	policy sequential least_bad
+}
+`
+	if stanza != expected {
+		t.Errorf("Expected stanza:\n%s\ngot:\n%s", expected, stanza)
+	}
+
+	f, err := FromConfig(c)
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	if f.from != "example.org." || f.Len() != 2 || f.maxfails != 0 || f.quorum != 2 || !f.leastBad {
+		t.Errorf("Forward not configured as expected: %+v", f)
+	}
+	if f.hcInterval != time.Second || f.protoExpire["tcp-tls"] != 5*time.Minute {
+		t.Errorf("Expected health check every 1s and tls expire of 5m, got %s and %s", f.hcInterval, f.protoExpire["tcp-tls"])
+	}
+
+	// Durations are marshaled as strings again.
+	out, err := json.Marshal(c)
+	if err != nil {
+		t.Fatalf("Failed to encode config: %s", err)
+	}
+	if !strings.Contains(string(out), `"expire":"30s"`) {
+		t.Errorf("Expected expire as a string, got %s", out)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		config      Config
+		expectedErr string
+	}{
+		{Config{From: ".", To: []string{"127.0.0.1"}}, ""},
+		{Config{To: []string{"127.0.0.1"}}, "from is required"},
+		{Config{From: "."}, "Wrong argument count"},
+		{Config{From: ".", To: []string{"127.0.0.1"}, Quorum: 2}, "quorum can't be larger"},
+		{Config{From: ".", To: []string{"127.0.0.1"}, Conflict: "all"}, "unknown conflict policy"},
+		{Config{From: ".", To: []string{"127.0.0.1"}, MergeDomains: []string{"a b"}}, "invalid argument"},
+		{Config{From: ".", To: []string{"127.0.0.1"}, TLS: &TLSConfig{Cert: "cert.pem"}}, "invalid argument"},
+	}
+	for i, tc := range tests {
+		err := tc.config.Validate()
+		if tc.expectedErr == "" {
+			if err != nil {
+				t.Errorf("Test %d: expected no error, got %s", i, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.expectedErr) {
+			t.Errorf("Test %d: expected error containing %q, got %v", i, tc.expectedErr, err)
+		}
+	}
+}
@@ -6,11 +6,15 @@ package forward
 
 import (
 	"context"
+	"crypto/tls"
 	"io"
+	"net"
 	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
 
+	"github.com/coredns/coredns/plugin/pkg/transport"
 	"github.com/coredns/coredns/request"
 
 	"github.com/miekg/dns"
@@ -35,42 +39,196 @@ func averageTimeout(currentAvg *int64, observedDuration time.Duration, weight in
 	atomic.AddInt64(currentAvg, int64(observedDuration-dt)/weight)
 }
 
-func (t *Transport) dialTimeout() time.Duration {
+func (t *persistentTransport) dialTimeout() time.Duration {
 	return limitTimeout(&t.avgDialTime, minDialTimeout, maxDialTimeout)
 }
 
-func (t *Transport) updateDialTimeout(newDialTime time.Duration) {
+func (t *persistentTransport) updateDialTimeout(newDialTime time.Duration) {
 	averageTimeout(&t.avgDialTime, newDialTime, cumulativeAvgWeight)
 }
 
-// Dial dials the address configured in transport, potentially reusing a connection or creating a new one.
-func (t *Transport) Dial(proto string) (*persistConn, bool, error) {
+// dialProto returns the protocol Dial uses for connections when proto is asked for.
+func (t *persistentTransport) dialProto(proto string) string {
 	// If tls has been configured; use it.
 	if t.tlsConfig != nil {
-		proto = "tcp-tls"
+		return "tcp-tls"
+	}
+	// A unix socket is what it is, and its connections are all cached as tcp ones.
+	if t.unix != "" {
+		return "tcp"
 	}
+	return proto
+}
+
+// proto returns the protocol reported in ExchangeInfo for an exchange over proto.
+func (t *persistentTransport) proto(proto string) string {
+	if t.unix != "" {
+		return t.unix
+	}
+	return t.dialProto(proto)
+}
+
+// Dial dials the address configured in transport, potentially reusing a connection or creating a new one.
+func (t *persistentTransport) Dial(proto string) (*persistConn, bool, error) {
+	return t.dialBy(proto, time.Time{})
+}
+
+// dialBy is Dial, but a new connection must be dialed by deadline, if it isn't zero.
+func (t *persistentTransport) dialBy(proto string, deadline time.Time) (*persistConn, bool, error) {
+	proto = t.dialProto(proto)
 
 	t.dial <- proto
 	pc := <-t.ret
 
 	if pc != nil {
+		ConnCacheHitsCount.WithLabelValues(t.addr, proto).Add(1)
 		return pc, true, nil
 	}
+	ConnCacheMissesCount.WithLabelValues(t.addr, proto).Add(1)
 
-	reqTime := time.Now()
+	pc, err := t.dialConn(proto, deadline)
+	return pc, false, err
+}
+
+// dialTimeoutBy returns the dial timeout, shortened to end at deadline if it isn't zero. It returns
+// context.DeadlineExceeded if deadline passed.
+func (t *persistentTransport) dialTimeoutBy(deadline time.Time) (time.Duration, error) {
 	timeout := t.dialTimeout()
+	if deadline.IsZero() {
+		return timeout, nil
+	}
+	left := time.Until(deadline)
+	if left <= 0 {
+		return 0, context.DeadlineExceeded
+	}
+	if left < timeout {
+		return left, nil
+	}
+	return timeout, nil
+}
+
+// dialConn dials a new connection, bypassing the cache. If dialing the upstream's address fails and it has
+// an alternate address, of the other address family, that one is dialed too. A zero deadline is none.
+func (t *persistentTransport) dialConn(proto string, deadline time.Time) (*persistConn, error) {
+	if t.unix != "" {
+		timeout, err := t.dialTimeoutBy(deadline)
+		if err != nil {
+			return nil, err
+		}
+		reqTime := time.Now()
+		conn, err := dialUnix(t.unix, t.addr, timeout)
+		t.updateDialTimeout(time.Since(reqTime))
+		return &persistConn{c: conn, created: reqTime}, err
+	}
+	pc, err := t.dialAddr(proto, t.addr, deadline)
+	if err != nil && err != context.DeadlineExceeded && t.altAddr != "" {
+		DialFallbackCount.WithLabelValues(t.addr).Add(1)
+		return t.dialAddr(proto, t.altAddr, deadline)
+	}
+	return pc, err
+}
+
+func (t *persistentTransport) dialAddr(proto, addr string, deadline time.Time) (*persistConn, error) {
+	timeout, err := t.dialTimeoutBy(deadline)
+	if err != nil {
+		return nil, err
+	}
+	reqTime := time.Now()
 	if proto == "tcp-tls" {
-		conn, err := dns.DialTimeoutWithTLS("tcp", t.addr, t.tlsConfig, timeout)
+		c := dns.Client{Net: proto, TLSConfig: t.tlsConfig, Dialer: &net.Dialer{Timeout: timeout, Control: streamControl(t.mark, t.dscp)}}
+		conn, err := c.Dial(addr)
 		t.updateDialTimeout(time.Since(reqTime))
-		return &persistConn{c: conn}, false, err
+		if err == nil && t.tlsConfig.ClientSessionCache != nil {
+			t.countResumption(conn)
+		}
+		return &persistConn{c: conn, created: reqTime}, classifyTLS(err)
 	}
-	conn, err := dns.DialTimeout(proto, t.addr, timeout)
+	c := dns.Client{Net: proto, Dialer: &net.Dialer{Timeout: timeout, Control: streamControl(t.mark, t.dscp)}}
+	if proto == "udp" {
+		c.Dialer.Control = udpControl(t.dontFrag, t.mark, t.dscp)
+	}
+	conn, err := c.Dial(addr)
 	t.updateDialTimeout(time.Since(reqTime))
-	return &persistConn{c: conn}, false, err
+	return &persistConn{c: conn, created: reqTime}, err
+}
+
+// countResumption counts if the handshake of conn resumed a cached TLS session, see tls_session_cache.
+func (t *persistentTransport) countResumption(conn *dns.Conn) {
+	tc, ok := conn.Conn.(*tls.Conn)
+	if !ok {
+		return
+	}
+	TLSResumptionCount.WithLabelValues(t.addr, strconv.FormatBool(tc.ConnectionState().DidResume)).Add(1)
+}
+
+// ctxErr returns the error of ctx, whose deadline is deadline, if it's done. A read deadline set to deadline
+// can expire just before ctx does, that's ctx's expiry too and not the upstream timing out.
+func ctxErr(ctx context.Context, deadline time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+	return nil
 }
 
-// Connect selects an upstream, sends the request and waits for a response.
+// watchContext interrupts any read on pc when ctx is done. The returned function stops watching and must
+// be called before pc is handed to anyone else.
+func watchContext(ctx context.Context, pc *persistConn) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			pc.c.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+	}
+}
+
+// Connect selects an upstream, sends the request and waits for a response. It gives up as soon as ctx is done.
 func (p *Proxy) Connect(ctx context.Context, state request.Request, opts options) (*dns.Msg, error) {
+	ret, _, err := p.ConnectInfo(ctx, state, opts)
+	return ret, err
+}
+
+// ConnectInfo is Connect, but also returns how the message was exchanged.
+func (p *Proxy) ConnectInfo(ctx context.Context, state request.Request, opts options) (*dns.Msg, ExchangeInfo, error) {
+	start := time.Now()
+	ret, info, err := p.exchange(ctx, state, opts)
+	info.RTT = time.Since(start)
+
+	switch err {
+	case ErrCachedClosed, errOversizeUDP:
+		// These are retried by the caller, no real exchange happened.
+	case nil:
+		atomic.StoreUint32(&p.healthy, 1)
+		atomic.AddUint64(&p.queries, 1)
+		averageTimeout(&p.avgRtt, info.RTT, cumulativeAvgWeight)
+	default:
+		atomic.AddUint64(&p.queries, 1)
+		atomic.AddUint64(&p.failures, 1)
+		if ctx.Err() == nil {
+			UpstreamErrorCount.WithLabelValues(p.addr, errorClassLabel(err)).Add(1)
+		}
+	}
+	return ret, info, err
+}
+
+func (p *Proxy) exchange(ctx context.Context, state request.Request, opts options) (*dns.Msg, ExchangeInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, ExchangeInfo{}, err
+	}
 	start := time.Now()
 
 	proto := ""
@@ -83,55 +241,206 @@ func (p *Proxy) Connect(ctx context.Context, state request.Request, opts options
 		proto = state.Proto()
 	}
 
-	pc, cached, err := p.transport.Dial(proto)
+	// Set buffer size correctly for this client.
+	udpSize := uint16(state.Size())
+	if udpSize < 512 {
+		udpSize = 512
+	}
+
+	// Every exchange gets its own random ID, the client's ID is not something a spoofer should be able to
+	// rely on. The copy is shallow, except for the additional section and its OPT record: packing writes the
+	// extended rcode to the OPT record, padding and capping the payload change it, and in a fan-out the same
+	// request is sent to several upstreams at once.
+	req := *state.Req
+	req.Id = dns.Id()
+	req.Extra = copyExtra(req.Extra)
+	if opts.lowerQname {
+		req.Question = lowerQuestion(req.Question)
+	}
+	if opts.anonymize {
+		req.Extra = anonymizeExtra(req.Extra)
+	}
+	if p.rd != rdClient {
+		req.RecursionDesired = p.rd == rdSet
+	}
+	if proto == "udp" && opts.maxUDPSize > 0 && udpSize > opts.maxUDPSize {
+		if opt := req.IsEdns0(); opt != nil {
+			opt.SetUDPSize(opts.maxUDPSize)
+		}
+		udpSize = opts.maxUDPSize
+	}
+	if opts.pad {
+		padQuery(&req, udpSize)
+	}
+
+	ret, info, err := p.transport.Exchange(ctx, &req, proto, udpSize)
 	if err != nil {
-		return nil, err
+		return ret, info, classify(err)
+	}
+	ret.Id = state.Req.Id
+	ret.RecursionDesired = state.Req.RecursionDesired
+	if opts.lowerQname {
+		restoreCase(ret, state.Req)
+	}
+	if opts.pad && state.Req.IsEdns0() == nil {
+		ret.Extra = withoutOPT(ret.Extra)
 	}
 
-	// Set buffer size correctly for this client.
-	pc.c.UDPSize = uint16(state.Size())
-	if pc.c.UDPSize < 512 {
-		pc.c.UDPSize = 512
+	if p.maxSize > 0 && info.Size > p.maxSize {
+		OversizeCount.WithLabelValues(p.addr, proto).Add(1)
+		if proto == "udp" && p.trans != transport.TLS {
+			return nil, info, errOversizeUDP
+		}
+		return nil, info, ErrOversize
+	}
+	if p.needRA && !ret.RecursionAvailable {
+		return nil, info, ErrNoRecursion
 	}
 
-	pc.c.SetWriteDeadline(time.Now().Add(maxTimeout))
-	if err := pc.c.WriteMsg(state.Req); err != nil {
+	rc := rcodeString(ret.Rcode)
+	RequestCount.WithLabelValues(p.addr).Add(1)
+	RcodeCount.WithLabelValues(rc, p.addr).Add(1)
+	took := time.Since(start)
+	RequestDuration.WithLabelValues(p.addr).Observe(took.Seconds())
+	UpstreamLatency.WithLabelValues(p.addr, info.Proto).Observe(took.Seconds())
+	p.latency.observe(info.Proto, took)
+	countEDE(p.addr, ret)
+
+	return ret, info, nil
+}
+
+// copyExtra returns a copy of extra. The records themselves are shared, except the OPT record.
+func copyExtra(extra []dns.RR) []dns.RR {
+	if len(extra) == 0 {
+		return extra
+	}
+	copied := make([]dns.RR, len(extra))
+	for i, rr := range extra {
+		if opt, ok := rr.(*dns.OPT); ok {
+			rr = dns.Copy(opt)
+		}
+		copied[i] = rr
+	}
+	return copied
+}
+
+// Exchange implements Transport. It sends m over a, possibly cached, connection and waits for the reply that
+// carries m's ID. It gives up as soon as ctx is done.
+func (t *persistentTransport) Exchange(ctx context.Context, m *dns.Msg, proto string, udpSize uint16) (*dns.Msg, ExchangeInfo, error) {
+	var (
+		pc     *persistConn
+		cached bool
+		err    error
+	)
+	// A deadline of ctx, e.g. from a query budget, shortens every timeout of the exchange.
+	deadline, _ := ctx.Deadline()
+	if freshConn(ctx) {
+		pc, err = t.dialConn(t.dialProto(proto), deadline)
+	} else {
+		pc, cached, err = t.dialBy(proto, deadline)
+	}
+	info := ExchangeInfo{Proto: t.proto(proto), Reused: cached}
+	if err != nil {
+		return nil, info, err
+	}
+
+	pc.c.UDPSize = udpSize
+
+	writeDeadline := time.Now().Add(maxTimeout)
+	if !deadline.IsZero() && deadline.Before(writeDeadline) {
+		writeDeadline = deadline
+	}
+	pc.c.SetWriteDeadline(writeDeadline)
+	if err := pc.c.WriteMsg(m); err != nil {
 		pc.c.Close() // not giving it back
 		if err == io.EOF && cached {
-			return nil, ErrCachedClosed
+			CachedClosedCount.WithLabelValues(t.addr).Add(1)
+			return nil, info, ErrCachedClosed
 		}
-		return nil, err
+		return nil, info, err
 	}
 
-	var ret *dns.Msg
-	pc.c.SetReadDeadline(time.Now().Add(readTimeout))
+	var (
+		ret *dns.Msg
+		buf []byte
+	)
+	readDeadline := time.Now().Add(readTimeout)
+	if !deadline.IsZero() && deadline.Before(readDeadline) {
+		readDeadline = deadline
+	}
+	pc.c.SetReadDeadline(readDeadline)
+	stop := watchContext(ctx, pc)
 	for {
-		ret, err = pc.c.ReadMsg()
+		buf, err = pc.c.ReadMsgHeader(nil)
+		if err == nil {
+			ret = new(dns.Msg)
+			if err = ret.Unpack(buf); err != nil {
+				err = &UpstreamError{ErrBadReply, err}
+			}
+		}
 		if err != nil {
+			stop()
+			if err := ctxErr(ctx, deadline); err != nil {
+				// We gave up. A UDP socket is still good, a late reply will be dropped as out-of-order
+				// by its next user. A TCP stream may be halfway a message.
+				if _, ok := pc.c.Conn.(*net.UDPConn); ok {
+					t.Yield(pc)
+				} else {
+					pc.c.Close()
+				}
+				return nil, info, err
+			}
+			if _, ok := pc.c.Conn.(*net.UDPConn); ok && unreachable(err) {
+				FastFailCount.WithLabelValues(t.addr, unreachableReason(pc.c.Conn, err)).Add(1)
+			}
 			pc.c.Close() // not giving it back
 			if err == io.EOF && cached {
-				return nil, ErrCachedClosed
+				CachedClosedCount.WithLabelValues(t.addr).Add(1)
+				return nil, info, ErrCachedClosed
 			}
-			return ret, err
+			return ret, info, err
 		}
-		// drop out-of-order responses
-		if state.Req.Id == ret.Id {
+		// drop out-of-order responses, and anything that doesn't carry the ID sent on this socket
+		if m.Id == ret.Id {
 			break
 		}
 	}
+	stop()
 
-	p.transport.Yield(pc)
+	if sameQuestion(m, ret) {
+		t.Yield(pc)
+	} else {
+		pc.c.Close() // possibly poisoned, the forwarder retries on a fresh connection
+	}
+	info.Size = len(buf)
+	return ret, info, nil
+}
 
-	rc, ok := dns.RcodeToString[ret.Rcode]
-	if !ok {
-		rc = strconv.Itoa(ret.Rcode)
+// sameQuestion returns true if ret is a reply to the question of m.
+func sameQuestion(m, ret *dns.Msg) bool {
+	if len(m.Question) != len(ret.Question) {
+		return false
+	}
+	for i, q := range m.Question {
+		r := ret.Question[i]
+		if q.Qtype != r.Qtype || q.Qclass != r.Qclass || !strings.EqualFold(q.Name, r.Name) {
+			return false
+		}
 	}
+	return true
+}
 
-	RequestCount.WithLabelValues(p.addr).Add(1)
-	RcodeCount.WithLabelValues(rc, p.addr).Add(1)
-	RequestDuration.WithLabelValues(p.addr).Observe(time.Since(start).Seconds())
+type freshConnKey struct{}
+
+// withFreshConn returns a copy of ctx that makes the default transport dial a new connection instead of
+// using a cached one.
+func withFreshConn(ctx context.Context) context.Context {
+	return context.WithValue(ctx, freshConnKey{}, true)
+}
 
-	return ret, nil
+func freshConn(ctx context.Context) bool {
+	fresh, _ := ctx.Value(freshConnKey{}).(bool)
+	return fresh
 }
 
 const cumulativeAvgWeight = 4
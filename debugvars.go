@@ -0,0 +1,144 @@
+package forward
+
+import (
+	"context"
+	"expvar"
+	"net"
+	"net/http"
+	"runtime/pprof"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/reuseport"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// debugVars serves the expvar variables on /debug/vars. All started Forwards with the expvar option are
+// published in the "forward" variable, see forwardVars.
+type debugVars struct {
+	addr string
+
+	ln  net.Listener
+	srv *http.Server
+}
+
+// ForwardVars is the expvar view of a Forward.
+type ForwardVars struct {
+	From       string      `json:"from"`
+	Fanout     int64       `json:"fanout"`      // goroutines waiting for an upstream
+	WriteQueue int         `json:"write_queue"` // responses queued by async_write
+	WriteCap   int         `json:"write_queue_cap"`
+	Upstreams  []ProxyVars `json:"upstreams"`
+}
+
+// ProxyVars is the expvar view of a Proxy.
+type ProxyVars struct {
+	Addr        string `json:"addr"`
+	CachedConns int64  `json:"cached_conns"` // idle connections in the connection cache
+	Warming     bool   `json:"warming"`      // prewarm connections are being dialed
+	Fails       uint32 `json:"fails"`
+
+	Labels  map[string]string `json:"labels,omitempty"`
+	Latency []LatencyVars     `json:"latency"` // of successful exchanges, per transport
+}
+
+var (
+	varsOnce     sync.Once
+	varsMu       sync.Mutex
+	varsForwards []*Forward
+)
+
+// publish adds f to the "forward" expvar.
+func (d *debugVars) publish(f *Forward) {
+	varsOnce.Do(func() { expvar.Publish("forward", expvar.Func(forwardVars)) })
+
+	varsMu.Lock()
+	defer varsMu.Unlock()
+	varsForwards = append(varsForwards, f)
+}
+
+// unpublish removes f from the "forward" expvar, expvar itself can't remove variables.
+func (d *debugVars) unpublish(f *Forward) {
+	varsMu.Lock()
+	defer varsMu.Unlock()
+	for i := range varsForwards {
+		if varsForwards[i] == f {
+			varsForwards = append(varsForwards[:i], varsForwards[i+1:]...)
+			return
+		}
+	}
+}
+
+func forwardVars() interface{} {
+	varsMu.Lock()
+	defer varsMu.Unlock()
+
+	vs := make([]ForwardVars, len(varsForwards))
+	for i, f := range varsForwards {
+		vs[i] = f.vars()
+	}
+	return vs
+}
+
+// vars returns the current internals of f.
+func (f *Forward) vars() ForwardVars {
+	v := ForwardVars{From: f.from, Fanout: atomic.LoadInt64(&f.fanout), Upstreams: make([]ProxyVars, 0, len(f.proxies))}
+	if f.writer != nil {
+		v.WriteQueue = len(f.writer.queue)
+		v.WriteCap = cap(f.writer.queue)
+	}
+	for _, p := range f.upstreams() {
+		pv := ProxyVars{Addr: p.addr, Fails: p.failCount(), Labels: p.labels, Latency: p.latency.vars()}
+		if t, ok := p.transport.(*persistentTransport); ok {
+			pv.CachedConns = atomic.LoadInt64(&t.cached)
+			pv.Warming = atomic.LoadInt32(&t.warming) == 1
+		}
+		v.Upstreams = append(v.Upstreams, pv)
+	}
+	return v
+}
+
+// start publishes f and starts the HTTP endpoint.
+func (d *debugVars) start(f *Forward) error {
+	ln, err := reuseport.Listen("tcp", d.addr)
+	if err != nil {
+		return err
+	}
+	d.publish(f)
+
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	d.ln = ln
+	d.srv = &http.Server{Handler: mux}
+	go d.srv.Serve(ln)
+	return nil
+}
+
+// stop unpublishes f and stops the HTTP endpoint.
+func (d *debugVars) stop(f *Forward) error {
+	d.unpublish(f)
+	if d.srv == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return d.srv.Shutdown(ctx)
+}
+
+// labeledConnect is connect, but with pprof_labels the samples taken during the exchange are labeled with
+// the upstream and its transport, so a CPU profile shows where the time went per upstream.
+func (f *Forward) labeledConnect(ctx context.Context, proxy *Proxy, state request.Request) (ret *dns.Msg, info ExchangeInfo, err error) {
+	if !f.pprofLabels {
+		return f.connect(ctx, proxy, state)
+	}
+	pprof.Do(ctx, pprof.Labels("forward_upstream", proxy.addr, "forward_transport", proxy.trans), func(ctx context.Context) {
+		ret, info, err = f.connect(ctx, proxy, state)
+	})
+	return ret, info, err
+}
+
+const defaultVarsAddr = "localhost:9157"
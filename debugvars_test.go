@@ -0,0 +1,84 @@
+package forward
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestDebugVars(t *testing.T) {
+	s := newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"))
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	c := caddy.NewTestController("dns", "forward example.org "+s.Addr+" {\nexpvar 127.0.0.1:0\npprof_labels\nasync_write 1 8\n}")
+	f, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	if err := f.OnStartup(); err != nil {
+		t.Fatalf("Failed to start: %s", err)
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := f.ServeDNS(context.TODO(), rec, m); err != nil {
+		t.Fatalf("Expected to receive reply, but got: %s", err)
+	}
+
+	vars := func() []ForwardVars {
+		w := httptest.NewRecorder()
+		f.debugVars.srv.Handler.ServeHTTP(w, httptest.NewRequest("GET", "/debug/vars", nil))
+		all := map[string]json.RawMessage{}
+		if err := json.Unmarshal(w.Body.Bytes(), &all); err != nil {
+			t.Fatalf("Failed to decode expvars: %s", err)
+		}
+		var vs []ForwardVars
+		if err := json.Unmarshal(all["forward"], &vs); err != nil {
+			t.Fatalf("Failed to decode forward expvar: %s", err)
+		}
+		return vs
+	}
+
+	var v ForwardVars
+	for i := 0; i < 50; i++ {
+		vs := vars()
+		if len(vs) != 1 {
+			t.Fatalf("Expected 1 published forward, got %d", len(vs))
+		}
+		// The cache count is updated by the connection manager after the connection is returned.
+		if v = vs[0]; len(v.Upstreams) == 1 && v.Upstreams[0].CachedConns == 1 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if v.From != "example.org." || v.WriteCap != 8 || v.Fanout != 0 {
+		t.Errorf("Expected from example.org., queue cap 8 and no fan-out, got %+v", v)
+	}
+	if len(v.Upstreams) != 1 || v.Upstreams[0].Addr != s.Addr {
+		t.Fatalf("Expected upstream %s, got %+v", s.Addr, v.Upstreams)
+	}
+	if v.Upstreams[0].CachedConns != 1 {
+		t.Errorf("Expected 1 cached connection, got %d", v.Upstreams[0].CachedConns)
+	}
+	if l := v.Upstreams[0].Latency; len(l) != 1 || l[0].Transport != "udp" || l[0].Count != 1 || l[0].P99 == 0 {
+		t.Errorf("Expected the latency of 1 exchange over udp, got %+v", l)
+	}
+
+	f.OnShutdown()
+	if vs := forwardVars().([]ForwardVars); len(vs) != 0 {
+		t.Errorf("Expected no published forwards after shutdown, got %d", len(vs))
+	}
+}
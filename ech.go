@@ -0,0 +1,159 @@
+package forward
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	typeSVCB   = 64 // not known to miekg/dns yet, these come in as RFC3597
+	svcbKeyECH = 5
+	echTimeout = 5 * time.Second
+)
+
+// parseECH parses the arguments of tls_ech: a config, being a file with the ECHConfigList, the list in
+// base64, or dns://ADDRESS to look it up at ADDRESS, and the upstreams it's for.
+func (f *Forward) parseECH(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("tls_ech needs an ECH config or dns://ADDRESS")
+	}
+	if !echSupported {
+		return fmt.Errorf("tls_ech needs Go 1.23 or later")
+	}
+	var (
+		list []byte
+		from string
+		err  error
+	)
+	if strings.HasPrefix(args[0], "dns://") {
+		from = strings.TrimPrefix(args[0], "dns://")
+		if _, _, err := net.SplitHostPort(from); err != nil {
+			from = net.JoinHostPort(from, "53")
+		}
+	} else if list, err = readECH(args[0]); err != nil {
+		return err
+	}
+	proxies, err := f.matchProxies(args[1:])
+	if err != nil {
+		return err
+	}
+	for _, p := range proxies {
+		o := f.tlsOptionsFor(p)
+		o.ech, o.echFrom = list, from
+	}
+	return nil
+}
+
+// readECH returns the ECHConfigList in the file s, raw or in base64, or in s itself in base64.
+func readECH(s string) ([]byte, error) {
+	list, err := ioutil.ReadFile(s)
+	if err == nil {
+		if b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(list))); err == nil {
+			list = b
+		}
+	} else if list, err = base64.StdEncoding.DecodeString(s); err != nil {
+		return nil, fmt.Errorf("ECH config is neither a file nor base64: %s", s)
+	}
+	if len(list) < 2 || int(binary.BigEndian.Uint16(list)) != len(list)-2 {
+		return nil, fmt.Errorf("not an ECHConfigList: %s", s)
+	}
+	return list, nil
+}
+
+// fetchECH looks up the ECHConfigList of the upstreams with tls_ech dns://, and sets it in their TLS
+// config. Not finding one is an error, quietly connecting without ECH would expose the server name.
+func (f *Forward) fetchECH() error {
+	for p, o := range f.tlsOpts {
+		if o.echFrom == "" {
+			continue
+		}
+		name := f.tlsConfig.ServerName
+		if name == "" {
+			return fmt.Errorf("looking up the ECH config of %s needs tls_servername", p.addr)
+		}
+		list, err := lookupECH(o.echFrom, name)
+		if err != nil {
+			return err
+		}
+		o.ech = list
+		p.SetTLSConfig(f.proxyTLSConfig(p))
+	}
+	return nil
+}
+
+// lookupECH asks server for the SVCB records of the DNS server name (RFC 9461) and returns the ECHConfigList
+// of the one with the lowest priority.
+func lookupECH(server, name string) ([]byte, error) {
+	qname := "_dns." + dns.Fqdn(name)
+	m := new(dns.Msg)
+	m.SetQuestion(qname, typeSVCB)
+	c := &dns.Client{Timeout: echTimeout}
+	r, _, err := c.Exchange(m, server)
+	if err == nil && r.Truncated {
+		c.Net = "tcp"
+		r, _, err = c.Exchange(m, server)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("%s looking up SVCB of %s at %s", rcodeString(r.Rcode), qname, server)
+	}
+	var (
+		list []byte
+		best uint16
+	)
+	for _, rr := range r.Answer {
+		u, ok := rr.(*dns.RFC3597)
+		if !ok || u.Hdr.Rrtype != typeSVCB {
+			continue
+		}
+		rdata, err := hex.DecodeString(u.Rdata)
+		if err != nil {
+			continue
+		}
+		if prio, ech := svcbECH(rdata); ech != nil && (list == nil || prio < best) {
+			list, best = ech, prio
+		}
+	}
+	if list == nil {
+		return nil, fmt.Errorf("no ECH config in the SVCB records of %s at %s", qname, server)
+	}
+	return list, nil
+}
+
+// svcbECH returns the priority and the ech parameter of the SVCB rdata, nil if it has none. AliasMode records
+// aren't followed.
+func svcbECH(rdata []byte) (uint16, []byte) {
+	if len(rdata) < 2 {
+		return 0, nil
+	}
+	prio := binary.BigEndian.Uint16(rdata)
+	if prio == 0 {
+		return 0, nil
+	}
+	_, off, err := dns.UnpackDomainName(rdata, 2)
+	if err != nil {
+		return 0, nil
+	}
+	for off+4 <= len(rdata) {
+		key, n := binary.BigEndian.Uint16(rdata[off:]), int(binary.BigEndian.Uint16(rdata[off+2:]))
+		off += 4
+		if off+n > len(rdata) {
+			break
+		}
+		if key == svcbKeyECH {
+			return prio, rdata[off : off+n]
+		}
+		off += n
+	}
+	return 0, nil
+}
@@ -0,0 +1,11 @@
+//go:build go1.23
+// +build go1.23
+
+package forward
+
+import "crypto/tls"
+
+const echSupported = true
+
+// setECH makes cfg use Encrypted Client Hello with list.
+func setECH(cfg *tls.Config, list []byte) { cfg.EncryptedClientHelloConfigList = list }
@@ -0,0 +1,11 @@
+//go:build !go1.23
+// +build !go1.23
+
+package forward
+
+import "crypto/tls"
+
+// crypto/tls only does Encrypted Client Hello since Go 1.23, tls_ech is refused before.
+const echSupported = false
+
+func setECH(cfg *tls.Config, list []byte) {}
@@ -0,0 +1,116 @@
+//go:build go1.23
+// +build go1.23
+
+package forward
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+
+	"github.com/caddyserver/caddy"
+	"github.com/miekg/dns"
+)
+
+var testECH = []byte{0x00, 0x04, 0xfe, 0x0d, 0x00, 0x00}
+
+func TestSetupECH(t *testing.T) {
+	b64 := base64.StdEncoding.EncodeToString(testECH)
+	tests := []struct {
+		input       string
+		shouldErr   bool
+		expectedErr string
+		expected    []bool // ECH per upstream
+	}{
+		// positive
+		{"forward . tls://127.0.0.1 tls://127.0.0.2 {\ntls_ech " + b64 + "\n}\n", false, "", []bool{true, true}},
+		{"forward . tls://127.0.0.1 tls://127.0.0.2 {\ntls_ech " + b64 + " tls://127.0.0.2\n}\n", false, "", []bool{false, true}},
+		// negative
+		{"forward . tls://127.0.0.1 {\ntls_ech\n}\n", true, "needs an ECH config", nil},
+		{"forward . tls://127.0.0.1 {\ntls_ech ???\n}\n", true, "neither a file nor base64", nil},
+		{"forward . tls://127.0.0.1 {\ntls_ech AAUA\n}\n", true, "not an ECHConfigList", nil},
+		{"forward . tls://127.0.0.1 {\ntls_ech " + b64 + " 127.0.0.3\n}\n", true, "not a configured upstream", nil},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		f, err := parseForward(c)
+
+		if test.shouldErr {
+			if err == nil || !strings.Contains(err.Error(), test.expectedErr) {
+				t.Errorf("Test %d: expected error to contain: %v, found error: %v, input: %s", i, test.expectedErr, err, test.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: expected no error but found one for input %s, got: %v", i, test.input, err)
+			continue
+		}
+		for j, p := range f.proxies {
+			cfg := p.transport.(*persistentTransport).tlsConfig
+			ech := cfg.EncryptedClientHelloConfigList != nil
+			if ech != test.expected[j] {
+				t.Errorf("Test %d: expected ECH %t for %s, got %t", i, test.expected[j], p.addr, ech)
+			}
+			if ech && cfg.MinVersion != tls.VersionTLS13 {
+				t.Errorf("Test %d: expected ECH to imply TLS 1.3 for %s, got minimum %x", i, p.addr, cfg.MinVersion)
+			}
+		}
+	}
+}
+
+// svcbRdata returns the rdata of an SVCB record with target . and alpn dot, with ech if given.
+func svcbRdata(prio uint16, ech []byte) string {
+	rdata := []byte{byte(prio >> 8), byte(prio), 0, 0, 1, 0, 4, 3, 'd', 'o', 't'}
+	if ech != nil {
+		rdata = append(rdata, 0, svcbKeyECH, byte(len(ech)>>8), byte(len(ech)))
+		rdata = append(rdata, ech...)
+	}
+	return hex.EncodeToString(rdata)
+}
+
+func TestFetchECH(t *testing.T) {
+	other := []byte{0x00, 0x02, 0xff, 0xff}
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		if r.Question[0].Name == "_dns.dns.example." && r.Question[0].Qtype == typeSVCB {
+			hdr := dns.RR_Header{Name: r.Question[0].Name, Rrtype: typeSVCB, Class: dns.ClassINET, Ttl: 60}
+			ret.Answer = []dns.RR{
+				&dns.RFC3597{Hdr: hdr, Rdata: svcbRdata(2, other)},
+				&dns.RFC3597{Hdr: hdr, Rdata: svcbRdata(1, testECH)},
+				&dns.RFC3597{Hdr: hdr, Rdata: svcbRdata(0, nil)},
+			}
+		} else {
+			ret.Rcode = dns.RcodeNameError
+		}
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	c := caddy.NewTestController("dns", "forward . tls://127.0.0.1 {\ntls_servername dns.example\ntls_ech dns://"+s.Addr+"\n}\n")
+	f, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to parse: %s", err)
+	}
+	if err := f.fetchECH(); err != nil {
+		t.Fatalf("Failed to fetch ECH config: %s", err)
+	}
+	cfg := f.proxies[0].transport.(*persistentTransport).tlsConfig
+	if !bytes.Equal(cfg.EncryptedClientHelloConfigList, testECH) {
+		t.Errorf("Expected the ECH config of the lowest priority, got %x", cfg.EncryptedClientHelloConfigList)
+	}
+
+	c = caddy.NewTestController("dns", "forward . tls://127.0.0.1 {\ntls_servername other.example\ntls_ech dns://"+s.Addr+"\n}\n")
+	if f, err = parseForward(c); err != nil {
+		t.Fatalf("Failed to parse: %s", err)
+	}
+	if err := f.fetchECH(); err == nil || !strings.Contains(err.Error(), "NXDOMAIN") {
+		t.Errorf("Expected NXDOMAIN looking up the ECH config, got %v", err)
+	}
+}
@@ -0,0 +1,152 @@
+package forward
+
+import (
+	"context"
+	"encoding/binary"
+	"strconv"
+
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// Extended DNS Errors (RFC 8914). miekg/dns doesn't know the option yet, so it's (un)packed as an
+// EDNS0_LOCAL: a 2 byte INFO-CODE followed by the EXTRA-TEXT.
+const optionEDE = 15
+
+// EDE INFO-CODEs used by forward.
+const (
+	edeOther                uint16 = 0
+	edeFiltered             uint16 = 17
+	edeNoReachableAuthority uint16 = 22
+	edeNetworkError         uint16 = 23
+	edeInvalidData          uint16 = 24
+)
+
+// edeFor returns the EDE INFO-CODE and EXTRA-TEXT for a SERVFAIL caused by err.
+func edeFor(err error) (uint16, string) {
+	switch err {
+	case ErrNoHealthy:
+		return edeNoReachableAuthority, "no healthy upstreams"
+	case context.DeadlineExceeded:
+		return edeNoReachableAuthority, "upstreams timed out"
+	case ErrNoQuorum:
+		return edeOther, "no quorum among upstreams"
+	case ErrOversize:
+		return edeOther, "upstream response too large"
+	case ErrNoRecursion:
+		return edeOther, "upstream doesn't offer recursion"
+	}
+	switch ErrorClass(err) {
+	case ErrTimeout:
+		return edeNoReachableAuthority, "upstreams timed out"
+	case ErrConnRefused:
+		return edeNetworkError, "upstream refused connection"
+	case ErrTLSHandshake:
+		return edeNetworkError, "upstream TLS handshake failed"
+	case ErrBadReply:
+		return edeInvalidData, "bad reply from upstream"
+	}
+	return edeOther, "upstream error"
+}
+
+// newEDE returns an EDE option with code and text.
+func newEDE(code uint16, text string) *dns.EDNS0_LOCAL {
+	data := make([]byte, 2+len(text))
+	binary.BigEndian.PutUint16(data, code)
+	copy(data[2:], text)
+	return &dns.EDNS0_LOCAL{Code: optionEDE, Data: data}
+}
+
+// setEdns0 gives m, a reply made here, an OPT record of its own with the payload size and DO bit of the
+// request's, if the request has one. state.SizeAndDo would put the request's OPT record itself in m, and the
+// options added to m and packing it would then change the request.
+func setEdns0(state request.Request, m *dns.Msg) {
+	if o := state.Req.IsEdns0(); o != nil {
+		m.SetEdns0(o.UDPSize(), o.Do())
+	}
+}
+
+// addEDE adds an EDE option with code and text to m's OPT record. m is left as is if it has no OPT record,
+// EDE is only for clients that speak EDNS.
+func addEDE(m *dns.Msg, code uint16, text string) {
+	opt := ownOPT(m)
+	if opt == nil {
+		return
+	}
+	opt.Option = append(opt.Option, newEDE(code, text))
+}
+
+// ownOPT replaces m's OPT record by a copy and returns it, or returns nil if m has none. Options are added to
+// the copy: the OPT record may be the request's, which SizeAndDo puts in replies, and the request is still
+// sent by other goroutines.
+func ownOPT(m *dns.Msg) *dns.OPT {
+	for i, rr := range m.Extra {
+		if opt, ok := rr.(*dns.OPT); ok {
+			own := &dns.OPT{Hdr: opt.Hdr, Option: append([]dns.EDNS0(nil), opt.Option...)}
+			m.Extra = append([]dns.RR(nil), m.Extra...)
+			m.Extra[i] = own
+			return own
+		}
+	}
+	return nil
+}
+
+// parseEDE returns the INFO-CODE and EXTRA-TEXT of o if it's an EDE option.
+func parseEDE(o dns.EDNS0) (code uint16, text string, ok bool) {
+	l, ok := o.(*dns.EDNS0_LOCAL)
+	if !ok || l.Code != optionEDE || len(l.Data) < 2 {
+		return 0, "", false
+	}
+	return binary.BigEndian.Uint16(l.Data), string(l.Data[2:]), true
+}
+
+// edes returns the EDE options in m.
+func edes(m *dns.Msg) []*dns.EDNS0_LOCAL {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	var es []*dns.EDNS0_LOCAL
+	for _, o := range opt.Option {
+		if _, _, ok := parseEDE(o); ok {
+			es = append(es, o.(*dns.EDNS0_LOCAL))
+		}
+	}
+	return es
+}
+
+// countEDE counts and logs the EDE options in a reply from addr.
+func countEDE(addr string, m *dns.Msg) {
+	for _, e := range edes(m) {
+		code, text, _ := parseEDE(e)
+		EDECount.WithLabelValues(addr, edeLabel(code)).Add(1)
+		log.Debugf("Extended DNS Error %d from %s: %s", code, addr, text)
+	}
+}
+
+// edeLabel returns the code label of code in EDECount: the INFO-CODEs registered by RFC 8914, 0 to 24, are
+// themselves, all others "other", so an upstream can't grow the metric without bound.
+func edeLabel(code uint16) string {
+	if code > edeInvalidData { // the last one
+		return "other"
+	}
+	return strconv.Itoa(int(code))
+}
+
+// copyEDE adds the EDE options of the responses in sets to m, once each.
+func copyEDE(m *dns.Msg, sets []addrSet) {
+	opt := ownOPT(m)
+	if opt == nil {
+		return
+	}
+	seen := map[string]bool{}
+	for _, set := range sets {
+		for _, e := range edes(set.resp.ret) {
+			if key := string(e.Data); !seen[key] {
+				seen[key] = true
+				opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: e.Code, Data: e.Data})
+			}
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package forward
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+func TestEDEFor(t *testing.T) {
+	tests := []struct {
+		err  error
+		code uint16
+	}{
+		{ErrNoHealthy, edeNoReachableAuthority},
+		{context.DeadlineExceeded, edeNoReachableAuthority},
+		{&UpstreamError{ErrTimeout, context.DeadlineExceeded}, edeNoReachableAuthority},
+		{&UpstreamError{ErrConnRefused, ErrNoHealthy}, edeNetworkError},
+		{&UpstreamError{ErrBadReply, ErrNoHealthy}, edeInvalidData},
+		{ErrNoQuorum, edeOther},
+	}
+	for i, tc := range tests {
+		if code, _ := edeFor(tc.err); code != tc.code {
+			t.Errorf("Test %d: expected code %d for %s, got %d", i, tc.code, tc.err, code)
+		}
+	}
+}
+
+func TestForwardFailEDE(t *testing.T) {
+	p := NewProxy("fake", transport.DNS)
+	p.SetTransport(&fakeTransport{exchange: func(m *dns.Msg, proto string) (*dns.Msg, error) {
+		return nil, &UpstreamError{ErrConnRefused, ErrNoHealthy}
+	}})
+	p.health = nil
+	f := New()
+	f.SetProxy(p)
+	defer f.OnShutdown()
+
+	// Without EDNS the server writes the SERVFAIL.
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if rcode, err := f.ServeDNS(context.TODO(), rec, m); rcode != dns.RcodeServerFailure || err == nil {
+		t.Errorf("Expected SERVFAIL and an error, got %d, %v", rcode, err)
+	}
+	if rec.Msg != nil {
+		t.Errorf("Expected nothing to be written, got %v", rec.Msg)
+	}
+
+	m.SetEdns0(4096, false)
+	rcode, err := f.ServeDNS(context.TODO(), rec, m)
+	if err == nil {
+		t.Errorf("Expected the error to be returned")
+	}
+	if rcode != dns.RcodeSuccess || rec.Msg == nil || rec.Msg.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("Expected a SERVFAIL to be written, got %d, %v", rcode, rec.Msg)
+	}
+	opt := rec.Msg.IsEdns0()
+	if opt == nil || len(opt.Option) != 1 {
+		t.Fatalf("Expected an EDE option, got %v", rec.Msg)
+	}
+	if ede := opt.Option[0].(*dns.EDNS0_LOCAL); ede.Code != optionEDE || ede.Data[0] != 0 || ede.Data[1] != byte(edeNetworkError) {
+		t.Errorf("Expected EDE %d, got %v", edeNetworkError, ede)
+	}
+	if opt == m.IsEdns0() || len(m.IsEdns0().Option) != 0 {
+		t.Errorf("Expected the request's OPT record to be left as is, got %v", m.IsEdns0())
+	}
+}
+
+func TestEDEPassThrough(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	req.SetEdns0(4096, false)
+	state := request.Request{W: &test.ResponseWriter{}, Req: req}
+
+	withEDE := func(rr dns.RR, code uint16, text string) *dns.Msg {
+		m := answer(req, false, rr)
+		m.SetEdns0(4096, false)
+		addEDE(m, code, text)
+		return m
+	}
+	resps := []fwdResp{
+		{ret: withEDE(test.A("example.org. IN A 127.0.0.1"), 3, "stale answer")},
+		{ret: withEDE(test.A("example.org. IN A 127.0.0.2"), 3, "stale answer")},
+		{ret: withEDE(test.A("example.org. IN A 127.0.0.3"), 18, "prohibited")},
+	}
+
+	ret, err := New().reply(state, resps)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	es := edes(ret)
+	if len(es) != 2 {
+		t.Fatalf("Expected 2 distinct EDE options, got %v", ret.IsEdns0())
+	}
+	if code, text, _ := parseEDE(es[0]); code != 3 || text != "stale answer" {
+		t.Errorf("Expected EDE 3 stale answer, got %d %s", code, text)
+	}
+	if ret.IsEdns0() == req.IsEdns0() || len(req.IsEdns0().Option) != 0 {
+		t.Errorf("Expected the request's OPT record to be left as is, got %v", req.IsEdns0())
+	}
+}
+
+func TestEDELabel(t *testing.T) {
+	for code, want := range map[uint16]string{0: "0", 24: "24", 25: "other", 65535: "other"} {
+		if got := edeLabel(code); got != want {
+			t.Errorf("Expected label %s for code %d, got %s", want, code, got)
+		}
+	}
+}
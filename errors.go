@@ -0,0 +1,116 @@
+package forward
+
+import (
+	"context"
+	"net"
+	"os"
+	"syscall"
+)
+
+// UpstreamError is an error exchanging a message with an upstream. Class is one of ErrTimeout,
+// ErrConnRefused, ErrTLSHandshake or ErrBadReply, Err is the error that was classified.
+type UpstreamError struct {
+	Class error
+	Err   error
+}
+
+func (e *UpstreamError) Error() string { return e.Class.Error() + ": " + e.Err.Error() }
+
+// Unwrap returns the underlying error.
+func (e *UpstreamError) Unwrap() error { return e.Err }
+
+// Is reports if target is e's class, so errors.Is(err, ErrTimeout) works.
+func (e *UpstreamError) Is(target error) bool { return target == e.Class }
+
+// ErrorClass returns the class of err: ErrTimeout, ErrConnRefused, ErrTLSHandshake, ErrBadReply, or
+// nil if err is not an UpstreamError.
+func ErrorClass(err error) error {
+	if e, ok := err.(*UpstreamError); ok {
+		return e.Class
+	}
+	return nil
+}
+
+// classify wraps err in an UpstreamError if it's a timeout, a refused connection or an unreachable upstream. Other errors,
+// including the ones already classified, are returned as is.
+func classify(err error) error {
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return err // we gave up, the upstream didn't fail
+	}
+	switch x := err.(type) {
+	case nil, *UpstreamError:
+		return err
+	case net.Error:
+		if x.Timeout() {
+			return &UpstreamError{ErrTimeout, err}
+		}
+	}
+	if unreachable(err) {
+		return &UpstreamError{ErrConnRefused, err}
+	}
+	return err
+}
+
+// unreachable returns true if err reports the upstream, its host or its network as unreachable. Over UDP
+// these are the ICMP errors that fail a read before its timeout.
+func unreachable(err error) bool {
+	switch errno(err) {
+	case syscall.ECONNREFUSED, syscall.EHOSTUNREACH, syscall.ENETUNREACH:
+		return true
+	}
+	return false
+}
+
+// errnoReason returns the label for FastFailCount of an unreachable err.
+func errnoReason(err error) string {
+	switch errno(err) {
+	case syscall.ECONNREFUSED:
+		return "port"
+	case syscall.EHOSTUNREACH:
+		return "host"
+	case syscall.ENETUNREACH:
+		return "net"
+	}
+	return "other"
+}
+
+// classifyTLS classifies an error dialing a TLS upstream, anything but a timeout or a refused connection
+// happened during the handshake.
+func classifyTLS(err error) error {
+	if err == nil {
+		return nil
+	}
+	if err = classify(err); ErrorClass(err) != nil {
+		return err
+	}
+	return &UpstreamError{ErrTLSHandshake, err}
+}
+
+// errno returns the syscall.Errno wrapped in err, or 0.
+func errno(err error) syscall.Errno {
+	if op, ok := err.(*net.OpError); ok {
+		err = op.Err
+	}
+	if sc, ok := err.(*os.SyscallError); ok {
+		err = sc.Err
+	}
+	if e, ok := err.(syscall.Errno); ok {
+		return e
+	}
+	return 0
+}
+
+// errorClassLabel returns the label for err in UpstreamErrorCount.
+func errorClassLabel(err error) string {
+	switch ErrorClass(err) {
+	case ErrTimeout:
+		return "timeout"
+	case ErrConnRefused:
+		return "refused"
+	case ErrTLSHandshake:
+		return "tls"
+	case ErrBadReply:
+		return "bad_reply"
+	}
+	return "other"
+}
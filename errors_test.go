@@ -0,0 +1,58 @@
+package forward
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+func TestErrorClass(t *testing.T) {
+	silent := newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		// never answer
+	})
+	defer silent.Close()
+	garbage := newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		// A question whose name is a compression pointer to itself.
+		w.Write([]byte{byte(r.Id >> 8), byte(r.Id), 0x81, 0x80, 0, 1, 0, 0, 0, 0, 0, 0, 0xc0, 0x0c, 0, 1, 0, 1})
+	})
+	defer garbage.Close()
+	refused := newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {})
+	refused.Close()
+
+	tests := []struct {
+		addr     string
+		expected error
+	}{
+		{silent.Addr, ErrTimeout},
+		{garbage.Addr, ErrBadReply},
+		{refused.Addr, ErrConnRefused},
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	state := request.Request{W: &test.ResponseWriter{}, Req: req}
+
+	for i, tc := range tests {
+		p := NewProxy(tc.addr, transport.DNS)
+		p.start(hcInterval)
+		_, err := p.Connect(context.TODO(), state, options{})
+		p.stop()
+		if x := ErrorClass(err); x != tc.expected {
+			t.Errorf("Test %d: expected %v, got %v (%v)", i, tc.expected, x, err)
+		}
+	}
+}
+
+func TestClassifyTLS(t *testing.T) {
+	if err := classifyTLS(ErrCachedClosed); ErrorClass(err) != ErrTLSHandshake {
+		t.Errorf("Expected %v, got %v", ErrTLSHandshake, err)
+	}
+	if err := classifyTLS(nil); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+}
@@ -0,0 +1,124 @@
+package forward
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// exceptAction is what to do with a query for an excepted name.
+type exceptAction int
+
+const (
+	exceptNext     exceptAction = iota // hand the query to the next plugin
+	exceptNXDOMAIN                     // answer NXDOMAIN
+	exceptRefused                      // answer REFUSED
+	exceptForward                      // forward to the exception's own upstreams
+)
+
+func (a exceptAction) String() string {
+	switch a {
+	case exceptNXDOMAIN:
+		return "nxdomain"
+	case exceptRefused:
+		return "refused"
+	case exceptForward:
+		return "forward"
+	}
+	return "next"
+}
+
+// exception is a single except line: queries for any of names are handled by action instead of being
+// forwarded to the configured upstreams.
+type exception struct {
+	names    []string
+	patterns []*regexp.Regexp // wildcards and regular expressions
+	action   exceptAction
+	proxies  []*Proxy // upstreams for exceptForward
+}
+
+// parseException parses the arguments of except: DOMAIN... [next|nxdomain|refused|to TO...].
+func parseException(args []string) (exception, error) {
+	e := exception{}
+	i := 0
+	for ; i < len(args); i++ {
+		if a := args[i]; a == "next" || a == "nxdomain" || a == "refused" || a == "to" {
+			break
+		}
+		re, ok, err := compilePattern(args[i])
+		if err != nil {
+			return e, err
+		}
+		if ok {
+			e.patterns = append(e.patterns, re)
+			continue
+		}
+		e.names = append(e.names, normalizeHost(args[i]))
+	}
+	if len(e.names) == 0 && len(e.patterns) == 0 {
+		return e, fmt.Errorf("except needs at least one domain")
+	}
+	if i == len(args) {
+		return e, nil
+	}
+
+	action, rest := args[i], args[i+1:]
+	switch action {
+	case "to":
+		if len(rest) == 0 {
+			return e, fmt.Errorf("except to needs at least one upstream")
+		}
+		proxies, err := newProxies(rest)
+		if err != nil {
+			return e, err
+		}
+		e.action = exceptForward
+		e.proxies = proxies
+		return e, nil
+	case "nxdomain":
+		e.action = exceptNXDOMAIN
+	case "refused":
+		e.action = exceptRefused
+	}
+	if len(rest) > 0 {
+		return e, fmt.Errorf("unexpected argument after %s: %s", action, rest[0])
+	}
+	return e, nil
+}
+
+// exception returns the exception matching name, or nil if name isn't excepted.
+func (f *Forward) exception(name string) *exception {
+	if dns.Name(name) == dns.Name(f.from) {
+		return nil
+	}
+
+	for i := range f.except {
+		for _, ignore := range f.except[i].names {
+			if plugin.Name(ignore).Matches(name) {
+				return &f.except[i]
+			}
+		}
+		for _, re := range f.except[i].patterns {
+			if matchPattern(re, name) {
+				return &f.except[i]
+			}
+		}
+	}
+	return nil
+}
+
+// exceptReply returns the reply for a query answered by an nxdomain or refused exception.
+func exceptReply(state request.Request, action exceptAction) *dns.Msg {
+	m := new(dns.Msg)
+	if action == exceptNXDOMAIN {
+		m.SetRcode(state.Req, dns.RcodeNameError)
+	} else {
+		m.SetRcode(state.Req, dns.RcodeRefused)
+	}
+	setEdns0(state, m)
+	return m
+}
@@ -0,0 +1,88 @@
+package forward
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/caddyserver/caddy"
+	"github.com/miekg/dns"
+)
+
+func TestExceptAction(t *testing.T) {
+	s := newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A(r.Question[0].Name+" IN A 127.0.0.1"))
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+	group := newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A(r.Question[0].Name+" IN A 127.0.0.2"))
+		w.WriteMsg(ret)
+	})
+	defer group.Close()
+
+	corefile := "forward . " + s.Addr + ` {
+except blocked.org nxdomain
+except refused.org refused
+except next.org
+except internal.org to ` + group.Addr + `
+}
+`
+	f, err := parseForward(caddy.NewTestController("dns", corefile))
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	f.OnStartup()
+	defer f.OnShutdown()
+
+	tests := []struct {
+		qname         string
+		expectedRcode int
+		expectedA     string // empty when no answer is expected
+	}{
+		{"example.org.", dns.RcodeSuccess, "127.0.0.1"},
+		{"a.blocked.org.", dns.RcodeNameError, ""},
+		{"refused.org.", dns.RcodeRefused, ""},
+		{"next.org.", dns.RcodeServerFailure, ""}, // there is no next plugin
+		{"a.internal.org.", dns.RcodeSuccess, "127.0.0.2"},
+	}
+	for i, tc := range tests {
+		m := new(dns.Msg)
+		m.SetQuestion(tc.qname, dns.TypeA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		rcode, _ := f.ServeDNS(context.TODO(), rec, m)
+		if rec.Msg != nil {
+			rcode = rec.Msg.Rcode
+		}
+		if rcode != tc.expectedRcode {
+			t.Errorf("Test %d: expected rcode %d, got %d", i, tc.expectedRcode, rcode)
+			continue
+		}
+		if tc.expectedA == "" {
+			continue
+		}
+		if len(rec.Msg.Answer) != 1 {
+			t.Errorf("Test %d: expected 1 answer, got %d", i, len(rec.Msg.Answer))
+			continue
+		}
+		if x := rec.Msg.Answer[0].(*dns.A).A.String(); x != tc.expectedA {
+			t.Errorf("Test %d: expected %s, got %s", i, tc.expectedA, x)
+		}
+	}
+
+	// EDNS clients get an OPT record back.
+	m := new(dns.Msg)
+	m.SetQuestion("a.blocked.org.", dns.TypeA)
+	m.SetEdns0(4096, true)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	f.ServeDNS(context.TODO(), rec, m)
+	if opt := rec.Msg.IsEdns0(); opt == nil || !opt.Do() || opt.UDPSize() != 4096 {
+		t.Errorf("Expected an OPT record with DO and a payload of 4096, got %v", opt)
+	}
+}
@@ -0,0 +1,124 @@
+package forward
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/coredns/coredns/plugin"
+
+	"github.com/miekg/dns"
+)
+
+// batchConcurrency is the number of queries of ExchangeBatch in flight at once.
+const batchConcurrency = 32
+
+// Exchange resolves m as if a client sent it over UDP from 127.0.0.1, for programs that use Forward as a
+// resolver library: with the fan-out, policies and everything else of ServeDNS. A truncated reply is retried
+// as if the client switched to TCP. When ServeDNS answered a SERVFAIL, e.g. with an Extended DNS Error, that
+// reply is returned together with the error; a query that isn't answered by f or its Next plugins gets a reply
+// with the rcode ServeDNS returned, and its error.
+func (f *Forward) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	ret, err := f.exchangeOver(ctx, m, false)
+	if err == nil && ret.Truncated {
+		return f.exchangeOver(ctx, m, true)
+	}
+	return ret, err
+}
+
+func (f *Forward) exchangeOver(ctx context.Context, m *dns.Msg, tcp bool) (*dns.Msg, error) {
+	w := &exchangeWriter{tcp: tcp, msg: make(chan *dns.Msg, 1)}
+	rcode, err := f.ServeDNS(ctx, w, m)
+	if !plugin.ClientWrite(rcode) {
+		ret := new(dns.Msg)
+		ret.SetRcode(m, rcode)
+		return ret, err
+	}
+	// With async_write the reply is written after ServeDNS returned.
+	select {
+	case ret := <-w.msg:
+		return ret, err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// ExchangeResult is the reply to one question of ExchangeBatch, and the error of its Exchange.
+type ExchangeResult struct {
+	Question dns.Question
+	Msg      *dns.Msg
+	Err      error
+}
+
+// ExchangeBatch resolves questions, each as a query of its own with RD and an EDNS0 payload of 1232, and
+// returns the results in the same order. Up to batchConcurrency queries are in flight at once.
+func (f *Forward) ExchangeBatch(ctx context.Context, questions []dns.Question) []ExchangeResult {
+	results := make([]ExchangeResult, len(questions))
+	sem := make(chan struct{}, batchConcurrency)
+	var wg sync.WaitGroup
+	for i, q := range questions {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, q dns.Question) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if q.Qclass == 0 {
+				q.Qclass = dns.ClassINET
+			}
+			m := new(dns.Msg)
+			m.SetQuestion(dns.Fqdn(q.Name), q.Qtype)
+			m.Question[0].Qclass = q.Qclass
+			m.SetEdns0(defaultMaxUDPSize, false)
+			ret, err := f.Exchange(ctx, m)
+			results[i] = ExchangeResult{Question: q, Msg: ret, Err: err}
+		}(i, q)
+	}
+	wg.Wait()
+	return results
+}
+
+// exchangeWriter is the dns.ResponseWriter of Exchange, it hands the first message written to msg.
+type exchangeWriter struct {
+	tcp bool
+	msg chan *dns.Msg
+}
+
+// exchangeLocal is the address of both ends of an Exchange.
+var exchangeLocal = net.IPv4(127, 0, 0, 1)
+
+func (w *exchangeWriter) LocalAddr() net.Addr {
+	if w.tcp {
+		return &net.TCPAddr{IP: exchangeLocal, Port: 53}
+	}
+	return &net.UDPAddr{IP: exchangeLocal, Port: 53}
+}
+
+func (w *exchangeWriter) RemoteAddr() net.Addr {
+	if w.tcp {
+		return &net.TCPAddr{IP: exchangeLocal}
+	}
+	return &net.UDPAddr{IP: exchangeLocal}
+}
+
+func (w *exchangeWriter) WriteMsg(m *dns.Msg) error {
+	select {
+	case w.msg <- m:
+	default:
+	}
+	return nil
+}
+
+func (w *exchangeWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	return len(b), w.WriteMsg(m)
+}
+
+func (w *exchangeWriter) Close() error        { return nil }
+func (w *exchangeWriter) TsigStatus() error   { return nil }
+func (w *exchangeWriter) TsigTimersOnly(bool) {}
+func (w *exchangeWriter) Hijack()             {}
@@ -0,0 +1,65 @@
+package forward
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+func TestExchange(t *testing.T) {
+	s := newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		switch r.Question[0].Name {
+		case "example.org.":
+			ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"))
+		case "big.example.org.":
+			if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+				ret.Truncated = true
+				break
+			}
+			ret.Answer = append(ret.Answer, test.A("big.example.org. IN A 127.0.0.2"))
+		default:
+			ret.Rcode = dns.RcodeNameError
+		}
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	f, err := FromConfig(Config{From: "example.org", To: []string{s.Addr}})
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	f.OnStartup()
+	defer f.OnShutdown()
+
+	m := new(dns.Msg)
+	m.SetQuestion("big.example.org.", dns.TypeA)
+	ret, err := f.Exchange(context.TODO(), m)
+	if err != nil {
+		t.Fatalf("Expected a reply, got %s", err)
+	}
+	if ret.Truncated || len(ret.Answer) != 1 {
+		t.Errorf("Expected the truncated reply to be retried over TCP, got %v", ret)
+	}
+
+	m.SetQuestion("example.net.", dns.TypeA)
+	if ret, err = f.Exchange(context.TODO(), m); err == nil || ret.Rcode != dns.RcodeServerFailure {
+		t.Errorf("Expected SERVFAIL and an error for a name not forwarded, got %v", err)
+	}
+
+	results := f.ExchangeBatch(context.TODO(), []dns.Question{{Name: "example.org", Qtype: dns.TypeA}, {Name: "nx.example.org.", Qtype: dns.TypeA}})
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 results, got %d", len(results))
+	}
+	if r := results[0]; r.Err != nil || len(r.Msg.Answer) != 1 || r.Question.Qclass != dns.ClassINET {
+		t.Errorf("Expected an answer for %s, got %v", r.Question.Name, r.Err)
+	}
+	if r := results[1]; r.Err != nil || r.Msg.Rcode != dns.RcodeNameError {
+		t.Errorf("Expected NXDOMAIN for %s, got %v", r.Question.Name, r.Err)
+	}
+}
@@ -0,0 +1,27 @@
+package forward
+
+import (
+	"strconv"
+
+	"github.com/miekg/dns"
+)
+
+// countFanout counts how many of the n upstreams asked for a query gave a usable reply, a NOERROR or
+// NXDOMAIN the reply could be built from. Fewer than n is a partial fan-out. Queries that went to one
+// upstream aren't a fan-out and aren't counted.
+func countFanout(resps []fwdResp, n int) int {
+	answered := 0
+	for _, resp := range resps {
+		if resp.ret != nil && (resp.ret.Rcode == dns.RcodeSuccess || resp.ret.Rcode == dns.RcodeNameError) {
+			answered++
+		}
+	}
+	if n < 2 {
+		return answered
+	}
+	FanoutCount.WithLabelValues(strconv.Itoa(n), strconv.Itoa(answered)).Add(1)
+	if answered < n {
+		PartialFanoutCount.Add(1)
+	}
+	return answered
+}
@@ -0,0 +1,138 @@
+package forward
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// FaultInjector picks the fault injected into an exchange with an upstream, to test how a configuration
+// copes with misbehaving upstreams. It's called for every exchange, concurrently, and must not block.
+type FaultInjector interface {
+	Fault(addr string, r *dns.Msg) Fault
+}
+
+// FaultKind is what an injected fault does to an exchange.
+type FaultKind int
+
+// Faults. FaultNone exchanges as usual, after the Fault's Delay if any.
+const (
+	FaultNone    FaultKind = iota
+	FaultDrop              // the query is lost, the exchange times out
+	FaultCorrupt           // the reply can't be parsed
+	FaultRcode             // the upstream answers with the Fault's Rcode, without asking it
+)
+
+// Fault is a fault injected into an exchange. Delay, if set, comes first.
+type Fault struct {
+	Kind  FaultKind
+	Delay time.Duration
+	Rcode int // for FaultRcode
+}
+
+// errInjected is the error of an exchange failed by an injected fault.
+var errInjected = errors.New("injected fault")
+
+// SetFaultInjector makes f inject the faults fi picks into its upstream exchanges. It must be called
+// before f serves queries.
+func (f *Forward) SetFaultInjector(fi FaultInjector) { f.current().faults = fi }
+
+// faultyConnect is proxy.ConnectInfo, with the fault f.faults picks injected.
+func (f *Forward) faultyConnect(ctx context.Context, proxy *Proxy, state request.Request, opts options) (*dns.Msg, ExchangeInfo, error) {
+	fault := f.faults.Fault(proxy.addr, state.Req)
+	if fault.Kind == FaultNone && fault.Delay == 0 {
+		return proxy.ConnectInfo(ctx, state, opts)
+	}
+	traceFrom(ctx).logf("upstream %s: injecting fault %d after %s", proxy.addr, fault.Kind, fault.Delay)
+	FaultCount.WithLabelValues(proxy.addr, fault.Kind.String()).Add(1)
+
+	delay := fault.Delay
+	if fault.Kind == FaultDrop {
+		delay += readTimeout
+	}
+	if delay > 0 {
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ExchangeInfo{}, ctx.Err()
+		case <-t.C:
+		}
+	}
+
+	switch fault.Kind {
+	case FaultDrop:
+		return nil, ExchangeInfo{}, &UpstreamError{ErrTimeout, errInjected}
+	case FaultCorrupt:
+		return nil, ExchangeInfo{}, &UpstreamError{ErrBadReply, errInjected}
+	case FaultRcode:
+		ret := new(dns.Msg)
+		ret.SetRcode(state.Req, fault.Rcode)
+		return ret, ExchangeInfo{}, nil
+	}
+	return proxy.ConnectInfo(ctx, state, opts)
+}
+
+func (k FaultKind) String() string {
+	switch k {
+	case FaultDrop:
+		return "drop"
+	case FaultCorrupt:
+		return "corrupt"
+	case FaultRcode:
+		return "rcode"
+	}
+	return "delay"
+}
+
+// faultRule injects fault into percent of the exchanges, see the fault option.
+type faultRule struct {
+	percent float64
+	fault   Fault
+}
+
+// randomFaults is the FaultInjector of the fault options. Every rule gets its own chance, the first that
+// hits wins.
+type randomFaults []faultRule
+
+func (rf randomFaults) Fault(string, *dns.Msg) Fault {
+	for _, r := range rf {
+		if rand.Float64()*100 < r.percent {
+			return r.fault
+		}
+	}
+	return Fault{}
+}
+
+// parseFault parses the fault of a fault option: drop, corrupt, delay DURATION or rcode RCODE.
+func parseFault(args []string) (Fault, error) {
+	switch {
+	case len(args) == 1 && args[0] == "drop":
+		return Fault{Kind: FaultDrop}, nil
+	case len(args) == 1 && args[0] == "corrupt":
+		return Fault{Kind: FaultCorrupt}, nil
+	case len(args) == 2 && args[0] == "delay":
+		d, err := time.ParseDuration(args[1])
+		if err != nil {
+			return Fault{}, err
+		}
+		if d <= 0 {
+			return Fault{}, fmt.Errorf("fault delay can't be negative or zero: %s", d)
+		}
+		return Fault{Delay: d}, nil
+	case len(args) == 2 && args[0] == "rcode":
+		rcode, err := parseRcode(args[1])
+		if err != nil {
+			return Fault{}, err
+		}
+		return Fault{Kind: FaultRcode, Rcode: rcode}, nil
+	}
+	return Fault{}, fmt.Errorf("unknown fault: %s", strings.Join(args, " "))
+}
@@ -0,0 +1,102 @@
+package forward
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// faultFor injects a fault into the exchanges with one upstream.
+type faultFor struct {
+	addr  string
+	fault Fault
+}
+
+func (ff faultFor) Fault(addr string, _ *dns.Msg) Fault {
+	if addr == ff.addr {
+		return ff.fault
+	}
+	return Fault{}
+}
+
+func TestFaultInjector(t *testing.T) {
+	s := newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"))
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	tests := []struct {
+		fault      Fault
+		expectErr  error
+		expectCode int
+		minTime    time.Duration
+	}{
+		{Fault{}, nil, dns.RcodeSuccess, 0},
+		{Fault{Delay: 50 * time.Millisecond}, nil, dns.RcodeSuccess, 50 * time.Millisecond},
+		{Fault{Kind: FaultCorrupt}, ErrBadReply, 0, 0},
+		{Fault{Kind: FaultRcode, Rcode: dns.RcodeRefused}, nil, dns.RcodeRefused, 0},
+	}
+	for i, tc := range tests {
+		f := New()
+		f.SetProxy(NewProxy(s.Addr, transport.DNS))
+		f.SetFaultInjector(faultFor{s.Addr, tc.fault})
+
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", dns.TypeA)
+		start := time.Now()
+		ret, _, err := f.connect(context.TODO(), f.proxies[0], request.Request{W: &test.ResponseWriter{}, Req: m})
+		if ErrorClass(err) != tc.expectErr {
+			t.Errorf("Test %d: expected error %v, got %v", i, tc.expectErr, err)
+		}
+		if err == nil && ret.Rcode != tc.expectCode {
+			t.Errorf("Test %d: expected rcode %s, got %s", i, dns.RcodeToString[tc.expectCode], dns.RcodeToString[ret.Rcode])
+		}
+		if d := time.Since(start); d < tc.minTime {
+			t.Errorf("Test %d: expected a delay of %s, took %s", i, tc.minTime, d)
+		}
+		f.OnShutdown()
+	}
+}
+
+func TestFaultFailover(t *testing.T) {
+	answer := func(ip string) dns.HandlerFunc {
+		return func(w dns.ResponseWriter, r *dns.Msg) {
+			ret := new(dns.Msg)
+			ret.SetReply(r)
+			ret.Answer = append(ret.Answer, test.A("example.org. IN A "+ip))
+			w.WriteMsg(ret)
+		}
+	}
+	s1 := newTestServer(t, answer("127.0.0.1"))
+	defer s1.Close()
+	s2 := newTestServer(t, answer("127.0.0.2"))
+	defer s2.Close()
+
+	f := New()
+	f.p = new(sequential)
+	f.retryNext = true
+	f.SetProxy(NewProxy(s1.Addr, transport.DNS))
+	f.SetProxy(NewProxy(s2.Addr, transport.DNS))
+	f.SetFaultInjector(faultFor{s1.Addr, Fault{Kind: FaultCorrupt}})
+	defer f.OnShutdown()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := f.ServeDNS(context.TODO(), rec, m); err != nil {
+		t.Fatalf("Expected to receive reply, but got: %s", err)
+	}
+	if len(rec.Msg.Answer) != 1 || rec.Msg.Answer[0].(*dns.A).A.String() != "127.0.0.2" {
+		t.Errorf("Expected the answer of the second upstream, got %v", rec.Msg.Answer)
+	}
+}
@@ -8,7 +8,10 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
+	"math/rand"
+	"regexp"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coredns/coredns/plugin"
@@ -25,255 +28,640 @@ var log = clog.NewWithPlugin("forward")
 // Forward represents a plugin instance that can proxy requests to another (DNS) server. It has a list
 // of proxies each representing one upstream proxy.
 type Forward struct {
+	// 64 bit atomics first, for alignment on 32 bit platforms.
+	fanout   int64  // forward goroutines in flight, see ForwardVars
+	inflight int64  // queries being served, see Reload
+	logged   uint64 // queries counted for log_sample
+	draining uint32 // 1 while new queries go to the next plugin, see SetDraining
+
 	proxies    []*Proxy
+	shadow     *Proxy // receives a copy of every query, its answers are only compared, never served
+	cdRetry    *Proxy // SERVFAILs are retried on it with CD set, see retryCD
+	mirror     []*Proxy
 	p          Policy
 	hcInterval time.Duration
+	hcProbe    HealthProbe
+
+	from        string
+	fromPattern *regexp.Regexp // set if from is a wildcard or regular expression
+	except      []exception
+	reverses    []reverseRoute
+	authorities []authority // upstreams whose answers override the others' for some zones
 
-	from    string
-	ignored []string
+	mergeNames    []string // if set, only answers for these names are merged
+	mergePatterns []*regexp.Regexp
+	annotation    *annotation // if set, replies name the upstreams that answered
 
 	tlsConfig     *tls.Config
+	tlsSet        bool // tls was configured explicitly
 	tlsServerName string
-	maxfails      uint32
+	tlsSessions   int                    // if > 0, the size of the TLS session cache of each TLS upstream
+	tlsOpts       map[*Proxy]*tlsOptions // TLS settings of single upstreams
+	keyLog        *keyLog                // if set, TLS secrets are written to a file, see tls_keylog
+	preferLabel   *label                 // upstreams with this label are asked first, see prefer_label
+	zone          *label                 // only upstreams with this label are asked while any is up, see local_zone
+	bailiwick     string                 // bailiwickStrip or bailiwickRefuse records outside of it, if set
+	hosts         *hosts                 // if set, names answered locally before forwarding
+	nxCache       *nxCache               // if set, recent NXDOMAINs are answered without forwarding
+	nxFile        string                 // if set, the nxCache is kept in it across restarts, see nxdomain_cache_file
+	nxHandover    bool                   // the nxCache gets the entries of the generation g replaces, not nxFile's
+	randomSub     *randomSub             // if set, random subdomain floods are answered NXDOMAIN
+	pin           *pinOption             // if set, trusted clients can pick upstreams by label
+	maxfails      uint32                 // fails after which a proxy is considered down
+	failDecay     time.Duration          // half-life of a proxy's fails, 0 if they don't decay
+	maxRetries    int                    // retries of a single query
+	retryNext     bool                   // retry on the next proxy instead of the same one
+	leastBad      bool                   // when all proxies are down, try the one with the fewest fails
 	expire        time.Duration
-
-	opts options // also here for testing
+	protoExpire   map[string]time.Duration // expire per protocol, overrides expire
+	udpPool       int
+	dontFrag      bool   // set DF on UDP sockets, see avoid_fragmentation
+	prewarm       int    // TLS connections to keep open per upstream
+	rotate        rotate // when TCP and TLS connections are replaced
+	clearAD       bool
+	rcodeMap      map[int]int // rcodes of upstream replies translated before answering, see rcode_map
+	conflict      conflictPolicy
+	mirrorPercent float64 // percentage of queries copied to the mirror proxies
+	quorum        int     // if > 0, number of upstreams that must return the same answer
+	fanoutMax     int     // if > 0, maximum number of upstreams asked per query
+
+	opts    options // also here for testing
+	capture *capture
+	writer  *asyncWriter // if set, responses are written asynchronously
+	early   bool         // answer with the first good response, don't wait for the whole fan-out
+
+	selfTest *selfTest     // if set, the upstreams are tested on startup
+	tracer   *tracer       // if set, queries can be traced at runtime
+	faults   FaultInjector // if set, faults are injected into upstream exchanges
+
+	debugVars   *debugVars    // if set, f's internals are published with expvar
+	pprofLabels bool          // label exchanges with their upstream in CPU profiles
+	logSample   uint64        // if > 0, 1 in logSample queries is logged
+	errLog      *errorLimiter // if set, upstream errors are logged, rate limited
+	idnDisplay  bool          // show internationalized names in Unicode in logs and debug output
+
+	hooksMu sync.Mutex
+	hooks   []func(addr string, up bool)
+
+	servfails   *servfailAlert // if set, the SERVFAIL ratio is tracked, see servfail_alert
+	breachHooks []func(ratio float64, breached bool)
+
+	shareUp bool            // share proxies with other Forwards, see sharedUpstreams
+	shared  map[*Proxy]bool // proxies started and stopped through sharedUpstreams
+
+	reloadMu sync.Mutex   // serializes Reload, OnShutdown and SetDraining
+	gen      atomic.Value // *Forward that serves queries after a Reload, see current
 
 	Next plugin.Handler
 }
 
 // New returns a new Forward.
 func New() *Forward {
-	f := &Forward{maxfails: 2, tlsConfig: new(tls.Config), expire: defaultExpire, p: new(random), from: ".", hcInterval: hcInterval}
+	f := &Forward{maxfails: 2, maxRetries: 1, tlsConfig: new(tls.Config), expire: defaultExpire, p: new(random), from: ".", hcInterval: hcInterval, hcProbe: defaultProbe}
 	return f
 }
 
 // SetProxy appends p to the proxy list and starts healthchecking.
 func (f *Forward) SetProxy(p *Proxy) {
 	f.proxies = append(f.proxies, p)
+	p.onChange = f.checkState
 	p.start(f.hcInterval)
 }
 
+// upstreams returns all proxies f talks to, including the shadow, cd_retry and mirror ones.
+func (f *Forward) upstreams() []*Proxy {
+	ps := make([]*Proxy, 0, len(f.proxies)+len(f.mirror)+2)
+	ps = append(ps, f.proxies...)
+	for _, e := range f.except {
+		ps = append(ps, e.proxies...)
+	}
+	for _, r := range f.reverses {
+		ps = append(ps, r.proxies...)
+	}
+	if f.shadow != nil {
+		ps = append(ps, f.shadow)
+	}
+	if f.cdRetry != nil {
+		ps = append(ps, f.cdRetry)
+	}
+	return append(ps, f.mirror...)
+}
+
 // Len returns the number of configured proxies.
-func (f *Forward) Len() int { return len(f.proxies) }
+func (f *Forward) Len() int { return len(f.current().proxies) }
 
 // Name implements plugin.Handler.
 func (f *Forward) Name() string { return "forward" }
 
 type fwdResp struct {
+	proxy       *Proxy // proxy that gave us ret, or the last one tried
 	ret         *dns.Msg
-	code        int
 	upstreamErr error
+	mismatch    bool         // every attempt got a reply that didn't match the question
+	info        ExchangeInfo // how ret was exchanged
 }
 
 // ServeDNS implements plugin.Handler.
 func (f *Forward) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	g := f.acquire()
+	defer atomic.AddInt64(&g.inflight, -1)
+	if g.sampled() {
+		return g.serveLogged(ctx, w, r)
+	}
+	return g.serveDNS(ctx, w, r)
+}
 
+func (f *Forward) serveDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
 	state := request.Request{W: w, Req: r}
 	if !f.match(state) {
 		return plugin.NextOrFailure(f.Name(), f.Next, ctx, w, r)
 	}
 
-	var span ot.Span
-	span = ot.SpanFromContext(ctx)
-	list := f.List()
+	tr := f.tracer.begin(state)
+	ctx = withTrace(ctx, tr)
+
+	if f.hosts != nil {
+		if m := f.hosts.answer(state); m != nil {
+			tr.logf("answered from hosts")
+			HostsCount.Inc()
+			return f.write(state, m, nil)
+		}
+	}
+
+	ctx, cancel := withBudget(ctx)
+	if cancel != nil {
+		if d, ok := ctx.Deadline(); ok {
+			tr.logf("budget of %s left", time.Until(d).Round(time.Millisecond))
+		}
+		defer func() {
+			if cancel != nil {
+				cancel()
+			}
+		}()
+	}
+
+	list := f.listName(state.Name(), f.proxies)
+	if r := f.reverse(state.Name()); r != nil {
+		tr.logf("reverse route to %s", proxyAddrs(r.proxies))
+		list = f.listName(state.Name(), r.proxies)
+	}
+	if e := f.exception(state.Name()); e != nil {
+		tr.logf("excepted, action %s", e.action)
+		switch e.action {
+		case exceptNXDOMAIN, exceptRefused:
+			return f.write(state, exceptReply(state, e.action), nil)
+		case exceptForward:
+			list = f.listName(state.Name(), e.proxies)
+		default:
+			return plugin.NextOrFailure(f.Name(), f.Next, ctx, w, r)
+		}
+	}
+	// Pinned queries bypass the nxdomain_cache, their upstreams may know names the others don't.
+	nxCache := f.nxCache
+	if f.pin != nil {
+		if l, ok := f.pin.pin(state); ok {
+			var found bool
+			if list, found = pinned(list, l); found {
+				tr.logf("pinned to %s", l)
+				nxCache = nil
+			} else {
+				tr.logf("no upstream has the pinned label %s", l)
+			}
+		}
+	}
+
+	if nxCache != nil {
+		if m := nxCache.answer(state); m != nil {
+			tr.logf("answered from nxdomain_cache")
+			NXCacheHitsCount.Inc()
+			return f.write(state, m, nil)
+		}
+	}
+
+	if f.randomSub != nil {
+		if zone := f.randomSub.held(state.Name()); zone != "" {
+			tr.logf("random subdomain flood under %s", zone)
+			RandomSubdomainCount.Inc()
+			return f.write(state, exceptReply(state, exceptNXDOMAIN), nil)
+		}
+	}
+
+	if list = acceptQtype(list, state.QType()); len(list) == 0 {
+		tr.logf("no upstream accepts %s", dns.Type(state.QType()))
+		return f.write(state, filteredReply(state), nil)
+	}
 
 	live := make([]*Proxy, 0, len(list))
 	for _, proxy := range list {
-		if proxy.Down(f.maxfails) {
+		if proxy.Down(f.maxfails) || atomic.LoadUint32(&proxy.drained) == 1 {
 			continue
 		}
 		live = append(live, proxy)
 	}
+	if f.zone != nil {
+		live = f.inZone(live, tr)
+	}
+	if tr != nil {
+		tr.logf("policy %s picked %s, %d of %d upstreams are up", f.p, proxyAddrs(list), len(live), len(list))
+	}
+	if len(live) == 0 {
+		// Don't bother with the fan-out, shadow and mirror.
+		HealthcheckBrokenCount.Add(1)
+		if !f.leastBad || len(list) == 0 {
+			return f.fail(state, ErrNoHealthy)
+		}
+		live = append(live, leastBad(list))
+		tr.logf("all upstreams are down, trying %s with the fewest fails", live[0].addr)
+	}
 
-	wg := &sync.WaitGroup{}
-	ch := make(chan fwdResp, len(live))
+	if len(f.mirror) > 0 && rand.Float64()*100 < f.mirrorPercent {
+		f.mirrorQuery(state)
+	}
 
-	for _, proxy := range live {
-		wg.Add(1)
-		go func(proxy *Proxy) {
-			defer wg.Done()
-			var child ot.Span
-			var ctxInner context.Context
-			var fails uint32 = 0
+	var shadow chan fwdResp
+	if f.shadow != nil {
+		shadow = make(chan fwdResp, 1)
+		atomic.AddInt64(&f.fanout, 1)
+		go func() {
+			shadow <- f.forward(context.Background(), state, []*Proxy{f.shadow}, 0)
+			atomic.AddInt64(&f.fanout, -1)
+		}()
+	}
 
-			for fails < f.maxfails {
-				if span != nil {
-					child = span.Tracer().StartSpan("connect", ot.ChildOf(span.Context()))
-					ctxInner = ot.ContextWithSpan(ctx, child)
-				}
+	// Only the first fanout_max proxies are asked, the others are still there for retries.
+	n := len(live)
+	if f.fanoutMax > 0 && n > f.fanoutMax {
+		n = f.fanoutMax
+	}
+	ch := make(chan fwdResp, n)
+	for i := 0; i < n; i++ {
+		atomic.AddInt64(&f.fanout, 1)
+		go func(i int) {
+			ch <- f.forward(ctx, state, live, i)
+			atomic.AddInt64(&f.fanout, -1)
+		}(i)
+	}
 
-				var (
-					ret *dns.Msg
-					err error
-				)
-
-				opts := f.opts
-				for {
-					ret, err = proxy.Connect(ctxInner, state, opts)
-					if err == ErrCachedClosed { // Remote side closed conn, can only happen with TCP.
-						continue
-					}
-					// Retry with TCP if truncated and prefer_udp configured.
-					if ret != nil && ret.Truncated && !opts.forceTCP && opts.preferUDP {
-						opts.forceTCP = true
-						continue
-					}
-					break
+	resps := make([]fwdResp, 0, n)
+	for i := 0; i < n; i++ {
+		resp := <-ch
+		resps = append(resps, resp)
+		if tr != nil {
+			tr.logf("upstream %s: %s", resp.proxy.addr, resp)
+		}
+		if len(resps) < n && f.answerEarly(state, resp) {
+			// Answer now, the stragglers are only awaited for the conflict metrics. Without a reply yet,
+			// e.g. no quorum, wait for them like for any other response.
+			ret, err := f.reply(state, resps)
+			if err != nil {
+				tr.logf("no early reply: %s", err)
+				continue
+			}
+			tr.logf("early response with %d answers", len(ret.Answer))
+			f.annotate(state, ret, resps)
+			f.remapRcode(ret)
+			f.observeRandomSub(state, ret)
+			// The stragglers keep the budget's deadline, it's cancelled once they are in.
+			go func(cancel context.CancelFunc) {
+				f.backfill(state, resps, ch, n)
+				if cancel != nil {
+					cancel()
 				}
+			}(cancel)
+			cancel = nil
+			return f.write(state, ret, shadow)
+		}
+	}
 
-				if child != nil {
-					child.Finish()
-				}
+	if answered := countFanout(resps, n); answered < n {
+		tr.logf("%d of %d upstreams answered", answered, n)
+	}
+	ret, err := f.reply(state, resps)
+	if err != nil {
+		tr.logf("no reply: %s", err)
+		if shadow != nil {
+			go f.compareShadow(state, "", shadow)
+		}
+		return f.fail(state, err)
+	}
+	if ret.Rcode == dns.RcodeServerFailure && f.cdRetry != nil && !state.Req.CheckingDisabled {
+		ret = f.retryCD(ctx, state, ret)
+	}
+	if tr != nil {
+		tr.logf("reply rcode %s with %d answers, conflict policy %s", dns.RcodeToString[ret.Rcode], len(ret.Answer), f.conflict)
+	}
+	f.annotate(state, ret, resps)
+	f.remapRcode(ret)
+	if nxCache != nil {
+		nxCache.add(state, ret)
+	}
+	f.observeRandomSub(state, ret)
+	return f.write(state, ret, shadow)
+}
 
-				if err != nil {
-					// Kick off health check to see if *our* upstream is broken.
-					if f.maxfails != 0 {
-						proxy.Healthcheck()
-					}
-
-					fails++
-					if !proxy.Down(f.maxfails) {
-						continue
-					}
-
-					ch <- fwdResp{
-						ret:         nil,
-						code:        0,
-						upstreamErr: err,
-					}
-					break
-				}
+// observeRandomSub hands the reply ret to state to the random_subdomain detection, if there is one.
+func (f *Forward) observeRandomSub(state request.Request, ret *dns.Msg) {
+	if f.randomSub != nil && f.randomSub.observe(state.Name(), ret.Rcode) {
+		zone, _ := randomLabel(state.Name())
+		log.Warningf("Random subdomain flood under %s, answering random names in it NXDOMAIN for %s", zone, f.randomSub.hold)
+	}
+}
 
-				if !state.Match(ret) {
-					debug.Hexdumpf(ret, "Wrong reply for id: %d, %s %d", ret.Id, state.QName(), state.QType())
-
-					formerr := new(dns.Msg)
-					formerr.SetRcode(state.Req, dns.RcodeFormatError)
-					ch <- fwdResp{
-						ret:         formerr,
-						code:        0,
-						upstreamErr: nil,
-					}
-					break
-				} else {
-					ch <- fwdResp{
-						ret:         ret,
-						code:        0,
-						upstreamErr: nil,
-					}
-					break
-				}
-			}
-		}(proxy)
+// fail answers SERVFAIL because of err. EDNS clients get an Extended DNS Error saying why, in a reply
+// written here; for the others the server writes the SERVFAIL.
+func (f *Forward) fail(state request.Request, err error) (int, error) {
+	if state.Req.IsEdns0() == nil {
+		f.observeRcode(dns.RcodeServerFailure)
+		return dns.RcodeServerFailure, err
 	}
+	m := new(dns.Msg)
+	m.SetRcode(state.Req, dns.RcodeServerFailure)
+	setEdns0(state, m)
+	code, text := edeFor(err)
+	addEDE(m, code, text)
+	f.write(state, m, nil)
+	// Already written, so the server mustn't write another SERVFAIL. err still goes to the errors plugin.
+	return dns.RcodeSuccess, err
+}
 
-	wg.Wait()
-	close(ch)
+// answerEarly returns true if resp can be answered without waiting for the other upstreams: with
+// early_response when it's successful, for names not in merge_domains when it also has an answer. For
+// names some upstreams are authoritative for it must come from one of them.
+func (f *Forward) answerEarly(state request.Request, resp fwdResp) bool {
+	if resp.ret == nil || resp.ret.Rcode != dns.RcodeSuccess {
+		return false
+	}
+	if !f.early && (f.merges(state.Name()) || len(resp.ret.Answer) == 0) {
+		return false
+	}
+	return !f.hasAuthority(state.Name()) || f.isAuthoritative(state.Name(), resp.proxy)
+}
 
-	resps := make([]fwdResp, 0, len(live))
-	for resp := range ch {
-		resps = append(resps, resp)
+// write writes ret to the client, after handing it to f.compareShadow if a shadow upstream is queried.
+func (f *Forward) write(state request.Request, ret *dns.Msg, shadow <-chan fwdResp) (int, error) {
+	if shadow != nil {
+		go f.compareShadow(state, shadowKey(ret), shadow)
+	}
+	if f.clearAD {
+		ret.AuthenticatedData = false
+	}
+	f.observeRcode(ret.Rcode)
+	if f.writer != nil {
+		f.writer.write(state.W, ret)
+		return 0, nil
 	}
+	state.W.WriteMsg(ret)
+	return 0, nil
+}
 
-	ipAnswers := make([]dns.RR, 0, len(live))
-	for _, resp := range resps {
-		if resp.ret == nil {
+// backfill waits for the responses still outstanding on ch after an early response, of the n upstreams
+// asked, so the conflict between all upstreams and the completeness of the fan-out are still counted.
+func (f *Forward) backfill(state request.Request, resps []fwdResp, ch <-chan fwdResp, n int) {
+	for len(resps) < n {
+		resps = append(resps, <-ch)
+	}
+	countFanout(resps, n)
+	sets := make([]addrSet, 0, len(resps))
+	for i := range resps {
+		if resps[i].ret == nil {
 			continue
 		}
-		for _, rr := range resp.ret.Answer {
-			switch rr.Header().Rrtype {
-			case dns.TypeA:
-				ipAnswers = append(ipAnswers, rr)
-			case dns.TypeAAAA:
-				ipAnswers = append(ipAnswers, rr)
-			}
+		if set := newAddrSet(&resps[i]); len(set.rrs) > 0 {
+			sets = append(sets, set)
 		}
 	}
+	if len(sets) > 1 {
+		f.resolveConflict(state, sets)
+	}
+}
 
-	if len(ipAnswers) > 0 {
-		var ret = &dns.Msg{}
-		ret.SetReply(r)
-		ret.Authoritative = false
-		ret.RecursionAvailable = true
-		name := ret.Question[0].Name
-		for _, ip := range ipAnswers {
-			ip.Header().Name = name
-			ret.Answer = append(ret.Answer, ip)
+// forward sends state to live[i] until it gets a usable reply or runs out of attempts, 1 + f.maxRetries of
+// them. An error or a reply that doesn't match the question both count as a failed attempt; after a mismatch
+// we move on to the next proxy in live, as the one we asked may well be broken. With f.retryNext errors do
+// the same, otherwise an error only stops the retries early when it got the proxy marked down, which is
+// governed by f.maxfails.
+func (f *Forward) forward(ctx context.Context, state request.Request, live []*Proxy, i int) fwdResp {
+	span := ot.SpanFromContext(ctx)
+	proxy := live[i]
+
+	var resp fwdResp
+	for attempt := 0; attempt <= f.maxRetries; attempt++ {
+		var child ot.Span
+		ctxInner := ctx
+		if span != nil {
+			child = span.Tracer().StartSpan("connect", ot.ChildOf(span.Context()))
+			ctxInner = ot.ContextWithSpan(ctx, child)
 		}
-		w.WriteMsg(ret)
-		return 0, nil
-	}
 
-	// find a successful response
-	for _, resp := range resps {
-		if resp.ret != nil && resp.ret.Rcode == dns.RcodeSuccess {
-			w.WriteMsg(resp.ret)
-			return 0, nil
+		start := time.Now()
+		ret, info, err := f.labeledConnect(ctxInner, proxy, state)
+
+		if child != nil {
+			child.Finish()
+		}
+		if f.capture != nil {
+			f.capture.record(proxy.addr, start, state.Req, ret, err)
 		}
-	}
 
-	for _, resp := range resps {
-		if resp.ret != nil {
-			w.WriteMsg(resp.ret)
-			return 0, nil
+		tr := traceFrom(ctx)
+		if err != nil {
+			tr.logf("upstream %s: attempt %d failed: %s", proxy.addr, attempt+1, err)
 		}
-	}
 
-	for _, resp := range resps {
-		if resp.upstreamErr == nil {
+		if err != nil && ctx.Err() != nil {
+			// The client went away or ran out of time, not the upstream's fault.
+			return fwdResp{proxy: proxy, upstreamErr: err}
+		}
+		if err != nil && f.errLog != nil {
+			f.errLog.logError(proxy.describe(), err)
+		}
+
+		if err != nil {
+			// Kick off health check to see if *our* upstream is broken.
+			if f.maxfails != 0 {
+				proxy.Healthcheck()
+			}
+
+			resp = fwdResp{proxy: proxy, upstreamErr: err}
+			if f.retryNext {
+				if j := f.nextUp(live, i); j != i {
+					tr.logf("upstream %s: failed, retrying on %s", proxy.addr, live[j].addr)
+					i = j
+					proxy = live[i]
+					continue
+				}
+			}
+			if !proxy.Down(f.maxfails) {
+				continue
+			}
+			break
+		}
+
+		if !state.Match(ret) {
+			debug.Hexdumpf(ret, "Wrong reply for id: %d, %s %d", ret.Id, displayName(state.QName(), f.idnDisplay), state.QType())
+
+			resp = fwdResp{proxy: proxy, mismatch: true}
+			i = (i + 1) % len(live)
+			tr.logf("upstream %s: mismatched reply, trying %s", proxy.addr, live[i].addr)
+			proxy = live[i]
+			continue
+		}
+		if f.bailiwick != "" && f.checkBailiwick(proxy, state, ret) > 0 && f.bailiwick == bailiwickRefuse {
+			resp = fwdResp{proxy: proxy, mismatch: true}
+			i = (i + 1) % len(live)
+			tr.logf("upstream %s: records outside the bailiwick, trying %s", proxy.addr, live[i].addr)
+			proxy = live[i]
 			continue
 		}
 
-		return dns.RcodeServerFailure, resp.upstreamErr
+		return fwdResp{proxy: proxy, ret: ret, info: info}
 	}
 
-	return dns.RcodeServerFailure, ErrNoHealthy
+	return resp
 }
 
-func (f *Forward) match(state request.Request) bool {
-	if !plugin.Name(f.from).Matches(state.Name()) || !f.isAllowedDomain(state.Name()) {
-		return false
+// nextUp returns the index of the first proxy after live[i] that isn't down, or i if there is none.
+func (f *Forward) nextUp(live []*Proxy, i int) int {
+	for n := 1; n < len(live); n++ {
+		j := (i + n) % len(live)
+		if !live[j].Down(f.maxfails) {
+			return j
+		}
 	}
-
-	return true
+	return i
 }
 
-func (f *Forward) isAllowedDomain(name string) bool {
-	if dns.Name(name) == dns.Name(f.from) {
-		return true
-	}
+// connect sends state to proxy, transparently retrying when a cached connection turned out to be closed or
+// gave a bad reply, or over TCP when the response didn't fit in UDP. Retries are capped at maxConnectRetries.
+func (f *Forward) connect(ctx context.Context, proxy *Proxy, state request.Request) (*dns.Msg, ExchangeInfo, error) {
+	var (
+		ret  *dns.Msg
+		info ExchangeInfo
+		err  error
+	)
+
+	opts := f.opts
+	for retries := 0; ; retries++ {
+		if retries > maxConnectRetries {
+			RetryCapCount.WithLabelValues(proxy.addr).Add(1)
+			if ret != nil && err == nil {
+				return ret, info, nil // a truncated response is still a response
+			}
+			return nil, info, ErrRetryCap
+		}
 
-	for _, ignore := range f.ignored {
-		if plugin.Name(ignore).Matches(name) {
-			return false
+		if f.faults != nil {
+			ret, info, err = f.faultyConnect(ctx, proxy, state, opts)
+		} else {
+			ret, info, err = proxy.ConnectInfo(ctx, state, opts)
+		}
+		info.Retries = retries
+		if err == ErrCachedClosed { // Remote side closed conn, can only happen with TCP.
+			traceFrom(ctx).logf("upstream %s: cached connection closed, retrying", proxy.addr)
+			continue
+		}
+		// A garbled or mismatched reply on a cached connection, the transport dropped the connection. Try
+		// once more on a new one, stale and poisoned pooled sockets are a common cause.
+		if info.Reused && !freshConn(ctx) && (ErrorClass(err) == ErrBadReply || (err == nil && !state.Match(ret))) {
+			traceFrom(ctx).logf("upstream %s: bad reply on a cached connection, retrying on a new one", proxy.addr)
+			ctx = withFreshConn(ctx)
+			continue
+		}
+		// Too large for UDP, see if the upstream does better over TCP.
+		if err == errOversizeUDP && opts.sameTransport {
+			return nil, info, ErrOversize
+		}
+		if err == errOversizeUDP && !opts.forceTCP {
+			traceFrom(ctx).logf("upstream %s: response too large, retrying over tcp", proxy.addr)
+			opts.forceTCP = true
+			continue
 		}
+		// Retry with TCP if truncated only because of the payload we advertised, the client could take more.
+		if ret != nil && ret.Truncated && !opts.forceTCP && !opts.sameTransport && opts.maxUDPSize > 0 && state.Size() > int(opts.maxUDPSize) {
+			traceFrom(ctx).logf("upstream %s: truncated at %d bytes, retrying over tcp", proxy.addr, opts.maxUDPSize)
+			opts.forceTCP = true
+			continue
+		}
+		// Retry with TCP if truncated and prefer_udp configured.
+		if ret != nil && ret.Truncated && !opts.forceTCP && opts.preferUDP {
+			traceFrom(ctx).logf("upstream %s: truncated, retrying over tcp", proxy.addr)
+			opts.forceTCP = true
+			continue
+		}
+		return ret, info, err
 	}
-	return true
+}
+
+func (f *Forward) match(state request.Request) bool {
+	if atomic.LoadUint32(&f.draining) == 1 {
+		return false
+	}
+	if f.fromPattern != nil {
+		return matchPattern(f.fromPattern, state.Name())
+	}
+	return plugin.Name(f.from).Matches(state.Name())
 }
 
 // ForceTCP returns if TCP is forced to be used even when the request comes in over UDP.
-func (f *Forward) ForceTCP() bool { return f.opts.forceTCP }
+func (f *Forward) ForceTCP() bool { return f.current().opts.forceTCP }
 
 // PreferUDP returns if UDP is preferred to be used even when the request comes in over TCP.
-func (f *Forward) PreferUDP() bool { return f.opts.preferUDP }
+func (f *Forward) PreferUDP() bool { return f.current().opts.preferUDP }
 
 // List returns a set of proxies to be used for this client depending on the policy in f.
-func (f *Forward) List() []*Proxy { return f.p.List(f.proxies) }
+func (f *Forward) List() []*Proxy {
+	g := f.current()
+	return g.p.List(g.proxies)
+}
 
 var (
 	// ErrNoHealthy means no healthy proxies left.
 	ErrNoHealthy = errors.New("no healthy proxies")
 	// ErrNoForward means no forwarder defined.
 	ErrNoForward = errors.New("no forwarder defined")
+	// ErrNoQuorum means not enough upstreams agreed on the answer.
+	ErrNoQuorum = errors.New("no quorum among upstreams")
 	// ErrCachedClosed means cached connection was closed by peer.
 	ErrCachedClosed = errors.New("cached connection was closed by peer")
+	// ErrRetryCap means we gave up on an upstream after retrying maxConnectRetries times.
+	ErrRetryCap = errors.New("too many retries")
+	// ErrOversize means the upstream's response was larger than allowed.
+	ErrOversize = errors.New("response larger than max_response_size")
+	// ErrNoRecursion means the upstream's response didn't have RA set, while require_ra wants it.
+	ErrNoRecursion = errors.New("upstream doesn't offer recursion")
+	// ErrTimeout means the upstream didn't answer in time.
+	ErrTimeout = errors.New("upstream timed out")
+	// ErrConnRefused means the upstream refused the connection, or is unreachable over UDP.
+	ErrConnRefused = errors.New("upstream refused connection")
+	// ErrTLSHandshake means the TLS handshake with the upstream failed.
+	ErrTLSHandshake = errors.New("tls handshake with upstream failed")
+	// ErrBadReply means the upstream's reply could not be parsed.
+	ErrBadReply = errors.New("bad reply from upstream")
+
+	// errOversizeUDP means the response over UDP was too large and we should retry over TCP.
+	errOversizeUDP = errors.New("response over udp larger than max_response_size")
 )
 
 // options holds various options that can be set.
 type options struct {
-	forceTCP  bool
-	preferUDP bool
+	forceTCP      bool
+	preferUDP     bool
+	sameTransport bool   // never switch from the client's transport, not even for oversized responses
+	maxUDPSize    uint16 // if > 0, the largest EDNS0 payload advertised to upstreams over UDP
+	lowerQname    bool   // send query names in lower case, see lowercase_qname
+	anonymize     bool   // strip what tells about the client from queries, see anonymize
+	pad           bool   // pad queries, see anonymize
 }
 
-const defaultTimeout = 5 * time.Second
+const (
+	defaultTimeout = 5 * time.Second
+
+	// defaultTLSSessions is the size of the per upstream session cache of tls_session_cache.
+	defaultTLSSessions = 64
+
+	// defaultMaxUDPSize is the payload size avoid_fragmentation advertises, as recommended by DNS flag day 2020.
+	defaultMaxUDPSize = 1232
+
+	// maxConnectRetries caps the retries of a single upstream exchange, see (*Forward).connect.
+	maxConnectRetries = 3
+)
@@ -0,0 +1,531 @@
+package forward
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// testServer is a UDP and TCP DNS server on the loopback interface. Unlike dnstest.Server, which
+// registers its handler globally, each testServer has its own handler so several can be used in one test.
+type testServer struct {
+	Addr string
+
+	s1 *dns.Server // udp
+	s2 *dns.Server // tcp
+}
+
+func newTestServer(t *testing.T, f dns.HandlerFunc) *testServer {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+
+	ch1, ch2 := make(chan bool), make(chan bool)
+	s1 := &dns.Server{PacketConn: pc, Handler: f, NotifyStartedFunc: func() { close(ch1) }}
+	s2 := &dns.Server{Listener: l, Handler: f, NotifyStartedFunc: func() { close(ch2) }}
+	go s1.ActivateAndServe()
+	go s2.ActivateAndServe()
+	<-ch1
+	<-ch2
+
+	return &testServer{Addr: pc.LocalAddr().String(), s1: s1, s2: s2}
+}
+
+// Close shuts down the server.
+func (s *testServer) Close() {
+	s.s1.Shutdown()
+	s.s2.Shutdown()
+}
+
+// newMismatchServer returns a server that answers every query for a question that wasn't asked.
+func newMismatchServer(t *testing.T) *testServer {
+	return newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Question[0].Name = "wrong.example.org."
+		w.WriteMsg(ret)
+	})
+}
+
+func TestForwardMismatchRetry(t *testing.T) {
+	bad := newMismatchServer(t)
+	defer bad.Close()
+	good := newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"))
+		w.WriteMsg(ret)
+	})
+	defer good.Close()
+
+	f := New()
+	f.p = &sequential{}
+	f.SetProxy(NewProxy(bad.Addr, transport.DNS))
+	f.SetProxy(NewProxy(good.Addr, transport.DNS))
+	defer f.OnShutdown()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+
+	if _, err := f.ServeDNS(context.TODO(), rec, m); err != nil {
+		t.Fatalf("Expected to receive reply, but got: %s", err)
+	}
+	if rec.Msg.Rcode != dns.RcodeSuccess {
+		t.Errorf("Expected rcode %d, got %d", dns.RcodeSuccess, rec.Msg.Rcode)
+	}
+	if len(rec.Msg.Answer) == 0 {
+		t.Errorf("Expected an answer from the well-behaved upstream")
+	}
+}
+
+func TestForwardFreshConnRetry(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		ports []string
+	)
+	s := newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		mu.Lock()
+		defer mu.Unlock()
+		ports = append(ports, w.RemoteAddr().String())
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		if len(ports) == 2 {
+			ret.Question[0].Name = "example.net." // poisoned
+		}
+		ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"))
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	f := New()
+	p := NewProxy(s.Addr, transport.DNS)
+	f.SetProxy(p)
+	defer f.OnShutdown()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	state := request.Request{W: &test.ResponseWriter{}, Req: m}
+	for i := 0; i < 2; i++ {
+		ret, info, err := f.connect(context.TODO(), p, state)
+		if err != nil || !state.Match(ret) {
+			t.Fatalf("Query %d: expected a matching reply, got %v, %v", i, ret, err)
+		}
+		if i == 1 && info.Retries != 1 {
+			t.Errorf("Expected 1 retry after the poisoned reply, got %d", info.Retries)
+		}
+	}
+	seen := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), ports...)
+	}
+	if ports := seen(); len(ports) != 3 || ports[1] != ports[0] || ports[2] == ports[1] {
+		t.Errorf("Expected the cached socket to be used, then a new one, got %v", ports)
+	}
+
+	// The poisoned socket isn't used again.
+	if _, _, err := f.connect(context.TODO(), p, state); err != nil {
+		t.Fatalf("Expected a reply, got %s", err)
+	}
+	if ports := seen(); len(ports) != 4 || ports[3] != ports[2] {
+		t.Errorf("Expected the new socket to be cached, got %v", ports)
+	}
+}
+
+func TestForwardAvoidFragmentation(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		sizes []uint16 // advertised payload of UDP queries, 0 for TCP
+	)
+	s := newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			mu.Lock()
+			sizes = append(sizes, r.IsEdns0().UDPSize())
+			mu.Unlock()
+			ret.Truncated = true
+		} else {
+			mu.Lock()
+			sizes = append(sizes, 0)
+			mu.Unlock()
+			ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"))
+		}
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	f := New()
+	f.opts.maxUDPSize = defaultMaxUDPSize
+	p := NewProxy(s.Addr, transport.DNS)
+	p.SetDontFragment(true)
+	f.SetProxy(p)
+	defer f.OnShutdown()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	m.SetEdns0(4096, false)
+	state := request.Request{W: &test.ResponseWriter{}, Req: m}
+	ret, info, err := f.connect(context.TODO(), p, state)
+	if err != nil {
+		t.Fatalf("Expected a reply, got %s", err)
+	}
+	if ret.Truncated || len(ret.Answer) != 1 || info.Retries != 1 {
+		t.Errorf("Expected the full answer after 1 retry, got %v after %d", ret, info.Retries)
+	}
+	mu.Lock()
+	if len(sizes) != 2 || sizes[0] != defaultMaxUDPSize || sizes[1] != 0 {
+		t.Errorf("Expected a capped UDP query, then a TCP one, got %v", sizes)
+	}
+	mu.Unlock()
+	if o := m.IsEdns0(); o.UDPSize() != 4096 {
+		t.Errorf("Expected the client's OPT record to be left alone, got %d", o.UDPSize())
+	}
+
+	// The client takes no more than the cap, it gets the truncated reply.
+	m.IsEdns0().SetUDPSize(1000)
+	if ret, _, err := f.connect(context.TODO(), p, state); err != nil || !ret.Truncated {
+		t.Errorf("Expected the truncated reply, got %v, %v", ret, err)
+	}
+}
+
+func TestForwardMismatchAll(t *testing.T) {
+	bad1 := newMismatchServer(t)
+	defer bad1.Close()
+	bad2 := newMismatchServer(t)
+	defer bad2.Close()
+
+	f := New()
+	f.SetProxy(NewProxy(bad1.Addr, transport.DNS))
+	f.SetProxy(NewProxy(bad2.Addr, transport.DNS))
+	defer f.OnShutdown()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+
+	if _, err := f.ServeDNS(context.TODO(), rec, m); err != nil {
+		t.Fatalf("Expected to receive reply, but got: %s", err)
+	}
+	if rec.Msg.Rcode != dns.RcodeFormatError {
+		t.Errorf("Expected rcode %d, got %d", dns.RcodeFormatError, rec.Msg.Rcode)
+	}
+}
+
+func TestForwardEarlyResponse(t *testing.T) {
+	fast := newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"))
+		w.WriteMsg(ret)
+	})
+	defer fast.Close()
+	slow := newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		time.Sleep(200 * time.Millisecond)
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.2"))
+		w.WriteMsg(ret)
+	})
+	defer slow.Close()
+
+	f := New()
+	f.early = true
+	f.SetProxy(NewProxy(fast.Addr, transport.DNS))
+	f.SetProxy(NewProxy(slow.Addr, transport.DNS))
+	defer f.OnShutdown()
+
+	before := testutil.ToFloat64(ConflictCount)
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := f.ServeDNS(context.TODO(), rec, m); err != nil {
+		t.Fatalf("Expected to receive reply, but got: %s", err)
+	}
+	if len(rec.Msg.Answer) != 1 {
+		t.Fatalf("Expected only the fast upstream's answer, got %d answers", len(rec.Msg.Answer))
+	}
+	if x := rec.Msg.Answer[0].(*dns.A).A.String(); x != "127.0.0.1" {
+		t.Errorf("Expected 127.0.0.1, got %s", x)
+	}
+
+	// The slow upstream's answer is still compared once it arrives.
+	for i := 0; i < 50; i++ {
+		if testutil.ToFloat64(ConflictCount) > before {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Errorf("Expected the late answer to be counted as a conflict")
+}
+
+func TestForwardEarlyNoReply(t *testing.T) {
+	fast := newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"))
+		w.WriteMsg(ret)
+	})
+	defer fast.Close()
+	slow := newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		time.Sleep(50 * time.Millisecond)
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.2"))
+		w.WriteMsg(ret)
+	})
+	defer slow.Close()
+
+	// The first response is no reply yet without a quorum, the early path waits for the others.
+	f := New()
+	f.early = true
+	f.quorum = 2
+	f.SetProxy(NewProxy(fast.Addr, transport.DNS))
+	f.SetProxy(NewProxy(slow.Addr, transport.DNS))
+	f.SetProxy(NewProxy(slow.Addr, transport.DNS))
+	defer f.OnShutdown()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := f.ServeDNS(context.TODO(), rec, m); err != nil {
+		t.Fatalf("Expected to receive reply, but got: %s", err)
+	}
+	if rec.Msg == nil || len(rec.Msg.Answer) != 1 {
+		t.Fatalf("Expected the quorum's answer, got %v", rec.Msg)
+	}
+	if x := rec.Msg.Answer[0].(*dns.A).A.String(); x != "127.0.0.2" {
+		t.Errorf("Expected 127.0.0.2, got %s", x)
+	}
+}
+
+func TestForwardPartialFanout(t *testing.T) {
+	ok := newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"))
+		w.WriteMsg(ret)
+	})
+	defer ok.Close()
+	broken := newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetRcode(r, dns.RcodeServerFailure)
+		w.WriteMsg(ret)
+	})
+	defer broken.Close()
+
+	f := New()
+	f.SetProxy(NewProxy(ok.Addr, transport.DNS))
+	f.SetProxy(NewProxy(broken.Addr, transport.DNS))
+	defer f.OnShutdown()
+
+	before, beforePartial := testutil.ToFloat64(FanoutCount.WithLabelValues("2", "1")), testutil.ToFloat64(PartialFanoutCount)
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := f.ServeDNS(context.TODO(), rec, m); err != nil {
+		t.Fatalf("Expected to receive reply, but got: %s", err)
+	}
+	if len(rec.Msg.Answer) != 1 {
+		t.Errorf("Expected the answer of the upstream that answered, got %d answers", len(rec.Msg.Answer))
+	}
+	if x := testutil.ToFloat64(FanoutCount.WithLabelValues("2", "1")) - before; x != 1 {
+		t.Errorf("Expected 1 query with 1 of 2 upstreams answering, got %v", x)
+	}
+	if x := testutil.ToFloat64(PartialFanoutCount) - beforePartial; x != 1 {
+		t.Errorf("Expected 1 partial fan-out, got %v", x)
+	}
+}
+
+func TestForwardBudget(t *testing.T) {
+	s := newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		time.Sleep(500 * time.Millisecond)
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	f := New()
+	p := NewProxy(s.Addr, transport.DNS)
+	f.SetProxy(p)
+	defer f.OnShutdown()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	start := time.Now()
+	ctx := WithBudget(context.TODO(), 100*time.Millisecond)
+	if _, err := f.ServeDNS(ctx, dnstest.NewRecorder(&test.ResponseWriter{}), m); err == nil {
+		t.Fatalf("Expected no reply within the budget")
+	}
+	if d := time.Since(start); d > 300*time.Millisecond {
+		t.Errorf("Expected to give up after the budget of 100ms, took %s", d)
+	}
+	if fails := atomic.LoadUint32(&p.fails); fails != 0 {
+		t.Errorf("Expected a spent budget not to count as a failure, got %d fails", fails)
+	}
+}
+
+func TestForwardMaxRetries(t *testing.T) {
+	tests := []struct {
+		maxfails         uint32
+		maxRetries       int
+		expectedAttempts int
+	}{
+		{2, 1, 2},
+		{0, 0, 1}, // max_fails 0 must still send the query
+		{0, 3, 4},
+		{5, 3, 4},
+	}
+	for i, tc := range tests {
+		attempts := 0
+		p := NewProxy("fake", transport.DNS)
+		p.SetTransport(&fakeTransport{exchange: func(m *dns.Msg, proto string) (*dns.Msg, error) {
+			attempts++
+			return nil, ErrTimeout
+		}})
+		// Don't let the health check interfere with the count.
+		p.health = nil
+
+		f := New()
+		f.maxfails = tc.maxfails
+		f.maxRetries = tc.maxRetries
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", dns.TypeA)
+		state := request.Request{W: &test.ResponseWriter{}, Req: m}
+
+		f.forward(context.TODO(), state, []*Proxy{p}, 0)
+		if attempts != tc.expectedAttempts {
+			t.Errorf("Test %d: expected %d attempts, got %d", i, tc.expectedAttempts, attempts)
+		}
+	}
+}
+
+func TestForwardFanoutMax(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		asked []string
+	)
+	f := New()
+	f.p = &sequential{}
+	f.fanoutMax = 2
+	for _, addr := range []string{"a", "b", "c", "d"} {
+		addr := addr
+		p := NewProxy(addr, transport.DNS)
+		p.SetTransport(&fakeTransport{exchange: func(m *dns.Msg, proto string) (*dns.Msg, error) {
+			mu.Lock()
+			asked = append(asked, addr)
+			mu.Unlock()
+			ret := new(dns.Msg)
+			ret.SetReply(m)
+			ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"))
+			return ret, nil
+		}})
+		f.SetProxy(p)
+	}
+	defer f.OnShutdown()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := f.ServeDNS(context.TODO(), rec, m); err != nil {
+		t.Fatalf("Expected to receive reply, but got: %s", err)
+	}
+	sort.Strings(asked)
+	if len(asked) != 2 || asked[0] != "a" || asked[1] != "b" {
+		t.Errorf("Expected only the first 2 upstreams to be asked, got %v", asked)
+	}
+}
+
+func TestForwardLeastBad(t *testing.T) {
+	var asked []string
+	newFake := func(addr string, fails uint32) *Proxy {
+		p := NewProxy(addr, transport.DNS)
+		p.SetTransport(&fakeTransport{exchange: func(m *dns.Msg, proto string) (*dns.Msg, error) {
+			asked = append(asked, addr)
+			ret := new(dns.Msg)
+			ret.SetReply(m)
+			return ret, nil
+		}})
+		p.health = nil
+		p.fails = fails
+		return p
+	}
+
+	f := New()
+	f.p = &sequential{}
+	f.proxies = []*Proxy{newFake("a", 5), newFake("b", 3), newFake("c", 4)}
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := f.ServeDNS(context.TODO(), rec, m); err != ErrNoHealthy {
+		t.Errorf("Expected %s, got %v", ErrNoHealthy, err)
+	}
+	if len(asked) != 0 {
+		t.Errorf("Expected no upstream to be asked, got %v", asked)
+	}
+
+	f.leastBad = true
+	if _, err := f.ServeDNS(context.TODO(), rec, m); err != nil {
+		t.Fatalf("Expected to receive reply, but got: %s", err)
+	}
+	if len(asked) != 1 || asked[0] != "b" {
+		t.Errorf("Expected only the upstream with the fewest fails to be asked, got %v", asked)
+	}
+}
+
+func TestForwardRetryNext(t *testing.T) {
+	var asked []string
+	newFake := func(addr string, fail bool) *Proxy {
+		p := NewProxy(addr, transport.DNS)
+		p.SetTransport(&fakeTransport{exchange: func(m *dns.Msg, proto string) (*dns.Msg, error) {
+			asked = append(asked, addr)
+			if fail {
+				return nil, ErrTimeout
+			}
+			ret := new(dns.Msg)
+			ret.SetReply(m)
+			return ret, nil
+		}})
+		p.health = nil
+		return p
+	}
+	live := []*Proxy{newFake("bad", true), newFake("good", false)}
+
+	f := New()
+	f.retryNext = true
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	state := request.Request{W: &test.ResponseWriter{}, Req: m}
+
+	resp := f.forward(context.TODO(), state, live, 0)
+	if resp.ret == nil {
+		t.Fatalf("Expected a reply, got %v", resp.upstreamErr)
+	}
+	if resp.proxy.addr != "good" {
+		t.Errorf("Expected the reply to come from good, got %s", resp.proxy.addr)
+	}
+	if len(asked) != 2 || asked[0] != "bad" || asked[1] != "good" {
+		t.Errorf("Expected bad to be retried on good, asked %v", asked)
+	}
+}
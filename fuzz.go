@@ -1,3 +1,4 @@
+//go:build gofuzz
 // +build gofuzz
 
 package forward
@@ -5,6 +6,8 @@ package forward
 import (
 	"github.com/coredns/coredns/plugin/pkg/dnstest"
 	"github.com/coredns/coredns/plugin/pkg/fuzz"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
 
 	"github.com/miekg/dns"
 )
@@ -32,3 +35,58 @@ func (r r) reflectHandler(w dns.ResponseWriter, req *dns.Msg) {
 	m.SetReply(req)
 	w.WriteMsg(m)
 }
+
+var fuzzProxies = []*Proxy{NewProxy("fuzz0", "udp"), NewProxy("fuzz1", "udp"), NewProxy("fuzz2", "udp"), NewProxy("fuzz3", "udp")}
+
+// FuzzReply fuzzes the reply matching and merging of upstream responses. The first byte picks the conflict
+// policy and quorum, the rest holds up to 4 upstream responses in TCP framing: a 2 byte length followed by
+// the message. Responses that don't match the question are handled like forward does, as a mismatch.
+func FuzzReply(data []byte) int {
+	if len(data) < 1 {
+		return 0
+	}
+	fw := New()
+	fw.conflict = conflictPolicy(data[0] & 0x3)
+	fw.quorum = int(data[0]>>2) & 0x3
+	data = data[1:]
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	req.SetEdns0(4096, true)
+	state := request.Request{W: &test.ResponseWriter{}, Req: req}
+
+	var resps []fwdResp
+	for len(data) >= 2 && len(resps) < len(fuzzProxies) {
+		l := int(data[0])<<8 | int(data[1])
+		data = data[2:]
+		if l > len(data) {
+			return 0
+		}
+		ret := new(dns.Msg)
+		if err := ret.Unpack(data[:l]); err != nil {
+			return 0
+		}
+		data = data[l:]
+
+		resp := fwdResp{proxy: fuzzProxies[len(resps)], ret: ret}
+		if !state.Match(ret) {
+			resp = fwdResp{proxy: resp.proxy, mismatch: true}
+		}
+		resps = append(resps, resp)
+	}
+	if len(resps) == 0 {
+		return 0
+	}
+
+	ret, err := fw.reply(state, resps)
+	if err != nil {
+		return 0
+	}
+	if ret.Len() > dns.MaxMsgSize {
+		return 0 // merging can legitimately grow past what fits in a message
+	}
+	if _, err := ret.Pack(); err != nil {
+		panic(err)
+	}
+	return 1
+}
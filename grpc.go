@@ -0,0 +1,105 @@
+package forward
+
+import (
+	"context"
+	"crypto/tls"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/pb"
+
+	"github.com/miekg/dns"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+// grpcTransport is a Transport to an upstream speaking the CoreDNS gRPC protocol (pb.DnsService). A single
+// client connection is kept, gRPC multiplexes all exchanges over it.
+type grpcTransport struct {
+	addr      string
+	tlsConfig *tls.Config
+
+	mu     sync.Mutex
+	conn   *grpc.ClientConn
+	client pb.DnsServiceClient
+}
+
+func newGRPCTransport(addr string) *grpcTransport { return &grpcTransport{addr: addr} }
+
+// Exchange implements Transport. Proto and udpSize don't apply to gRPC and are ignored.
+func (t *grpcTransport) Exchange(ctx context.Context, m *dns.Msg, proto string, udpSize uint16) (*dns.Msg, ExchangeInfo, error) {
+	info := ExchangeInfo{Proto: "grpc"}
+	client, err := t.dial()
+	if err != nil {
+		return nil, info, err
+	}
+
+	msg, err := m.Pack()
+	if err != nil {
+		return nil, info, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, readTimeout)
+	defer cancel()
+	reply, err := client.Query(ctx, &pb.DnsPacket{Msg: msg})
+	if err != nil {
+		// if not found message, return empty message with NXDomain code
+		if status.Code(err) == codes.NotFound {
+			ret := new(dns.Msg).SetRcode(m, dns.RcodeNameError)
+			info.Size = ret.Len()
+			return ret, info, nil
+		}
+		return nil, info, err
+	}
+
+	ret := new(dns.Msg)
+	if err := ret.Unpack(reply.Msg); err != nil {
+		return nil, info, err
+	}
+	info.Size = len(reply.Msg)
+	return ret, info, nil
+}
+
+// dial returns the client, setting up the connection on first use.
+func (t *grpcTransport) dial() (pb.DnsServiceClient, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.client != nil {
+		return t.client, nil
+	}
+
+	opt := grpc.WithInsecure()
+	if t.tlsConfig != nil {
+		opt = grpc.WithTransportCredentials(credentials.NewTLS(t.tlsConfig))
+	}
+	conn, err := grpc.Dial(t.addr, opt)
+	if err != nil {
+		return nil, err
+	}
+	t.conn = conn
+	t.client = pb.NewDnsServiceClient(conn)
+	return t.client, nil
+}
+
+// Start implements Transport.
+func (t *grpcTransport) Start() { t.dial() }
+
+// Close implements Transport.
+func (t *grpcTransport) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conn != nil {
+		t.conn.Close()
+	}
+	t.conn, t.client = nil, nil
+}
+
+// SetTLSConfig implements Transport, it must be called before the first exchange.
+func (t *grpcTransport) SetTLSConfig(cfg *tls.Config) { t.tlsConfig = cfg }
+
+// SetExpire implements Transport, gRPC keeps its connection open so this is a noop.
+func (t *grpcTransport) SetExpire(expire time.Duration) {}
@@ -0,0 +1,68 @@
+package forward
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/coredns/coredns/pb"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/caddyserver/caddy"
+	"github.com/miekg/dns"
+	"google.golang.org/grpc"
+)
+
+type grpcServer struct{}
+
+func (s grpcServer) Query(ctx context.Context, in *pb.DnsPacket) (*pb.DnsPacket, error) {
+	r := new(dns.Msg)
+	if err := r.Unpack(in.Msg); err != nil {
+		return nil, err
+	}
+	ret := new(dns.Msg)
+	ret.SetReply(r)
+	ret.Answer = append(ret.Answer, test.A(r.Question[0].Name+" IN A 127.0.0.1"))
+	msg, err := ret.Pack()
+	if err != nil {
+		return nil, err
+	}
+	return &pb.DnsPacket{Msg: msg}, nil
+}
+
+func TestGRPC(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	s := grpc.NewServer()
+	pb.RegisterDnsServiceServer(s, grpcServer{})
+	go s.Serve(l)
+	defer s.Stop()
+
+	c := caddy.NewTestController("dns", "forward . grpc://"+l.Addr().String())
+	f, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	f.OnStartup()
+	defer f.OnShutdown()
+
+	if _, ok := f.proxies[0].transport.(*grpcTransport); !ok {
+		t.Fatalf("Expected a gRPC transport, got %T", f.proxies[0].transport)
+	}
+	if err := f.proxies[0].health.Check(f.proxies[0]); err != nil {
+		t.Errorf("Expected health check to pass, got: %s", err)
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := f.ServeDNS(context.TODO(), rec, m); err != nil {
+		t.Fatalf("Expected to receive reply, but got: %s", err)
+	}
+	if len(rec.Msg.Answer) != 1 {
+		t.Errorf("Expected 1 answer, got %d", len(rec.Msg.Answer))
+	}
+}
@@ -1,7 +1,10 @@
 package forward
 
 import (
+	"context"
 	"crypto/tls"
+	"net"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -14,10 +17,32 @@ import (
 type HealthChecker interface {
 	Check(*Proxy) error
 	SetTLSConfig(*tls.Config)
+	SetProbe(HealthProbe)
 }
 
+// HealthProbe describes the query a HealthChecker sends to an upstream.
+type HealthProbe struct {
+	Domain           string // Name to query, "." by default.
+	Minimize         bool   // Walk Domain label by label with NS queries, RFC 7816 style.
+	RecursionDesired bool
+	DNSSECOK         bool
+	CheckingDisabled bool
+}
+
+// defaultProbe is the probe used when nothing is configured: . IN NS with RD set.
+var defaultProbe = HealthProbe{Domain: ".", RecursionDesired: true}
+
 // dnsHc is a health checker for a DNS endpoint (DNS, and DoT).
-type dnsHc struct{ c *dns.Client }
+type dnsHc struct {
+	c      *dns.Client
+	probe  HealthProbe
+	source net.IP // if set, the source address of the checks
+	mark   uint32 // if set, the firewall mark of their sockets
+	dscp   uint8  // if set, the DSCP of their packets
+}
+
+// hcDialTimeout is the dial timeout of health checks from a source address, dns.Client's default.
+const hcDialTimeout = 2 * time.Second
 
 // NewHealthChecker returns a new HealthChecker based on transport.
 func NewHealthChecker(trans string) HealthChecker {
@@ -28,7 +53,9 @@ func NewHealthChecker(trans string) HealthChecker {
 		c.ReadTimeout = 1 * time.Second
 		c.WriteTimeout = 1 * time.Second
 
-		return &dnsHc{c: c}
+		return &dnsHc{c: c, probe: defaultProbe}
+	case transport.GRPC, transportUnix, transportUnixgram:
+		return &transportHc{probe: defaultProbe}
 	}
 
 	log.Warningf("No healthchecker for transport %q", trans)
@@ -38,36 +65,121 @@ func NewHealthChecker(trans string) HealthChecker {
 func (h *dnsHc) SetTLSConfig(cfg *tls.Config) {
 	h.c.Net = "tcp-tls"
 	h.c.TLSConfig = cfg
+	h.setDialer()
+}
+
+// setDialer makes the client of h dial from h.source and with h.mark and h.dscp, if set.
+func (h *dnsHc) setDialer() {
+	if h.source == nil && h.mark == 0 && h.dscp == 0 {
+		return
+	}
+	d := &net.Dialer{Timeout: hcDialTimeout, Control: streamControl(h.mark, h.dscp)}
+	if h.c.Net == "udp" {
+		d.Control = udpControl(false, h.mark, h.dscp)
+	}
+	if h.source != nil {
+		d.LocalAddr = &net.UDPAddr{IP: h.source}
+		if h.c.Net != "udp" {
+			d.LocalAddr = &net.TCPAddr{IP: h.source}
+		}
+	}
+	h.c.Dialer = d
 }
 
-// For HC we send to . IN NS +norec message to the upstream. Dial timeouts and empty
-// replies are considered fails, basically anything else constitutes a healthy upstream.
+// SetProbe sets the query sent on each health check.
+func (h *dnsHc) SetProbe(probe HealthProbe) { h.probe = probe }
+
+// For HC we send to . IN NS message to the upstream, or whatever probe is configured. Dial timeouts
+// and empty replies are considered fails, basically anything else constitutes a healthy upstream.
 
 // Check is used as the up.Func in the up.Probe.
 func (h *dnsHc) Check(p *Proxy) error {
 	err := h.send(p.addr)
 	if err != nil {
 		HealthcheckFailureCount.WithLabelValues(p.addr).Add(1)
-		atomic.AddUint32(&p.fails, 1)
+		p.fail()
+		p.stateChanged()
 		return err
 	}
 
 	atomic.StoreUint32(&p.fails, 0)
+	atomic.StoreUint32(&p.healthy, 1)
+	p.stateChanged()
+	return nil
+}
+
+// transportHc is a health checker that sends its probe through the proxy's own Transport, for upstreams
+// that don't speak plain DNS.
+type transportHc struct{ probe HealthProbe }
+
+// SetTLSConfig is a noop, the transport holds the TLS configuration.
+func (h *transportHc) SetTLSConfig(cfg *tls.Config) {}
+
+// SetProbe sets the query sent on each health check.
+func (h *transportHc) SetProbe(probe HealthProbe) { h.probe = probe }
+
+// Check is used as the up.Func in the up.Probe.
+func (h *transportHc) Check(p *Proxy) error {
+	for _, ping := range h.probe.msgs() {
+		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		_, _, err := p.transport.Exchange(ctx, ping, "tcp", dns.MinMsgSize)
+		cancel()
+		if err != nil {
+			HealthcheckFailureCount.WithLabelValues(p.addr).Add(1)
+			p.fail()
+			p.stateChanged()
+			return err
+		}
+	}
+
+	atomic.StoreUint32(&p.fails, 0)
+	atomic.StoreUint32(&p.healthy, 1)
+	p.stateChanged()
 	return nil
 }
 
 func (h *dnsHc) send(addr string) error {
-	ping := new(dns.Msg)
-	ping.SetQuestion(".", dns.TypeNS)
-
-	m, _, err := h.c.Exchange(ping, addr)
-	// If we got a header, we're alright, basically only care about I/O errors 'n stuff.
-	if err != nil && m != nil {
-		// Silly check, something sane came back.
-		if m.Response || m.Opcode == dns.OpcodeQuery {
-			err = nil
+	for _, ping := range h.probe.msgs() {
+		m, _, err := h.c.Exchange(ping, addr)
+		// If we got a header, we're alright, basically only care about I/O errors 'n stuff.
+		if err != nil && m != nil {
+			// Silly check, something sane came back.
+			if m.Response || m.Opcode == dns.OpcodeQuery {
+				err = nil
+			}
+		}
+		if err != nil {
+			return err
 		}
 	}
 
-	return err
+	return nil
+}
+
+// msgs returns the messages to send for a single check. Without minimization this is a single
+// Domain IN NS query. With minimization we send an NS query for every ancestor of Domain, starting
+// at the top, so no upstream sees more of the name than it needs to.
+func (p HealthProbe) msgs() []*dns.Msg {
+	domain := dns.Fqdn(p.Domain)
+	names := []string{domain}
+	if p.Minimize && domain != "." {
+		labels := dns.SplitDomainName(domain)
+		names = names[:0]
+		for i := len(labels) - 1; i >= 0; i-- {
+			names = append(names, dns.Fqdn(strings.Join(labels[i:], ".")))
+		}
+	}
+
+	msgs := make([]*dns.Msg, len(names))
+	for i, name := range names {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeNS)
+		m.RecursionDesired = p.RecursionDesired
+		m.CheckingDisabled = p.CheckingDisabled
+		if p.DNSSECOK {
+			m.SetEdns0(4096, true)
+		}
+		msgs[i] = m
+	}
+	return msgs
 }
@@ -2,6 +2,7 @@ package forward
 
 import (
 	"context"
+	"net"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -182,3 +183,60 @@ func TestHealthNoMaxFails(t *testing.T) {
 		t.Errorf("Expected number of health checks to be %d, got %d", expected, i1)
 	}
 }
+
+func TestHealthProbeMinimize(t *testing.T) {
+	probe := HealthProbe{Domain: "www.example.org.", Minimize: true, DNSSECOK: true}
+	msgs := probe.msgs()
+
+	expected := []string{"org.", "example.org.", "www.example.org."}
+	if len(msgs) != len(expected) {
+		t.Fatalf("Expected %d probe messages, got %d", len(expected), len(msgs))
+	}
+	for i, m := range msgs {
+		if m.Question[0].Name != expected[i] {
+			t.Errorf("Expected probe %d to be for %q, got %q", i, expected[i], m.Question[0].Name)
+		}
+		if m.RecursionDesired {
+			t.Errorf("Expected probe %d to have RD unset", i)
+		}
+		if o := m.IsEdns0(); o == nil || !o.Do() {
+			t.Errorf("Expected probe %d to have DO set", i)
+		}
+	}
+
+	if msgs := defaultProbe.msgs(); len(msgs) != 1 || msgs[0].Question[0].Name != "." || !msgs[0].RecursionDesired {
+		t.Errorf("Expected default probe to be a single . IN NS with RD set, got %v", msgs)
+	}
+}
+
+func TestHealthCheckSource(t *testing.T) {
+	from := make(chan string, 1)
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		if r.Question[0].Name == "." {
+			host, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+			select {
+			case from <- host:
+			default:
+			}
+		}
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	p := NewProxy(s.Addr, transport.DNS)
+	if err := p.SetHealthCheckSource(net.ParseIP("127.0.0.2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.health.Check(p); err != nil {
+		t.Fatalf("Expected the health check to pass, got %s", err)
+	}
+	if host := <-from; host != "127.0.0.2" {
+		t.Errorf("Expected the health check from 127.0.0.2, got %s", host)
+	}
+
+	if err := NewProxy("/run/dns.sock", transportUnix).SetHealthCheckSource(net.ParseIP("127.0.0.2")); err == nil {
+		t.Errorf("Expected an error for a unix socket upstream")
+	}
+}
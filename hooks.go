@@ -0,0 +1,43 @@
+package forward
+
+import "sync/atomic"
+
+// OnUpstreamStateChange registers fn to be called whenever an upstream goes down, i.e. failed more than
+// max_fails health checks, or comes back up. Fn is called from the health checking goroutine, or from a
+// query when fail_decay brings an upstream back up, so it should not block: a slow fn slows queries too.
+func (f *Forward) OnUpstreamStateChange(fn func(addr string, up bool)) {
+	f.hooksMu.Lock()
+	f.hooks = append(f.hooks, fn)
+	f.hooksMu.Unlock()
+
+	if g := f.current(); g != f {
+		g.hooksMu.Lock()
+		g.hooks = append(g.hooks, fn)
+		g.hooksMu.Unlock()
+	}
+}
+
+// checkState calls the hooks if p's state changed since the last call.
+func (f *Forward) checkState(p *Proxy) {
+	if up, changed := p.stateChange(f.maxfails); changed {
+		f.callHooks(p.addr, up)
+	}
+}
+
+// stateChange returns if p is up, and if that changed since the last call.
+func (p *Proxy) stateChange(maxfails uint32) (up, changed bool) {
+	var down uint32
+	if p.Down(maxfails) {
+		down = 1
+	}
+	return down == 0, atomic.CompareAndSwapUint32(&p.down, 1-down, down)
+}
+
+func (f *Forward) callHooks(addr string, up bool) {
+	f.hooksMu.Lock()
+	hooks := f.hooks
+	f.hooksMu.Unlock()
+	for _, fn := range hooks {
+		fn(addr, up)
+	}
+}
@@ -0,0 +1,48 @@
+package forward
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/transport"
+
+	"github.com/miekg/dns"
+)
+
+func TestOnUpstreamStateChange(t *testing.T) {
+	var broken int32 = 1
+	s := newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		if atomic.LoadInt32(&broken) == 1 {
+			return
+		}
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	f := New()
+	f.maxfails = 1
+	p := NewProxy(s.Addr, transport.DNS)
+	f.SetProxy(p)
+	defer f.OnShutdown()
+
+	var changes []bool
+	f.OnUpstreamStateChange(func(addr string, up bool) {
+		if addr != s.Addr {
+			t.Errorf("Expected %s, got %s", s.Addr, addr)
+		}
+		changes = append(changes, up)
+	})
+
+	p.health.Check(p) // 1 fail, still up
+	p.health.Check(p) // 2 fails, down
+	p.health.Check(p) // still down
+	atomic.StoreInt32(&broken, 0)
+	p.health.Check(p) // up again
+	p.health.Check(p)
+
+	if len(changes) != 2 || changes[0] || !changes[1] {
+		t.Errorf("Expected to see down and then up, got %v", changes)
+	}
+}
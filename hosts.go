@@ -0,0 +1,190 @@
+package forward
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultHostsReload = 5 * time.Second
+	hostsTTL           = 3600
+)
+
+// hosts are the overrides of the hosts property: names from a file in hosts syntax, answered locally
+// before the fan-out, so they resolve even if every upstream is down. The file is read again when it
+// changed, checked every reload.
+type hosts struct {
+	path   string
+	reload time.Duration
+
+	mu    sync.RWMutex
+	names map[string][]net.IP // A and AAAA, by lower case FQDN
+	addrs map[string][]string // PTR, by reverse name
+	mtime time.Time
+	size  int64
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+// newHosts returns the overrides in the file path, which must be readable.
+func newHosts(path string, reload time.Duration) (*hosts, error) {
+	h := &hosts{path: path, reload: reload}
+	if err := h.read(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// read (re)reads the file of h.
+func (h *hosts) read() error {
+	file, err := os.Open(h.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	names, addrs := parseHosts(file)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.names, h.addrs = names, addrs
+	h.mtime, h.size = fi.ModTime(), fi.Size()
+	return nil
+}
+
+// parseHosts parses hosts file syntax: an address followed by its names on each line, # starts a comment.
+// Lines that don't parse are skipped, like the resolver of the C library does.
+func parseHosts(r io.Reader) (map[string][]net.IP, map[string][]string) {
+	names := map[string][]net.IP{}
+	addrs := map[string][]string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		addr := fields[0]
+		if i := strings.IndexByte(addr, '%'); i >= 0 {
+			addr = addr[:i] // zone of a link-local address
+		}
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			continue
+		}
+		rev, _ := dns.ReverseAddr(ip.String())
+		for _, name := range fields[1:] {
+			if _, ok := dns.IsDomainName(name); !ok {
+				continue
+			}
+			name = strings.ToLower(dns.Fqdn(name))
+			names[name] = append(names[name], ip)
+			addrs[rev] = append(addrs[rev], name)
+		}
+	}
+	return names, addrs
+}
+
+// answer returns the reply to state from h, or nil if h doesn't have the name. A name in h gets a reply for
+// A and AAAA, empty if it has no address of that family, and an address in h one for PTR; other queries
+// are forwarded.
+func (h *hosts) answer(state request.Request) *dns.Msg {
+	name := strings.ToLower(state.Name())
+	hdr := dns.RR_Header{Name: state.QName(), Rrtype: state.QType(), Class: dns.ClassINET, Ttl: hostsTTL}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	var answer []dns.RR
+	switch state.QType() {
+	case dns.TypeA, dns.TypeAAAA:
+		ips, ok := h.names[name]
+		if !ok {
+			return nil
+		}
+		for _, ip := range ips {
+			if ip4 := ip.To4(); ip4 != nil && state.QType() == dns.TypeA {
+				answer = append(answer, &dns.A{Hdr: hdr, A: ip4})
+			} else if ip4 == nil && state.QType() == dns.TypeAAAA {
+				answer = append(answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+			}
+		}
+	case dns.TypePTR:
+		names, ok := h.addrs[name]
+		if !ok {
+			return nil
+		}
+		for _, n := range names {
+			answer = append(answer, &dns.PTR{Hdr: hdr, Ptr: n})
+		}
+	default:
+		return nil
+	}
+	m := new(dns.Msg)
+	m.SetReply(state.Req)
+	m.Authoritative = true
+	m.Answer = answer
+	setEdns0(state, m)
+	return m
+}
+
+// changed returns true if the file of h isn't the one last read.
+func (h *hosts) changed() bool {
+	fi, err := os.Stat(h.path)
+	if err != nil {
+		return false
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return !fi.ModTime().Equal(h.mtime) || fi.Size() != h.size
+}
+
+// start watches the file of h for changes.
+func (h *hosts) start() {
+	if h.reload == 0 {
+		return
+	}
+	h.quit, h.done = make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(h.done)
+		ticker := time.NewTicker(h.reload)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if !h.changed() {
+					continue
+				}
+				if err := h.read(); err != nil {
+					log.Errorf("Failed to read hosts overrides, keeping the old ones: %s", err)
+				}
+			case <-h.quit:
+				return
+			}
+		}
+	}()
+}
+
+func (h *hosts) stop() {
+	if h.quit == nil {
+		return
+	}
+	close(h.quit)
+	<-h.done
+	h.quit = nil
+}
@@ -0,0 +1,90 @@
+package forward
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+func TestHosts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pforward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "hosts")
+	if err := ioutil.WriteFile(file, []byte("# overrides\n10.0.0.1 DB.example.org db\nnot-an-ip x.example.org\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The upstream is down, the overrides still answer.
+	f, err := FromConfig(Config{From: ".", To: []string{"127.0.0.1:1"}, Hosts: &HostsConfig{File: file, Reload: Duration(10 * time.Millisecond)}})
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	f.OnStartup()
+	defer f.OnShutdown()
+
+	tests := []struct {
+		name    string
+		qtype   uint16
+		rcode   int
+		answers int
+	}{
+		{"db.example.org.", dns.TypeA, dns.RcodeSuccess, 1},
+		{"Db.Example.Org.", dns.TypeA, dns.RcodeSuccess, 1},
+		{"db.", dns.TypeA, dns.RcodeSuccess, 1},
+		{"db.example.org.", dns.TypeAAAA, dns.RcodeSuccess, 0},
+		{"1.0.0.10.in-addr.arpa.", dns.TypePTR, dns.RcodeSuccess, 2},
+		// forwarded, and failed
+		{"db.example.org.", dns.TypeMX, dns.RcodeServerFailure, 0},
+		{"x.example.org.", dns.TypeA, dns.RcodeServerFailure, 0},
+	}
+	for _, tc := range tests {
+		m := new(dns.Msg)
+		m.SetQuestion(tc.name, tc.qtype)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		rcode, _ := f.ServeDNS(context.TODO(), rec, m)
+		if rec.Msg != nil {
+			rcode = rec.Msg.Rcode
+		}
+		if rcode != tc.rcode || (rec.Msg != nil && len(rec.Msg.Answer) != tc.answers) {
+			t.Errorf("%s %s: expected rcode %d with %d answers, got %d: %v", tc.name, dns.TypeToString[tc.qtype], tc.rcode, tc.answers, rcode, rec.Msg)
+		}
+	}
+
+	// EDNS clients get an OPT record back.
+	m := new(dns.Msg)
+	m.SetQuestion("db.example.org.", dns.TypeA)
+	m.SetEdns0(4096, true)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	f.ServeDNS(context.TODO(), rec, m)
+	if opt := rec.Msg.IsEdns0(); opt == nil || !opt.Do() || opt.UDPSize() != 4096 {
+		t.Errorf("Expected an OPT record with DO and a payload of 4096, got %v", opt)
+	}
+
+	if err := ioutil.WriteFile(file, []byte("10.0.0.2 db.example.org\n2001:db8::1 db.example.org\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m = new(dns.Msg)
+	m.SetQuestion("db.example.org.", dns.TypeAAAA)
+	for i := 0; ; i++ {
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		f.ServeDNS(context.TODO(), rec, m)
+		if len(rec.Msg.Answer) == 1 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("Expected the changed file to be read again")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
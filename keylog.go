@@ -0,0 +1,52 @@
+package forward
+
+import (
+	"os"
+	"sync"
+)
+
+// keyLog is the KeyLogWriter of the TLS configs of tls_keylog. It appends the TLS secrets of the upstream
+// connections, in the NSS key log format that Wireshark reads, to a file that's open between start and stop.
+type keyLog struct {
+	path string
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+func newKeyLog(path string) *keyLog { return &keyLog{path: path} }
+
+// start opens the file of k, creating it readable only by us.
+func (k *keyLog) start() error {
+	f, err := os.OpenFile(k.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	log.Warningf("TLS secrets of upstream connections are written to %s, anyone who can read it can decrypt them", k.path)
+	k.mu.Lock()
+	k.f = f
+	k.mu.Unlock()
+	return nil
+}
+
+// stop closes the file of k, later secrets are dropped.
+func (k *keyLog) stop() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.f == nil {
+		return nil
+	}
+	err := k.f.Close()
+	k.f = nil
+	return err
+}
+
+// Write implements io.Writer. crypto/tls writes each line with a single call.
+func (k *keyLog) Write(b []byte) (int, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.f == nil {
+		return len(b), nil
+	}
+	return k.f.Write(b)
+}
@@ -0,0 +1,81 @@
+package forward
+
+import (
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy"
+)
+
+func TestKeyLog(t *testing.T) {
+	var accepted int32
+	l := newTLSListener(t, &accepted)
+	defer l.Close()
+
+	path := filepath.Join(t.TempDir(), "keys")
+	k := newKeyLog(path)
+	if err := k.start(); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := newTransport(l.Addr().String())
+	tr.SetTLSConfig(&tls.Config{InsecureSkipVerify: true, KeyLogWriter: k})
+	tr.Start()
+	defer tr.Close()
+
+	pc, err := tr.dialConn("tcp-tls", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc.c.Close()
+	if err := k.stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("Expected the key log to be readable only by the owner, got %s", fi.Mode())
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "CLIENT_TRAFFIC_SECRET_0 ") {
+		t.Errorf("Expected TLS 1.3 secrets in the key log, got %q", b)
+	}
+
+	// Secrets after stop are dropped.
+	if n, err := k.Write([]byte("x\n")); n != 2 || err != nil {
+		t.Errorf("Expected a write after stop to be dropped, got %d, %v", n, err)
+	}
+}
+
+func TestKeyLogStartup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	c := caddy.NewTestController("dns", "forward . tls://127.0.0.1 {\ntls_keylog "+path+"\n}\n")
+	f, err := parseForward(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Prewarming dials as soon as the transport is started, the key log must be open by then.
+	open := false
+	f.proxies[0].SetTransport(&fakeTransport{start: func() {
+		f.keyLog.mu.Lock()
+		open = f.keyLog.f != nil
+		f.keyLog.mu.Unlock()
+	}})
+	if err := f.OnStartup(); err != nil {
+		t.Fatal(err)
+	}
+	f.OnShutdown()
+	if !open {
+		t.Errorf("Expected the key log to be open before the upstreams are started")
+	}
+}
@@ -0,0 +1,184 @@
+package forward
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// labelSelector prefixes a label in the TO of options that are set per upstream: label:KEY=VALUE selects the
+// upstreams with that label.
+const labelSelector = "label:"
+
+// label is one KEY=VALUE label of an upstream.
+type label struct {
+	key, value string
+}
+
+func (l label) String() string { return l.key + "=" + l.value }
+
+// parseLabel parses KEY=VALUE, ok is false if s isn't a label.
+func parseLabel(s string) (l label, ok bool) {
+	i := strings.IndexByte(s, '=')
+	if i < 1 {
+		return label{}, false
+	}
+	return label{s[:i], s[i+1:]}, true
+}
+
+// parseLabels parses the arguments of label: one or more KEY=VALUE labels and the upstreams they're for.
+func (f *Forward) parseLabels(args []string) error {
+	var labels []label
+	for len(args) > 0 {
+		l, ok := parseLabel(args[0])
+		if !ok {
+			break
+		}
+		labels, args = append(labels, l), args[1:]
+	}
+	if len(labels) == 0 {
+		return fmt.Errorf("label needs at least one KEY=VALUE")
+	}
+	proxies, err := f.matchProxies(args)
+	if err != nil {
+		return err
+	}
+	for _, p := range proxies {
+		for _, l := range labels {
+			p.SetLabel(l.key, l.value)
+		}
+	}
+	return nil
+}
+
+// withLabel returns the proxies of f that have the label of sel, label:KEY=VALUE.
+func (f *Forward) withLabel(sel string) ([]*Proxy, error) {
+	l, ok := parseLabel(strings.TrimPrefix(sel, labelSelector))
+	if !ok {
+		return nil, fmt.Errorf("not a label: %s", sel)
+	}
+	var proxies []*Proxy
+	for _, p := range f.proxies {
+		if p.HasLabel(l.key, l.value) {
+			proxies = append(proxies, p)
+		}
+	}
+	if len(proxies) == 0 {
+		return nil, fmt.Errorf("no upstream has label %s", l)
+	}
+	return proxies, nil
+}
+
+// SetLabel sets label key of p to value. Labels are set while configuring, before p is started.
+func (p *Proxy) SetLabel(key, value string) {
+	if p.labels == nil {
+		p.labels = map[string]string{}
+	}
+	p.labels[key] = value
+}
+
+// Labels returns the labels of p, which must not be modified.
+func (p *Proxy) Labels() map[string]string { return p.labels }
+
+// HasLabel returns true if p has label key set to value.
+func (p *Proxy) HasLabel(key, value string) bool {
+	v, ok := p.labels[key]
+	return ok && v == value
+}
+
+// describe returns the address of p, followed by its labels if it has any, for logs.
+func (p *Proxy) describe() string {
+	if len(p.labels) == 0 {
+		return p.addr
+	}
+	return p.addr + " (" + p.labelString() + ")"
+}
+
+// labelString returns the labels of p as sorted KEY=VALUE pairs, separated by commas.
+func (p *Proxy) labelString() string {
+	labels := make([]string, 0, len(p.labels))
+	for k, v := range p.labels {
+		labels = append(labels, k+"="+v)
+	}
+	sort.Strings(labels)
+	return strings.Join(labels, ",")
+}
+
+// preferLabel is a policy that puts the upstreams with a label first, in the order of the policy it wraps,
+// then the others.
+type preferLabel struct {
+	label
+	Policy
+}
+
+func (pl *preferLabel) String() string {
+	return pl.Policy.String() + " preferring " + pl.label.String()
+}
+
+func (pl *preferLabel) List(p []*Proxy) []*Proxy {
+	list := pl.Policy.List(p)
+	ordered := make([]*Proxy, 0, len(list))
+	for _, q := range list {
+		if q.HasLabel(pl.key, pl.value) {
+			ordered = append(ordered, q)
+		}
+	}
+	for _, q := range list {
+		if !q.HasLabel(pl.key, pl.value) {
+			ordered = append(ordered, q)
+		}
+	}
+	return ordered
+}
+
+// defaultZoneLabel is the label key of local_zone.
+const defaultZoneLabel = "zone"
+
+// inZone returns the upstreams of live in the local zone, or all of live when none of them are: cross-zone
+// upstreams are only asked when the local ones are down.
+func (f *Forward) inZone(live []*Proxy, tr *queryTrace) []*Proxy {
+	local := make([]*Proxy, 0, len(live))
+	for _, p := range live {
+		if p.HasLabel(f.zone.key, f.zone.value) {
+			local = append(local, p)
+		}
+	}
+	if len(local) == 0 && len(live) > 0 {
+		ZoneFallbackCount.Add(1)
+		tr.logf("no upstream in zone %s is up, asking other zones", f.zone.value)
+		return live
+	}
+	return local
+}
+
+// labelSeries counts the started upstreams per series of UpstreamLabels, so a series set by more than one
+// Forward, e.g. the old and new one of a reload, is only deleted once none has it.
+var labelSeries = struct {
+	sync.Mutex
+	refs map[[3]string]int
+}{refs: map[[3]string]int{}}
+
+// exportLabels sets the labels of p in UpstreamLabels.
+func exportLabels(p *Proxy) {
+	labelSeries.Lock()
+	defer labelSeries.Unlock()
+	for k, v := range p.labels {
+		s := [3]string{p.addr, k, v}
+		labelSeries.refs[s]++
+		UpstreamLabels.WithLabelValues(s[:]...).Set(1)
+	}
+}
+
+// unexportLabels undoes exportLabels.
+func unexportLabels(p *Proxy) {
+	labelSeries.Lock()
+	defer labelSeries.Unlock()
+	for k, v := range p.labels {
+		s := [3]string{p.addr, k, v}
+		if labelSeries.refs[s]--; labelSeries.refs[s] <= 0 {
+			delete(labelSeries.refs, s)
+			UpstreamLabels.DeleteLabelValues(s[:]...)
+		}
+	}
+}
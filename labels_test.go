@@ -0,0 +1,149 @@
+package forward
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/caddyserver/caddy"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSetupLabels(t *testing.T) {
+	tests := []struct {
+		input       string
+		shouldErr   bool
+		expectedErr string
+		expected    []string // labels per upstream
+		expectedTLS []uint16 // minimum TLS version per upstream
+	}{
+		// positive
+		{"forward . tls://127.0.0.1 tls://127.0.0.2 {\nlabel dc=eu1\nlabel tier=primary tls://127.0.0.2\n}\n", false, "",
+			[]string{"dc=eu1", "dc=eu1,tier=primary"}, []uint16{0, 0}},
+		{"forward . tls://127.0.0.1 tls://127.0.0.2 tls://127.0.0.3 {\nlabel dc=us1 tls://127.0.0.1 tls://127.0.0.3\ntls_version 1.3 label:dc=us1\n}\n", false, "",
+			[]string{"dc=us1", "", "dc=us1"}, []uint16{0x304, 0, 0x304}},
+		// negative
+		{"forward . 127.0.0.1 {\nlabel\n}\n", true, "at least one KEY=VALUE", nil, nil},
+		{"forward . 127.0.0.1 {\nlabel =eu1\n}\n", true, "at least one KEY=VALUE", nil, nil},
+		{"forward . 127.0.0.1 {\nlabel dc=eu1 127.0.0.2\n}\n", true, "not a configured upstream", nil, nil},
+		{"forward . 127.0.0.1 {\ntls_version 1.3 label:dc=eu1\n}\n", true, "no upstream has label dc=eu1", nil, nil},
+		{"forward . 127.0.0.1 {\ntls_version 1.3 label:eu1\n}\n", true, "not a label", nil, nil},
+		{"forward . 127.0.0.1 {\nlocal_zone\n}\n", true, "Wrong argument count", nil, nil},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		f, err := parseForward(c)
+
+		if test.shouldErr {
+			if err == nil || !strings.Contains(err.Error(), test.expectedErr) {
+				t.Errorf("Test %d: expected error to contain: %v, found error: %v, input: %s", i, test.expectedErr, err, test.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: expected no error but found one for input %s, got: %v", i, test.input, err)
+			continue
+		}
+		for j, p := range f.proxies {
+			if x := p.labelString(); x != test.expected[j] {
+				t.Errorf("Test %d: expected labels %q for %s, got %q", i, test.expected[j], p.addr, x)
+			}
+			if x := p.transport.(*persistentTransport).tlsConfig.MinVersion; x != test.expectedTLS[j] {
+				t.Errorf("Test %d: expected minimum TLS version %x for %s, got %x", i, test.expectedTLS[j], p.addr, x)
+			}
+		}
+	}
+}
+
+func TestPreferLabel(t *testing.T) {
+	a, b, c := NewProxy("10.0.0.1:53", "dns"), NewProxy("10.0.0.2:53", "dns"), NewProxy("10.0.0.3:53", "dns")
+	b.SetLabel("tier", "primary")
+	c.SetLabel("tier", "primary")
+	p := &preferLabel{label: label{"tier", "primary"}, Policy: &sequential{}}
+
+	list := p.List([]*Proxy{a, b, c})
+	if list[0] != b || list[1] != c || list[2] != a {
+		t.Errorf("Expected the primaries first in order, then the others, got %s", proxyAddrs(list))
+	}
+	if x := b.describe(); x != "10.0.0.2:53 (tier=primary)" {
+		t.Errorf("Expected the address with the labels, got %s", x)
+	}
+}
+
+func TestExportLabels(t *testing.T) {
+	p := NewProxy("10.0.0.1:53", "dns")
+	p.SetLabel("dc", "eu1")
+	// Two Forwards with the same upstream, as while reloading.
+	exportLabels(p)
+	exportLabels(p)
+	unexportLabels(p)
+	if n := labelSeries.refs[[3]string{"10.0.0.1:53", "dc", "eu1"}]; n != 1 {
+		t.Errorf("Expected the series to be kept while one user is left, got %d", n)
+	}
+	unexportLabels(p)
+	if _, ok := labelSeries.refs[[3]string{"10.0.0.1:53", "dc", "eu1"}]; ok {
+		t.Errorf("Expected the series to be deleted with its last user")
+	}
+}
+
+func TestLocalZone(t *testing.T) {
+	var asked []string
+	var mu sync.Mutex
+	// take returns the upstreams asked for example.org, health checks aside, since the last call.
+	take := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		got := asked
+		asked = nil
+		return got
+	}
+	handler := func(name string) dns.HandlerFunc {
+		return func(w dns.ResponseWriter, r *dns.Msg) {
+			if r.Question[0].Name == "example.org." {
+				mu.Lock()
+				asked = append(asked, name)
+				mu.Unlock()
+			}
+			ret := new(dns.Msg)
+			ret.SetReply(r)
+			w.WriteMsg(ret)
+		}
+	}
+	local := newTestServer(t, handler("local"))
+	defer local.Close()
+	remote := newTestServer(t, handler("remote"))
+	defer remote.Close()
+
+	c := caddy.NewTestController("dns", "forward . "+local.Addr+" "+remote.Addr+" {\nlabel az=eu1 "+local.Addr+
+		"\nlabel az=us1 "+remote.Addr+"\nlocal_zone eu1 az\n}\n")
+	f, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	f.OnStartup()
+	defer f.OnShutdown()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	f.ServeDNS(context.TODO(), dnstest.NewRecorder(&test.ResponseWriter{}), m)
+	if asked := take(); len(asked) != 1 || asked[0] != "local" {
+		t.Errorf("Expected only the local upstream to be asked, got %v", asked)
+	}
+
+	before := testutil.ToFloat64(ZoneFallbackCount)
+	atomic.StoreUint32(&f.proxies[0].fails, f.maxfails+1)
+	f.ServeDNS(context.TODO(), dnstest.NewRecorder(&test.ResponseWriter{}), m)
+	if asked := take(); len(asked) != 1 || asked[0] != "remote" {
+		t.Errorf("Expected the remote upstream to be asked with the local one down, got %v", asked)
+	}
+	if x := testutil.ToFloat64(ZoneFallbackCount) - before; x != 1 {
+		t.Errorf("Expected 1 zone fallback, got %v", x)
+	}
+}
@@ -0,0 +1,89 @@
+package forward
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the buckets of UpstreamLatency and of ProxyVars'
+// latencies: 250µs doubling up to 8s, finer than plugin.TimeBuckets at the low end where resolvers live.
+var latencyBuckets = prometheus.ExponentialBuckets(0.00025, 2, latencyBucketCount)
+
+const latencyBucketCount = 16
+
+// latencyHist is an in-process histogram of exchange latencies with latencyBuckets, the last count is
+// for the exchanges slower than all buckets.
+type latencyHist struct {
+	counts [latencyBucketCount + 1]uint64
+}
+
+func (h *latencyHist) observe(d time.Duration) {
+	s := d.Seconds()
+	i := sort.SearchFloat64s(latencyBuckets, s)
+	atomic.AddUint64(&h.counts[i], 1)
+}
+
+// LatencyVars is the expvar view of the exchange latencies of a Proxy over one transport. Quantiles are
+// the upper bounds of the buckets they fall in, in seconds, 0 if there's none.
+type LatencyVars struct {
+	Transport string    `json:"transport"`
+	Count     uint64    `json:"count"`
+	Le        []float64 `json:"le"`     // upper bounds of the buckets
+	Counts    []uint64  `json:"counts"` // per bucket, one more than Le for the slower exchanges
+	P50       float64   `json:"p50"`
+	P90       float64   `json:"p90"`
+	P99       float64   `json:"p99"`
+}
+
+func (h *latencyHist) vars(trans string) LatencyVars {
+	v := LatencyVars{Transport: trans, Le: latencyBuckets, Counts: make([]uint64, len(h.counts))}
+	for i := range h.counts {
+		v.Counts[i] = atomic.LoadUint64(&h.counts[i])
+		v.Count += v.Counts[i]
+	}
+	v.P50, v.P90, v.P99 = v.quantile(0.5), v.quantile(0.9), v.quantile(0.99)
+	return v
+}
+
+func (v LatencyVars) quantile(q float64) float64 {
+	if v.Count == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(v.Count)))
+	var n uint64
+	for i, c := range v.Counts[:len(v.Le)] {
+		if n += c; n >= rank {
+			return v.Le[i]
+		}
+	}
+	return v.Le[len(v.Le)-1] // slower than all buckets
+}
+
+// latencies holds a latencyHist per transport an upstream is used with.
+type latencies struct {
+	m sync.Map // transport -> *latencyHist
+}
+
+func (l *latencies) observe(trans string, d time.Duration) {
+	h, ok := l.m.Load(trans)
+	if !ok {
+		h, _ = l.m.LoadOrStore(trans, new(latencyHist))
+	}
+	h.(*latencyHist).observe(d)
+}
+
+// vars returns the LatencyVars of all transports, sorted by transport.
+func (l *latencies) vars() []LatencyVars {
+	var vs []LatencyVars
+	l.m.Range(func(k, h interface{}) bool {
+		vs = append(vs, h.(*latencyHist).vars(k.(string)))
+		return true
+	})
+	sort.Slice(vs, func(i, j int) bool { return vs[i].Transport < vs[j].Transport })
+	return vs
+}
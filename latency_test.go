@@ -0,0 +1,33 @@
+package forward
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyQuantiles(t *testing.T) {
+	var l latencies
+	for i := 0; i < 90; i++ {
+		l.observe("udp", 100*time.Microsecond)
+	}
+	for i := 0; i < 9; i++ {
+		l.observe("udp", 3*time.Millisecond)
+	}
+	l.observe("udp", time.Minute)
+	l.observe("tcp", time.Millisecond)
+
+	vs := l.vars()
+	if len(vs) != 2 || vs[0].Transport != "tcp" || vs[1].Transport != "udp" {
+		t.Fatalf("Expected the latencies of tcp and udp, got %+v", vs)
+	}
+	if vs[0].Count != 1 || vs[0].P50 != 0.001 {
+		t.Errorf("Expected 1 tcp exchange in the 1ms bucket, got %+v", vs[0])
+	}
+	v := vs[1]
+	if v.Count != 100 || v.Counts[len(v.Counts)-1] != 1 {
+		t.Errorf("Expected 100 udp exchanges, 1 slower than all buckets, got %+v", v)
+	}
+	if v.P50 != 0.00025 || v.P90 != 0.00025 || v.P99 != 0.004 {
+		t.Errorf("Expected p50 and p90 at 250µs and p99 at 4ms, got %g, %g and %g", v.P50, v.P90, v.P99)
+	}
+}
@@ -0,0 +1,97 @@
+package forward
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// sampled returns true for 1 in every log_sample queries.
+func (f *Forward) sampled() bool {
+	return f.logSample > 0 && atomic.AddUint64(&f.logged, 1)%f.logSample == 0
+}
+
+// serveLogged is serveDNS, logging the query and how it was answered.
+func (f *Forward) serveLogged(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	rec := dnstest.NewRecorder(w)
+	rcode, err := f.serveDNS(ctx, rec, r)
+
+	state := request.Request{W: w, Req: r}
+	answers := 0
+	if rec.Msg != nil {
+		rcode = rec.Rcode
+		answers = len(rec.Msg.Answer)
+	}
+	if err != nil {
+		log.Infof("%s %s from %s: %s, %s after %s", displayName(state.QName(), f.idnDisplay), state.Type(), state.IP(),
+			rcodeString(rcode), err, time.Since(rec.Start))
+	} else {
+		log.Infof("%s %s from %s: %s with %d answers after %s", displayName(state.QName(), f.idnDisplay), state.Type(),
+			state.IP(), rcodeString(rcode), answers, time.Since(rec.Start))
+	}
+	return rcode, err
+}
+
+// errorLimiter rate limits logging upstream errors: the same error of the same upstream is logged at most
+// once per interval, with the number of times it was suppressed since.
+type errorLimiter struct {
+	interval time.Duration
+
+	mu   sync.Mutex
+	seen map[errorKey]*limitedError
+}
+
+type errorKey struct {
+	addr string
+	err  string
+}
+
+type limitedError struct {
+	logged     time.Time
+	suppressed int
+}
+
+// defaultErrorLogInterval is the interval of log_errors.
+const defaultErrorLogInterval = 10 * time.Second
+
+func newErrorLimiter(interval time.Duration) *errorLimiter {
+	return &errorLimiter{interval: interval, seen: map[errorKey]*limitedError{}}
+}
+
+// logError logs err of the upstream addr, unless the same was logged less than l.interval ago.
+func (l *errorLimiter) logError(addr string, err error) {
+	k := errorKey{addr, err.Error()}
+	now := time.Now()
+
+	l.mu.Lock()
+	e := l.seen[k]
+	if e != nil && now.Sub(e.logged) < l.interval {
+		e.suppressed++
+		l.mu.Unlock()
+		return
+	}
+	suppressed := 0
+	if e != nil {
+		suppressed = e.suppressed
+	}
+	l.seen[k] = &limitedError{logged: now}
+	// Forget errors that weren't seen for a while, they'd only grow the map.
+	for k, e := range l.seen {
+		if now.Sub(e.logged) > 2*l.interval {
+			delete(l.seen, k)
+		}
+	}
+	l.mu.Unlock()
+
+	if suppressed > 0 {
+		log.Warningf("Upstream %s: %s (%d more since %s ago)", addr, err, suppressed, l.interval)
+		return
+	}
+	log.Warningf("Upstream %s: %s", addr, err)
+}
@@ -1,5 +1,81 @@
 package forward
 
-import clog "github.com/coredns/coredns/plugin/pkg/log"
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	golog "log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
 
 func init() { clog.Discard() }
+
+// captureLog returns the log output of fn.
+func captureLog(fn func()) string {
+	var buf bytes.Buffer
+	golog.SetOutput(&buf)
+	defer golog.SetOutput(ioutil.Discard)
+	fn()
+	return buf.String()
+}
+
+func TestLogSample(t *testing.T) {
+	s := newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"))
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	f := New()
+	f.logSample = 3
+	f.SetProxy(NewProxy(s.Addr, transport.DNS))
+	defer f.OnShutdown()
+
+	out := captureLog(func() {
+		for i := 0; i < 6; i++ {
+			m := new(dns.Msg)
+			m.SetQuestion("example.org.", dns.TypeA)
+			if _, err := f.ServeDNS(context.TODO(), dnstest.NewRecorder(&test.ResponseWriter{}), m); err != nil {
+				t.Fatalf("Expected to receive reply, but got: %s", err)
+			}
+		}
+	})
+	if n := strings.Count(out, "example.org. A from"); n != 2 {
+		t.Errorf("Expected 2 of 6 queries to be logged, got %d: %s", n, out)
+	}
+	if !strings.Contains(out, "NOERROR with 1 answers") {
+		t.Errorf("Expected the rcode and answers to be logged, got %s", out)
+	}
+}
+
+func TestErrorLimiter(t *testing.T) {
+	l := newErrorLimiter(50 * time.Millisecond)
+	err := errors.New("boom")
+	out := captureLog(func() {
+		for i := 0; i < 5; i++ {
+			l.logError("10.0.0.1:53", err)
+		}
+		l.logError("10.0.0.2:53", err)
+	})
+	if n := strings.Count(out, "boom"); n != 2 {
+		t.Errorf("Expected the first error of each upstream to be logged, got %d: %s", n, out)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	out = captureLog(func() { l.logError("10.0.0.1:53", err) })
+	if !strings.Contains(out, "(4 more since") {
+		t.Errorf("Expected the suppressed errors to be counted, got %s", out)
+	}
+}
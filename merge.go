@@ -0,0 +1,274 @@
+package forward
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// conflictPolicy decides what to do when upstreams return different address sets for the same question.
+type conflictPolicy int
+
+const (
+	conflictMerge    conflictPolicy = iota // return the union of all addresses
+	conflictMajority                       // return the address set most upstreams agree on
+	conflictFirst                          // return the address set of the first configured upstream
+	conflictLog                            // merge, but log the disagreeing upstreams
+)
+
+func (c conflictPolicy) String() string {
+	switch c {
+	case conflictMajority:
+		return "majority"
+	case conflictFirst:
+		return "first"
+	case conflictLog:
+		return "log"
+	}
+	return "merge"
+}
+
+// addrSet holds the A and AAAA records one upstream returned.
+type addrSet struct {
+	resp *fwdResp
+	rrs  []dns.RR
+	key  string // sorted addresses, used to compare sets regardless of order and TTL
+}
+
+func newAddrSet(resp *fwdResp) addrSet {
+	set := addrSet{resp: resp}
+	addrs := []string{}
+	for _, rr := range resp.ret.Answer {
+		switch x := rr.(type) {
+		case *dns.A:
+			set.rrs = append(set.rrs, rr)
+			addrs = append(addrs, x.A.String())
+		case *dns.AAAA:
+			set.rrs = append(set.rrs, rr)
+			addrs = append(addrs, x.AAAA.String())
+		}
+	}
+	sort.Strings(addrs)
+	set.key = strings.Join(addrs, ",")
+	return set
+}
+
+// resolveConflict returns the address sets to merge according to f's conflict policy.
+func (f *Forward) resolveConflict(state request.Request, sets []addrSet) []addrSet {
+	conflict := false
+	for _, set := range sets[1:] {
+		if set.key != sets[0].key {
+			conflict = true
+			break
+		}
+	}
+	if !conflict {
+		return sets
+	}
+
+	ConflictCount.Add(1)
+
+	switch f.conflict {
+	case conflictMajority:
+		count := map[string]int{}
+		for _, set := range sets {
+			count[set.key]++
+		}
+		// Ties are broken in favor of the first configured upstream.
+		order := f.configuredOrder(sets)
+		best := order[0]
+		for _, key := range order {
+			if count[key] > count[best] {
+				best = key
+			}
+		}
+		return filterAddrSets(sets, best)
+	case conflictFirst:
+		return filterAddrSets(sets, f.configuredOrder(sets)[0])
+	case conflictLog:
+		for _, set := range sets {
+			log.Warningf("Conflicting answer for %s %s from %s: %s", displayName(state.QName(), f.idnDisplay), state.Type(), set.resp.proxy.addr, set.key)
+		}
+	}
+	return sets
+}
+
+// configuredOrder returns the keys of sets ordered by the position of their upstream in the configuration.
+// Sets from upstreams that aren't in f.proxies, e.g. those of an except line, follow in the order given.
+func (f *Forward) configuredOrder(sets []addrSet) []string {
+	keys := make([]string, 0, len(sets))
+	seen := make([]bool, len(sets))
+	for _, p := range f.proxies {
+		for i, set := range sets {
+			if set.resp.proxy == p {
+				keys = append(keys, set.key)
+				seen[i] = true
+			}
+		}
+	}
+	for i, set := range sets {
+		if !seen[i] {
+			keys = append(keys, set.key)
+		}
+	}
+	return keys
+}
+
+func filterAddrSets(sets []addrSet, key string) []addrSet {
+	filtered := make([]addrSet, 0, len(sets))
+	for _, set := range sets {
+		if set.key == key {
+			filtered = append(filtered, set)
+		}
+	}
+	return filtered
+}
+
+// rrsetKey returns a key that is equal for two responses with the same rcode and answer section, ignoring
+// TTLs, case and record order.
+func rrsetKey(m *dns.Msg) string {
+	rrs := make([]string, len(m.Answer))
+	for i, rr := range m.Answer {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = 0
+		rrs[i] = strings.ToLower(rr.String())
+	}
+	sort.Strings(rrs)
+	return dns.RcodeToString[m.Rcode] + "\n" + strings.Join(rrs, "\n")
+}
+
+// quorumReply returns the response at least f.quorum upstreams agree on, or ErrNoQuorum.
+func (f *Forward) quorumReply(resps []fwdResp) (*dns.Msg, error) {
+	count := map[string]int{}
+	for _, resp := range resps {
+		if resp.ret == nil {
+			continue
+		}
+		key := rrsetKey(resp.ret)
+		count[key]++
+		if count[key] >= f.quorum {
+			return resp.ret, nil
+		}
+	}
+	return nil, ErrNoQuorum
+}
+
+// reply builds the message we send back to the client out of the responses collected from the upstreams.
+// All A and AAAA records are merged into a single answer, failing that the first successful response is
+// used, then any response. If nothing usable came back the (first) upstream error is returned. For names
+// some upstreams are authoritative for, only their responses are used if they replied. With merge_domains
+// names not on the list don't get merged, they get the first successful response with an answer.
+func (f *Forward) reply(state request.Request, resps []fwdResp) (*dns.Msg, error) {
+	if f.quorum > 0 {
+		return f.quorumReply(resps)
+	}
+	resps = f.authoritativeResps(state.Name(), resps)
+	if !f.merges(state.Name()) {
+		for _, resp := range resps {
+			if resp.ret != nil && resp.ret.Rcode == dns.RcodeSuccess && len(resp.ret.Answer) > 0 {
+				return resp.ret, nil
+			}
+		}
+		return firstReply(state, resps)
+	}
+
+	sets := make([]addrSet, 0, len(resps))
+	for i := range resps {
+		if resps[i].ret == nil {
+			continue
+		}
+		if set := newAddrSet(&resps[i]); len(set.rrs) > 0 {
+			sets = append(sets, set)
+		}
+	}
+
+	if len(sets) > 0 {
+		sets = f.resolveConflict(state, sets)
+
+		var ret = &dns.Msg{}
+		ret.SetReply(state.Req)
+		ret.Authoritative = false
+		ret.RecursionAvailable = true
+		ret.AuthenticatedData = true // AD is only kept if every upstream contributing to the answer set it
+		name := ret.Question[0].Name
+		for _, set := range sets {
+			if !set.resp.ret.AuthenticatedData {
+				ret.AuthenticatedData = false
+			}
+			for _, ip := range set.rrs {
+				ip.Header().Name = name
+				ret.Answer = append(ret.Answer, ip)
+			}
+		}
+		ret.Answer = dns.Dedup(ret.Answer, nil)
+		// Echo the client's payload size and DO bit, so the DO bit makes it back.
+		setEdns0(state, ret)
+		// And pass on the Extended DNS Errors of the upstreams that contributed.
+		copyEDE(ret, sets)
+		return ret, nil
+	}
+
+	return firstReply(state, resps)
+}
+
+// firstReply returns the first successful response, failing that any response. If nothing usable came back
+// the (first) upstream error is returned.
+func firstReply(state request.Request, resps []fwdResp) (*dns.Msg, error) {
+	for _, resp := range resps {
+		if resp.ret != nil && resp.ret.Rcode == dns.RcodeSuccess {
+			return resp.ret, nil
+		}
+	}
+
+	for _, resp := range resps {
+		if resp.ret != nil {
+			return resp.ret, nil
+		}
+	}
+
+	// Only answer FORMERR when every upstream misbehaved, otherwise report the upstream error.
+	mismatches := 0
+	for _, resp := range resps {
+		if resp.mismatch {
+			mismatches++
+		}
+	}
+	if mismatches > 0 && mismatches == len(resps) {
+		formerr := new(dns.Msg)
+		formerr.SetRcode(state.Req, dns.RcodeFormatError)
+		return formerr, nil
+	}
+
+	for _, resp := range resps {
+		if resp.upstreamErr == nil {
+			continue
+		}
+
+		return nil, resp.upstreamErr
+	}
+
+	return nil, ErrNoHealthy
+}
+
+// merges returns true if the answers for name are merged, that is if no merge_domains are configured or
+// name is one of them.
+func (f *Forward) merges(name string) bool {
+	if len(f.mergeNames) == 0 && len(f.mergePatterns) == 0 {
+		return true
+	}
+	for _, n := range f.mergeNames {
+		if plugin.Name(n).Matches(name) {
+			return true
+		}
+	}
+	for _, re := range f.mergePatterns {
+		if matchPattern(re, name) {
+			return true
+		}
+	}
+	return false
+}
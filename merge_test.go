@@ -0,0 +1,190 @@
+package forward
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+func answer(req *dns.Msg, ad bool, rrs ...dns.RR) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.AuthenticatedData = ad
+	m.Answer = rrs
+	return m
+}
+
+func TestReplyAuthenticatedData(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	req.SetEdns0(4096, true)
+	req.CheckingDisabled = true
+	state := request.Request{W: &test.ResponseWriter{}, Req: req}
+
+	tests := []struct {
+		ad1, ad2 bool
+		expected bool
+	}{
+		{true, true, true},
+		{true, false, false},
+		{false, false, false},
+	}
+
+	f := New()
+	for i, tc := range tests {
+		resps := []fwdResp{
+			{ret: answer(req, tc.ad1, test.A("example.org. IN A 127.0.0.1"))},
+			{ret: answer(req, tc.ad2, test.A("example.org. IN A 127.0.0.2"))},
+			{ret: answer(req, false)}, // doesn't contribute, so doesn't count
+		}
+		ret, err := f.reply(state, resps)
+		if err != nil {
+			t.Fatalf("Test %d: expected no error, got %s", i, err)
+		}
+		if ret.AuthenticatedData != tc.expected {
+			t.Errorf("Test %d: expected AD to be %t, got %t", i, tc.expected, ret.AuthenticatedData)
+		}
+		if !ret.CheckingDisabled {
+			t.Errorf("Test %d: expected CD to be copied from the request", i)
+		}
+		if o := ret.IsEdns0(); o == nil || !o.Do() {
+			t.Errorf("Test %d: expected DO to be copied from the request", i)
+		}
+	}
+}
+
+func TestReplyConflict(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	state := request.Request{W: &test.ResponseWriter{}, Req: req}
+
+	f := New()
+	p1, p2, p3 := NewProxy("10.0.0.1:53", "dns"), NewProxy("10.0.0.2:53", "dns"), NewProxy("10.0.0.3:53", "dns")
+	f.proxies = []*Proxy{p1, p2, p3}
+
+	tests := []struct {
+		policy   conflictPolicy
+		expected []string
+	}{
+		{conflictMerge, []string{"127.0.0.1", "127.0.0.2"}},
+		{conflictLog, []string{"127.0.0.1", "127.0.0.2"}},
+		{conflictMajority, []string{"127.0.0.2"}},
+		{conflictFirst, []string{"127.0.0.1"}},
+	}
+
+	for i, tc := range tests {
+		f.conflict = tc.policy
+		// Responses arrive in fan-out order, not configured order.
+		resps := []fwdResp{
+			{proxy: p3, ret: answer(req, false, test.A("example.org. IN A 127.0.0.2"))},
+			{proxy: p1, ret: answer(req, false, test.A("example.org. IN A 127.0.0.1"))},
+			{proxy: p2, ret: answer(req, false, test.A("example.org. IN A 127.0.0.2"))},
+		}
+		ret, err := f.reply(state, resps)
+		if err != nil {
+			t.Fatalf("Test %d: expected no error, got %s", i, err)
+		}
+		if len(ret.Answer) != len(tc.expected) {
+			t.Fatalf("Test %d: expected %d answers, got %d: %v", i, len(tc.expected), len(ret.Answer), ret.Answer)
+		}
+		for _, addr := range tc.expected {
+			found := false
+			for _, rr := range ret.Answer {
+				if rr.(*dns.A).A.String() == addr {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("Test %d: expected %s in answer, got %v", i, addr, ret.Answer)
+			}
+		}
+	}
+}
+
+func TestReplyConflictUnconfigured(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	state := request.Request{W: &test.ResponseWriter{}, Req: req}
+
+	// Upstreams of an except line aren't in f.proxies.
+	f := New()
+	f.conflict = conflictFirst
+	resps := []fwdResp{
+		{proxy: NewProxy("10.0.0.1:53", "dns"), ret: answer(req, false, test.A("example.org. IN A 127.0.0.1"))},
+		{proxy: NewProxy("10.0.0.2:53", "dns"), ret: answer(req, false, test.A("example.org. IN A 127.0.0.2"))},
+	}
+	ret, err := f.reply(state, resps)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if len(ret.Answer) != 1 || ret.Answer[0].(*dns.A).A.String() != "127.0.0.1" {
+		t.Errorf("Expected the first answer, got %v", ret.Answer)
+	}
+}
+
+func TestReplyQuorum(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	state := request.Request{W: &test.ResponseWriter{}, Req: req}
+
+	resps := []fwdResp{
+		{ret: answer(req, false, test.A("example.org. 300 IN A 127.0.0.1"), test.A("example.org. 300 IN A 127.0.0.2"))},
+		{ret: answer(req, false, test.A("example.org. 300 IN A 127.0.0.3"))},
+		// Same set as the first, different TTL and order.
+		{ret: answer(req, false, test.A("example.org. 60 IN A 127.0.0.2"), test.A("EXAMPLE.org. 60 IN A 127.0.0.1"))},
+		{upstreamErr: ErrNoHealthy},
+	}
+
+	f := New()
+	f.quorum = 2
+	ret, err := f.reply(state, resps)
+	if err != nil {
+		t.Fatalf("Expected quorum of 2, got error: %s", err)
+	}
+	if len(ret.Answer) != 2 {
+		t.Errorf("Expected the agreed upon answer with 2 records, got %v", ret.Answer)
+	}
+
+	f.quorum = 3
+	if _, err := f.reply(state, resps); err != ErrNoQuorum {
+		t.Errorf("Expected %s, got %v", ErrNoQuorum, err)
+	}
+}
+
+func TestReplyMergeDomains(t *testing.T) {
+	f := New()
+	f.mergeNames = []string{"svc.example.org."}
+	re, _, _ := compilePattern("*.dc.example.org")
+	f.mergePatterns = []*regexp.Regexp{re}
+
+	tests := []struct {
+		qname    string
+		expected int
+	}{
+		{"svc.example.org.", 2},
+		{"a.svc.example.org.", 2},
+		{"db.dc.example.org.", 2},
+		{"www.example.org.", 1},
+	}
+	for i, tc := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(tc.qname, dns.TypeA)
+		state := request.Request{W: &test.ResponseWriter{}, Req: req}
+		resps := []fwdResp{
+			{ret: answer(req, false)},
+			{ret: answer(req, false, test.A(tc.qname+" IN A 127.0.0.1"))},
+			{ret: answer(req, false, test.A(tc.qname+" IN A 127.0.0.2"))},
+		}
+		ret, err := f.reply(state, resps)
+		if err != nil {
+			t.Fatalf("Test %d: expected no error, got %s", i, err)
+		}
+		if len(ret.Answer) != tc.expected {
+			t.Errorf("Test %d: expected %d answers for %s, got %v", i, tc.expected, tc.qname, ret.Answer)
+		}
+	}
+}
@@ -27,6 +27,13 @@ var (
 		Buckets:   plugin.TimeBuckets,
 		Help:      "Histogram of the time each request took.",
 	}, []string{"to"})
+	UpstreamLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "upstream_latency_seconds",
+		Buckets:   latencyBuckets,
+		Help:      "Histogram of the latency of successful exchanges, per upstream and transport.",
+	}, []string{"to", "transport"})
 	HealthcheckFailureCount = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: plugin.Namespace,
 		Subsystem: "forward",
@@ -39,6 +46,168 @@ var (
 		Name:      "healthcheck_broken_count_total",
 		Help:      "Counter of the number of complete failures of the healthchecks.",
 	})
+	ConflictCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "conflict_count_total",
+		Help:      "Counter of queries for which upstreams returned different address sets.",
+	})
+	ShadowCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "shadow_count_total",
+		Help:      "Counter of shadow upstream answers compared against the served answer, by result.",
+	}, []string{"result"})
+	OversizeCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "oversize_count_total",
+		Help:      "Counter of responses larger than max_response_size per upstream.",
+	}, []string{"to", "proto"})
+	RetryCapCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "retry_cap_count_total",
+		Help:      "Counter of upstream exchanges abandoned after hitting the retry cap.",
+	}, []string{"to"})
+	UpstreamErrorCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "upstream_error_count_total",
+		Help:      "Counter of failed upstream exchanges per upstream and error class.",
+	}, []string{"to", "class"})
+	ConnCacheHitsCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "conn_cache_hits_total",
+		Help:      "Counter of connection cache hits per upstream and protocol.",
+	}, []string{"to", "proto"})
+	ConnCacheMissesCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "conn_cache_misses_total",
+		Help:      "Counter of connection cache misses per upstream and protocol.",
+	}, []string{"to", "proto"})
+	ConnExpiredCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "conn_expired_total",
+		Help:      "Counter of cached connections closed because they expired, per upstream and protocol.",
+	}, []string{"to", "proto"})
+	ConnRotatedCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "conn_rotated_total",
+		Help:      "Counter of TCP and TLS connections closed because they reached the rotate limits.",
+	}, []string{"to", "proto"})
+	CachedClosedCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "cached_closed_total",
+		Help:      "Counter of cached connections found closed by the upstream when used.",
+	}, []string{"to"})
+	DialFallbackCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "dial_fallback_count_total",
+		Help:      "Counter of failed dials retried on the alternate address of an upstream.",
+	}, []string{"to"})
+	FastFailCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "fast_failure_count_total",
+		Help:      "Counter of UDP exchanges failed by an ICMP unreachable before the read timeout, per upstream and reason.",
+	}, []string{"to", "reason"})
+	EDECount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "extended_error_count_total",
+		Help:      "Counter of Extended DNS Errors in upstream responses, per upstream and info code.",
+	}, []string{"to", "code"})
+	CDRetryCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "cd_retry_count_total",
+		Help:      "Counter of SERVFAILs retried with checking disabled, per upstream and outcome.",
+	}, []string{"to", "outcome"})
+	FaultCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "injected_fault_count_total",
+		Help:      "Counter of faults injected into upstream exchanges, per upstream and fault.",
+	}, []string{"to", "fault"})
+	RcodeRemapCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "rcode_remap_count_total",
+		Help:      "Counter of replies whose rcode was translated by rcode_map.",
+	}, []string{"from", "to"})
+	TLSResumptionCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "tls_resumption_count_total",
+		Help:      "Counter of TLS handshakes with upstreams with a session cache, per upstream and if they resumed a session.",
+	}, []string{"to", "resumed"})
+	FanoutCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "fanout_count_total",
+		Help:      "Counter of queries asked of more than one upstream, per number of upstreams asked and number that answered.",
+	}, []string{"asked", "answered"})
+	PartialFanoutCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "partial_fanout_count_total",
+		Help:      "Counter of queries asked of more than one upstream where some didn't answer.",
+	})
+	UpstreamLabels = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "upstream_labels",
+		Help:      "Gauge that is 1 for every label of an upstream, to join with the metrics of the upstream by to.",
+	}, []string{"to", "label", "value"})
+	ZoneFallbackCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "zone_fallback_count_total",
+		Help:      "Counter of queries sent to other zones because no upstream in the local_zone was up.",
+	})
+	OutOfBailiwickCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "out_of_bailiwick_count_total",
+		Help:      "Counter of records in upstream replies outside the bailiwick of the query, per upstream and section.",
+	}, []string{"to", "section"})
+	HostsCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "hosts_count_total",
+		Help:      "Counter of queries answered from the hosts overrides.",
+	})
+	NXCacheHitsCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "nxdomain_cache_hits_total",
+		Help:      "Counter of queries answered NXDOMAIN from the nxdomain_cache.",
+	})
+	RandomSubdomainCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "random_subdomain_count_total",
+		Help:      "Counter of queries answered NXDOMAIN because of a random subdomain flood under their zone.",
+	})
+	ServfailBreachGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "servfail_breach",
+		Help:      "Gauge that is 1 while the SERVFAIL ratio of the replies exceeds the threshold of servfail_alert.",
+	}, []string{"from"})
+	ServfailBreachCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "servfail_breach_count_total",
+		Help:      "Counter of the times the SERVFAIL ratio of the replies exceeded the threshold of servfail_alert.",
+	}, []string{"from"})
 	SocketGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: plugin.Namespace,
 		Subsystem: "forward",
@@ -46,3 +215,11 @@ var (
 		Help:      "Gauge of open sockets per upstream.",
 	}, []string{"to"})
 )
+
+// Collectors returns all metrics of the plugin, for programs that serve them without the metrics plugin.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{RequestCount, RcodeCount, RequestDuration, UpstreamLatency, HealthcheckFailureCount, HealthcheckBrokenCount, SocketGauge, ConflictCount, ShadowCount, OversizeCount, RetryCapCount, UpstreamErrorCount,
+		ConnCacheHitsCount, ConnCacheMissesCount, ConnExpiredCount, ConnRotatedCount, CachedClosedCount, DialFallbackCount, FastFailCount, EDECount, CDRetryCount, FaultCount, RcodeRemapCount, TLSResumptionCount,
+		FanoutCount, PartialFanoutCount, UpstreamLabels, ZoneFallbackCount, OutOfBailiwickCount, HostsCount, NXCacheHitsCount, RandomSubdomainCount,
+		ServfailBreachGauge, ServfailBreachCount}
+}
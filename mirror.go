@@ -0,0 +1,17 @@
+package forward
+
+import (
+	"context"
+
+	"github.com/coredns/coredns/request"
+)
+
+// mirrorQuery sends a copy of state to every mirror proxy. This is fire-and-forget: responses and errors are
+// dropped, and the client never waits for them. The per upstream metrics are recorded as usual.
+func (f *Forward) mirrorQuery(state request.Request) {
+	for _, proxy := range f.mirror {
+		go func(proxy *Proxy) {
+			proxy.Connect(context.Background(), state, f.opts)
+		}(proxy)
+	}
+}
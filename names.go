@@ -0,0 +1,90 @@
+package forward
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/coredns/coredns/plugin"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/idna"
+)
+
+// normalizeHost returns the normalized name of a configured host: lower case, fully qualified and, if
+// written in Unicode, in punycode, so it's matched against query names as they are on the wire.
+func normalizeHost(s string) string { return plugin.Host(toASCII(s)).Normalize() }
+
+// toASCII returns s with its internationalized labels in punycode. A label that isn't valid IDNA is left
+// as is, it won't match any query then. Labels are converted one by one so wildcards and regular
+// expressions survive.
+func toASCII(s string) string {
+	if isASCII(s) {
+		return s
+	}
+	labels := strings.Split(s, ".")
+	for i, l := range labels {
+		if isASCII(l) {
+			continue
+		}
+		if a, err := idna.Lookup.ToASCII(l); err == nil {
+			labels[i] = a
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// lowerQuestion returns a copy of q with the names in lower case.
+func lowerQuestion(q []dns.Question) []dns.Question {
+	lq := make([]dns.Question, len(q))
+	for i := range q {
+		lq[i] = q[i]
+		lq[i].Name = strings.ToLower(q[i].Name)
+	}
+	return lq
+}
+
+// restoreCase gives the question of ret, and the records owned by the query name, the case the client
+// used in r, for the replies to queries sent with lowercase_qname. Clients that randomize the case of
+// their queries (DNS 0x20) check it.
+func restoreCase(ret, r *dns.Msg) {
+	if len(ret.Question) == 0 || len(r.Question) == 0 {
+		return
+	}
+	lower, orig := ret.Question[0].Name, r.Question[0].Name
+	if !strings.EqualFold(lower, orig) {
+		return
+	}
+	ret.Question[0].Name = orig
+	for _, rr := range ret.Answer {
+		if h := rr.Header(); strings.EqualFold(h.Name, orig) {
+			h.Name = orig
+		}
+	}
+}
+
+// displayName returns name for logs and debug output: with unicode its punycode labels in Unicode, for
+// idn_display. Labels that aren't valid punycode are shown as they are.
+func displayName(name string, unicode bool) string {
+	if !unicode || !strings.Contains(name, "xn--") && !strings.Contains(name, "XN--") {
+		return name
+	}
+	labels := strings.Split(name, ".")
+	for i, l := range labels {
+		if len(l) < 4 || !strings.EqualFold(l[:4], "xn--") {
+			continue
+		}
+		if u, err := idna.Display.ToUnicode(strings.ToLower(l)); err == nil {
+			labels[i] = u
+		}
+	}
+	return strings.Join(labels, ".")
+}
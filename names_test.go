@@ -0,0 +1,103 @@
+package forward
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/caddyserver/caddy"
+	"github.com/miekg/dns"
+)
+
+func TestNormalizeHost(t *testing.T) {
+	tests := []struct {
+		in, expected string
+	}{
+		{"Example.ORG", "example.org."},
+		{"example.org.", "example.org."},
+		{"Bücher.example", "xn--bcher-kva.example."},
+		{"xn--bcher-kva.example.", "xn--bcher-kva.example."},
+	}
+	for i, tc := range tests {
+		if x := normalizeHost(tc.in); x != tc.expected {
+			t.Errorf("Test %d: expected %s for %s, got %s", i, tc.expected, tc.in, x)
+		}
+	}
+
+	re, _, err := compilePattern("*.bücher.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !matchPattern(re, "www.XN--BCHER-KVA.example.") {
+		t.Errorf("Expected the Unicode wildcard to match its punycode")
+	}
+}
+
+func TestLowercaseQname(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		asked string
+	)
+	s := newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		if r.Question[0].Name != "." { // not a health check
+			mu.Lock()
+			asked = r.Question[0].Name
+			mu.Unlock()
+		}
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A(r.Question[0].Name+" IN A 127.0.0.1"))
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	c := caddy.NewTestController("dns", "forward . "+s.Addr+" {\nlowercase_qname\n}\n")
+	f, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	f.OnStartup()
+	defer f.OnShutdown()
+
+	m := new(dns.Msg)
+	m.SetQuestion("ExAmPlE.oRg.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := f.ServeDNS(context.TODO(), rec, m); err != nil {
+		t.Fatalf("Expected to receive reply, but got: %s", err)
+	}
+	mu.Lock()
+	if asked != "example.org." {
+		t.Errorf("Expected the upstream to be asked for example.org., got %s", asked)
+	}
+	mu.Unlock()
+	if x := rec.Msg.Question[0].Name; x != "ExAmPlE.oRg." {
+		t.Errorf("Expected the client's case in the question, got %s", x)
+	}
+	if x := rec.Msg.Answer[0].Header().Name; x != "ExAmPlE.oRg." {
+		t.Errorf("Expected the client's case in the answer, got %s", x)
+	}
+	if m.Question[0].Name != "ExAmPlE.oRg." {
+		t.Errorf("Expected the client's query to be left alone, got %s", m.Question[0].Name)
+	}
+}
+
+func TestDisplayName(t *testing.T) {
+	tests := []struct {
+		in       string
+		unicode  bool
+		expected string
+	}{
+		{"xn--bcher-kva.example.", true, "bücher.example."},
+		{"www.XN--BCHER-KVA.example.", true, "www.bücher.example."},
+		{"xn--bcher-kva.example.", false, "xn--bcher-kva.example."},
+		{"example.org.", true, "example.org."},
+	}
+	for i, tc := range tests {
+		if x := displayName(tc.in, tc.unicode); x != tc.expected {
+			t.Errorf("Test %d: expected %s for %s, got %s", i, tc.expected, tc.in, x)
+		}
+	}
+}
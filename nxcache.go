@@ -0,0 +1,306 @@
+package forward
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultNXCacheSize = 10000
+	defaultNXCacheTTL  = 5 * time.Second
+)
+
+// nxCache is the LRU of nxdomain_cache: the names upstreams recently answered NXDOMAIN for, so repeats are
+// answered without another fan-out. Entries are kept for at most ttl, never longer than the negative TTL
+// of the reply, and are partitioned by the DO bit and the client subnet of the query, as the replies to
+// those may differ.
+type nxCache struct {
+	size int
+	ttl  time.Duration
+
+	mu    sync.Mutex
+	ll    *list.List // of *nxEntry, most recently used first
+	items map[nxKey]*list.Element
+}
+
+// nxKey identifies the NXDOMAINs of an nxCache. The qtype isn't part of it, a name that doesn't exist
+// doesn't exist for any type.
+type nxKey struct {
+	name   string // lower case
+	qclass uint16
+	do     bool
+	subnet string // ECS option of the query, if any
+}
+
+type nxEntry struct {
+	key     nxKey
+	expires time.Time
+	ns      []dns.RR // the authority section, with the SOA
+	ra, ad  bool
+}
+
+func newNXCache(size int, ttl time.Duration) *nxCache {
+	return &nxCache{size: size, ttl: ttl, ll: list.New(), items: make(map[nxKey]*list.Element)}
+}
+
+func nxKeyOf(state request.Request) nxKey {
+	k := nxKey{name: strings.ToLower(state.Name()), qclass: state.QClass(), do: state.Do()}
+	if opt := state.Req.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+				k.subnet = ecs.String()
+			}
+		}
+	}
+	return k
+}
+
+// flush removes the entries of the names match returns true for, all if match is nil, and returns how many
+// there were.
+func (c *nxCache) flush(match func(name string) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for e := c.ll.Front(); e != nil; {
+		next := e.Next()
+		if x := e.Value.(*nxEntry); match == nil || match(x.key.name) {
+			c.ll.Remove(e)
+			delete(c.items, x.key)
+			n++
+		}
+		e = next
+	}
+	return n
+}
+
+// FlushCache removes the names of pattern from the nxdomain_cache of f, so names that were just added
+// upstream resolve right away, and returns the number of entries removed. Pattern is a name, which matches
+// it and the names below it, a wildcard like *.example.org, which matches only the names below example.org,
+// or a "regex:" regular expression, as in except; an empty pattern flushes the whole cache.
+func (f *Forward) FlushCache(pattern string) (int, error) {
+	g := f.current()
+	if g.nxCache == nil {
+		return 0, nil
+	}
+	if pattern == "" {
+		return g.nxCache.flush(nil), nil
+	}
+	re, ok, err := compilePattern(pattern)
+	if err != nil {
+		return 0, err
+	}
+	if ok {
+		return g.nxCache.flush(func(name string) bool { return matchPattern(re, name) }), nil
+	}
+	zone := plugin.Name(normalizeHost(pattern))
+	return g.nxCache.flush(zone.Matches), nil
+}
+
+// add records ret if it's an NXDOMAIN for state.
+func (c *nxCache) add(state request.Request, ret *dns.Msg) {
+	if ret.Rcode != dns.RcodeNameError {
+		return
+	}
+	ttl := c.ttl
+	for _, rr := range ret.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			// RFC 2308 section 5, the negative TTL is the lower of the SOA's TTL and MINIMUM.
+			neg := soa.Hdr.Ttl
+			if soa.Minttl < neg {
+				neg = soa.Minttl
+			}
+			if d := time.Duration(neg) * time.Second; d < ttl {
+				ttl = d
+			}
+		}
+	}
+	if ttl <= 0 {
+		return
+	}
+	e := &nxEntry{key: nxKeyOf(state), expires: time.Now().Add(ttl), ra: ret.RecursionAvailable, ad: ret.AuthenticatedData}
+	for _, rr := range ret.Ns {
+		e.ns = append(e.ns, dns.Copy(rr))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[e.key]; ok {
+		el.Value = e
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[e.key] = c.ll.PushFront(e)
+	if c.ll.Len() > c.size {
+		old := c.ll.Back()
+		c.ll.Remove(old)
+		delete(c.items, old.Value.(*nxEntry).key)
+	}
+}
+
+// answer returns an NXDOMAIN for state if its name recently was one, or nil. The TTLs of the reply are
+// what is left of the entry's time.
+func (c *nxCache) answer(state request.Request) *dns.Msg {
+	key := nxKeyOf(state)
+	now := time.Now()
+
+	c.mu.Lock()
+	el, ok := c.items[key]
+	if !ok {
+		c.mu.Unlock()
+		return nil
+	}
+	e := el.Value.(*nxEntry)
+	if !now.Before(e.expires) {
+		c.ll.Remove(el)
+		delete(c.items, key)
+		c.mu.Unlock()
+		return nil
+	}
+	c.ll.MoveToFront(el)
+	c.mu.Unlock()
+
+	left := uint32(e.expires.Sub(now) / time.Second)
+	if left == 0 {
+		left = 1
+	}
+	m := new(dns.Msg)
+	m.SetRcode(state.Req, dns.RcodeNameError)
+	m.RecursionAvailable = e.ra
+	m.AuthenticatedData = e.ad
+	for _, rr := range e.ns {
+		rr = dns.Copy(rr)
+		if rr.Header().Ttl > left {
+			rr.Header().Ttl = left
+		}
+		m.Ns = append(m.Ns, rr)
+	}
+	setEdns0(state, m)
+	return m
+}
+
+// copyFrom adds the entries of old that haven't expired to c, most recently used first, as far as c's size
+// allows. Their expiry time is kept, but not beyond c's ttl.
+func (c *nxCache) copyFrom(old *nxCache) {
+	now := time.Now()
+	old.mu.Lock()
+	entries := make([]nxEntry, 0, old.ll.Len())
+	for el := old.ll.Front(); el != nil; el = el.Next() {
+		if e := el.Value.(*nxEntry); now.Before(e.expires) {
+			entries = append(entries, *e)
+		}
+	}
+	old.mu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := range entries {
+		if c.ll.Len() >= c.size {
+			break
+		}
+		e := &entries[i]
+		if _, ok := c.items[e.key]; ok {
+			continue
+		}
+		if max := now.Add(c.ttl); e.expires.After(max) {
+			e.expires = max
+		}
+		c.items[e.key] = c.ll.PushBack(e)
+	}
+}
+
+// nxSaved is an entry of an nxCache in its file, see save.
+type nxSaved struct {
+	Name    string    `json:"name"`
+	Class   uint16    `json:"class"`
+	DO      bool      `json:"do,omitempty"`
+	Subnet  string    `json:"subnet,omitempty"`
+	Expires time.Time `json:"expires"`
+	RA      bool      `json:"ra,omitempty"`
+	AD      bool      `json:"ad,omitempty"`
+	Ns      []string  `json:"ns"` // in presentation format
+}
+
+// save writes the entries of c that haven't expired to the file name, most recently used first, as JSON. It
+// writes a temporary file that's renamed to name, so a crash never leaves half a file.
+func (c *nxCache) save(name string) error {
+	now := time.Now()
+	c.mu.Lock()
+	saved := make([]nxSaved, 0, c.ll.Len())
+	for el := c.ll.Front(); el != nil; el = el.Next() {
+		e := el.Value.(*nxEntry)
+		if !now.Before(e.expires) {
+			continue
+		}
+		s := nxSaved{Name: e.key.name, Class: e.key.qclass, DO: e.key.do, Subnet: e.key.subnet, Expires: e.expires, RA: e.ra, AD: e.ad}
+		for _, rr := range e.ns {
+			s.Ns = append(s.Ns, rr.String())
+		}
+		saved = append(saved, s)
+	}
+	c.mu.Unlock()
+
+	b, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	tmp := name + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// load adds the entries in the file name, as written by save, to c. Entries keep their expiry time, so the
+// TTLs of the replies are what's left of the original ones, and those that expired while the file was
+// written are skipped. A file that doesn't exist is an empty cache.
+func (c *nxCache) load(name string) (int, error) {
+	b, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var saved []nxSaved
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return 0, fmt.Errorf("%s: %s", name, err)
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, s := range saved {
+		if c.ll.Len() >= c.size {
+			break
+		}
+		if !now.Before(s.Expires) {
+			continue
+		}
+		e := &nxEntry{key: nxKey{name: s.Name, qclass: s.Class, do: s.DO, subnet: s.Subnet}, expires: s.Expires, ra: s.RA, ad: s.AD}
+		for _, text := range s.Ns {
+			rr, err := dns.NewRR(text)
+			if err != nil {
+				return n, fmt.Errorf("%s: %s", name, err)
+			}
+			e.ns = append(e.ns, rr)
+		}
+		if _, ok := c.items[e.key]; ok {
+			continue
+		}
+		c.items[e.key] = c.ll.PushBack(e)
+		n++
+	}
+	return n, nil
+}
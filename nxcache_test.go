@@ -0,0 +1,182 @@
+package forward
+
+import (
+	"context"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+func TestNXCache(t *testing.T) {
+	var asked int32
+	s := newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		if r.Question[0].Name != "." {
+			atomic.AddInt32(&asked, 1)
+			ret.Rcode = dns.RcodeNameError
+			ret.Ns = append(ret.Ns, test.SOA("example.org. 3600 IN SOA ns.example.org. admin.example.org. 1 3600 600 86400 60"))
+		}
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	f, err := FromConfig(Config{From: ".", To: []string{s.Addr}, NXDomainCache: &NXDomainCacheConfig{}})
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	f.OnStartup()
+	defer f.OnShutdown()
+
+	query := func(name string, do bool) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		if do {
+			m.SetEdns0(4096, true)
+		}
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		f.ServeDNS(context.TODO(), rec, m)
+		return rec.Msg
+	}
+
+	query("nx.example.org.", false)
+	ret := query("NX.example.org.", false)
+	if n := atomic.LoadInt32(&asked); n != 1 {
+		t.Errorf("Expected the repeat NXDOMAIN to be answered from the cache, upstream was asked %d times", n)
+	}
+	if ret.Rcode != dns.RcodeNameError || len(ret.Ns) != 1 || ret.Ns[0].Header().Ttl > 5 || ret.Question[0].Name != "NX.example.org." {
+		t.Errorf("Expected an NXDOMAIN with a TTL of at most 5s, got %v", ret)
+	}
+	query("nx.example.org.", true)
+	if n := atomic.LoadInt32(&asked); n != 2 {
+		t.Errorf("Expected a query with DO to be forwarded, upstream was asked %d times", n)
+	}
+	if ret = query("nx.example.org.", true); ret.IsEdns0() == nil || !ret.IsEdns0().Do() {
+		t.Errorf("Expected an OPT record with DO in the cached reply to a DO query, got %v", ret)
+	}
+}
+
+func TestNXCacheEvict(t *testing.T) {
+	c := newNXCache(1, time.Minute)
+	state := func(name string) request.Request {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		return request.Request{W: &test.ResponseWriter{}, Req: m}
+	}
+	nx := func(name string, minttl uint32) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetRcode(state(name).Req, dns.RcodeNameError)
+		m.Ns = []dns.RR{&dns.SOA{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60}, Minttl: minttl}}
+		return m
+	}
+
+	c.add(state("a.example.org."), nx("a.example.org.", 60))
+	c.add(state("b.example.org."), nx("b.example.org.", 60))
+	if c.answer(state("a.example.org.")) != nil || c.answer(state("b.example.org.")) == nil {
+		t.Errorf("Expected the least recently used name to be evicted")
+	}
+	c.add(state("c.example.org."), nx("c.example.org.", 0))
+	if c.answer(state("c.example.org.")) != nil {
+		t.Errorf("Expected an NXDOMAIN with a negative TTL of 0 not to be remembered")
+	}
+
+}
+
+func TestFlushCache(t *testing.T) {
+	f := New()
+	f.nxCache = newNXCache(10, time.Minute)
+	add := func(name string) {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		ret := new(dns.Msg)
+		ret.SetRcode(m, dns.RcodeNameError)
+		ret.Ns = []dns.RR{&dns.SOA{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60}, Minttl: 60}}
+		f.nxCache.add(request.Request{W: &test.ResponseWriter{}, Req: m}, ret)
+	}
+	for _, name := range []string{"example.org.", "a.example.org.", "b.a.example.org.", "www.example.net."} {
+		add(name)
+	}
+
+	tests := []struct {
+		pattern string
+		flushed int
+	}{
+		{"B.a.example.org", 1},
+		{"a.example.org.", 1},
+		{"b.a.example.org.", 0},
+		{"*.example.org.", 0},
+		{"regex:net\\.$", 1},
+	}
+	for _, tc := range tests {
+		n, err := f.FlushCache(tc.pattern)
+		if err != nil || n != tc.flushed {
+			t.Errorf("%q: expected %d entries flushed, got %d, %v", tc.pattern, tc.flushed, n, err)
+		}
+	}
+	if f.nxCache.answer(request.Request{W: &test.ResponseWriter{}, Req: new(dns.Msg).SetQuestion("example.org.", dns.TypeA)}) == nil {
+		t.Errorf("Expected example.org. to be left by a.example.org.")
+	}
+	if n, _ := f.FlushCache("example.org"); n != 1 {
+		t.Errorf("Expected example.org to flush itself, got %d", n)
+	}
+	add("c.example.org.")
+	if n, _ := f.FlushCache("*.example.org"); n != 1 {
+		t.Errorf("Expected *.example.org to flush the names below it, got %d", n)
+	}
+	add("example.org.")
+	if n, _ := f.FlushCache(""); n != 1 {
+		t.Errorf("Expected the empty pattern to flush the rest, got %d", n)
+	}
+	if _, err := f.FlushCache("regex:("); err == nil {
+		t.Errorf("Expected an invalid regular expression to be an error")
+	}
+}
+
+func TestNXCacheFile(t *testing.T) {
+	state := func(name string) request.Request {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		m.SetEdns0(1232, true)
+		return request.Request{W: &test.ResponseWriter{}, Req: m}
+	}
+	c := newNXCache(10, time.Minute)
+	for _, name := range []string{"a.example.org.", "b.example.org."} {
+		ret := new(dns.Msg)
+		ret.SetRcode(state(name).Req, dns.RcodeNameError)
+		ret.RecursionAvailable = true
+		ret.Ns = []dns.RR{test.SOA("example.org. 60 IN SOA ns.example.org. admin.example.org. 1 7200 3600 1209600 60")}
+		c.add(state(name), ret)
+	}
+	// An entry that expired isn't saved.
+	c.items[nxKeyOf(state("b.example.org."))].Value.(*nxEntry).expires = time.Now()
+
+	name := filepath.Join(t.TempDir(), "nx.json")
+	if n, err := c.load(name); n != 0 || err != nil {
+		t.Fatalf("Expected a missing file to be an empty cache, got %d, %v", n, err)
+	}
+	if err := c.save(name); err != nil {
+		t.Fatal(err)
+	}
+
+	d := newNXCache(10, time.Minute)
+	if n, err := d.load(name); n != 1 || err != nil {
+		t.Fatalf("Expected 1 entry loaded, got %d, %v", n, err)
+	}
+	m := d.answer(state("a.example.org."))
+	if m == nil || m.Rcode != dns.RcodeNameError || !m.RecursionAvailable || len(m.Ns) != 1 {
+		t.Fatalf("Expected the loaded NXDOMAIN for a.example.org., got %v", m)
+	}
+	if ttl := m.Ns[0].Header().Ttl; ttl > 60 || ttl < 58 {
+		t.Errorf("Expected the TTL of the loaded entry to count down from 60, got %d", ttl)
+	}
+	if d.answer(state("b.example.org.")) != nil {
+		t.Errorf("Expected the expired entry not to be loaded")
+	}
+}
@@ -0,0 +1,35 @@
+package forward
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// regexPrefix marks a from or except name as a regular expression.
+const regexPrefix = "regex:"
+
+// compilePattern compiles s into a regular expression matching query names if s is a wildcard or a
+// regular expression. A * matches anything within a label, and like a plain name a wildcard also matches
+// the names below it. Regular expressions are opt-in with the "regex:" prefix and are matched against the
+// lowercased, fully qualified query name. ok is false if s is a plain name.
+func compilePattern(s string) (re *regexp.Regexp, ok bool, err error) {
+	if strings.HasPrefix(s, regexPrefix) {
+		re, err = regexp.Compile(strings.TrimPrefix(s, regexPrefix))
+		return re, true, err
+	}
+	if !strings.Contains(s, "*") {
+		return nil, false, nil
+	}
+
+	s = strings.ToLower(dns.Fqdn(toASCII(s)))
+	expr := strings.Replace(regexp.QuoteMeta(s), `\*`, `[^.]*`, -1)
+	re, err = regexp.Compile(`(^|\.)` + expr + `$`)
+	return re, true, err
+}
+
+// matchPattern reports if name matches re.
+func matchPattern(re *regexp.Regexp, name string) bool {
+	return re.MatchString(strings.ToLower(dns.Fqdn(name)))
+}
@@ -0,0 +1,39 @@
+package forward
+
+import "testing"
+
+func TestPattern(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		name     string
+		expected bool
+	}{
+		{"*.example.org", "a.example.org.", true},
+		{"*.example.org", "b.a.example.org.", true},
+		{"*.example.org", "example.org.", false},
+		{"*.example.org", "a.example.com.", false},
+		{"ads*.example.org", "ads1.example.org.", true},
+		{"ads*.example.org", "x.ADS.example.org.", true},
+		{"ads*.example.org", "bads.example.org.", false},
+		{"regex:^ads[0-9]+\\.", "ads12.example.org.", true},
+		{"regex:^ads[0-9]+\\.", "ads.example.org.", false},
+		{"regex:\\.example\\.(org|com)\\.$", "a.example.com.", true},
+	}
+
+	for i, tc := range tests {
+		re, ok, err := compilePattern(tc.pattern)
+		if err != nil || !ok {
+			t.Fatalf("Test %d: expected %s to compile, got %v", i, tc.pattern, err)
+		}
+		if x := matchPattern(re, tc.name); x != tc.expected {
+			t.Errorf("Test %d: expected %s matching %s to be %t, got %t", i, tc.pattern, tc.name, tc.expected, x)
+		}
+	}
+
+	if _, ok, _ := compilePattern("example.org"); ok {
+		t.Errorf("Expected a plain name not to be a pattern")
+	}
+	if _, _, err := compilePattern("regex:(a"); err == nil {
+		t.Errorf("Expected an error for an invalid regular expression")
+	}
+}
@@ -3,6 +3,7 @@ package forward
 import (
 	"crypto/tls"
 	"sort"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
@@ -10,17 +11,31 @@ import (
 
 // a persistConn hold the dns.Conn and the last used time.
 type persistConn struct {
-	c    *dns.Conn
-	used time.Time
+	c       *dns.Conn
+	used    time.Time
+	created time.Time // when c was dialed, see rotate
+	queries int       // exchanges done over c, see rotate
 }
 
-// Transport hold the persistent cache.
-type Transport struct {
+// persistentTransport is the default Transport, it speaks DNS over UDP, TCP and TLS and holds the
+// persistent connection cache.
+type persistentTransport struct {
 	avgDialTime int64                          // kind of average time of dial time
+	cached      int64                          // number of cached connections, for Stats
 	conns       [typeTotalCount][]*persistConn // Buckets for udp, tcp and tcp-tls.
-	expire      time.Duration                  // After this duration a connection is expired.
+	expire      [typeTotalCount]time.Duration  // After this duration a connection of that type is expired.
 	addr        string
+	altAddr     string // if set, dialed when dialing addr fails, see SetAlternate
 	tlsConfig   *tls.Config
+	udpPool     int    // if > 0, number of UDP sockets (source ports) to rotate over
+	dontFrag    bool   // set DF on UDP sockets, where the platform allows
+	mark        uint32 // if set, SO_MARK of the sockets, where the platform allows
+	dscp        uint8  // if set, DSCP of the packets, where the platform allows
+	prewarm     int    // number of TLS connections to keep open
+	rotate      rotate // when to replace TCP and TLS connections
+	warming     int32  // set while prewarm connections are dialed
+	refs        int32  // proxies that started the transport, see Start
+	unix        string // if set, addr is the path of a unix socket of this type, see dialUnix
 
 	dial  chan string
 	yield chan *persistConn
@@ -28,11 +43,11 @@ type Transport struct {
 	stop  chan bool
 }
 
-func newTransport(addr string) *Transport {
-	t := &Transport{
+func newTransport(addr string) *persistentTransport {
+	t := &persistentTransport{
 		avgDialTime: int64(maxDialTimeout / 2),
 		conns:       [typeTotalCount][]*persistConn{},
-		expire:      defaultExpire,
+		expire:      [typeTotalCount]time.Duration{defaultExpire, defaultExpire, defaultExpire},
 		addr:        addr,
 		dial:        make(chan string),
 		yield:       make(chan *persistConn),
@@ -43,17 +58,29 @@ func newTransport(addr string) *Transport {
 }
 
 // connManagers manages the persistent connection cache for UDP and TCP.
-func (t *Transport) connManager() {
-	ticker := time.NewTicker(t.expire)
+func (t *persistentTransport) connManager() {
+	ticker := time.NewTicker(t.minExpire())
+	var warm <-chan time.Time
+	if t.prewarm > 0 && t.tlsConfig != nil {
+		warmTicker := time.NewTicker(prewarmInterval)
+		defer warmTicker.Stop()
+		warm = warmTicker.C
+		t.warm()
+	}
 Wait:
 	for {
+		t.updateCached()
 		select {
 		case proto := <-t.dial:
 			transtype := stringToTransportType(proto)
+			if transtype == typeUdp && t.udpPool > 0 {
+				t.ret <- t.rotateUDP()
+				continue Wait
+			}
 			// take the last used conn - complexity O(1)
 			if stack := t.conns[transtype]; len(stack) > 0 {
 				pc := stack[len(stack)-1]
-				if time.Since(pc.used) < t.expire {
+				if time.Since(pc.used) < t.expire[transtype] {
 					// Found one, remove from pool and return this conn.
 					t.conns[transtype] = stack[:len(stack)-1]
 					t.ret <- pc
@@ -61,6 +88,7 @@ Wait:
 				}
 				// clear entire cache if the last conn is expired
 				t.conns[transtype] = nil
+				t.expired(transtype, len(stack))
 				// now, the connections being passed to closeConns() are not reachable from
 				// transport methods anymore. So, it's safe to close them in a separate goroutine
 				go closeConns(stack)
@@ -69,11 +97,18 @@ Wait:
 
 		case pc := <-t.yield:
 			transtype := t.transportTypeFromConn(pc)
+			if transtype == typeUdp && t.udpPool > 0 && len(t.conns[typeUdp]) >= t.udpPool {
+				go closeConns([]*persistConn{pc})
+				continue Wait
+			}
 			t.conns[transtype] = append(t.conns[transtype], pc)
 
 		case <-ticker.C:
 			t.cleanup(false)
 
+		case <-warm:
+			t.warm()
+
 		case <-t.stop:
 			t.cleanup(true)
 			close(t.ret)
@@ -82,6 +117,69 @@ Wait:
 	}
 }
 
+// rotateUDP returns the least recently used UDP connection once the cache holds udpPool of them, so
+// queries rotate over udpPool source ports. Until then it returns nil, to have a new socket dialed.
+func (t *persistentTransport) rotateUDP() *persistConn {
+	stack := t.conns[typeUdp]
+
+	// connections in stack are sorted by "used", drop the expired ones at the front
+	staleTime := time.Now().Add(-t.expire[typeUdp])
+	good := sort.Search(len(stack), func(i int) bool {
+		return stack[i].used.After(staleTime)
+	})
+	if good > 0 {
+		go closeConns(stack[:good])
+		t.expired(typeUdp, good)
+		stack = stack[good:]
+	}
+
+	if len(stack) < t.udpPool {
+		t.conns[typeUdp] = stack
+		return nil
+	}
+	t.conns[typeUdp] = stack[1:]
+	return stack[0]
+}
+
+// warm dials the TLS connections missing to have t.prewarm of them cached, it must only be called from
+// connManager. The connections are dialed in the background and yielded like any other.
+func (t *persistentTransport) warm() {
+	n := t.prewarm - len(t.conns[typeTls])
+	if n <= 0 || !atomic.CompareAndSwapInt32(&t.warming, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&t.warming, 0)
+		for i := 0; i < n; i++ {
+			pc, err := t.dialConn("tcp-tls", time.Time{})
+			if err != nil {
+				return
+			}
+			pc.used = time.Now()
+			select {
+			case t.yield <- pc:
+			case <-t.stop:
+				pc.c.Close()
+				return
+			}
+		}
+	}()
+}
+
+// updateCached publishes the number of cached connections, it must only be called from connManager.
+func (t *persistentTransport) updateCached() {
+	n := 0
+	for _, stack := range t.conns {
+		n += len(stack)
+	}
+	atomic.StoreInt64(&t.cached, int64(n))
+}
+
+// expired counts n connections of transtype closed because they expired.
+func (t *persistentTransport) expired(transtype transportType, n int) {
+	ConnExpiredCount.WithLabelValues(t.addr, transtype.String()).Add(float64(n))
+}
+
 // closeConns closes connections.
 func closeConns(conns []*persistConn) {
 	for _, pc := range conns {
@@ -90,8 +188,7 @@ func closeConns(conns []*persistConn) {
 }
 
 // cleanup removes connections from cache.
-func (t *Transport) cleanup(all bool) {
-	staleTime := time.Now().Add(-t.expire)
+func (t *persistentTransport) cleanup(all bool) {
 	for transtype, stack := range t.conns {
 		if len(stack) == 0 {
 			continue
@@ -103,6 +200,7 @@ func (t *Transport) cleanup(all bool) {
 			go closeConns(stack)
 			continue
 		}
+		staleTime := time.Now().Add(-t.expire[transtype])
 		if stack[0].used.After(staleTime) {
 			continue
 		}
@@ -112,6 +210,7 @@ func (t *Transport) cleanup(all bool) {
 			return stack[i].used.After(staleTime)
 		})
 		t.conns[transtype] = stack[good:]
+		t.expired(transportType(transtype), good)
 		// now, the connections being passed to closeConns() are not reachable from
 		// transport methods anymore. So, it's safe to close them in a separate goroutine
 		go closeConns(stack[:good])
@@ -121,9 +220,32 @@ func (t *Transport) cleanup(all bool) {
 // It is hard to pin a value to this, the import thing is to no block forever, losing at cached connection is not terrible.
 const yieldTimeout = 25 * time.Millisecond
 
+// rotate sets after how many queries, or how long, a TCP or TLS connection is replaced by a new one. Zero
+// values mean no limit.
+type rotate struct {
+	queries int
+	age     time.Duration
+}
+
+// due returns true if pc has to be rotated.
+func (r rotate) due(pc *persistConn) bool {
+	if r.queries > 0 && pc.queries >= r.queries {
+		return true
+	}
+	return r.age > 0 && time.Since(pc.created) >= r.age
+}
+
 // Yield return the connection to transport for reuse.
-func (t *Transport) Yield(pc *persistConn) {
+func (t *persistentTransport) Yield(pc *persistConn) {
 	pc.used = time.Now() // update used time
+	pc.queries++
+
+	// The exchange on pc is done, so closing it here can't break any in-flight query.
+	if transtype := t.transportTypeFromConn(pc); transtype != typeUdp && t.rotate.due(pc) {
+		ConnRotatedCount.WithLabelValues(t.addr, transtype.String()).Add(1)
+		pc.c.Close()
+		return
+	}
 
 	// Make this non-blocking, because in the case of a very busy forwarder we will *block* on this yield. This
 	// blocks the outer go-routine and stuff will just pile up.  We timeout when the send fails to as returning
@@ -136,22 +258,77 @@ func (t *Transport) Yield(pc *persistConn) {
 	}
 }
 
-// Start starts the transport's connection manager.
-func (t *Transport) Start() { go t.connManager() }
+// Start starts the transport's connection manager. A transport shared by several proxies is started by the
+// first of them.
+func (t *persistentTransport) Start() {
+	if atomic.AddInt32(&t.refs, 1) == 1 {
+		go t.connManager()
+	}
+}
 
-// Stop stops the transport's connection manager.
-func (t *Transport) Stop() { close(t.stop) }
+// Close stops the transport's connection manager and closes all cached connections. A transport shared by
+// several proxies is closed by the last of them.
+func (t *persistentTransport) Close() {
+	if atomic.AddInt32(&t.refs, -1) <= 0 {
+		close(t.stop)
+	}
+}
 
 // SetExpire sets the connection expire time in transport.
-func (t *Transport) SetExpire(expire time.Duration) { t.expire = expire }
+func (t *persistentTransport) SetExpire(expire time.Duration) {
+	for i := range t.expire {
+		t.expire[i] = expire
+	}
+}
+
+// SetProtoExpire sets the expire time of connections of transtype only.
+func (t *persistentTransport) SetProtoExpire(transtype transportType, expire time.Duration) {
+	t.expire[transtype] = expire
+}
+
+// minExpire returns the shortest expire time, cleanup runs at this interval.
+func (t *persistentTransport) minExpire() time.Duration {
+	min := t.expire[0]
+	for _, e := range t.expire[1:] {
+		if e < min {
+			min = e
+		}
+	}
+	return min
+}
+
+// SetRotate sets after how many queries, or how long, TCP and TLS connections are replaced.
+func (t *persistentTransport) SetRotate(queries int, age time.Duration) {
+	t.rotate = rotate{queries: queries, age: age}
+}
+
+// SetPrewarm sets the number of TLS connections transport keeps open.
+func (t *persistentTransport) SetPrewarm(n int) { t.prewarm = n }
+
+// SetUDPPool sets the number of UDP sockets transport rotates over, 0 means reuse the most recently used one.
+func (t *persistentTransport) SetUDPPool(n int) { t.udpPool = n }
+
+// SetAlternate sets the address dialed when dialing the upstream's own address fails.
+func (t *persistentTransport) SetAlternate(addr string) { t.altAddr = addr }
+
+// SetDontFragment sets if UDP datagrams to the upstream are sent with DF set.
+func (t *persistentTransport) SetDontFragment(df bool) { t.dontFrag = df }
+
+// SetMark sets the firewall mark of the sockets of t.
+func (t *persistentTransport) SetMark(mark uint32) { t.mark = mark }
+
+// SetDSCP sets the DSCP of the packets t sends.
+func (t *persistentTransport) SetDSCP(dscp uint8) { t.dscp = dscp }
 
 // SetTLSConfig sets the TLS config in transport.
-func (t *Transport) SetTLSConfig(cfg *tls.Config) { t.tlsConfig = cfg }
+func (t *persistentTransport) SetTLSConfig(cfg *tls.Config) { t.tlsConfig = cfg }
 
 const (
-	defaultExpire  = 10 * time.Second
-	minDialTimeout = 1 * time.Second
-	maxDialTimeout = 30 * time.Second
+	defaultExpire = 10 * time.Second
+	// prewarmInterval is how often we check if prewarmed connections need to be replaced.
+	prewarmInterval = 1 * time.Second
+	minDialTimeout  = 1 * time.Second
+	maxDialTimeout  = 30 * time.Second
 
 	// Some resolves might take quite a while, usually (cached) responses are fast. Set to 2s to give us some time to retry a different upstream.
 	readTimeout = 2 * time.Second
@@ -1,12 +1,23 @@
 package forward
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/coredns/coredns/plugin/pkg/dnstest"
 
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestCached(t *testing.T) {
@@ -19,7 +30,7 @@ func TestCached(t *testing.T) {
 
 	tr := newTransport(s.Addr)
 	tr.Start()
-	defer tr.Stop()
+	defer tr.Close()
 
 	c1, cache1, _ := tr.Dial("udp")
 	c2, cache2, _ := tr.Dial("udp")
@@ -59,7 +70,7 @@ func TestCleanupByTimer(t *testing.T) {
 	tr := newTransport(s.Addr)
 	tr.SetExpire(100 * time.Millisecond)
 	tr.Start()
-	defer tr.Stop()
+	defer tr.Close()
 
 	c1, _, _ := tr.Dial("udp")
 	c2, _, _ := tr.Dial("udp")
@@ -96,7 +107,7 @@ func TestCleanupAll(t *testing.T) {
 	c2, _ := dns.DialTimeout("udp", tr.addr, maxDialTimeout)
 	c3, _ := dns.DialTimeout("udp", tr.addr, maxDialTimeout)
 
-	tr.conns[typeUdp] = []*persistConn{{c1, time.Now()}, {c2, time.Now()}, {c3, time.Now()}}
+	tr.conns[typeUdp] = []*persistConn{{c: c1, used: time.Now()}, {c: c2, used: time.Now()}, {c: c3, used: time.Now()}}
 
 	if len(tr.conns[typeUdp]) != 3 {
 		t.Error("Expected 3 connections")
@@ -107,3 +118,294 @@ func TestCleanupAll(t *testing.T) {
 		t.Error("Expected no cached connections")
 	}
 }
+
+func TestUDPPool(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	tr := newTransport(s.Addr)
+	tr.SetUDPPool(2)
+	tr.Start()
+	defer tr.Close()
+
+	// Fill the pool, every dial is a new socket until it holds 2.
+	ports := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		c, cached, _ := tr.Dial("udp")
+		if cached {
+			t.Errorf("Expected non-cached connection (%d)", i)
+		}
+		ports[c.c.LocalAddr().String()] = true
+		tr.Yield(c)
+	}
+	if len(ports) != 2 {
+		t.Fatalf("Expected 2 distinct source ports, got %d", len(ports))
+	}
+
+	// Now we rotate over them.
+	c1, cached1, _ := tr.Dial("udp")
+	tr.Yield(c1)
+	c2, cached2, _ := tr.Dial("udp")
+	tr.Yield(c2)
+	if !cached1 || !cached2 {
+		t.Errorf("Expected cached connections")
+	}
+	if c1 == c2 {
+		t.Errorf("Expected to rotate over the pool, got the same connection twice")
+	}
+}
+
+func TestConnCacheMetrics(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	tr := newTransport(s.Addr)
+	tr.SetExpire(100 * time.Millisecond)
+	tr.Start()
+	defer tr.Close()
+
+	c1, _, _ := tr.Dial("udp")
+	tr.Yield(c1)
+	c2, _, _ := tr.Dial("udp")
+	tr.Yield(c2)
+
+	if x := testutil.ToFloat64(ConnCacheMissesCount.WithLabelValues(s.Addr, "udp")); x != 1 {
+		t.Errorf("Expected 1 miss, got %v", x)
+	}
+	if x := testutil.ToFloat64(ConnCacheHitsCount.WithLabelValues(s.Addr, "udp")); x != 1 {
+		t.Errorf("Expected 1 hit, got %v", x)
+	}
+
+	time.Sleep(120 * time.Millisecond)
+	c3, _, _ := tr.Dial("udp")
+	tr.Yield(c3)
+	if x := testutil.ToFloat64(ConnExpiredCount.WithLabelValues(s.Addr, "udp")); x != 1 {
+		t.Errorf("Expected 1 expired connection, got %v", x)
+	}
+}
+
+func TestProtoExpire(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	tr := newTransport(s.Addr)
+	tr.SetExpire(time.Minute)
+	tr.SetProtoExpire(typeUdp, 50*time.Millisecond)
+	tr.Start()
+	defer tr.Close()
+
+	c1, _, _ := tr.Dial("udp")
+	c2, _, _ := tr.Dial("tcp")
+	tr.Yield(c1)
+	tr.Yield(c2)
+
+	time.Sleep(100 * time.Millisecond)
+	c3, cached, _ := tr.Dial("udp")
+	if cached {
+		t.Error("Expected the udp connection to be expired")
+	}
+	tr.Yield(c3)
+	c4, cached, _ := tr.Dial("tcp")
+	if !cached {
+		t.Error("Expected the tcp connection to be cached")
+	}
+	tr.Yield(c4)
+}
+
+// newTLSListener returns a TLS listener with a self-signed certificate that completes the handshake of
+// every connection and counts them.
+func newTLSListener(t *testing.T, accepted *int32) net.Listener {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(accepted, 1)
+			go c.(*tls.Conn).Handshake()
+		}
+	}()
+	return l
+}
+
+func TestPrewarm(t *testing.T) {
+	var accepted int32
+	l := newTLSListener(t, &accepted)
+	defer l.Close()
+
+	tr := newTransport(l.Addr().String())
+	tr.SetTLSConfig(&tls.Config{InsecureSkipVerify: true})
+	tr.SetPrewarm(2)
+	tr.Start()
+	defer tr.Close()
+
+	for i := 0; i < 50 && atomic.LoadInt64(&tr.cached) < 2; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if x := atomic.LoadInt64(&tr.cached); x != 2 {
+		t.Fatalf("Expected 2 prewarmed connections, got %d", x)
+	}
+
+	pc, cached, err := tr.Dial("tcp")
+	if err != nil || !cached {
+		t.Fatalf("Expected a prewarmed connection, got %v", err)
+	}
+	pc.c.Close()
+
+	// The one taken is replaced.
+	for i := 0; i < 100 && atomic.LoadInt32(&accepted) < 3; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if x := atomic.LoadInt32(&accepted); x != 3 {
+		t.Errorf("Expected 3 connections, got %d", x)
+	}
+}
+
+func TestTLSSessionResumption(t *testing.T) {
+	var accepted int32
+	l := newTLSListener(t, &accepted)
+	defer l.Close()
+
+	tr := newTransport(l.Addr().String())
+	// TLS 1.2 has the session ticket in the handshake, with 1.3 it's only read along with a reply.
+	tr.SetTLSConfig(&tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12, ClientSessionCache: tls.NewLRUClientSessionCache(1)})
+
+	resumed := TLSResumptionCount.WithLabelValues(tr.addr, "true")
+	before := testutil.ToFloat64(resumed)
+	for i := 0; i < 2; i++ {
+		pc, err := tr.dialConn("tcp-tls", time.Time{})
+		if err != nil {
+			t.Fatalf("Failed to dial: %s", err)
+		}
+		pc.c.Close()
+	}
+	if x := testutil.ToFloat64(resumed); x != before+1 {
+		t.Errorf("Expected the second handshake to resume the session, %f resumed", x-before)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	tr := newTransport(s.Addr)
+	tr.SetRotate(2, 0)
+	tr.Start()
+	defer tr.Close()
+
+	c1, _, _ := tr.Dial("tcp")
+	tr.Yield(c1)
+	c2, cached, _ := tr.Dial("tcp")
+	if !cached || c1 != c2 {
+		t.Fatalf("Expected the connection to be reused once")
+	}
+	tr.Yield(c2)
+	if _, cached, _ := tr.Dial("tcp"); cached {
+		t.Errorf("Expected the connection to be rotated after 2 queries")
+	}
+
+	// UDP sockets aren't rotated.
+	u1, _, _ := tr.Dial("udp")
+	tr.Yield(u1)
+	u2, _, _ := tr.Dial("udp")
+	tr.Yield(u2)
+	if _, cached, _ := tr.Dial("udp"); !cached {
+		t.Errorf("Expected the udp socket to be cached")
+	}
+}
+
+func TestAlternate(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	// A port nothing listens on, so dialing it over TCP is refused.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := ln.Addr().String()
+	ln.Close()
+
+	tr := newTransport(down)
+	tr.Start()
+	defer tr.Close()
+
+	if _, _, err := tr.Dial("tcp"); err == nil {
+		t.Fatalf("Expected dialing %s to fail", down)
+	}
+
+	tr.SetAlternate(s.Addr)
+	pc, _, err := tr.Dial("tcp")
+	if err != nil {
+		t.Fatalf("Expected the alternate to be dialed, got %s", err)
+	}
+	_, port, _ := net.SplitHostPort(s.Addr)
+	if addr := pc.c.RemoteAddr().(*net.TCPAddr); strconv.Itoa(addr.Port) != port {
+		t.Errorf("Expected a connection to %s, got %s", s.Addr, addr)
+	}
+	if x := testutil.ToFloat64(DialFallbackCount.WithLabelValues(down)); x != 1 {
+		t.Errorf("Expected 1 dial fallback, got %v", x)
+	}
+}
+
+func TestFastFail(t *testing.T) {
+	// A port nothing listens on, the kernel answers with a port unreachable.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := pc.LocalAddr().String()
+	pc.Close()
+
+	tr := newTransport(down)
+	tr.Start()
+	defer tr.Close()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	start := time.Now()
+	_, _, err = tr.Exchange(context.Background(), m, "udp", dns.MinMsgSize)
+	if ErrorClass(classify(err)) != ErrConnRefused {
+		t.Fatalf("Expected %s, got %v", ErrConnRefused, err)
+	}
+	if d := time.Since(start); d > readTimeout/2 {
+		t.Errorf("Expected to fail before the read timeout, took %s", d)
+	}
+	if x := testutil.ToFloat64(FastFailCount.WithLabelValues(down, "port")); x != 1 {
+		t.Errorf("Expected 1 fast failure, got %v", x)
+	}
+}
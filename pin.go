@@ -0,0 +1,86 @@
+package forward
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// pinOption is the pin_option property: trusted clients can pin their query to the upstreams with a label,
+// with an EDNS0 option of code whose data is the label, KEY=VALUE.
+type pinOption struct {
+	code    uint16
+	trusted []*net.IPNet
+}
+
+// parsePinOption parses the arguments of pin_option: CODE CIDR....
+func parsePinOption(args []string) (*pinOption, error) {
+	if len(args) < 2 {
+		return nil, fmt.Errorf("pin_option needs a code and at least one trusted CIDR")
+	}
+	code, err := strconv.ParseUint(args[0], 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	if code < dns.EDNS0LOCALSTART || code > dns.EDNS0LOCALEND {
+		return nil, fmt.Errorf("pin_option code must be a local option code, %d to %d: %d", dns.EDNS0LOCALSTART, dns.EDNS0LOCALEND, code)
+	}
+	po := &pinOption{code: uint16(code)}
+	for _, arg := range args[1:] {
+		_, n, err := net.ParseCIDR(arg)
+		if err != nil {
+			return nil, err
+		}
+		po.trusted = append(po.trusted, n)
+	}
+	return po, nil
+}
+
+// pin removes the option from the query of state, it's not for the upstreams, and returns the label it
+// pins the query to. Ok is false if there is no option, the client isn't trusted or the data isn't a label.
+func (po *pinOption) pin(state request.Request) (l label, ok bool) {
+	opt := state.Req.IsEdns0()
+	if opt == nil {
+		return l, false
+	}
+	var data []byte
+	found := false
+	for i, o := range opt.Option {
+		if local, isLocal := o.(*dns.EDNS0_LOCAL); isLocal && local.Code == po.code {
+			data, found = local.Data, true
+			opt.Option = append(opt.Option[:i:i], opt.Option[i+1:]...)
+			break
+		}
+	}
+	if !found || !po.trusts(net.ParseIP(state.IP())) {
+		return l, false
+	}
+	return parseLabel(string(data))
+}
+
+func (po *pinOption) trusts(ip net.IP) bool {
+	for _, n := range po.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// pinned returns the proxies of list with label l, or list if none has it.
+func pinned(list []*Proxy, l label) ([]*Proxy, bool) {
+	ps := make([]*Proxy, 0, len(list))
+	for _, p := range list {
+		if p.HasLabel(l.key, l.value) {
+			ps = append(ps, p)
+		}
+	}
+	if len(ps) == 0 {
+		return list, false
+	}
+	return ps, true
+}
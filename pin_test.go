@@ -0,0 +1,127 @@
+package forward
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+func TestPinOption(t *testing.T) {
+	var asked [2]int32
+	var leaked int32
+	servers := make([]string, 2)
+	for i := range servers {
+		i := i
+		s := newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+			if r.Question[0].Name != "." {
+				atomic.AddInt32(&asked[i], 1)
+			}
+			if opt := r.IsEdns0(); opt != nil && len(opt.Option) > 0 {
+				atomic.AddInt32(&leaked, 1)
+			}
+			ret := new(dns.Msg)
+			ret.SetReply(r)
+			w.WriteMsg(ret)
+		})
+		defer s.Close()
+		servers[i] = s.Addr
+	}
+
+	f, err := FromConfig(Config{From: ".", To: servers, Policy: "sequential", FanoutMax: 1,
+		Labels:    []LabelConfig{{Labels: map[string]string{"group": "internal"}, To: servers[1:]}},
+		PinOption: &PinOptionConfig{Code: 65001, Trusted: []string{"10.240.0.0/24"}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	f.OnStartup()
+	defer f.OnShutdown()
+
+	// test.ResponseWriter's client is 10.240.0.1.
+	tests := []struct {
+		client string
+		pin    string
+		asked  [2]int32
+	}{
+		{"", "group=internal", [2]int32{0, 1}},
+		{"", "group=none", [2]int32{1, 0}},
+		{"", "", [2]int32{1, 0}},
+		{"192.0.2.1", "group=internal", [2]int32{1, 0}},
+	}
+	for _, tc := range tests {
+		atomic.StoreInt32(&asked[0], 0)
+		atomic.StoreInt32(&asked[1], 0)
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", dns.TypeA)
+		m.SetEdns0(4096, false)
+		if tc.pin != "" {
+			opt := m.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: 65001, Data: []byte(tc.pin)})
+		}
+		w := &test.ResponseWriter{}
+		if tc.client != "" {
+			w.RemoteIP = tc.client
+		}
+		f.ServeDNS(context.TODO(), dnstest.NewRecorder(w), m)
+		if got := [2]int32{atomic.LoadInt32(&asked[0]), atomic.LoadInt32(&asked[1])}; got != tc.asked {
+			t.Errorf("client %q pin %q: expected upstreams to be asked %v times, got %v", tc.client, tc.pin, tc.asked, got)
+		}
+	}
+	if n := atomic.LoadInt32(&leaked); n != 0 {
+		t.Errorf("Expected the pin option to be removed from the queries, %d had it", n)
+	}
+}
+
+func TestPinNXCache(t *testing.T) {
+	servers := make([]string, 2)
+	for i := range servers {
+		i := i
+		s := newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+			ret := new(dns.Msg)
+			ret.SetReply(r)
+			if i == 0 {
+				// Only the internal upstream knows the name.
+				ret.Rcode = dns.RcodeNameError
+				ret.Ns = []dns.RR{test.SOA("example.org. 60 IN SOA ns.example.org. admin.example.org. 1 7200 3600 1209600 60")}
+			}
+			w.WriteMsg(ret)
+		})
+		defer s.Close()
+		servers[i] = s.Addr
+	}
+
+	f, err := FromConfig(Config{From: ".", To: servers, Policy: "sequential", FanoutMax: 1,
+		Labels:        []LabelConfig{{Labels: map[string]string{"group": "internal"}, To: servers[1:]}},
+		PinOption:     &PinOptionConfig{Code: 65001, Trusted: []string{"10.240.0.0/24"}},
+		NXDomainCache: &NXDomainCacheConfig{},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	f.OnStartup()
+	defer f.OnShutdown()
+
+	for _, pin := range []string{"", "group=internal"} {
+		m := new(dns.Msg)
+		m.SetQuestion("internal.example.org.", dns.TypeA)
+		m.SetEdns0(4096, false)
+		if pin != "" {
+			opt := m.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: 65001, Data: []byte(pin)})
+		}
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		f.ServeDNS(context.TODO(), rec, m)
+		expected := dns.RcodeNameError
+		if pin != "" {
+			expected = dns.RcodeSuccess
+		}
+		if rec.Msg == nil || rec.Msg.Rcode != expected {
+			t.Errorf("pin %q: expected rcode %s, got %v", pin, dns.RcodeToString[expected], rec.Msg)
+		}
+	}
+}
@@ -1,7 +1,12 @@
 package forward
 
 import (
+	"fmt"
+	"hash/fnv"
 	"math/rand"
+	"sort"
+	"strings"
+	"sync"
 	"sync/atomic"
 )
 
@@ -11,6 +16,41 @@ type Policy interface {
 	String() string
 }
 
+// policies are the policies `policy` can select, by name.
+var policies = struct {
+	sync.RWMutex
+	m map[string]func() Policy
+}{m: map[string]func() Policy{
+	"random":          func() Policy { return &random{} },
+	"round_robin":     func() Policy { return &roundRobin{} },
+	"sequential":      func() Policy { return &sequential{} },
+	"rendezvous":      func() Policy { return &rendezvous{} },
+	"weighted_random": func() Policy { return &weightedRandom{} },
+}}
+
+// RegisterPolicy makes the policies of factory selectable with `policy name`. Every Forward that uses it gets
+// its own, so factory must return a new Policy each call. Like plugins, policies are registered from an init
+// function, in a package imported by the CoreDNS build; registering a name twice panics.
+func RegisterPolicy(name string, factory func() Policy) {
+	policies.Lock()
+	defer policies.Unlock()
+	if _, ok := policies.m[name]; ok {
+		panic(fmt.Sprintf("forward: policy %s registered twice", name))
+	}
+	policies.m[name] = factory
+}
+
+// newPolicy returns a new policy called name, ok is false if there's no such policy.
+func newPolicy(name string) (p Policy, ok bool) {
+	policies.RLock()
+	factory, ok := policies.m[name]
+	policies.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	return factory(), true
+}
+
 // random is a policy that implements random upstream selection.
 type random struct{}
 
@@ -36,6 +76,36 @@ func (r *random) List(p []*Proxy) []*Proxy {
 	return rnd
 }
 
+// weightedRandom is a random policy weighted by health: a proxy with n fails is picked first with a weight of
+// 1/(1+n), so upstreams that recently failed get proportionally less traffic long before they're down.
+type weightedRandom struct{}
+
+func (r *weightedRandom) String() string { return "weighted_random" }
+
+func (r *weightedRandom) List(p []*Proxy) []*Proxy {
+	if len(p) == 1 {
+		return p
+	}
+	// Weighted sampling without replacement (Efraimidis-Spirakis): sort by -ln(U)/w, an
+	// exponentially distributed key with rate w.
+	type keyed struct {
+		p   *Proxy
+		key float64
+	}
+	k := make([]keyed, len(p))
+	for i := range p {
+		w := 1 / float64(1+p[i].failCount())
+		k[i] = keyed{p[i], rand.ExpFloat64() / w}
+	}
+	sort.Slice(k, func(i, j int) bool { return k[i].key < k[j].key })
+
+	ordered := make([]*Proxy, len(p))
+	for i := range k {
+		ordered[i] = k[i].p
+	}
+	return ordered
+}
+
 // roundRobin is a policy that selects hosts based on round robin ordering.
 type roundRobin struct {
 	robin uint32
@@ -62,3 +132,62 @@ func (r *sequential) String() string { return "sequential" }
 func (r *sequential) List(p []*Proxy) []*Proxy {
 	return p
 }
+
+// leastBad returns the proxy of list with the fewest fails, the first one picked by the policy on a tie. Used
+// when every proxy is down and least_bad is set.
+func leastBad(list []*Proxy) *Proxy {
+	best := list[0]
+	fails := best.failCount()
+	for _, p := range list[1:] {
+		if x := p.failCount(); x < fails {
+			best, fails = p, x
+		}
+	}
+	return best
+}
+
+// namePolicy is a Policy that orders the proxies per query name.
+type namePolicy interface {
+	ListName(name string, p []*Proxy) []*Proxy
+}
+
+// rendezvous is a policy that orders hosts by their rendezvous (highest random weight) hash with the query
+// name, so a name is consistently sent to the same upstreams, keeping their caches warm. Only when a host
+// is added or removed the names it ranks first for move, spread over the others.
+type rendezvous struct{}
+
+func (r *rendezvous) String() string { return "rendezvous" }
+
+// List returns p as is, the order depends on the query name, see ListName.
+func (r *rendezvous) List(p []*Proxy) []*Proxy { return p }
+
+func (r *rendezvous) ListName(name string, p []*Proxy) []*Proxy {
+	type scored struct {
+		p     *Proxy
+		score uint64
+	}
+	name = strings.ToLower(name)
+	s := make([]scored, len(p))
+	for i := range p {
+		h := fnv.New64a()
+		h.Write([]byte(name))
+		h.Write([]byte{0})
+		h.Write([]byte(p[i].addr))
+		s[i] = scored{p[i], h.Sum64()}
+	}
+	sort.Slice(s, func(i, j int) bool { return s[i].score > s[j].score })
+
+	ordered := make([]*Proxy, len(p))
+	for i := range s {
+		ordered[i] = s[i].p
+	}
+	return ordered
+}
+
+// listName returns the proxies of p to use for a query for name, in the order f's policy picks them.
+func (f *Forward) listName(name string, p []*Proxy) []*Proxy {
+	if np, ok := f.p.(namePolicy); ok {
+		return np.ListName(name, p)
+	}
+	return f.p.List(p)
+}
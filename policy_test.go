@@ -0,0 +1,93 @@
+package forward
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/caddyserver/caddy"
+)
+
+func TestRendezvous(t *testing.T) {
+	r := &rendezvous{}
+	proxies := []*Proxy{NewProxy("10.0.0.1:53", "dns"), NewProxy("10.0.0.2:53", "dns"), NewProxy("10.0.0.3:53", "dns")}
+
+	first := map[*Proxy]int{}
+	for i := 0; i < 300; i++ {
+		name := fmt.Sprintf("host%d.example.org.", i)
+		list := r.ListName(name, proxies)
+		if len(list) != len(proxies) {
+			t.Fatalf("Expected %d proxies, got %d", len(proxies), len(list))
+		}
+		again := r.ListName(name, proxies)
+		for j := range list {
+			if list[j] != again[j] {
+				t.Fatalf("Expected the same order for %s every time", name)
+			}
+		}
+		first[list[0]]++
+
+		// Removing a proxy only moves the names it ranked first.
+		if list[0] != proxies[2] {
+			if x := r.ListName(name, proxies[:2])[0]; x != list[0] {
+				t.Errorf("Expected %s to stay on %s after removing another upstream, got %s", name, list[0].addr, x.addr)
+			}
+		}
+	}
+	for _, p := range proxies {
+		if first[p] < 50 {
+			t.Errorf("Expected names to be spread over the upstreams, %s is first for %d of 300", p.addr, first[p])
+		}
+	}
+}
+
+func TestWeightedRandom(t *testing.T) {
+	r := &weightedRandom{}
+	healthy, failing := NewProxy("10.0.0.1:53", "dns"), NewProxy("10.0.0.2:53", "dns")
+	failing.fails = 3 // weight 1/4
+	proxies := []*Proxy{healthy, failing}
+
+	first := 0
+	for i := 0; i < 1000; i++ {
+		list := r.List(proxies)
+		if len(list) != 2 || list[0] == list[1] {
+			t.Fatalf("Expected both proxies once, got %v", list)
+		}
+		if list[0] == healthy {
+			first++
+		}
+	}
+	// 4 to 1, so the healthy one is first 80% of the time.
+	if first < 720 || first > 880 {
+		t.Errorf("Expected the healthy proxy first about 800 of 1000 times, got %d", first)
+	}
+}
+
+type firstPolicy struct{}
+
+func (firstPolicy) String() string           { return "first" }
+func (firstPolicy) List(p []*Proxy) []*Proxy { return p }
+
+func TestRegisterPolicy(t *testing.T) {
+	RegisterPolicy("test_first", func() Policy { return firstPolicy{} })
+	t.Cleanup(func() {
+		policies.Lock()
+		delete(policies.m, "test_first")
+		policies.Unlock()
+	})
+
+	c := caddy.NewTestController("dns", "forward . 127.0.0.1 {\npolicy test_first least_bad\n}\n")
+	f, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Expected the registered policy, got %s", err)
+	}
+	if _, ok := f.p.(firstPolicy); !ok || !f.leastBad {
+		t.Errorf("Expected policy first with least_bad, got %s", f.p)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected registering a policy twice to panic")
+		}
+	}()
+	RegisterPolicy("random", func() Policy { return firstPolicy{} })
+}
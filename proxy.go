@@ -2,33 +2,66 @@ package forward
 
 import (
 	"crypto/tls"
+	"fmt"
+	"net"
 	"runtime"
 	"sync/atomic"
 	"time"
 
+	"github.com/coredns/coredns/plugin/pkg/transport"
 	"github.com/coredns/coredns/plugin/pkg/up"
 )
 
 // Proxy defines an upstream host.
 type Proxy struct {
-	fails uint32
-	addr  string
+	// 64 bit atomics first, for alignment on 32 bit platforms.
+	queries  uint64 // exchanges with this upstream
+	failures uint64 // exchanges that returned an error
+	avgRtt   int64  // kind of average round trip time, see averageTimeout
+	lastFail int64  // unix nanoseconds of the last fail, or the last decay of fails, see failCount
 
-	transport *Transport
+	fails   uint32
+	healthy uint32 // set once a health check passed or a query was answered, see Ready
+	down    uint32 // last state reported to onChange, 1 if down
+	drained uint32 // 1 while no new queries are sent to it, see Forward.SetUpstreamDraining
+	addr    string
+	trans   string
+	maxSize int    // maximum response size in bytes, 0 means no limit
+	rd      rdMode // see SetRecursionDesired
+	needRA  bool   // responses without RA are ErrNoRecursion
+	qtypes  qtypeFilter
+	hcSrc   net.IP // source address of health checks, see SetHealthCheckSource
+	mark    uint32 // see SetMark
+	dscp    uint8  // see SetDSCP
+
+	failDecay time.Duration     // if > 0, fails halve every failDecay after the last, see fail_decay
+	labels    map[string]string // see SetLabel
+
+	transport Transport
+	latency   latencies // exchange latencies per transport, see ProxyVars
 
 	// health checking
 	probe  *up.Probe
 	health HealthChecker
+
+	onChange func(p *Proxy) // called when fails changed, see Forward.OnUpstreamStateChange
 }
 
 // NewProxy returns a new proxy.
 func NewProxy(addr, trans string) *Proxy {
 	p := &Proxy{
 		addr:      addr,
+		trans:     trans,
 		fails:     0,
 		probe:     up.New(),
 		transport: newTransport(addr),
 	}
+	switch trans {
+	case transport.GRPC:
+		p.transport = newGRPCTransport(addr)
+	case transportUnix, transportUnixgram:
+		p.transport.(*persistentTransport).unix = trans
+	}
 	p.health = NewHealthChecker(trans)
 	runtime.SetFinalizer(p, (*Proxy).finalizer)
 	return p
@@ -43,6 +76,128 @@ func (p *Proxy) SetTLSConfig(cfg *tls.Config) {
 // SetExpire sets the expire duration in the lower p.transport.
 func (p *Proxy) SetExpire(expire time.Duration) { p.transport.SetExpire(expire) }
 
+// SetProtoExpire sets the expire duration of proto ("udp", "tcp" or "tcp-tls") connections only. This is
+// only supported by the default transport.
+func (p *Proxy) SetProtoExpire(proto string, expire time.Duration) {
+	if t, ok := p.transport.(*persistentTransport); ok {
+		t.SetProtoExpire(stringToTransportType(proto), expire)
+	}
+}
+
+// SetRotate sets after how many queries, or how long, TCP and TLS connections to p's upstream are replaced.
+// This is only supported by the default transport.
+func (p *Proxy) SetRotate(queries int, age time.Duration) {
+	if t, ok := p.transport.(*persistentTransport); ok {
+		t.SetRotate(queries, age)
+	}
+}
+
+// SetPrewarm sets the number of connections to a TLS upstream p keeps open at all times. This is only
+// supported by the default transport.
+func (p *Proxy) SetPrewarm(n int) {
+	if t, ok := p.transport.(*persistentTransport); ok {
+		t.SetPrewarm(n)
+	}
+}
+
+// SetUDPPool sets the number of UDP source ports p rotates over. This is only supported by the default transport.
+func (p *Proxy) SetUDPPool(n int) {
+	if t, ok := p.transport.(*persistentTransport); ok {
+		t.SetUDPPool(n)
+	}
+}
+
+// SetAlternate sets a second address of p's upstream, of the other address family. When dialing p's address
+// fails, the alternate is dialed in the same attempt, before the failure counts. This is only supported by the
+// default transport.
+func (p *Proxy) SetAlternate(addr string) {
+	if t, ok := p.transport.(*persistentTransport); ok {
+		t.SetAlternate(addr)
+	}
+}
+
+// SetDontFragment sets if p sends its UDP queries with DF set. This is only supported by the default
+// transport, and only on Linux.
+func (p *Proxy) SetDontFragment(df bool) {
+	if t, ok := p.transport.(*persistentTransport); ok {
+		t.SetDontFragment(df)
+	}
+}
+
+// SetMark sets the firewall mark, SO_MARK, of the sockets of p and its health checks, for policy routing and
+// firewall rules. Only the default transport and plain DNS and DoT health checks support this, and only on
+// Linux.
+func (p *Proxy) SetMark(mark uint32) {
+	p.mark = mark
+	if t, ok := p.transport.(*persistentTransport); ok {
+		t.SetMark(mark)
+	}
+	if h, ok := p.health.(*dnsHc); ok {
+		h.mark = mark
+		h.setDialer()
+	}
+}
+
+// SetDSCP sets the DSCP of the packets to the upstream of p and its health checks, for networks that
+// prioritize traffic by it. Like SetMark, only the default transport and plain DNS and DoT health checks
+// support this, and only on Linux.
+func (p *Proxy) SetDSCP(dscp uint8) {
+	p.dscp = dscp
+	if t, ok := p.transport.(*persistentTransport); ok {
+		t.SetDSCP(dscp)
+	}
+	if h, ok := p.health.(*dnsHc); ok {
+		h.dscp = dscp
+		h.setDialer()
+	}
+}
+
+// SetTransport replaces the transport p uses to talk to its upstream. It must be called before the proxy is
+// started.
+func (p *Proxy) SetTransport(t Transport) {
+	p.transport.Close()
+	p.transport = t
+}
+
+// Addr returns the address of p, host:port or the path of a unix socket.
+func (p *Proxy) Addr() string { return p.addr }
+
+// SetMaxResponseSize sets the maximum size of a response accepted from p, 0 disables the check.
+func (p *Proxy) SetMaxResponseSize(size int) { p.maxSize = size }
+
+// rdMode is what is done with RD in queries to an upstream.
+type rdMode int
+
+const (
+	rdClient rdMode = iota // keep the client's RD
+	rdSet
+	rdClear
+)
+
+// SetRecursionDesired sets RD in all queries to p, or clears it.
+func (p *Proxy) SetRecursionDesired(rd bool) {
+	p.rd = rdClear
+	if rd {
+		p.rd = rdSet
+	}
+}
+
+// SetHealthCheckSource makes the health checks of p use the source address ip, so they can take another
+// path than the queries, e.g. through a management network. Only plain DNS and DoT upstreams support this.
+func (p *Proxy) SetHealthCheckSource(ip net.IP) error {
+	h, ok := p.health.(*dnsHc)
+	if !ok {
+		return fmt.Errorf("health checks of %s can't have a source address", p.addr)
+	}
+	p.hcSrc = ip
+	h.source = ip
+	h.setDialer()
+	return nil
+}
+
+// SetRequireRA makes responses of p without RA fail with ErrNoRecursion.
+func (p *Proxy) SetRequireRA(require bool) { p.needRA = require }
+
 // Healthcheck kicks of a round of health checks for this proxy.
 func (p *Proxy) Healthcheck() {
 	if p.health == nil {
@@ -61,13 +216,54 @@ func (p *Proxy) Down(maxfails uint32) bool {
 		return false
 	}
 
+	return p.failCount() > maxfails
+}
+
+// SetFailDecay makes p's fails halve every d after the last fail, with 0 they're only reset by a passed
+// health check.
+func (p *Proxy) SetFailDecay(d time.Duration) { p.failDecay = d }
+
+// fail counts a failed health check.
+func (p *Proxy) fail() {
+	atomic.AddUint32(&p.fails, 1)
+	atomic.StoreInt64(&p.lastFail, time.Now().UnixNano())
+}
+
+// failCount returns p's fails, after decaying them for the half-lives passed since the last fail. A
+// decay can bring p back up without a health check, so it's reported as a state change.
+func (p *Proxy) failCount() uint32 {
 	fails := atomic.LoadUint32(&p.fails)
-	return fails > maxfails
+	if p.failDecay <= 0 || fails == 0 {
+		return fails
+	}
+	last := atomic.LoadInt64(&p.lastFail)
+	halvings := time.Duration(time.Now().UnixNano()-last) / p.failDecay
+	if halvings <= 0 {
+		return fails
+	}
+	decayed := uint32(0)
+	if halvings < 32 {
+		decayed = fails >> uint(halvings)
+	}
+	// The remainder of a half-life carries over to the next decay. Whoever moves lastFail decays fails,
+	// unless a new fail came in meanwhile.
+	if atomic.CompareAndSwapInt64(&p.lastFail, last, last+int64(halvings*p.failDecay)) &&
+		atomic.CompareAndSwapUint32(&p.fails, fails, decayed) {
+		p.stateChanged()
+	}
+	return decayed
+}
+
+// stateChanged is called after p's fails changed.
+func (p *Proxy) stateChanged() {
+	if p.onChange != nil {
+		p.onChange(p)
+	}
 }
 
 // close stops the health checking goroutine.
 func (p *Proxy) stop()      { p.probe.Stop() }
-func (p *Proxy) finalizer() { p.transport.Stop() }
+func (p *Proxy) finalizer() { p.transport.Close() }
 
 // start starts the proxy's healthchecking.
 func (p *Proxy) start(duration time.Duration) {
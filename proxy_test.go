@@ -2,7 +2,12 @@ package forward
 
 import (
 	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/coredns/coredns/plugin/pkg/dnstest"
 	"github.com/coredns/coredns/plugin/pkg/transport"
@@ -114,10 +119,358 @@ func TestProtocolSelection(t *testing.T) {
 	}()
 
 	for i, exp := range []string{"udp", "tcp", "udp", "tcp", "tcp", "tcp", "udp", "tcp"} {
-		proto := <-p.transport.dial
-		p.transport.ret <- nil
+		proto := <-p.transport.(*persistentTransport).dial
+		p.transport.(*persistentTransport).ret <- nil
 		if proto != exp {
 			t.Errorf("Unexpected protocol in case %d, expected %q, actual %q", i, exp, proto)
 		}
 	}
 }
+
+func TestProxyMaxResponseSize(t *testing.T) {
+	s := newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		n := 1
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			n = 50 // too large, but only over UDP
+		}
+		for i := 0; i < n; i++ {
+			ret.Answer = append(ret.Answer, test.A(fmt.Sprintf("example.org. IN A 127.0.0.%d", i+1)))
+		}
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	f := New()
+	p := NewProxy(s.Addr, transport.DNS)
+	p.SetMaxResponseSize(dns.MinMsgSize)
+	f.SetProxy(p)
+	defer f.OnShutdown()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	req.SetEdns0(4096, false)
+	state := request.Request{W: &test.ResponseWriter{}, Req: req}
+
+	if _, err := p.Connect(context.TODO(), state, options{}); err != errOversizeUDP {
+		t.Errorf("Expected %s, got %v", errOversizeUDP, err)
+	}
+
+	// ServeDNS retries over TCP.
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := f.ServeDNS(context.TODO(), rec, req); err != nil {
+		t.Fatalf("Expected to receive reply, but got: %s", err)
+	}
+	if len(rec.Msg.Answer) != 1 {
+		t.Errorf("Expected the TCP answer with 1 record, got %d", len(rec.Msg.Answer))
+	}
+
+	// Unless same_transport is set.
+	f.opts.sameTransport = true
+	if _, err := f.ServeDNS(context.TODO(), rec, req); err != ErrOversize {
+		t.Errorf("Expected %s with same_transport, got %v", ErrOversize, err)
+	}
+
+	p.SetMaxResponseSize(dns.MinMsgSize / 16)
+	if _, err := p.Connect(context.TODO(), state, options{forceTCP: true}); err != ErrOversize {
+		t.Errorf("Expected %s, got %v", ErrOversize, err)
+	}
+}
+
+func TestProxyRecursionFlags(t *testing.T) {
+	var (
+		mu sync.Mutex
+		rd bool
+	)
+	// askedRD returns the RD bit of the last query for recursive.example.
+	askedRD := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return rd
+	}
+	s := newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		if r.Question[0].Name == "recursive.example." { // not a health check
+			mu.Lock()
+			rd = r.RecursionDesired
+			mu.Unlock()
+		}
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.RecursionAvailable = r.Question[0].Name == "recursive.example."
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	c := caddy.NewTestController("dns", "forward . "+s.Addr+" {\nrequire_ra\nrecursion_desired on\n}\n")
+	f, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	f.OnStartup()
+	defer f.OnShutdown()
+	p := f.proxies[0]
+
+	req := new(dns.Msg)
+	req.SetQuestion("recursive.example.", dns.TypeA)
+	req.RecursionDesired = false
+	state := request.Request{W: &test.ResponseWriter{}, Req: req}
+	ret, err := p.Connect(context.TODO(), state, options{})
+	if err != nil {
+		t.Fatalf("Expected a reply, got %s", err)
+	}
+	if rd := askedRD(); !rd || ret.RecursionDesired {
+		t.Errorf("Expected RD set upstream and the client's RD in the reply, got %t and %t", rd, ret.RecursionDesired)
+	}
+
+	req.SetQuestion("authoritative.example.", dns.TypeA)
+	if _, err := p.Connect(context.TODO(), state, options{}); err != ErrNoRecursion {
+		t.Errorf("Expected %s without RA, got %v", ErrNoRecursion, err)
+	}
+
+	p.SetRecursionDesired(false)
+	req.SetQuestion("recursive.example.", dns.TypeA)
+	req.RecursionDesired = true
+	if _, err := p.Connect(context.TODO(), state, options{}); err != nil || askedRD() {
+		t.Errorf("Expected a reply without RD upstream, got %v and RD %t", err, askedRD())
+	}
+}
+
+func TestProxyContextCancel(t *testing.T) {
+	s := newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		// never answer
+	})
+	defer s.Close()
+
+	p := NewProxy(s.Addr, transport.DNS)
+	p.start(hcInterval)
+	defer p.stop()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	state := request.Request{W: &test.ResponseWriter{}, Req: req}
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := p.Connect(ctx, state, options{}); err != context.DeadlineExceeded {
+		t.Errorf("Expected %s, got %v", context.DeadlineExceeded, err)
+	}
+	// The read deadline may expire a moment before ctx does, that's still ctx's expiry.
+	if err := ctxErr(context.TODO(), time.Now()); err != context.DeadlineExceeded {
+		t.Errorf("Expected %s at the deadline, got %v", context.DeadlineExceeded, err)
+	}
+	if d := time.Since(start); d >= readTimeout {
+		t.Errorf("Expected Connect to return when the context expired, took %s", d)
+	}
+
+	ctx, cancel = context.WithCancel(context.TODO())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := p.Connect(ctx, state, options{}); err != context.Canceled {
+		t.Errorf("Expected %s, got %v", context.Canceled, err)
+	}
+
+	// The UDP socket went back into the cache.
+	if _, cached, _ := p.transport.(*persistentTransport).Dial("udp"); !cached {
+		t.Errorf("Expected cached connection after cancellation")
+	}
+}
+
+func TestProxyRandomID(t *testing.T) {
+	ids := make(chan uint16, 2)
+	s := newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ids <- r.Id
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	p := NewProxy(s.Addr, transport.DNS)
+	p.start(hcInterval)
+	defer p.stop()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	state := request.Request{W: &test.ResponseWriter{}, Req: req}
+
+	same := 0
+	for i := 0; i < 2; i++ {
+		ret, err := p.Connect(context.TODO(), state, options{})
+		if err != nil {
+			t.Fatalf("Expected to receive reply, but got: %s", err)
+		}
+		if ret.Id != req.Id {
+			t.Errorf("Expected reply to carry the client's ID %d, got %d", req.Id, ret.Id)
+		}
+		if <-ids == req.Id {
+			same++
+		}
+	}
+	if same == 2 {
+		t.Errorf("Expected the upstream to see a random ID, got the client's ID twice")
+	}
+}
+
+// fakeTransport is a Transport that hands every message to exchange.
+type fakeTransport struct {
+	exchange func(m *dns.Msg, proto string) (*dns.Msg, error)
+	start    func() // called by Start, if set
+}
+
+func (t *fakeTransport) Exchange(ctx context.Context, m *dns.Msg, proto string, udpSize uint16) (*dns.Msg, ExchangeInfo, error) {
+	ret, err := t.exchange(m, proto)
+	if err != nil {
+		return nil, ExchangeInfo{Proto: proto}, err
+	}
+	return ret, ExchangeInfo{Size: ret.Len(), Proto: proto}, nil
+}
+
+func (t *fakeTransport) Start() {
+	if t.start != nil {
+		t.start()
+	}
+}
+
+func (t *fakeTransport) Close()                         {}
+func (t *fakeTransport) SetTLSConfig(cfg *tls.Config)   {}
+func (t *fakeTransport) SetExpire(expire time.Duration) {}
+
+func TestProxyTransport(t *testing.T) {
+	p := NewProxy("fake", transport.DNS)
+	p.SetTransport(&fakeTransport{exchange: func(m *dns.Msg, proto string) (*dns.Msg, error) {
+		ret := new(dns.Msg)
+		ret.SetReply(m)
+		ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"))
+		return ret, nil
+	}})
+
+	f := New()
+	f.SetProxy(p)
+	defer f.OnShutdown()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := f.ServeDNS(context.TODO(), rec, m); err != nil {
+		t.Fatalf("Expected to receive reply, but got: %s", err)
+	}
+	if len(rec.Msg.Answer) != 1 || rec.Msg.Id != m.Id {
+		t.Errorf("Expected the fake transport's answer with the client's ID, got %v", rec.Msg)
+	}
+}
+
+func TestConnectRetryCap(t *testing.T) {
+	tries := 0
+	p := NewProxy("fake", transport.DNS)
+	p.SetTransport(&fakeTransport{exchange: func(m *dns.Msg, proto string) (*dns.Msg, error) {
+		tries++
+		return nil, ErrCachedClosed
+	}})
+
+	f := New()
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	state := request.Request{W: &test.ResponseWriter{}, Req: req}
+
+	if _, _, err := f.connect(context.TODO(), p, state); err != ErrRetryCap {
+		t.Errorf("Expected %s, got %v", ErrRetryCap, err)
+	}
+	if tries != maxConnectRetries+1 {
+		t.Errorf("Expected %d tries, got %d", maxConnectRetries+1, tries)
+	}
+}
+
+func TestProxyConnectInfo(t *testing.T) {
+	s := newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	p := NewProxy(s.Addr, transport.DNS)
+	p.start(hcInterval)
+	defer p.stop()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	state := request.Request{W: &test.ResponseWriter{}, Req: req}
+
+	for i, reused := range []bool{false, true} {
+		_, info, err := p.ConnectInfo(context.TODO(), state, options{})
+		if err != nil {
+			t.Fatalf("Test %d: expected no error, got: %s", i, err)
+		}
+		if info.Reused != reused {
+			t.Errorf("Test %d: expected reused to be %t", i, reused)
+		}
+		if info.Proto != "udp" || info.Size != req.Len() || info.RTT <= 0 {
+			t.Errorf("Test %d: unexpected exchange info %+v", i, info)
+		}
+	}
+}
+
+func TestConnectRetries(t *testing.T) {
+	p := NewProxy("fake", transport.DNS)
+	p.SetTransport(&fakeTransport{exchange: func(m *dns.Msg, proto string) (*dns.Msg, error) {
+		ret := new(dns.Msg)
+		ret.SetReply(m)
+		ret.Truncated = proto == "udp"
+		return ret, nil
+	}})
+
+	f := New()
+	f.opts.preferUDP = true
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	state := request.Request{W: &test.ResponseWriter{}, Req: req}
+
+	_, info, err := f.connect(context.TODO(), p, state)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if info.Retries != 1 || info.Proto != "tcp" {
+		t.Errorf("Expected 1 retry over tcp, got %+v", info)
+	}
+}
+
+func TestProxyFailDecay(t *testing.T) {
+	p := NewProxy("10.0.0.1:53", transport.DNS)
+	p.SetFailDecay(time.Minute)
+	for i := 0; i < 8; i++ {
+		p.fail()
+	}
+	if n := p.failCount(); n != 8 {
+		t.Fatalf("Expected 8 fails right after failing, got %d", n)
+	}
+
+	changes := 0
+	p.onChange = func(*Proxy) { changes++ }
+	// Two and a half half-lives ago.
+	p.lastFail = time.Now().Add(-150 * time.Second).UnixNano()
+	if n := p.Stats().Fails; n != 2 {
+		t.Errorf("Expected 8 fails to decay to 2, got %d", n)
+	}
+	if changes != 1 {
+		t.Errorf("Expected the decay to be reported once, got %d", changes)
+	}
+	// The half half-life left carries over.
+	p.lastFail -= int64(30 * time.Second)
+	if n := p.failCount(); n != 1 {
+		t.Errorf("Expected 2 fails to decay to 1, got %d", n)
+	}
+	if p.Down(1) {
+		t.Errorf("Expected 1 fail not to be down with max_fails 1")
+	}
+
+	p.SetFailDecay(0)
+	p.lastFail = 0
+	if n := p.failCount(); n != 1 {
+		t.Errorf("Expected fails not to decay without fail_decay, got %d", n)
+	}
+}
@@ -0,0 +1,102 @@
+package forward
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// qtypeFilter restricts the query types sent to an upstream, see qtype_allow and qtype_deny. The zero
+// value lets every type through.
+type qtypeFilter struct {
+	allow bool // if set, only types are sent, else all but them
+	types map[uint16]bool
+}
+
+func (q qtypeFilter) accepts(qtype uint16) bool {
+	if q.types == nil {
+		return true
+	}
+	return q.types[qtype] == q.allow
+}
+
+func (q qtypeFilter) String() string {
+	if q.types == nil {
+		return ""
+	}
+	names := make([]string, 0, len(q.types))
+	for t := range q.types {
+		names = append(names, dns.Type(t).String())
+	}
+	sort.Strings(names)
+	verb := "deny"
+	if q.allow {
+		verb = "allow"
+	}
+	return verb + " " + strings.Join(names, ",")
+}
+
+// SetQtypes restricts the query types p is asked: with allow only qtypes, else all but qtypes. It adds to
+// the qtypes of an earlier call of the same kind.
+func (p *Proxy) SetQtypes(allow bool, qtypes ...uint16) error {
+	if p.qtypes.types != nil && p.qtypes.allow != allow {
+		return fmt.Errorf("upstream %s has both qtype_allow and qtype_deny", p.addr)
+	}
+	if p.qtypes.types == nil {
+		p.qtypes = qtypeFilter{allow: allow, types: make(map[uint16]bool)}
+	}
+	for _, t := range qtypes {
+		p.qtypes.types[t] = true
+	}
+	return nil
+}
+
+// parseQtypes splits the arguments of qtype_allow or qtype_deny, TYPE... [TO...], into the types and the
+// upstreams.
+func parseQtypes(args []string) ([]uint16, []string, error) {
+	var qtypes []uint16
+	for len(args) > 0 {
+		t, ok := dns.StringToType[strings.ToUpper(args[0])]
+		if !ok {
+			break
+		}
+		qtypes = append(qtypes, t)
+		args = args[1:]
+	}
+	if len(qtypes) == 0 {
+		return nil, nil, fmt.Errorf("qtype_allow and qtype_deny need at least one query type")
+	}
+	return qtypes, args, nil
+}
+
+// acceptQtype returns the proxies of list that may be asked for qtype.
+func acceptQtype(list []*Proxy, qtype uint16) []*Proxy {
+	for i, p := range list {
+		if p.qtypes.accepts(qtype) {
+			continue
+		}
+		// Seldom needed, only copy list when it is.
+		accepted := append(make([]*Proxy, 0, len(list)-1), list[:i]...)
+		for _, p := range list[i+1:] {
+			if p.qtypes.accepts(qtype) {
+				accepted = append(accepted, p)
+			}
+		}
+		return accepted
+	}
+	return list
+}
+
+// filteredReply returns the REFUSED for a query no upstream may be asked, with an Extended DNS Error saying
+// it's filtered for EDNS clients.
+func filteredReply(state request.Request) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetRcode(state.Req, dns.RcodeRefused)
+	setEdns0(state, m)
+	addEDE(m, edeFiltered, "query type not forwarded")
+	return m
+}
@@ -0,0 +1,68 @@
+package forward
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+func TestQtypes(t *testing.T) {
+	var asked [2]int32
+	servers := make([]string, 2)
+	for i := range servers {
+		i := i
+		s := newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+			if r.Question[0].Name != "." {
+				atomic.AddInt32(&asked[i], 1)
+			}
+			ret := new(dns.Msg)
+			ret.SetReply(r)
+			w.WriteMsg(ret)
+		})
+		defer s.Close()
+		servers[i] = s.Addr
+	}
+
+	f, err := FromConfig(Config{From: ".", To: servers,
+		QtypeDeny:  []QtypesConfig{{Types: []string{"ANY", "axfr"}, To: servers[:1]}},
+		QtypeAllow: []QtypesConfig{{Types: []string{"PTR"}, To: servers[1:]}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	f.OnStartup()
+	defer f.OnShutdown()
+
+	tests := []struct {
+		qtype uint16
+		asked [2]int32
+		rcode int
+	}{
+		{dns.TypeA, [2]int32{1, 0}, dns.RcodeSuccess},
+		{dns.TypePTR, [2]int32{1, 1}, dns.RcodeSuccess},
+		{dns.TypeANY, [2]int32{0, 0}, dns.RcodeRefused},
+	}
+	for _, tc := range tests {
+		atomic.StoreInt32(&asked[0], 0)
+		atomic.StoreInt32(&asked[1], 0)
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", tc.qtype)
+		m.SetEdns0(4096, false)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		f.ServeDNS(context.TODO(), rec, m)
+		if got := [2]int32{atomic.LoadInt32(&asked[0]), atomic.LoadInt32(&asked[1])}; got != tc.asked {
+			t.Errorf("%s: expected upstreams to be asked %v times, got %v", dns.TypeToString[tc.qtype], tc.asked, got)
+		}
+		if rec.Msg == nil || rec.Msg.Rcode != tc.rcode {
+			t.Errorf("%s: expected rcode %d, got %v", dns.TypeToString[tc.qtype], tc.rcode, rec.Msg)
+		}
+	}
+	if _, err := FromConfig(Config{From: ".", To: servers, QtypeDeny: []QtypesConfig{{Types: []string{"ANY"}}}, QtypeAllow: []QtypesConfig{{Types: []string{"A"}}}}); err == nil {
+		t.Errorf("Expected an error for an upstream with both qtype_allow and qtype_deny")
+	}
+}
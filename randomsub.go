@@ -0,0 +1,135 @@
+package forward
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultRandomSubWindow = 10 * time.Second
+	defaultRandomSubHold   = time.Minute
+
+	// randomLabelLen and randomLabelEntropy make a label look random: at least this long, and at least this
+	// many bits of Shannon entropy per character. Most host names are below, the labels of random subdomain
+	// floods, 8 or more random letters and digits, above. Words of 8 distinct letters, e.g. "platform",
+	// reach the entropy too, so a label without digits must be at least randomLabelLetters long.
+	randomLabelLen     = 8
+	randomLabelLetters = 16
+	randomLabelEntropy = 3.0
+
+	maxRandomSubZones = 10000 // zones tracked before expired ones are swept
+)
+
+// randomSub detects pseudo-random subdomain floods, the queries for random names under a single zone that
+// wear out its name servers and the resolvers on the way: when more than threshold queries with a random
+// looking first label get NXDOMAIN under the same zone within window, queries with such labels under that
+// zone are answered NXDOMAIN for hold, without being forwarded.
+type randomSub struct {
+	threshold int
+	window    time.Duration
+	hold      time.Duration
+
+	mu    sync.Mutex
+	zones map[string]*randomSubZone
+}
+
+type randomSubZone struct {
+	start time.Time // of the current window
+	count int       // NXDOMAINs for random labels in it
+	until time.Time // end of the hold, if the zone is held
+}
+
+func newRandomSub(threshold int, window, hold time.Duration) *randomSub {
+	return &randomSub{threshold: threshold, window: window, hold: hold, zones: make(map[string]*randomSubZone)}
+}
+
+// randomLabel splits name into its first label and the zone it's in, and reports whether that label looks
+// random.
+func randomLabel(name string) (zone string, random bool) {
+	labels := dns.SplitDomainName(strings.ToLower(name))
+	if len(labels) < 2 {
+		return "", false
+	}
+	zone = dns.Fqdn(strings.Join(labels[1:], "."))
+	label := labels[0]
+	if len(label) < randomLabelLen {
+		return zone, false
+	}
+	var freq [256]int
+	digits := false
+	for i := 0; i < len(label); i++ {
+		freq[label[i]]++
+		digits = digits || label[i] >= '0' && label[i] <= '9'
+	}
+	if !digits && len(label) < randomLabelLetters {
+		return zone, false
+	}
+	entropy := 0.0
+	for _, n := range freq {
+		if n > 0 {
+			p := float64(n) / float64(len(label))
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return zone, entropy >= randomLabelEntropy
+}
+
+// held returns the zone if name is a random looking name in a zone that is held, else "".
+func (r *randomSub) held(name string) string {
+	zone, random := randomLabel(name)
+	if !random {
+		return ""
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if z, ok := r.zones[zone]; ok && time.Now().Before(z.until) {
+		return zone
+	}
+	return ""
+}
+
+// observe counts the reply with rcode to a query for name, and returns true if its zone is held because
+// of it.
+func (r *randomSub) observe(name string, rcode int) bool {
+	if rcode != dns.RcodeNameError {
+		return false
+	}
+	zone, random := randomLabel(name)
+	if !random {
+		return false
+	}
+	now := time.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	z, ok := r.zones[zone]
+	if !ok {
+		if len(r.zones) >= maxRandomSubZones {
+			r.sweep(now)
+		}
+		z = &randomSubZone{start: now}
+		r.zones[zone] = z
+	}
+	if now.Sub(z.start) > r.window {
+		z.start, z.count = now, 0
+	}
+	z.count++
+	if z.count <= r.threshold || now.Before(z.until) {
+		return false
+	}
+	z.until = now.Add(r.hold)
+	return true
+}
+
+// sweep forgets the zones whose window and hold are over.
+func (r *randomSub) sweep(now time.Time) {
+	for zone, z := range r.zones {
+		if now.Sub(z.start) > r.window && !now.Before(z.until) {
+			delete(r.zones, zone)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package forward
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestRandomLabel(t *testing.T) {
+	tests := []struct {
+		name   string
+		zone   string
+		random bool
+	}{
+		{"x8fk2q9zl1.example.org.", "example.org.", true},
+		{"X8FK2Q9ZL1.Example.org.", "example.org.", true},
+		{"www.example.org.", "example.org.", false},
+		{"facebook.example.org.", "example.org.", false},
+		{"platform.example.org.", "example.org.", false},
+		{"mailhost.example.org.", "example.org.", false},
+		{"computer.example.org.", "example.org.", false},
+		{"qwfpgjluyzxkvbmc.example.org.", "example.org.", true},
+		{"aaaaaaaaaaaa.example.org.", "example.org.", false},
+		{"org.", "", false},
+	}
+	for _, tc := range tests {
+		zone, random := randomLabel(tc.name)
+		if zone != tc.zone || random != tc.random {
+			t.Errorf("%s: expected %q, %t, got %q, %t", tc.name, tc.zone, tc.random, zone, random)
+		}
+	}
+}
+
+func TestRandomSub(t *testing.T) {
+	r := newRandomSub(2, time.Minute, time.Minute)
+	for i, name := range []string{"q8zk1x0pd3.example.org.", "m2v9c7ty4w.example.org."} {
+		if r.observe(name, dns.RcodeNameError) {
+			t.Errorf("Expected no flood after %d NXDOMAINs", i+1)
+		}
+	}
+	if r.observe("www.example.org.", dns.RcodeNameError) || r.observe("r5n1b8gk0s.example.org.", dns.RcodeSuccess) {
+		t.Errorf("Expected only NXDOMAINs for random names to count")
+	}
+	if !r.observe("h3j6l9zq2e.example.org.", dns.RcodeNameError) {
+		t.Errorf("Expected a flood after more than 2 NXDOMAINs")
+	}
+	if zone := r.held("f7d2s4a1k9.example.org."); zone != "example.org." {
+		t.Errorf("Expected random names under example.org. to be held, got %q", zone)
+	}
+	if r.held("www.example.org.") != "" || r.held("f7d2s4a1k9.example.net.") != "" {
+		t.Errorf("Expected other names and zones not to be held")
+	}
+}
@@ -0,0 +1,36 @@
+package forward
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// remapRcode translates the rcode of an upstream's reply with rcode_map, after merging, so clients that
+// mishandle some rcodes get one they understand.
+func (f *Forward) remapRcode(ret *dns.Msg) {
+	to, ok := f.rcodeMap[ret.Rcode]
+	if !ok {
+		return
+	}
+	RcodeRemapCount.WithLabelValues(rcodeString(ret.Rcode), rcodeString(to)).Add(1)
+	ret.Rcode = to
+}
+
+// parseRcode parses an rcode name, e.g. NXDOMAIN, case insensitively.
+func parseRcode(s string) (int, error) {
+	rcode, ok := dns.StringToRcode[strings.ToUpper(s)]
+	if !ok {
+		return 0, fmt.Errorf("unknown rcode: %s", s)
+	}
+	return rcode, nil
+}
+
+func rcodeString(rcode int) string {
+	if rc, ok := dns.RcodeToString[rcode]; ok {
+		return rc
+	}
+	return strconv.Itoa(rcode)
+}
@@ -0,0 +1,52 @@
+package forward
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/caddyserver/caddy"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRcodeMap(t *testing.T) {
+	s := newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetRcode(r, dns.RcodeRefused)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	c := caddy.NewTestController("dns", "forward . "+s.Addr+" {\nrcode_map refused NXDOMAIN\n}\n")
+	f, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	f.OnStartup()
+	defer f.OnShutdown()
+
+	before := testutil.ToFloat64(RcodeRemapCount.WithLabelValues("REFUSED", "NXDOMAIN"))
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := f.ServeDNS(context.TODO(), rec, m); err != nil {
+		t.Fatalf("Expected to receive reply, but got: %s", err)
+	}
+	if rec.Msg.Rcode != dns.RcodeNameError {
+		t.Errorf("Expected REFUSED to be answered as NXDOMAIN, got %s", dns.RcodeToString[rec.Msg.Rcode])
+	}
+	if x := testutil.ToFloat64(RcodeRemapCount.WithLabelValues("REFUSED", "NXDOMAIN")); x != before+1 {
+		t.Errorf("Expected 1 translation to be counted, got %f", x-before)
+	}
+
+	for _, input := range []string{"rcode_map REFUSED", "rcode_map REFUSED BOGUS", "rcode_map BOGUS NXDOMAIN"} {
+		_, err := parseForward(caddy.NewTestController("dns", "forward . 127.0.0.1 {\n"+input+"\n}\n"))
+		if err == nil || !(strings.Contains(err.Error(), "unknown rcode") || strings.Contains(err.Error(), "Wrong argument count")) {
+			t.Errorf("Expected %q to be rejected, got %v", input, err)
+		}
+	}
+}
@@ -0,0 +1,18 @@
+package forward
+
+import "sync/atomic"
+
+// Ready implements the ready.Readiness interface. Forward is ready once one of its upstreams passed a
+// health check or answered a query, so we don't get traffic we can only SERVFAIL right after startup. It's
+// not ready while draining.
+func (f *Forward) Ready() bool {
+	if f.Draining() {
+		return false
+	}
+	for _, p := range f.current().proxies {
+		if atomic.LoadUint32(&p.healthy) == 1 {
+			return true
+		}
+	}
+	return false
+}
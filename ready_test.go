@@ -0,0 +1,37 @@
+package forward
+
+import (
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy"
+	"github.com/miekg/dns"
+)
+
+func TestReady(t *testing.T) {
+	s := newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	c := caddy.NewTestController("dns", "forward . "+s.Addr)
+	f, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	if f.Ready() {
+		t.Fatalf("Expected not to be ready before startup")
+	}
+	f.OnStartup()
+	defer f.OnShutdown()
+
+	for i := 0; i < 50; i++ {
+		if f.Ready() {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Errorf("Expected to be ready after the startup health check")
+}
@@ -0,0 +1,133 @@
+package forward
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Reload replaces the upstreams, policies and options of f by those of c, without dropping queries. The
+// Forward for c is set up and started first, then swapped in with a single pointer store: new queries use
+// it, while the ones already in flight finish on the old generation, which is stopped once they're done or
+// after drainTimeout. If c is invalid or doesn't start f is left as it is. Reload must only be called on a
+// started Forward.
+func (f *Forward) Reload(c Config) error {
+	g, err := FromConfig(c)
+	if err != nil {
+		return err
+	}
+	g.Next = f.Next
+	f.hooksMu.Lock()
+	g.hooks = append(g.hooks, f.hooks...)
+	g.breachHooks = append(g.breachHooks, f.breachHooks...)
+	f.hooksMu.Unlock()
+	// The file of nxdomain_cache_file is only saved when the old generation stops, after g started. g takes
+	// the live entries instead.
+	g.nxHandover = g.nxCache != nil && f.current().nxCache != nil
+	if err := g.OnStartup(); err != nil {
+		g.shutdown()
+		return err
+	}
+
+	f.reloadMu.Lock()
+	defer f.reloadMu.Unlock()
+	atomic.StoreUint32(&g.draining, atomic.LoadUint32(&f.draining))
+	old := f.current()
+	if g.nxHandover {
+		g.nxCache.copyFrom(old.nxCache)
+	}
+	for _, p := range old.upstreams() {
+		if atomic.LoadUint32(&p.drained) == 1 {
+			g.setUpstreamDraining(p.addr, true)
+		}
+	}
+	f.gen.Store(g)
+	old.drain(drainTimeout)
+	old.shutdown()
+	return nil
+}
+
+// current returns the generation of f that serves new queries: the Forward of the last Reload, or f itself.
+func (f *Forward) current() *Forward {
+	if g, ok := f.gen.Load().(*Forward); ok {
+		return g
+	}
+	return f
+}
+
+// acquire returns the current generation with its in-flight count incremented, the caller must decrement
+// it when done. It's incremented before checking the generation is still current, so drain never misses a
+// query that is about to use the old one.
+func (f *Forward) acquire() *Forward {
+	for {
+		g := f.current()
+		atomic.AddInt64(&g.inflight, 1)
+		if f.current() == g {
+			return g
+		}
+		atomic.AddInt64(&g.inflight, -1)
+	}
+}
+
+// SetDraining puts f in drain, or takes it out again. While draining new queries aren't forwarded but go to
+// the next plugin, as if they didn't match from, and Ready is false, so the instance can be taken out of
+// rotation during a deploy. Queries already being forwarded, fan-outs included, complete normally; InFlight
+// tells when they're done. A Reload keeps the drain.
+func (f *Forward) SetDraining(draining bool) {
+	var v uint32
+	if draining {
+		v = 1
+	}
+	f.reloadMu.Lock()
+	defer f.reloadMu.Unlock()
+	atomic.StoreUint32(&f.draining, v)
+	atomic.StoreUint32(&f.current().draining, v)
+}
+
+// SetUpstreamDraining puts the upstream addr, as in Stats, in drain, or takes it out again. A drained upstream
+// gets no new queries, like one that's down, but is still health checked, and exchanges with it already in
+// progress complete normally; so it can be taken out of service without failing queries. A Reload keeps the
+// drain of the upstreams that are still configured.
+func (f *Forward) SetUpstreamDraining(addr string, draining bool) error {
+	f.reloadMu.Lock()
+	defer f.reloadMu.Unlock()
+	if !f.current().setUpstreamDraining(addr, draining) {
+		return fmt.Errorf("not a configured upstream: %s", addr)
+	}
+	return nil
+}
+
+// setUpstreamDraining sets the drain of the upstreams of f with addr, and returns if there was one.
+func (f *Forward) setUpstreamDraining(addr string, draining bool) bool {
+	var v uint32
+	if draining {
+		v = 1
+	}
+	found := false
+	for _, p := range f.upstreams() {
+		if p.addr == addr {
+			atomic.StoreUint32(&p.drained, v)
+			found = true
+		}
+	}
+	return found
+}
+
+// Draining returns true if f is in drain, see SetDraining.
+func (f *Forward) Draining() bool { return atomic.LoadUint32(&f.draining) == 1 }
+
+// InFlight returns the number of queries f is serving.
+func (f *Forward) InFlight() int64 { return atomic.LoadInt64(&f.current().inflight) }
+
+// drain waits until f has no queries in flight, or timeout passed.
+func (f *Forward) drain(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt64(&f.inflight) > 0 && time.Now().Before(deadline) {
+		time.Sleep(drainInterval)
+	}
+}
+
+const (
+	drainTimeout  = 2 * defaultTimeout
+	drainInterval = 10 * time.Millisecond
+)
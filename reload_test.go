@@ -0,0 +1,251 @@
+package forward
+
+import (
+	"context"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+func TestReload(t *testing.T) {
+	answerFrom := func(ip string, delay time.Duration) *testServer {
+		return newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+			time.Sleep(delay)
+			ret := new(dns.Msg)
+			ret.SetReply(r)
+			ret.Answer = append(ret.Answer, test.A("example.org. IN A "+ip))
+			w.WriteMsg(ret)
+		})
+	}
+	s1 := answerFrom("127.0.0.1", 200*time.Millisecond)
+	defer s1.Close()
+	s2 := answerFrom("127.0.0.2", 0)
+	defer s2.Close()
+
+	f, err := FromConfig(Config{From: ".", To: []string{s1.Addr}})
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	if err := f.OnStartup(); err != nil {
+		t.Fatalf("Failed to start: %s", err)
+	}
+	defer f.OnShutdown()
+
+	query := func() string {
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", dns.TypeA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := f.ServeDNS(context.TODO(), rec, m); err != nil {
+			return err.Error()
+		}
+		if rec.Msg == nil || len(rec.Msg.Answer) != 1 {
+			return "no answer"
+		}
+		return rec.Msg.Answer[0].(*dns.A).A.String()
+	}
+
+	// A query in flight during the reload is answered by the old upstream.
+	inflight := make(chan string)
+	go func() { inflight <- query() }()
+	time.Sleep(50 * time.Millisecond)
+
+	if err := f.Reload(Config{From: ".", To: []string{s2.Addr}, Quorum: 2}); err == nil {
+		t.Fatalf("Expected an invalid config to be rejected")
+	}
+	if err := f.Reload(Config{From: ".", To: []string{s2.Addr}}); err != nil {
+		t.Fatalf("Failed to reload: %s", err)
+	}
+	select {
+	case ip := <-inflight:
+		if ip != "127.0.0.1" {
+			t.Errorf("Expected the in-flight query to be answered by the old upstream, got %s", ip)
+		}
+	default:
+		t.Fatalf("Expected Reload to wait for the in-flight query")
+	}
+
+	if ip := query(); ip != "127.0.0.2" {
+		t.Errorf("Expected the new upstream to answer, got %s", ip)
+	}
+	if f.Len() != 1 || f.List()[0].addr != s2.Addr {
+		t.Errorf("Expected the new upstream to be listed, got %v", f.List())
+	}
+}
+
+func TestDraining(t *testing.T) {
+	s := newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		if r.Question[0].Name == "example.org." {
+			time.Sleep(200 * time.Millisecond)
+		}
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"))
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	f, err := FromConfig(Config{From: ".", To: []string{s.Addr}})
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	if err := f.OnStartup(); err != nil {
+		t.Fatalf("Failed to start: %s", err)
+	}
+	defer f.OnShutdown()
+
+	query := func() (*dns.Msg, error) {
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", dns.TypeA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		_, err := f.ServeDNS(context.TODO(), rec, m)
+		return rec.Msg, err
+	}
+
+	inflight := make(chan *dns.Msg)
+	go func() {
+		ret, _ := query()
+		inflight <- ret
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	f.SetDraining(true)
+	if f.Ready() {
+		t.Errorf("Expected not to be ready while draining")
+	}
+	if _, err := query(); err == nil {
+		t.Errorf("Expected a new query to go to the next plugin while draining")
+	}
+	if n := f.InFlight(); n != 1 {
+		t.Errorf("Expected 1 query in flight, got %d", n)
+	}
+	if ret := <-inflight; ret == nil || len(ret.Answer) != 1 {
+		t.Errorf("Expected the in-flight query to be answered, got %v", ret)
+	}
+
+	if err := f.Reload(Config{From: ".", To: []string{s.Addr}}); err != nil {
+		t.Fatalf("Failed to reload: %s", err)
+	}
+	if _, err := query(); err == nil {
+		t.Errorf("Expected the drain to survive a reload")
+	}
+	f.SetDraining(false)
+	if ret, err := query(); err != nil || len(ret.Answer) != 1 {
+		t.Errorf("Expected an answer after the drain, got %v", err)
+	}
+}
+
+func TestUpstreamDraining(t *testing.T) {
+	answerFrom := func(ip string) *testServer {
+		return newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+			ret := new(dns.Msg)
+			ret.SetReply(r)
+			ret.Answer = append(ret.Answer, test.A("example.org. IN A "+ip))
+			w.WriteMsg(ret)
+		})
+	}
+	s1 := answerFrom("127.0.0.1")
+	defer s1.Close()
+	s2 := answerFrom("127.0.0.2")
+	defer s2.Close()
+
+	f, err := FromConfig(Config{From: ".", To: []string{s1.Addr, s2.Addr}, Policy: "sequential", FanoutMax: 1})
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	if err := f.OnStartup(); err != nil {
+		t.Fatalf("Failed to start: %s", err)
+	}
+	defer f.OnShutdown()
+
+	query := func() string {
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", dns.TypeA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		f.ServeDNS(context.TODO(), rec, m)
+		if rec.Msg == nil || len(rec.Msg.Answer) != 1 {
+			return "no answer"
+		}
+		return rec.Msg.Answer[0].(*dns.A).A.String()
+	}
+
+	if err := f.SetUpstreamDraining("127.0.0.3:53", true); err == nil {
+		t.Errorf("Expected an error for an unknown upstream")
+	}
+	if err := f.SetUpstreamDraining(s1.Addr, true); err != nil {
+		t.Fatal(err)
+	}
+	if got := query(); got != "127.0.0.2" {
+		t.Errorf("Expected the drained upstream to be skipped, got %s", got)
+	}
+	if !f.Stats().Proxies[0].Draining {
+		t.Errorf("Expected Stats to show the drain")
+	}
+
+	if err := f.Reload(Config{From: ".", To: []string{s1.Addr, s2.Addr}, Policy: "sequential", FanoutMax: 1}); err != nil {
+		t.Fatalf("Failed to reload: %s", err)
+	}
+	if got := query(); got != "127.0.0.2" {
+		t.Errorf("Expected the drain to survive a reload, got %s", got)
+	}
+
+	f.SetUpstreamDraining(s1.Addr, false)
+	if got := query(); got != "127.0.0.1" {
+		t.Errorf("Expected the upstream back after the drain, got %s", got)
+	}
+}
+
+func TestReloadNXCache(t *testing.T) {
+	var asked int32
+	s := newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		if r.Question[0].Name != "." {
+			atomic.AddInt32(&asked, 1)
+			ret.Rcode = dns.RcodeNameError
+			ret.Ns = append(ret.Ns, test.SOA("example.org. 3600 IN SOA ns.example.org. admin.example.org. 1 3600 600 86400 60"))
+		}
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	c := Config{From: ".", To: []string{s.Addr}, NXDomainCache: &NXDomainCacheConfig{TTL: Duration(time.Minute), File: filepath.Join(t.TempDir(), "nx.json")}}
+	f, err := FromConfig(c)
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	if err := f.OnStartup(); err != nil {
+		t.Fatalf("Failed to start: %s", err)
+	}
+	defer f.OnShutdown()
+
+	query := func(name string) {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		f.ServeDNS(context.TODO(), dnstest.NewRecorder(&test.ResponseWriter{}), m)
+	}
+	query("a.example.org.")
+	query("b.example.org.")
+	// The file has both, the live cache only a.example.org.
+	if err := f.current().nxCache.save(c.NXDomainCache.File); err != nil {
+		t.Fatal(err)
+	}
+	f.FlushCache("b.example.org")
+
+	if err := f.Reload(c); err != nil {
+		t.Fatalf("Failed to reload: %s", err)
+	}
+	query("a.example.org.")
+	if n := atomic.LoadInt32(&asked); n != 2 {
+		t.Errorf("Expected the cached NXDOMAIN to survive the reload, upstream was asked %d times", n)
+	}
+	query("b.example.org.")
+	if n := atomic.LoadInt32(&asked); n != 3 {
+		t.Errorf("Expected the flushed NXDOMAIN not to come back from the file, upstream was asked %d times", n)
+	}
+}
@@ -0,0 +1,42 @@
+package forward
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// WithResolvConf returns c with the name servers and search domains of the resolv.conf file path, for
+// hosts whose DNS is set by DHCP or a VPN client: without To the name servers become the upstreams;
+// with To the search domains are forwarded to the name servers with an except line, after those of c, and
+// everything else to To. Call it again, and Reload, when the file changed.
+func (c Config) WithResolvConf(path string) (Config, error) {
+	rc, err := dns.ClientConfigFromFile(path)
+	if err != nil {
+		return c, err
+	}
+	if len(rc.Servers) == 0 {
+		return c, fmt.Errorf("no nameserver in %s", path)
+	}
+	servers := make([]string, len(rc.Servers))
+	for i, s := range rc.Servers {
+		servers[i] = net.JoinHostPort(s, rc.Port)
+	}
+	if len(c.To) == 0 {
+		c.To = servers
+		return c, nil
+	}
+
+	var domains []string
+	for _, d := range rc.Search {
+		if d != "." {
+			domains = append(domains, d)
+		}
+	}
+	if len(domains) == 0 {
+		return c, nil
+	}
+	c.Except = append(c.Except[:len(c.Except):len(c.Except)], ExceptConfig{Domains: domains, To: servers})
+	return c, nil
+}
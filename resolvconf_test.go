@@ -0,0 +1,49 @@
+package forward
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWithResolvConf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pforward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "resolv.conf")
+	if err := ioutil.WriteFile(path, []byte("# from DHCP\nsearch corp.example.com lab.example.com\nnameserver 10.0.0.53\nnameserver fd00::53\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := Config{From: "."}.WithResolvConf(path)
+	if err != nil {
+		t.Fatalf("Expected the resolv.conf to be read, got %s", err)
+	}
+	servers := []string{"10.0.0.53:53", "[fd00::53]:53"}
+	if !reflect.DeepEqual(c.To, servers) || len(c.Except) != 0 {
+		t.Errorf("Expected the name servers as upstreams, got %v and %v", c.To, c.Except)
+	}
+
+	c, err = Config{From: ".", To: []string{"9.9.9.9"}}.WithResolvConf(path)
+	if err != nil {
+		t.Fatalf("Expected the resolv.conf to be read, got %s", err)
+	}
+	except := []ExceptConfig{{Domains: []string{"corp.example.com", "lab.example.com"}, To: servers}}
+	if !reflect.DeepEqual(c.To, []string{"9.9.9.9"}) || !reflect.DeepEqual(c.Except, except) {
+		t.Errorf("Expected the search domains to be forwarded to the name servers, got %v", c.Except)
+	}
+	if _, err := FromConfig(c); err != nil {
+		t.Errorf("Expected a valid Config, got %s", err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("search example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (Config{From: "."}).WithResolvConf(path); err == nil {
+		t.Errorf("Expected an error for a resolv.conf without name servers")
+	}
+}
@@ -0,0 +1,191 @@
+package forward
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Resolver returns a net.Resolver backed by f: Go's own resolver, with every query it sends handed to
+// Exchange instead of a name server, so an application's lookups get the fan-out, merging and policies of f.
+// As with any Go resolver /etc/hosts and the search domains of /etc/resolv.conf are still applied first; the
+// name servers listed there are not used.
+func (f *Forward) Resolver() *net.Resolver {
+	return &net.Resolver{PreferGo: true, Dial: f.dialResolver}
+}
+
+// dialResolver is the Dial of Resolver, the network decides how the connection frames messages.
+func (f *Forward) dialResolver(ctx context.Context, network, address string) (net.Conn, error) {
+	c := &resolverConn{f: f, ctx: ctx, stream: !strings.HasPrefix(network, "udp"), replies: make(chan []byte, 4), done: make(chan struct{})}
+	if c.stream {
+		return c, nil
+	}
+	// Go's resolver picks the framing by whether the connection is a PacketConn.
+	return &resolverPacketConn{c}, nil
+}
+
+// errResolverClosed is returned by a resolverConn that was closed.
+var errResolverClosed = errors.New("resolver connection closed")
+
+// resolverConn is a connection of Resolver. Every query written to it is answered through Exchange, and the
+// reply is read back from it: on a stream connection with the 2 octet length prefix of TCP, else as a
+// datagram that is truncated to the payload size of the query.
+type resolverConn struct {
+	f      *Forward
+	ctx    context.Context
+	stream bool
+
+	mu       sync.Mutex
+	deadline time.Time
+	in       []byte // partial message written to a stream connection
+	pending  []byte // rest of a reply, partly read from a stream connection
+
+	replies chan []byte
+	done    chan struct{}
+	once    sync.Once
+}
+
+func (c *resolverConn) Write(b []byte) (int, error) {
+	if !c.stream {
+		return len(b), c.answer(b)
+	}
+	c.mu.Lock()
+	c.in = append(c.in, b...)
+	var msgs [][]byte
+	for len(c.in) >= 2 {
+		n := int(binary.BigEndian.Uint16(c.in))
+		if len(c.in) < 2+n {
+			break
+		}
+		msgs = append(msgs, c.in[2:2+n])
+		c.in = c.in[2+n:]
+	}
+	c.mu.Unlock()
+	for _, m := range msgs {
+		if err := c.answer(m); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// answer exchanges the query b and queues the reply for Read.
+func (c *resolverConn) answer(b []byte) error {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return err
+	}
+	ctx := c.ctx
+	if d := c.getDeadline(); !d.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, d)
+		defer cancel()
+	}
+	ret, _ := c.f.Exchange(ctx, m)
+	if ret == nil {
+		ret = new(dns.Msg)
+		ret.SetRcode(m, dns.RcodeServerFailure)
+	}
+	if !c.stream {
+		size := dns.MinMsgSize
+		if opt := m.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+			size = int(opt.UDPSize())
+		}
+		ret.Truncate(size)
+	}
+	out, err := ret.Pack()
+	if err != nil {
+		return err
+	}
+	if c.stream {
+		out = append([]byte{byte(len(out) >> 8), byte(len(out))}, out...)
+	}
+	select {
+	case c.replies <- out:
+		return nil
+	case <-c.done:
+		return errResolverClosed
+	}
+}
+
+func (c *resolverConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		c.mu.Unlock()
+		return n, nil
+	}
+	deadline := c.deadline
+	c.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case out := <-c.replies:
+		n := copy(b, out)
+		if c.stream {
+			c.mu.Lock()
+			c.pending = append(c.pending, out[n:]...)
+			c.mu.Unlock()
+		}
+		return n, nil
+	case <-timeout:
+		return 0, &net.OpError{Op: "read", Net: c.LocalAddr().Network(), Err: errResolverTimeout{}}
+	case <-c.done:
+		return 0, errResolverClosed
+	}
+}
+
+func (c *resolverConn) getDeadline() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.deadline
+}
+
+func (c *resolverConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return nil
+}
+
+func (c *resolverConn) LocalAddr() net.Addr  { return (&exchangeWriter{tcp: c.stream}).RemoteAddr() }
+func (c *resolverConn) RemoteAddr() net.Addr { return (&exchangeWriter{tcp: c.stream}).LocalAddr() }
+
+func (c *resolverConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return nil
+}
+
+func (c *resolverConn) SetReadDeadline(t time.Time) error  { return c.SetDeadline(t) }
+func (c *resolverConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// resolverPacketConn is a resolverConn for datagrams.
+type resolverPacketConn struct {
+	*resolverConn
+}
+
+func (c *resolverPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, err := c.Read(b)
+	return n, c.RemoteAddr(), err
+}
+
+func (c *resolverPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) { return c.Write(b) }
+
+// errResolverTimeout is the net.Error of a read past the deadline of a resolverConn.
+type errResolverTimeout struct{}
+
+func (errResolverTimeout) Error() string   { return "i/o timeout" }
+func (errResolverTimeout) Timeout() bool   { return true }
+func (errResolverTimeout) Temporary() bool { return true }
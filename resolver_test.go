@@ -0,0 +1,75 @@
+package forward
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+func TestResolver(t *testing.T) {
+	s := newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		switch {
+		case r.Question[0].Name == "example.org." && r.Question[0].Qtype == dns.TypeA:
+			ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"))
+		case r.Question[0].Name == "example.org.":
+		default:
+			ret.Rcode = dns.RcodeNameError
+		}
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	f, err := FromConfig(Config{From: ".", To: []string{s.Addr}})
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	f.OnStartup()
+	defer f.OnShutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := f.Resolver().LookupHost(ctx, "example.org.")
+	if err != nil {
+		t.Fatalf("Expected example.org. to resolve, got %s", err)
+	}
+	if len(addrs) != 1 || addrs[0] != "127.0.0.1" {
+		t.Errorf("Expected [127.0.0.1], got %v", addrs)
+	}
+	if _, err := f.Resolver().LookupHost(ctx, "nx.example.org."); err == nil {
+		t.Errorf("Expected an error for nx.example.org.")
+	}
+
+	// A stream connection frames its messages with a length prefix.
+	c, err := f.dialResolver(ctx, "tcp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	b, _ := m.Pack()
+	if _, err := c.Write(append([]byte{byte(len(b) >> 8), byte(len(b))}, b...)); err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	l := make([]byte, 2)
+	if _, err := io.ReadFull(c, l); err != nil {
+		t.Fatal(err)
+	}
+	b = make([]byte, binary.BigEndian.Uint16(l))
+	if _, err := io.ReadFull(c, b); err != nil {
+		t.Fatal(err)
+	}
+	ret := new(dns.Msg)
+	if err := ret.Unpack(b); err != nil || ret.Id != m.Id || len(ret.Answer) != 1 {
+		t.Errorf("Expected the answer to the query, got %v, %v", ret, err)
+	}
+}
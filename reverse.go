@@ -0,0 +1,144 @@
+package forward
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/coredns/coredns/plugin"
+)
+
+// reverseRoute is a reverse line: queries in the reverse zones of nets go to proxies instead of the
+// configured upstreams.
+type reverseRoute struct {
+	nets    []*net.IPNet
+	zones   []string // reverse zones covering nets, see reverseZones
+	proxies []*Proxy
+}
+
+// parseReverse parses the arguments of reverse: CIDR... to TO....
+func parseReverse(args []string) (reverseRoute, error) {
+	r := reverseRoute{}
+	i := 0
+	for ; i < len(args) && args[i] != "to"; i++ {
+		_, n, err := net.ParseCIDR(args[i])
+		if err != nil {
+			return r, err
+		}
+		r.nets = append(r.nets, n)
+		r.zones = append(r.zones, reverseZones(n)...)
+	}
+	if len(r.nets) == 0 {
+		return r, fmt.Errorf("reverse needs at least one CIDR")
+	}
+	if i == len(args) || i == len(args)-1 {
+		return r, fmt.Errorf("reverse needs at least one upstream after to")
+	}
+	proxies, err := newProxies(args[i+1:])
+	if err != nil {
+		return r, err
+	}
+	r.proxies = proxies
+	return r, nil
+}
+
+// reverseZones returns the in-addr.arpa. or ip6.arpa. zones of n: n's prefix rounded up to a whole octet,
+// or nibble for IPv6, so a /20 has 16 zones of a /24. Rounding up the prefix of a /26 would make every
+// address a zone, it gets the zone of its /24.
+func reverseZones(n *net.IPNet) (zones []string) {
+	ones, bits := n.Mask.Size()
+	step, suffix := 8, "in-addr.arpa."
+	ip := n.IP.To4()
+	if ip == nil || bits == 128 {
+		step, suffix, ip = 4, "ip6.arpa.", n.IP.To16()
+	}
+	labels := (ones + step - 1) / step
+	extra := labels*step - ones
+	if extra > 0 && labels*step == bits {
+		labels, extra = labels-1, 0
+	}
+	for i := 0; i < 1<<uint(extra); i++ {
+		addr := make(net.IP, len(ip))
+		copy(addr, ip)
+		// Set the extra bits, just below the prefix, to i.
+		for b := 0; b < extra; b++ {
+			if i&(1<<uint(b)) != 0 {
+				pos := ones + extra - 1 - b
+				addr[pos/8] |= 0x80 >> uint(pos%8)
+			}
+		}
+		zones = append(zones, reverseName(addr, labels, step)+suffix)
+	}
+	return zones
+}
+
+// reverseName returns the first labels octets (step 8) or nibbles (step 4) of ip as reversed labels.
+func reverseName(ip net.IP, labels, step int) string {
+	parts := make([]string, 0, labels)
+	for i := 0; i < labels; i++ {
+		if step == 8 {
+			parts = append(parts, strconv.Itoa(int(ip[i])))
+			continue
+		}
+		parts = append(parts, strconv.FormatUint(uint64(ip[i/2]>>uint(4*(1-i%2))&0xf), 16))
+	}
+	var b strings.Builder
+	for i := len(parts) - 1; i >= 0; i-- {
+		b.WriteString(parts[i])
+		b.WriteByte('.')
+	}
+	return b.String()
+}
+
+// reverseAddr returns the address a full reverse name stands for, or nil.
+func reverseAddr(name string) net.IP {
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa."):
+		labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa."), ".")
+		if len(labels) != 4 {
+			return nil
+		}
+		return net.ParseIP(labels[3] + "." + labels[2] + "." + labels[1] + "." + labels[0]).To4()
+	case strings.HasSuffix(name, ".ip6.arpa."):
+		labels := strings.Split(strings.TrimSuffix(name, ".ip6.arpa."), ".")
+		if len(labels) != 32 {
+			return nil
+		}
+		var b strings.Builder
+		for i := len(labels) - 1; i >= 0; i-- {
+			b.WriteString(labels[i])
+			if i%4 == 0 && i > 0 {
+				b.WriteByte(':')
+			}
+		}
+		return net.ParseIP(b.String())
+	}
+	return nil
+}
+
+// reverse returns the reverse route for name, or nil if it's in none of their zones. The name of a single
+// address also has to be in one of the route's nets, as the zones of a prefix that isn't on an octet or
+// nibble boundary hold other addresses too; other names are routed by the first route whose zones they're
+// in.
+func (f *Forward) reverse(name string) *reverseRoute {
+	for i := range f.reverses {
+		r := &f.reverses[i]
+		for _, z := range r.zones {
+			if !plugin.Name(z).Matches(name) {
+				continue
+			}
+			ip := reverseAddr(name)
+			if ip == nil {
+				return r
+			}
+			for _, n := range r.nets {
+				if n.Contains(ip) {
+					return r
+				}
+			}
+		}
+	}
+	return nil
+}
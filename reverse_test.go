@@ -0,0 +1,81 @@
+package forward
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+func TestReverseZones(t *testing.T) {
+	tests := []struct {
+		cidr  string
+		zones []string
+	}{
+		{"10.0.0.0/8", []string{"10.in-addr.arpa."}},
+		{"192.168.1.0/24", []string{"1.168.192.in-addr.arpa."}},
+		{"192.168.1.0/26", []string{"1.168.192.in-addr.arpa."}},
+		{"172.16.0.0/14", []string{"16.172.in-addr.arpa.", "17.172.in-addr.arpa.", "18.172.in-addr.arpa.", "19.172.in-addr.arpa."}},
+		{"fd00::/8", []string{"d.f.ip6.arpa."}},
+		{"2001:db8::/31", []string{"8.b.d.0.1.0.0.2.ip6.arpa.", "9.b.d.0.1.0.0.2.ip6.arpa."}},
+	}
+	for _, tc := range tests {
+		_, n, _ := net.ParseCIDR(tc.cidr)
+		if zones := reverseZones(n); !reflect.DeepEqual(zones, tc.zones) {
+			t.Errorf("%s: expected %v, got %v", tc.cidr, tc.zones, zones)
+		}
+	}
+}
+
+func TestReverse(t *testing.T) {
+	var internal int32
+	s := newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		if r.Question[0].Name != "." {
+			atomic.AddInt32(&internal, 1)
+		}
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+	public := newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer public.Close()
+
+	f, err := FromConfig(Config{From: ".", To: []string{public.Addr}, Reverse: []ReverseConfig{{CIDRs: []string{"192.168.1.0/26", "fd00::/8"}, To: []string{s.Addr}}}})
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %s", err)
+	}
+	f.OnStartup()
+	defer f.OnShutdown()
+
+	tests := []struct {
+		name     string
+		internal bool
+	}{
+		{"10.1.168.192.in-addr.arpa.", true},
+		{"1.168.192.in-addr.arpa.", true},
+		{"100.1.168.192.in-addr.arpa.", false}, // in the zone, not in the /26
+		{"1.1.1.1.in-addr.arpa.", false},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.", true},
+		{"example.org.", false},
+	}
+	for _, tc := range tests {
+		atomic.StoreInt32(&internal, 0)
+		m := new(dns.Msg)
+		m.SetQuestion(tc.name, dns.TypePTR)
+		f.ServeDNS(context.TODO(), dnstest.NewRecorder(&test.ResponseWriter{}), m)
+		if got := atomic.LoadInt32(&internal) == 1; got != tc.internal {
+			t.Errorf("%s: expected internal %t, got %t", tc.name, tc.internal, got)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package forward
+
+import (
+	"fmt"
+	"sync"
+)
+
+// selfTest is the startup check of the upstreams: at least min of them must answer the health check
+// probe, otherwise startup fails, or with warn a warning is logged.
+type selfTest struct {
+	min  int
+	warn bool
+}
+
+// runSelfTest sends the health check probe to every proxy and returns an error if fewer than f.selfTest.min
+// of them answered.
+func (f *Forward) runSelfTest() error {
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+		ok int
+	)
+	for _, p := range f.proxies {
+		wg.Add(1)
+		go func(p *Proxy) {
+			defer wg.Done()
+			if err := p.health.Check(p); err != nil {
+				log.Warningf("Self test of upstream %s failed: %s", p.addr, err)
+				return
+			}
+			mu.Lock()
+			ok++
+			mu.Unlock()
+		}(p)
+	}
+	wg.Wait()
+
+	if ok >= f.selfTest.min {
+		return nil
+	}
+	err := fmt.Errorf("self test failed: %d of %d upstreams answered, need %d", ok, len(f.proxies), f.selfTest.min)
+	if f.selfTest.warn {
+		log.Warning(err)
+		return nil
+	}
+	return err
+}
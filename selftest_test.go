@@ -0,0 +1,43 @@
+package forward
+
+import (
+	"testing"
+
+	"github.com/caddyserver/caddy"
+	"github.com/miekg/dns"
+)
+
+func TestSelfTest(t *testing.T) {
+	s := newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+	dead := newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {})
+	dead.Close()
+
+	tests := []struct {
+		selfTest  string
+		shouldErr bool
+	}{
+		{"self_test", false},
+		{"self_test 2", true},
+		{"self_test 2 warn", false},
+	}
+	for i, tc := range tests {
+		c := caddy.NewTestController("dns", "forward . "+s.Addr+" "+dead.Addr+" {\n"+tc.selfTest+"\n}\n")
+		f, err := parseForward(c)
+		if err != nil {
+			t.Fatalf("Test %d: failed to create forwarder: %s", i, err)
+		}
+		err = f.OnStartup()
+		f.OnShutdown()
+		if tc.shouldErr && err == nil {
+			t.Errorf("Test %d: expected an error", i)
+		}
+		if !tc.shouldErr && err != nil {
+			t.Errorf("Test %d: expected no error, got: %s", i, err)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package forward
+
+import (
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// servfailBuckets is the number of buckets the window of servfail_alert is counted in.
+const servfailBuckets = 10
+
+// Defaults of servfail_alert.
+const (
+	defaultServfailWindow = time.Minute
+	defaultServfailMin    = 100
+)
+
+// servfailAlert tracks the ratio of SERVFAILs among the replies to the clients over a sliding window and
+// reports when it exceeds ratio, a breach, and when it's back under it. The ratio is only judged with at least
+// min replies in the window, so a few failures in a quiet minute don't count.
+type servfailAlert struct {
+	ratio  float64
+	window time.Duration
+	min    int64
+
+	mu       sync.Mutex
+	buckets  [servfailBuckets]servfailBucket
+	breached bool
+
+	now func() time.Time // for testing
+}
+
+// servfailBucket counts the replies of one window/servfailBuckets slot.
+type servfailBucket struct {
+	slot     int64 // the slot counted, buckets of other slots are stale
+	total    int64
+	servfail int64
+}
+
+func newServfailAlert(ratio float64, window time.Duration, min int64) *servfailAlert {
+	return &servfailAlert{ratio: ratio, window: window, min: min, now: time.Now}
+}
+
+// observe counts a reply, servfail if it's a SERVFAIL. It returns the ratio in the window, and if that
+// changed the breach state, to breached. Under min replies the state is kept, so a breach only ends once
+// enough replies show the ratio back under the threshold.
+func (s *servfailAlert) observe(servfail bool) (ratio float64, changed, breached bool) {
+	slot := s.now().UnixNano() / int64(s.window/servfailBuckets)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := &s.buckets[slot%servfailBuckets]
+	if b.slot != slot {
+		*b = servfailBucket{slot: slot}
+	}
+	b.total++
+	if servfail {
+		b.servfail++
+	}
+
+	var total, failed int64
+	for i := range s.buckets {
+		if b := &s.buckets[i]; b.slot > slot-servfailBuckets {
+			total += b.total
+			failed += b.servfail
+		}
+	}
+	ratio = float64(failed) / float64(total)
+	breached = s.breached
+	if total >= s.min {
+		breached = ratio > s.ratio
+	}
+	changed = breached != s.breached
+	s.breached = breached
+	return ratio, changed, breached
+}
+
+// OnServfailBreach registers fn to be called whenever the ratio of SERVFAILs answered by f exceeds the
+// threshold of servfail_alert, with breached true, and when it's back under it, with breached false, e.g. to
+// fail over to another instance. Fn is called from the query that crossed the threshold, so it should not
+// block.
+func (f *Forward) OnServfailBreach(fn func(ratio float64, breached bool)) {
+	f.hooksMu.Lock()
+	f.breachHooks = append(f.breachHooks, fn)
+	f.hooksMu.Unlock()
+
+	if g := f.current(); g != f {
+		g.hooksMu.Lock()
+		g.breachHooks = append(g.breachHooks, fn)
+		g.hooksMu.Unlock()
+	}
+}
+
+// observeRcode counts a reply with rcode for servfail_alert, if it's set, and reports a breach or its end.
+func (f *Forward) observeRcode(rcode int) {
+	if f.servfails == nil {
+		return
+	}
+	ratio, changed, breached := f.servfails.observe(rcode == dns.RcodeServerFailure)
+	if !changed {
+		return
+	}
+	if breached {
+		log.Warningf("SERVFAIL ratio %.3f exceeds %.3f for %s", ratio, f.servfails.ratio, f.from)
+		ServfailBreachGauge.WithLabelValues(f.from).Set(1)
+		ServfailBreachCount.WithLabelValues(f.from).Inc()
+	} else {
+		log.Infof("SERVFAIL ratio alert for %s ended, ratio %.3f", f.from, ratio)
+		ServfailBreachGauge.WithLabelValues(f.from).Set(0)
+	}
+
+	f.hooksMu.Lock()
+	hooks := f.breachHooks
+	f.hooksMu.Unlock()
+	for _, fn := range hooks {
+		fn(ratio, breached)
+	}
+}
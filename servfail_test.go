@@ -0,0 +1,49 @@
+package forward
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestServfailAlert(t *testing.T) {
+	now := time.Unix(1000, 0)
+	s := newServfailAlert(0.5, 10*time.Second, 4)
+	s.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if _, changed, _ := s.observe(true); changed {
+			t.Fatalf("Expected no breach with %d replies, under the minimum", i+1)
+		}
+	}
+	if ratio, changed, breached := s.observe(false); !changed || !breached || ratio != 0.75 {
+		t.Fatalf("Expected a breach at ratio 0.75, got %t, %t, %v", changed, breached, ratio)
+	}
+	if _, changed, breached := s.observe(true); changed || !breached {
+		t.Errorf("Expected the breach to last, got %t, %t", changed, breached)
+	}
+
+	// The failures leave the window.
+	now = now.Add(10 * time.Second)
+	for i := 0; i < 3; i++ {
+		s.observe(false)
+	}
+	if ratio, changed, breached := s.observe(false); !changed || breached || ratio != 0 {
+		t.Errorf("Expected the breach to end at ratio 0, got %t, %t, %v", changed, breached, ratio)
+	}
+}
+
+func TestOnServfailBreach(t *testing.T) {
+	f := New()
+	f.servfails = newServfailAlert(0.5, time.Minute, 2)
+	var got []bool
+	f.OnServfailBreach(func(ratio float64, breached bool) { got = append(got, breached) })
+
+	for _, rcode := range []int{dns.RcodeServerFailure, dns.RcodeServerFailure, dns.RcodeSuccess, dns.RcodeSuccess, dns.RcodeSuccess} {
+		f.observeRcode(rcode)
+	}
+	if len(got) != 2 || !got[0] || got[1] {
+		t.Errorf("Expected a breach and its end, got %v", got)
+	}
+}
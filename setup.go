@@ -1,8 +1,12 @@
 package forward
 
 import (
+	"crypto/tls"
 	"fmt"
+	"net"
+	"runtime"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/coredns/coredns/core/dnsserver"
@@ -13,6 +17,7 @@ import (
 	"github.com/coredns/coredns/plugin/pkg/transport"
 
 	"github.com/caddyserver/caddy"
+	"github.com/miekg/dns"
 )
 
 func init() { plugin.Register("forward", setup) }
@@ -32,7 +37,7 @@ func setup(c *caddy.Controller) error {
 	})
 
 	c.OnStartup(func() error {
-		metrics.MustRegister(c, RequestCount, RcodeCount, RequestDuration, HealthcheckFailureCount, SocketGauge)
+		metrics.MustRegister(c, Collectors()...)
 		return f.OnStartup()
 	})
 
@@ -45,16 +50,109 @@ func setup(c *caddy.Controller) error {
 
 // OnStartup starts a goroutines for all proxies.
 func (f *Forward) OnStartup() (err error) {
+	if err := f.fetchECH(); err != nil {
+		log.Errorf("Failed to fetch ECH configs: %s", err)
+		return err
+	}
+	// Before any upstream is started: prewarming and the first health checks dial TLS right away.
+	if f.keyLog != nil {
+		if err := f.keyLog.start(); err != nil {
+			log.Errorf("Failed to open TLS key log: %s", err)
+			return err
+		}
+	}
+	if f.shareUp {
+		f.shareUpstreams()
+	}
+	for _, p := range f.upstreams() {
+		if !f.shared[p] {
+			p.start(f.hcInterval)
+		}
+		exportLabels(p)
+	}
+	// Check right away, we're not ready until an upstream is known to answer.
 	for _, p := range f.proxies {
-		p.start(f.hcInterval)
+		p.Healthcheck()
+	}
+	if f.writer != nil {
+		f.writer.start()
+	}
+	if f.hosts != nil {
+		f.hosts.start()
+	}
+	if f.nxFile != "" && !f.nxHandover {
+		// A cache is no reason not to start, it just starts cold.
+		if n, err := f.nxCache.load(f.nxFile); err != nil {
+			log.Warningf("Failed to load nxdomain_cache: %s", err)
+		} else if n > 0 {
+			log.Infof("Loaded %d nxdomain_cache entries from %s", n, f.nxFile)
+		}
+	}
+	if f.selfTest != nil {
+		if err := f.runSelfTest(); err != nil {
+			return err
+		}
+	}
+	if f.capture != nil {
+		if err := f.capture.start(f); err != nil {
+			log.Errorf("Failed to start capture handler: %s", err)
+			return err
+		}
+	}
+	if f.tracer != nil {
+		if err := f.tracer.start(); err != nil {
+			log.Errorf("Failed to start trace handler: %s", err)
+			return err
+		}
+	}
+	if f.debugVars != nil {
+		if err := f.debugVars.start(f); err != nil {
+			log.Errorf("Failed to start expvar handler: %s", err)
+			return err
+		}
 	}
 	return nil
 }
 
-// OnShutdown stops all configured proxies.
+// OnShutdown stops all configured proxies, of the current generation if f was reloaded.
 func (f *Forward) OnShutdown() error {
-	for _, p := range f.proxies {
-		p.stop()
+	f.reloadMu.Lock()
+	defer f.reloadMu.Unlock()
+	return f.current().shutdown()
+}
+
+func (f *Forward) shutdown() error {
+	for _, p := range f.upstreams() {
+		if !f.shared[p] {
+			p.stop()
+		}
+		unexportLabels(p)
+	}
+	if f.shared != nil {
+		f.unshareUpstreams()
+	}
+	if f.writer != nil {
+		f.writer.stop()
+	}
+	if f.hosts != nil {
+		f.hosts.stop()
+	}
+	if f.nxFile != "" {
+		if err := f.nxCache.save(f.nxFile); err != nil {
+			log.Errorf("Failed to save nxdomain_cache: %s", err)
+		}
+	}
+	if f.keyLog != nil {
+		f.keyLog.stop()
+	}
+	if f.tracer != nil {
+		f.tracer.stop()
+	}
+	if f.debugVars != nil {
+		f.debugVars.stop(f)
+	}
+	if f.capture != nil {
+		return f.capture.stop()
 	}
 	return nil
 }
@@ -79,61 +177,247 @@ func parseForward(c *caddy.Controller) (*Forward, error) {
 }
 
 func parseStanza(c *caddy.Controller) (*Forward, error) {
+	var err error
 	f := New()
 
 	if !c.Args(&f.from) {
 		return f, c.ArgErr()
 	}
-	f.from = plugin.Host(f.from).Normalize()
+	re, ok, err := compilePattern(f.from)
+	if err != nil {
+		return f, err
+	}
+	if ok {
+		f.fromPattern = re
+	} else {
+		f.from = normalizeHost(f.from)
+	}
 
 	to := c.RemainingArgs()
 	if len(to) == 0 {
 		return f, c.ArgErr()
 	}
 
-	toHosts, err := parse.HostPortOrFile(to...)
+	f.proxies, err = newProxies(to)
 	if err != nil {
 		return f, err
 	}
 
-	transports := make([]string, len(toHosts))
-	for i, host := range toHosts {
-		trans, h := parse.Transport(host)
-		p := NewProxy(h, trans)
-		f.proxies = append(f.proxies, p)
-		transports[i] = trans
-	}
-
 	for c.NextBlock() {
 		if err := parseBlock(c, f); err != nil {
 			return f, err
 		}
 	}
 
+	if f.nxFile != "" && f.nxCache == nil {
+		return f, fmt.Errorf("nxdomain_cache_file needs nxdomain_cache")
+	}
+
+	if f.fanoutMax > 0 && f.quorum > f.fanoutMax {
+		return f, fmt.Errorf("quorum can't be larger than fanout_max: %d > %d", f.quorum, f.fanoutMax)
+	}
+	if f.early && f.quorum > 0 {
+		return f, fmt.Errorf("early_response can't be combined with quorum")
+	}
+	if (len(f.mergeNames) > 0 || len(f.mergePatterns) > 0) && f.quorum > 0 {
+		return f, fmt.Errorf("merge_domains can't be combined with quorum")
+	}
+
+	if f.opts.sameTransport {
+		if f.opts.forceTCP || f.opts.preferUDP {
+			return f, fmt.Errorf("same_transport can't be combined with force_tcp or prefer_udp")
+		}
+		for _, p := range f.upstreams() {
+			if p.trans != transport.DNS {
+				return f, fmt.Errorf("same_transport can only be used with plain DNS upstreams: %s", p.addr)
+			}
+		}
+	}
+
+	if f.idnDisplay {
+		if f.tracer != nil {
+			f.tracer.unicode = true
+		}
+		if f.capture != nil {
+			f.capture.unicode = true
+		}
+	}
+
+	if f.preferLabel != nil {
+		f.p = &preferLabel{label: *f.preferLabel, Policy: f.p}
+	}
+
 	if f.tlsServerName != "" {
 		f.tlsConfig.ServerName = f.tlsServerName
 	}
-	for i := range f.proxies {
-		// Only set this for proxies that need it.
-		if transports[i] == transport.TLS {
-			f.proxies[i].SetTLSConfig(f.tlsConfig)
-		}
-		f.proxies[i].SetExpire(f.expire)
+	for _, p := range f.upstreams() {
+		f.configureProxy(p)
 	}
 	return f, nil
 }
 
+// newProxies returns a proxy for every host in to, hosts may be files in resolv.conf format or unix sockets.
+func newProxies(to []string) ([]*Proxy, error) {
+	proxies := []*Proxy{}
+	for _, host := range to {
+		if trans, path, ok := parseUnix(host); ok {
+			proxies = append(proxies, NewProxy(path, trans))
+			continue
+		}
+
+		toHosts, err := parse.HostPortOrFile(host)
+		if err != nil {
+			return nil, err
+		}
+		for _, host := range toHosts {
+			trans, h := parse.Transport(host)
+			if trans == transport.HTTPS {
+				// This would send plain DNS to port 443. There's no DoH transport, and thus nothing to
+				// authenticate to a DoH resolver with either.
+				return nil, fmt.Errorf("DNS over HTTPS upstreams are not supported: %s", host)
+			}
+			proxies = append(proxies, NewProxy(h, trans))
+		}
+	}
+	return proxies, nil
+}
+
+// alternateAddr returns alt as host:port, with the port of addr if alt has none. Both must be IP addresses of
+// different families.
+func alternateAddr(addr, alt string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("upstream has no IP address: %s", addr)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "", fmt.Errorf("upstream has no IP address: %s", addr)
+	}
+	altHost, altPort := alt, port
+	if h, p, err := net.SplitHostPort(alt); err == nil {
+		altHost, altPort = h, p
+	}
+	altIP := net.ParseIP(altHost)
+	if altIP == nil {
+		return "", fmt.Errorf("not an IP address: %s", alt)
+	}
+	if (ip.To4() == nil) == (altIP.To4() == nil) {
+		return "", fmt.Errorf("alternate %s is of the same address family as %s", alt, addr)
+	}
+	return net.JoinHostPort(altIP.String(), altPort), nil
+}
+
+// matchProxies returns the configured proxies for hosts, or all of them if hosts is empty. This is
+// used by options that can be set per upstream.
+func (f *Forward) matchProxies(hosts []string) ([]*Proxy, error) {
+	if len(hosts) == 0 {
+		return f.proxies, nil
+	}
+
+	proxies := make([]*Proxy, 0, len(hosts))
+Hosts:
+	for _, host := range hosts {
+		if strings.HasPrefix(host, labelSelector) {
+			labeled, err := f.withLabel(host)
+			if err != nil {
+				return nil, err
+			}
+			proxies = append(proxies, labeled...)
+			continue
+		}
+		h := host
+		if _, path, ok := parseUnix(host); ok {
+			h = path
+		} else {
+			toHosts, err := parse.HostPortOrFile(host)
+			if err != nil {
+				return nil, err
+			}
+			if len(toHosts) != 1 {
+				return nil, fmt.Errorf("not a single upstream: %s", host)
+			}
+			_, h = parse.Transport(toHosts[0])
+		}
+		for _, p := range f.proxies {
+			if p.addr == h {
+				proxies = append(proxies, p)
+				continue Hosts
+			}
+		}
+		return nil, fmt.Errorf("not a configured upstream: %s", host)
+	}
+	return proxies, nil
+}
+
+// configureProxy applies the settings of the stanza to p.
+func (f *Forward) configureProxy(p *Proxy) {
+	p.onChange = f.checkState
+	// Only set this for proxies that need it. gRPC can be used without TLS, so only if asked for.
+	if p.trans == transport.TLS || (p.trans == transport.GRPC && f.tlsSet) {
+		p.SetTLSConfig(f.proxyTLSConfig(p))
+	}
+	p.SetExpire(f.expire)
+	for proto, expire := range f.protoExpire {
+		p.SetProtoExpire(proto, expire)
+	}
+	p.SetUDPPool(f.udpPool)
+	p.SetDontFragment(f.dontFrag)
+	p.SetPrewarm(f.prewarm)
+	p.SetRotate(f.rotate.queries, f.rotate.age)
+	p.SetFailDecay(f.failDecay)
+	if p.health != nil {
+		p.health.SetProbe(f.hcProbe)
+	}
+}
+
+// proxyTLSConfig returns the TLS config of p: the one of the stanza with the TLS options of p.
+func (f *Forward) proxyTLSConfig(p *Proxy) *tls.Config {
+	cfg := f.tlsConfig
+	if o := f.tlsOpts[p]; o != nil {
+		cfg = o.apply(cfg)
+	}
+	if f.tlsSessions > 0 && p.trans == transport.TLS {
+		// Every upstream gets its own cache, so one can't evict the sessions of the others.
+		cfg = cfg.Clone()
+		cfg.ClientSessionCache = tls.NewLRUClientSessionCache(f.tlsSessions)
+	}
+	if f.keyLog != nil {
+		cfg = cfg.Clone()
+		cfg.KeyLogWriter = f.keyLog
+	}
+	return cfg
+}
+
 func parseBlock(c *caddy.Controller, f *Forward) error {
 	switch c.Val() {
 	case "except":
-		ignore := c.RemainingArgs()
-		if len(ignore) == 0 {
+		args := c.RemainingArgs()
+		if len(args) == 0 {
 			return c.ArgErr()
 		}
-		for i := 0; i < len(ignore); i++ {
-			ignore[i] = plugin.Host(ignore[i]).Normalize()
+		e, err := parseException(args)
+		if err != nil {
+			return err
+		}
+		f.except = append(f.except, e)
+	case "reverse":
+		r, err := parseReverse(c.RemainingArgs())
+		if err != nil {
+			return err
+		}
+		f.reverses = append(f.reverses, r)
+	case "pin_option":
+		po, err := parsePinOption(c.RemainingArgs())
+		if err != nil {
+			return err
+		}
+		f.pin = po
+	case "authoritative":
+		a, err := f.parseAuthority(c.RemainingArgs())
+		if err != nil {
+			return err
 		}
-		f.ignored = ignore
+		f.authorities = append(f.authorities, a)
 	case "max_fails":
 		if !c.NextArg() {
 			return c.ArgErr()
@@ -146,6 +430,45 @@ func parseBlock(c *caddy.Controller, f *Forward) error {
 			return fmt.Errorf("max_fails can't be negative: %d", n)
 		}
 		f.maxfails = uint32(n)
+	case "fail_decay":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		dur, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return err
+		}
+		if dur <= 0 {
+			return fmt.Errorf("fail_decay can't be negative or zero: %s", dur)
+		}
+		f.failDecay = dur
+	case "retry_upstream":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		switch c.Val() {
+		case "same":
+			f.retryNext = false
+		case "next":
+			f.retryNext = true
+		default:
+			return fmt.Errorf("retry_upstream must be same or next: %s", c.Val())
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+	case "max_retries":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		n, err := strconv.Atoi(c.Val())
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return fmt.Errorf("max_retries can't be negative: %d", n)
+		}
+		f.maxRetries = n
 	case "health_check":
 		if !c.NextArg() {
 			return c.ArgErr()
@@ -158,6 +481,29 @@ func parseBlock(c *caddy.Controller, f *Forward) error {
 			return fmt.Errorf("health_check can't be negative: %d", dur)
 		}
 		f.hcInterval = dur
+
+		for c.NextArg() {
+			switch hcOpt := c.Val(); hcOpt {
+			case "no_rec":
+				f.hcProbe.RecursionDesired = false
+			case "domain":
+				if !c.NextArg() {
+					return c.ArgErr()
+				}
+				if _, ok := dns.IsDomainName(c.Val()); !ok {
+					return fmt.Errorf("health_check: invalid domain name %q", c.Val())
+				}
+				f.hcProbe.Domain = plugin.Name(toASCII(c.Val())).Normalize()
+			case "minimize":
+				f.hcProbe.Minimize = true
+			case "dnssec":
+				f.hcProbe.DNSSECOK = true
+			case "cd":
+				f.hcProbe.CheckingDisabled = true
+			default:
+				return c.Errf("health_check: unknown option '%s'", hcOpt)
+			}
+		}
 	case "force_tcp":
 		if c.NextArg() {
 			return c.ArgErr()
@@ -168,6 +514,531 @@ func parseBlock(c *caddy.Controller, f *Forward) error {
 			return c.ArgErr()
 		}
 		f.opts.preferUDP = true
+	case "log_sample":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		n, err := strconv.ParseUint(c.Val(), 10, 64)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("log_sample must be at least 1: %d", n)
+		}
+		f.logSample = n
+	case "log_errors":
+		args := c.RemainingArgs()
+		if len(args) > 1 {
+			return c.ArgErr()
+		}
+		interval := defaultErrorLogInterval
+		if len(args) == 1 {
+			dur, err := time.ParseDuration(args[0])
+			if err != nil {
+				return err
+			}
+			if dur < 0 {
+				return fmt.Errorf("log_errors interval can't be negative: %s", dur)
+			}
+			interval = dur
+		}
+		f.errLog = newErrorLimiter(interval)
+	case "idn_display":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.idnDisplay = true
+	case "lowercase_qname":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.opts.lowerQname = true
+	case "anonymize":
+		args := c.RemainingArgs()
+		if len(args) > 1 || (len(args) == 1 && args[0] != "pad") {
+			return c.ArgErr()
+		}
+		// The case of the name can tell which resolver software the client runs.
+		f.opts.anonymize, f.opts.lowerQname = true, true
+		f.opts.pad = len(args) == 1
+	case "same_transport":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.opts.sameTransport = true
+	case "avoid_fragmentation":
+		args := c.RemainingArgs()
+		if len(args) > 1 {
+			return c.ArgErr()
+		}
+		size := defaultMaxUDPSize
+		if len(args) == 1 {
+			n, err := strconv.Atoi(args[0])
+			if err != nil {
+				return err
+			}
+			if n < dns.MinMsgSize || n > dns.MaxMsgSize {
+				return fmt.Errorf("avoid_fragmentation size must be between %d and %d: %d", dns.MinMsgSize, dns.MaxMsgSize, n)
+			}
+			size = n
+		}
+		f.opts.maxUDPSize = uint16(size)
+		f.dontFrag = true
+		if !featDontFragment.supported() {
+			log.Warningf("DF can't be set on %s, avoid_fragmentation only caps the payload", runtime.GOOS)
+		}
+	case "share_upstreams":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.shareUp = true
+	case "rcode_map":
+		args := c.RemainingArgs()
+		if len(args) != 2 {
+			return c.ArgErr()
+		}
+		from, err := parseRcode(args[0])
+		if err != nil {
+			return err
+		}
+		to, err := parseRcode(args[1])
+		if err != nil {
+			return err
+		}
+		if f.rcodeMap == nil {
+			f.rcodeMap = map[int]int{}
+		}
+		f.rcodeMap[from] = to
+	case "clear_ad":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.clearAD = true
+	case "trace":
+		args := c.RemainingArgs()
+		if len(args) > 1 {
+			return c.ArgErr()
+		}
+		addr := defaultTraceAddr
+		if len(args) == 1 {
+			addr = args[0]
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return err
+		}
+		f.tracer = &tracer{addr: addr}
+	case "expvar":
+		args := c.RemainingArgs()
+		if len(args) > 1 {
+			return c.ArgErr()
+		}
+		addr := defaultVarsAddr
+		if len(args) == 1 {
+			addr = args[0]
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return err
+		}
+		f.debugVars = &debugVars{addr: addr}
+	case "pprof_labels":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.pprofLabels = true
+	case "self_test":
+		args := c.RemainingArgs()
+		if len(args) > 2 {
+			return c.ArgErr()
+		}
+		st := &selfTest{min: 1}
+		for _, arg := range args {
+			if arg == "warn" {
+				st.warn = true
+				continue
+			}
+			n, err := strconv.Atoi(arg)
+			if err != nil {
+				return err
+			}
+			if n < 1 || n > len(f.proxies) {
+				return fmt.Errorf("self_test needs between 1 and %d upstreams to answer: %d", len(f.proxies), n)
+			}
+			st.min = n
+		}
+		f.selfTest = st
+	case "debug_upstream":
+		args := c.RemainingArgs()
+		a := &annotation{}
+		if len(args) > 0 && (args[0] == "ede" || args[0] == "txt") {
+			a.txt = args[0] == "txt"
+			args = args[1:]
+		}
+		for _, arg := range args {
+			n, err := parseCIDR(arg)
+			if err != nil {
+				return err
+			}
+			a.clients = append(a.clients, n)
+		}
+		f.annotation = a
+	case "merge_domains":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		for _, arg := range args {
+			re, ok, err := compilePattern(arg)
+			if err != nil {
+				return err
+			}
+			if ok {
+				f.mergePatterns = append(f.mergePatterns, re)
+				continue
+			}
+			f.mergeNames = append(f.mergeNames, normalizeHost(arg))
+		}
+	case "fanout_max":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		n, err := strconv.Atoi(c.Val())
+		if err != nil {
+			return err
+		}
+		if n < 1 {
+			return fmt.Errorf("fanout_max must be at least 1: %d", n)
+		}
+		f.fanoutMax = n
+	case "early_response":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		f.early = true
+	case "conflict":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		switch x := c.Val(); x {
+		case "merge":
+			f.conflict = conflictMerge
+		case "majority":
+			f.conflict = conflictMajority
+		case "first":
+			f.conflict = conflictFirst
+		case "log":
+			f.conflict = conflictLog
+		default:
+			return c.Errf("unknown conflict policy '%s'", x)
+		}
+	case "quorum":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		n, err := strconv.Atoi(c.Val())
+		if err != nil {
+			return err
+		}
+		if n < 1 {
+			return fmt.Errorf("quorum must be at least 1: %d", n)
+		}
+		if n > len(f.proxies) {
+			return fmt.Errorf("quorum can't be larger than the number of upstreams (%d): %d", len(f.proxies), n)
+		}
+		f.quorum = n
+	case "shadow":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		proxies, err := newProxies(args)
+		if err != nil {
+			return err
+		}
+		if len(proxies) != 1 {
+			return fmt.Errorf("shadow must be a single upstream, got %d", len(proxies))
+		}
+		f.shadow = proxies[0]
+	case "cd_retry":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		proxies, err := newProxies(args)
+		if err != nil {
+			return err
+		}
+		if len(proxies) != 1 {
+			return fmt.Errorf("cd_retry must be a single upstream, got %d", len(proxies))
+		}
+		f.cdRetry = proxies[0]
+	case "fault":
+		args := c.RemainingArgs()
+		if len(args) < 2 {
+			return c.ArgErr()
+		}
+		percent, err := strconv.ParseFloat(args[0], 64)
+		if err != nil {
+			return err
+		}
+		if percent <= 0 || percent > 100 {
+			return fmt.Errorf("fault percentage must be in (0, 100]: %s", args[0])
+		}
+		fault, err := parseFault(args[1:])
+		if err != nil {
+			return err
+		}
+		rf, _ := f.faults.(randomFaults)
+		f.faults = append(rf, faultRule{percent, fault})
+	case "mirror":
+		args := c.RemainingArgs()
+		if len(args) < 2 {
+			return c.ArgErr()
+		}
+		percent, err := strconv.ParseFloat(args[0], 64)
+		if err != nil {
+			return err
+		}
+		if percent <= 0 || percent > 100 {
+			return fmt.Errorf("mirror percentage must be in (0, 100]: %s", args[0])
+		}
+		proxies, err := newProxies(args[1:])
+		if err != nil {
+			return err
+		}
+		f.mirror = proxies
+		f.mirrorPercent = percent
+	case "capture":
+		args := c.RemainingArgs()
+		if len(args) == 0 || len(args) > 3 {
+			return c.ArgErr()
+		}
+		ratio, err := strconv.ParseFloat(args[0], 64)
+		if err != nil {
+			return err
+		}
+		if ratio <= 0 || ratio > 1 {
+			return fmt.Errorf("capture ratio must be in (0, 1]: %s", args[0])
+		}
+		size, addr := defaultCaptureSize, defaultCaptureAddr
+		args = args[1:]
+		if len(args) > 0 {
+			if n, err := strconv.Atoi(args[0]); err == nil {
+				if n < 1 {
+					return fmt.Errorf("capture size must be positive: %d", n)
+				}
+				size = n
+				args = args[1:]
+			}
+		}
+		if len(args) > 0 {
+			if _, _, err := net.SplitHostPort(args[0]); err != nil {
+				return err
+			}
+			addr = args[0]
+		}
+		f.capture = newCapture(ratio, size, addr)
+	case "max_response_size":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		size, err := strconv.Atoi(args[0])
+		if err != nil {
+			return err
+		}
+		if size < dns.MinMsgSize || size > dns.MaxMsgSize {
+			return fmt.Errorf("max_response_size must be between %d and %d: %d", dns.MinMsgSize, dns.MaxMsgSize, size)
+		}
+		proxies, err := f.matchProxies(args[1:])
+		if err != nil {
+			return err
+		}
+		for _, p := range proxies {
+			p.SetMaxResponseSize(size)
+		}
+	case "health_check_source":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		ip := net.ParseIP(args[0])
+		if ip == nil {
+			return fmt.Errorf("not an IP address: %q", args[0])
+		}
+		proxies, err := f.matchProxies(args[1:])
+		if err != nil {
+			return err
+		}
+		for _, p := range proxies {
+			if err := p.SetHealthCheckSource(ip); err != nil {
+				return err
+			}
+		}
+	case "so_mark":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		mark, err := strconv.ParseUint(args[0], 0, 32)
+		if err != nil {
+			return err
+		}
+		proxies, err := f.matchProxies(args[1:])
+		if err != nil {
+			return err
+		}
+		if !featMark.supported() {
+			log.Warningf("so_mark is not supported on this platform, sockets are not marked")
+		}
+		for _, p := range proxies {
+			p.SetMark(uint32(mark))
+		}
+	case "dscp":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		dscp, err := parseDSCP(args[0])
+		if err != nil {
+			return err
+		}
+		proxies, err := f.matchProxies(args[1:])
+		if err != nil {
+			return err
+		}
+		if !featDSCP.supported() {
+			log.Warningf("dscp is not supported on this platform, packets are not marked")
+		}
+		for _, p := range proxies {
+			p.SetDSCP(dscp)
+		}
+	case "require_ra":
+		proxies, err := f.matchProxies(c.RemainingArgs())
+		if err != nil {
+			return err
+		}
+		for _, p := range proxies {
+			p.SetRequireRA(true)
+		}
+	case "qtype_allow", "qtype_deny":
+		allow := c.Val() == "qtype_allow"
+		qtypes, to, err := parseQtypes(c.RemainingArgs())
+		if err != nil {
+			return err
+		}
+		proxies, err := f.matchProxies(to)
+		if err != nil {
+			return err
+		}
+		for _, p := range proxies {
+			if err := p.SetQtypes(allow, qtypes...); err != nil {
+				return err
+			}
+		}
+	case "recursion_desired":
+		args := c.RemainingArgs()
+		if len(args) == 0 || (args[0] != "on" && args[0] != "off") {
+			return c.ArgErr()
+		}
+		proxies, err := f.matchProxies(args[1:])
+		if err != nil {
+			return err
+		}
+		for _, p := range proxies {
+			p.SetRecursionDesired(args[0] == "on")
+		}
+	case "alternate":
+		args := c.RemainingArgs()
+		if len(args) != 2 {
+			return c.ArgErr()
+		}
+		proxies, err := f.matchProxies(args[:1])
+		if err != nil {
+			return err
+		}
+		if len(proxies) != 1 {
+			return fmt.Errorf("not a single upstream: %s matches %d", args[0], len(proxies))
+		}
+		addr, err := alternateAddr(proxies[0].addr, args[1])
+		if err != nil {
+			return err
+		}
+		proxies[0].SetAlternate(addr)
+	case "rotate":
+		args := c.RemainingArgs()
+		if len(args) == 0 || len(args)%2 != 0 {
+			return c.ArgErr()
+		}
+		for i := 0; i < len(args); i += 2 {
+			switch args[i] {
+			case "queries":
+				n, err := strconv.Atoi(args[i+1])
+				if err != nil {
+					return err
+				}
+				if n < 1 {
+					return fmt.Errorf("rotate queries must be positive: %d", n)
+				}
+				f.rotate.queries = n
+			case "age":
+				dur, err := time.ParseDuration(args[i+1])
+				if err != nil {
+					return err
+				}
+				if dur <= 0 {
+					return fmt.Errorf("rotate age must be positive: %s", dur)
+				}
+				f.rotate.age = dur
+			default:
+				return fmt.Errorf("unknown rotate limit: %s", args[i])
+			}
+		}
+	case "prewarm":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		n, err := strconv.Atoi(c.Val())
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return fmt.Errorf("prewarm can't be negative: %d", n)
+		}
+		f.prewarm = n
+	case "udp_pool":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		n, err := strconv.Atoi(c.Val())
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return fmt.Errorf("udp_pool can't be negative: %d", n)
+		}
+		f.udpPool = n
+	case "async_write":
+		args := c.RemainingArgs()
+		if len(args) == 0 || len(args) > 2 {
+			return c.ArgErr()
+		}
+		workers, err := strconv.Atoi(args[0])
+		if err != nil {
+			return err
+		}
+		if workers < 1 {
+			return fmt.Errorf("async_write needs at least 1 worker: %d", workers)
+		}
+		queue := workers * defaultQueuePerWorker
+		if len(args) == 2 {
+			if queue, err = strconv.Atoi(args[1]); err != nil {
+				return err
+			}
+			if queue < 0 {
+				return fmt.Errorf("async_write queue can't be negative: %d", queue)
+			}
+		}
+		f.writer = newAsyncWriter(workers, queue)
 	case "tls":
 		args := c.RemainingArgs()
 		if len(args) > 3 {
@@ -179,36 +1050,231 @@ func parseBlock(c *caddy.Controller, f *Forward) error {
 			return err
 		}
 		f.tlsConfig = tlsConfig
+		f.tlsSet = true
+	case "tls_alpn":
+		if err := f.parseALPN(c.RemainingArgs()); err != nil {
+			return err
+		}
+	case "tls_version":
+		if err := f.parseTLSVersion(c.RemainingArgs()); err != nil {
+			return err
+		}
+	case "tls_ech":
+		if err := f.parseECH(c.RemainingArgs()); err != nil {
+			return err
+		}
+	case "tls_session_cache":
+		args := c.RemainingArgs()
+		if len(args) > 1 {
+			return c.ArgErr()
+		}
+		f.tlsSessions = defaultTLSSessions
+		if len(args) == 1 {
+			n, err := strconv.Atoi(args[0])
+			if err != nil {
+				return err
+			}
+			if n < 0 {
+				return fmt.Errorf("tls_session_cache size can't be negative: %d", n)
+			}
+			f.tlsSessions = n
+		}
+	case "tls_keylog":
+		args := c.RemainingArgs()
+		if len(args) != 1 || args[0] == "" {
+			return c.ArgErr()
+		}
+		f.keyLog = newKeyLog(args[0])
 	case "tls_servername":
 		if !c.NextArg() {
 			return c.ArgErr()
 		}
 		f.tlsServerName = c.Val()
 	case "expire":
-		if !c.NextArg() {
+		args := c.RemainingArgs()
+		if len(args) == 0 || len(args) > 2 {
 			return c.ArgErr()
 		}
-		dur, err := time.ParseDuration(c.Val())
+		dur, err := time.ParseDuration(args[0])
 		if err != nil {
 			return err
 		}
 		if dur < 0 {
 			return fmt.Errorf("expire can't be negative: %s", dur)
 		}
-		f.expire = dur
-	case "policy":
+		if len(args) == 1 {
+			f.expire = dur
+			return nil
+		}
+		proto := args[1]
+		switch proto {
+		case "udp", "tcp":
+		case "tls":
+			proto = "tcp-tls"
+		default:
+			return fmt.Errorf("expire protocol must be udp, tcp or tls: %s", args[1])
+		}
+		if f.protoExpire == nil {
+			f.protoExpire = map[string]time.Duration{}
+		}
+		f.protoExpire[proto] = dur
+	case "label":
+		if err := f.parseLabels(c.RemainingArgs()); err != nil {
+			return err
+		}
+	case "prefer_label":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		l, ok := parseLabel(c.Val())
+		if !ok || c.NextArg() {
+			return c.ArgErr()
+		}
+		f.preferLabel = &l
+	case "local_zone":
+		args := c.RemainingArgs()
+		if len(args) == 0 || len(args) > 2 || args[0] == "" {
+			return c.ArgErr()
+		}
+		f.zone = &label{defaultZoneLabel, args[0]}
+		if len(args) == 2 {
+			f.zone.key = args[1]
+		}
+	case "hosts":
+		args := c.RemainingArgs()
+		if len(args) == 0 || len(args) > 2 {
+			return c.ArgErr()
+		}
+		reload := defaultHostsReload
+		if len(args) == 2 {
+			dur, err := time.ParseDuration(args[1])
+			if err != nil {
+				return err
+			}
+			if dur < 0 {
+				return fmt.Errorf("hosts reload can't be negative: %s", dur)
+			}
+			reload = dur
+		}
+		h, err := newHosts(args[0], reload)
+		if err != nil {
+			return err
+		}
+		f.hosts = h
+	case "nxdomain_cache":
+		args := c.RemainingArgs()
+		if len(args) > 2 {
+			return c.ArgErr()
+		}
+		size, ttl := defaultNXCacheSize, defaultNXCacheTTL
+		if len(args) > 0 {
+			n, err := strconv.Atoi(args[0])
+			if err != nil {
+				return err
+			}
+			if n <= 0 {
+				return fmt.Errorf("nxdomain_cache size must be positive: %d", n)
+			}
+			size = n
+		}
+		if len(args) > 1 {
+			dur, err := time.ParseDuration(args[1])
+			if err != nil {
+				return err
+			}
+			if dur < time.Second {
+				return fmt.Errorf("nxdomain_cache ttl must be at least 1s: %s", dur)
+			}
+			ttl = dur
+		}
+		f.nxCache = newNXCache(size, ttl)
+	case "nxdomain_cache_file":
+		args := c.RemainingArgs()
+		if len(args) != 1 || args[0] == "" {
+			return c.ArgErr()
+		}
+		f.nxFile = args[0]
+	case "random_subdomain":
+		args := c.RemainingArgs()
+		if len(args) == 0 || len(args) > 3 {
+			return c.ArgErr()
+		}
+		threshold, err := strconv.Atoi(args[0])
+		if err != nil {
+			return err
+		}
+		if threshold <= 0 {
+			return fmt.Errorf("random_subdomain threshold must be positive: %d", threshold)
+		}
+		durs := []time.Duration{defaultRandomSubWindow, defaultRandomSubHold}
+		for i, arg := range args[1:] {
+			dur, err := time.ParseDuration(arg)
+			if err != nil {
+				return err
+			}
+			if dur <= 0 {
+				return fmt.Errorf("random_subdomain durations must be positive: %s", dur)
+			}
+			durs[i] = dur
+		}
+		f.randomSub = newRandomSub(threshold, durs[0], durs[1])
+	case "servfail_alert":
+		args := c.RemainingArgs()
+		if len(args) == 0 || len(args) > 3 {
+			return c.ArgErr()
+		}
+		ratio, err := strconv.ParseFloat(args[0], 64)
+		if err != nil {
+			return err
+		}
+		if ratio <= 0 || ratio >= 1 {
+			return fmt.Errorf("servfail_alert ratio must be in (0, 1): %s", args[0])
+		}
+		window, min := defaultServfailWindow, int64(defaultServfailMin)
+		if len(args) > 1 {
+			if window, err = time.ParseDuration(args[1]); err != nil {
+				return err
+			}
+			if window < time.Second {
+				return fmt.Errorf("servfail_alert window must be at least 1s: %s", window)
+			}
+		}
+		if len(args) > 2 {
+			if min, err = strconv.ParseInt(args[2], 10, 64); err != nil {
+				return err
+			}
+			if min <= 0 {
+				return fmt.Errorf("servfail_alert minimum must be positive: %d", min)
+			}
+		}
+		f.servfails = newServfailAlert(ratio, window, min)
+	case "bailiwick":
 		if !c.NextArg() {
 			return c.ArgErr()
 		}
 		switch x := c.Val(); x {
-		case "random":
-			f.p = &random{}
-		case "round_robin":
-			f.p = &roundRobin{}
-		case "sequential":
-			f.p = &sequential{}
+		case bailiwickStrip, bailiwickRefuse:
+			f.bailiwick = x
 		default:
-			return c.Errf("unknown policy '%s'", x)
+			return c.Errf("unknown bailiwick action '%s'", x)
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+	case "policy":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		p, ok := newPolicy(c.Val())
+		if !ok {
+			return c.Errf("unknown policy '%s'", c.Val())
+		}
+		f.p = p
+		switch args := c.RemainingArgs(); {
+		case len(args) == 1 && args[0] == "least_bad":
+			f.leastBad = true
+		case len(args) > 0:
+			return c.ArgErr()
 		}
 
 	default:
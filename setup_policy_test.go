@@ -18,8 +18,14 @@ func TestSetupPolicy(t *testing.T) {
 		{"forward . 127.0.0.1 {\npolicy random\n}\n", false, "random", ""},
 		{"forward . 127.0.0.1 {\npolicy round_robin\n}\n", false, "round_robin", ""},
 		{"forward . 127.0.0.1 {\npolicy sequential\n}\n", false, "sequential", ""},
+		{"forward . 127.0.0.1 {\npolicy random least_bad\n}\n", false, "random", ""},
+		{"forward . 127.0.0.1 {\npolicy rendezvous\n}\n", false, "rendezvous", ""},
+		{"forward . 127.0.0.1 {\npolicy weighted_random\n}\n", false, "weighted_random", ""},
+		{"forward . 127.0.0.1 {\nprefer_label tier=primary\npolicy sequential\n}\n", false, "sequential preferring tier=primary", ""},
 		// negative
 		{"forward . 127.0.0.1 {\npolicy random2\n}\n", true, "random", "unknown policy"},
+		{"forward . 127.0.0.1 {\npolicy random worst\n}\n", true, "random", "Wrong argument count"},
+		{"forward . 127.0.0.1 {\nprefer_label primary\n}\n", true, "random", "Wrong argument count"},
 	}
 
 	for i, test := range tests {
@@ -45,3 +51,76 @@ func TestSetupPolicy(t *testing.T) {
 		}
 	}
 }
+
+func TestSetupConflict(t *testing.T) {
+	tests := []struct {
+		input            string
+		shouldErr        bool
+		expectedConflict string
+		expectedErr      string
+	}{
+		// positive
+		{"forward . 127.0.0.1\n", false, "merge", ""},
+		{"forward . 127.0.0.1 {\nconflict merge\n}\n", false, "merge", ""},
+		{"forward . 127.0.0.1 {\nconflict majority\n}\n", false, "majority", ""},
+		{"forward . 127.0.0.1 {\nconflict first\n}\n", false, "first", ""},
+		{"forward . 127.0.0.1 {\nconflict log\n}\n", false, "log", ""},
+		// negative
+		{"forward . 127.0.0.1 {\nconflict union\n}\n", true, "", "unknown conflict policy"},
+		{"forward . 127.0.0.1 {\nconflict\n}\n", true, "", "Wrong argument count"},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		f, err := parseForward(c)
+
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: expected error but found %s for input %s", i, err, test.input)
+		}
+
+		if err != nil {
+			if !test.shouldErr {
+				t.Errorf("Test %d: expected no error but found one for input %s, got: %v", i, test.input, err)
+			}
+
+			if !strings.Contains(err.Error(), test.expectedErr) {
+				t.Errorf("Test %d: expected error to contain: %v, found error: %v, input: %s", i, test.expectedErr, err, test.input)
+			}
+		}
+
+		if !test.shouldErr && f.conflict.String() != test.expectedConflict {
+			t.Errorf("Test %d: expected: %s, got: %s", i, test.expectedConflict, f.conflict.String())
+		}
+	}
+}
+
+func TestSetupAuthoritative(t *testing.T) {
+	tests := []struct {
+		input       string
+		shouldErr   bool
+		expectedErr string
+	}{
+		{"forward . 127.0.0.1 127.0.0.2 {\nauthoritative corp.example.org from 127.0.0.2\n}\n", false, ""},
+		{"forward . 127.0.0.1 127.0.0.2 {\nauthoritative a.example.org b.example.org from 127.0.0.1:53 127.0.0.2\n}\n", false, ""},
+		{"forward . 127.0.0.1 {\nauthoritative from 127.0.0.1\n}\n", true, "at least one zone"},
+		{"forward . 127.0.0.1 {\nauthoritative example.org\n}\n", true, "needs from"},
+		{"forward . 127.0.0.1 {\nauthoritative example.org from\n}\n", true, "needs from"},
+		{"forward . 127.0.0.1 {\nauthoritative example.org from 127.0.0.3\n}\n", true, "not a configured upstream"},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		_, err := parseForward(c)
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: expected error but found none for input %s", i, test.input)
+		}
+		if err != nil {
+			if !test.shouldErr {
+				t.Errorf("Test %d: expected no error but found one for input %s, got: %v", i, test.input, err)
+			}
+			if !strings.Contains(err.Error(), test.expectedErr) {
+				t.Errorf("Test %d: expected error to contain: %v, found error: %v, input: %s", i, test.expectedErr, err, test.input)
+			}
+		}
+	}
+}
@@ -1,13 +1,16 @@
 package forward
 
 import (
+	"crypto/tls"
 	"io/ioutil"
 	"os"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/caddyserver/caddy"
+	"github.com/miekg/dns"
 )
 
 func TestSetup(t *testing.T) {
@@ -22,18 +25,95 @@ func TestSetup(t *testing.T) {
 	}{
 		// positive
 		{"forward . 127.0.0.1", false, ".", nil, 2, options{}, ""},
-		{"forward . 127.0.0.1 {\nexcept miek.nl\n}\n", false, ".", nil, 2, options{}, ""},
+		{"forward . 127.0.0.1 {\nexcept miek.nl\n}\n", false, ".", []string{"miek.nl."}, 2, options{}, ""},
+		{"forward *.example.org 127.0.0.1 {\nexcept *.miek.nl regex:^ads\\.\n}\n", false, "*.example.org", []string{}, 2, options{}, ""},
+		{"forward . 127.0.0.1 {\nexcept miek.nl nxdomain\nexcept example.org to 127.0.0.2\n}\n", false, ".", []string{"miek.nl.", "example.org."}, 2, options{}, ""},
 		{"forward . 127.0.0.1 {\nmax_fails 3\n}\n", false, ".", nil, 3, options{}, ""},
 		{"forward . 127.0.0.1 {\nforce_tcp\n}\n", false, ".", nil, 2, options{forceTCP: true}, ""},
 		{"forward . 127.0.0.1 {\nprefer_udp\n}\n", false, ".", nil, 2, options{preferUDP: true}, ""},
 		{"forward . 127.0.0.1 {\nforce_tcp\nprefer_udp\n}\n", false, ".", nil, 2, options{preferUDP: true, forceTCP: true}, ""},
 		{"forward . 127.0.0.1:53", false, ".", nil, 2, options{}, ""},
+		{"forward . 127.0.0.1 127.0.0.2 {\nquorum 2\n}\n", false, ".", nil, 2, options{}, ""},
+		{"forward . 127.0.0.1 127.0.0.2 127.0.0.3 {\nfanout_max 2\nquorum 2\n}\n", false, ".", nil, 2, options{}, ""},
+		{"forward . 127.0.0.1 127.0.0.2 {\nmerge_domains svc.example.org *.dc.example.org\n}\n", false, ".", nil, 2, options{}, ""},
+		{"forward . 127.0.0.1 127.0.0.2 {\nself_test 2 warn\n}\n", false, ".", nil, 2, options{}, ""},
+		{"forward . 127.0.0.1 {\nexpire 10s\nexpire 5m tls\n}\n", false, ".", nil, 2, options{}, ""},
+		{"forward . tls://127.0.0.1 {\nprewarm 2\n}\n", false, ".", nil, 2, options{}, ""},
+		{"forward . 127.0.0.1 {\nrotate queries 1000 age 10m\n}\n", false, ".", nil, 2, options{}, ""},
+		{"forward . 127.0.0.1 127.0.0.2 {\nretry_upstream next\n}\n", false, ".", nil, 2, options{}, ""},
+		{"forward . 127.0.0.1 {\nmax_retries 0\n}\n", false, ".", nil, 2, options{}, ""},
+		{"forward . 127.0.0.1 {\ntrace\n}\n", false, ".", nil, 2, options{}, ""},
+		{"forward . 127.0.0.1 {\nexpvar localhost:9160\n}\n", false, ".", nil, 2, options{}, ""},
+		{"forward . 127.0.0.1 {\nsame_transport\n}\n", false, ".", nil, 2, options{sameTransport: true}, ""},
+		{"forward . 127.0.0.1 {\nanonymize\n}\n", false, ".", nil, 2, options{anonymize: true, lowerQname: true}, ""},
+		{"forward . 127.0.0.1 {\nanonymize pad\n}\n", false, ".", nil, 2, options{anonymize: true, lowerQname: true, pad: true}, ""},
+		{"forward . 127.0.0.1 {\ndebug_upstream\n}\n", false, ".", nil, 2, options{}, ""},
+		{"forward . 127.0.0.1 {\ndebug_upstream txt 10.0.0.0/8 ::1\n}\n", false, ".", nil, 2, options{}, ""},
+		{"forward . 127.0.0.1 {\npprof_labels\n}\n", false, ".", nil, 2, options{}, ""},
+		{"forward . 127.0.0.1 {\ncapture 0.1\n}\n", false, ".", nil, 2, options{}, ""},
+		{"forward . 127.0.0.1 127.0.0.2 {\nmax_response_size 1232 127.0.0.2\n}\n", false, ".", nil, 2, options{}, ""},
+		{"forward . 127.0.0.1 {\nshare_upstreams\n}\n", false, ".", nil, 2, options{}, ""},
+		{"forward . 127.0.0.1 {\navoid_fragmentation\n}\n", false, ".", nil, 2, options{maxUDPSize: 1232}, ""},
+		{"forward . 127.0.0.1 {\navoid_fragmentation 1400\n}\n", false, ".", nil, 2, options{maxUDPSize: 1400}, ""},
+		{"forward . 127.0.0.1 {\nalternate 127.0.0.1 ::1\n}\n", false, ".", nil, 2, options{}, ""},
+		{"forward . [::1]:1053 {\nalternate [::1]:1053 127.0.0.1:53\n}\n", false, ".", nil, 2, options{}, ""},
+		{"forward . 127.0.0.1 {\ncapture 0.1 100 localhost:9999\n}\n", false, ".", nil, 2, options{}, ""},
 		{"forward . 127.0.0.1:8080", false, ".", nil, 2, options{}, ""},
 		{"forward . [::1]:53", false, ".", nil, 2, options{}, ""},
 		{"forward . [2003::1]:53", false, ".", nil, 2, options{}, ""},
 		// negative
 		{"forward . a27.0.0.1", true, "", nil, 0, options{}, "not an IP"},
+		{"forward . 127.0.0.1 {\nrecursion_desired yes\n}\n", true, "", nil, 0, options{}, "Wrong argument count"},
+		{"forward . 127.0.0.1 {\nbailiwick drop\n}\n", true, "", nil, 0, options{}, "unknown bailiwick action"},
+		{"forward . 127.0.0.1 {\nhosts /nonexistent/hosts\n}\n", true, "", nil, 0, options{}, "no such file"},
+		{"forward . 127.0.0.1 {\nnxdomain_cache 100 10ms\n}\n", true, "", nil, 0, options{}, "must be at least 1s"},
+		{"forward . 127.0.0.1 {\nrandom_subdomain 0\n}\n", true, "", nil, 0, options{}, "threshold must be positive"},
+		{"forward . 127.0.0.1 {\nnxdomain_cache_file /tmp/nx\n}\n", true, "", nil, 0, options{}, "needs nxdomain_cache"},
+		{"forward . 127.0.0.1 {\nservfail_alert 1.5\n}\n", true, "", nil, 0, options{}, "ratio must be in (0, 1)"},
+		{"forward . 127.0.0.1 {\nservfail_alert 0.1 100ms\n}\n", true, "", nil, 0, options{}, "window must be at least 1s"},
+		{"forward . 127.0.0.1 {\nqtype_deny 127.0.0.1\n}\n", true, "", nil, 0, options{}, "need at least one query type"},
+		{"forward . 127.0.0.1 {\nreverse 10.0.0.0/8 to\n}\n", true, "", nil, 0, options{}, "at least one upstream"},
+		{"forward . 127.0.0.1 {\npin_option 10 10.0.0.0/8\n}\n", true, "", nil, 0, options{}, "must be a local option code"},
+		{"forward . 127.0.0.1 {\ndscp 64\n}\n", true, "", nil, 0, options{}, "invalid DSCP"},
+		{"forward . tls://127.0.0.1 {\ntls_keylog\n}\n", true, "", nil, 0, options{}, "Wrong argument count"},
+		{"forward . 127.0.0.1 {\ndscp AF50\n}\n", true, "", nil, 0, options{}, "invalid DSCP"},
+		{"forward . https://127.0.0.1", true, "", nil, 0, options{}, "DNS over HTTPS upstreams are not supported"},
 		{"forward . 127.0.0.1 {\nblaatl\n}\n", true, "", nil, 0, options{}, "unknown property"},
+		{"forward . 127.0.0.1 {\nexcept regex:(a\n}\n", true, "", nil, 0, options{}, "error parsing regexp"},
+		{"forward . 127.0.0.1 {\nexcept refused\n}\n", true, "", nil, 0, options{}, "at least one domain"},
+		{"forward . 127.0.0.1 {\nexcept miek.nl refused miek.nl\n}\n", true, "", nil, 0, options{}, "unexpected argument"},
+		{"forward . 127.0.0.1 {\nexcept miek.nl to\n}\n", true, "", nil, 0, options{}, "at least one upstream"},
+		{"forward . 127.0.0.1 127.0.0.2 {\nquorum 3\n}\n", true, "", nil, 0, options{}, "quorum can't be larger"},
+		{"forward . 127.0.0.1 {\nquorum 0\n}\n", true, "", nil, 0, options{}, "quorum must be at least 1"},
+		{"forward . 127.0.0.1 {\nfanout_max 0\n}\n", true, "", nil, 0, options{}, "fanout_max must be at least 1"},
+		{"forward . 127.0.0.1 127.0.0.2 {\nfanout_max 1\nquorum 2\n}\n", true, "", nil, 0, options{}, "larger than fanout_max"},
+		{"forward . 127.0.0.1 127.0.0.2 {\nquorum 2\nearly_response\n}\n", true, "", nil, 0, options{}, "can't be combined with quorum"},
+		{"forward . 127.0.0.1 127.0.0.2 {\nquorum 2\nmerge_domains example.org\n}\n", true, "", nil, 0, options{}, "can't be combined with quorum"},
+		{"forward . 127.0.0.1 {\nmerge_domains\n}\n", true, "", nil, 0, options{}, "Wrong argument count"},
+		{"forward . 127.0.0.1 {\nself_test 2\n}\n", true, "", nil, 0, options{}, "self_test needs between 1 and 1"},
+		{"forward . 127.0.0.1 {\nexpire 10s quic\n}\n", true, "", nil, 0, options{}, "expire protocol must be"},
+		{"forward . 127.0.0.1 {\nprewarm -1\n}\n", true, "", nil, 0, options{}, "prewarm can't be negative"},
+		{"forward . 127.0.0.1 {\nrotate queries 0\n}\n", true, "", nil, 0, options{}, "rotate queries must be positive"},
+		{"forward . 127.0.0.1 {\nrotate size 10\n}\n", true, "", nil, 0, options{}, "unknown rotate limit"},
+		{"forward . 127.0.0.1 {\nretry_upstream other\n}\n", true, "", nil, 0, options{}, "retry_upstream must be same or next"},
+		{"forward . 127.0.0.1 {\nmax_retries -1\n}\n", true, "", nil, 0, options{}, "max_retries can't be negative"},
+		{"forward . 127.0.0.1 {\ntrace localhost\n}\n", true, "", nil, 0, options{}, "missing port"},
+		{"forward . 127.0.0.1 {\nexpvar localhost\n}\n", true, "", nil, 0, options{}, "missing port"},
+		{"forward . 127.0.0.1 {\nsame_transport\nforce_tcp\n}\n", true, "", nil, 0, options{}, "can't be combined"},
+		{"forward . tls://127.0.0.1 {\nsame_transport\n}\n", true, "", nil, 0, options{}, "plain DNS upstreams"},
+		{"forward . 127.0.0.1 {\nanonymize padding\n}\n", true, "", nil, 0, options{}, "Wrong argument count"},
+		{"forward . 127.0.0.1 {\ndebug_upstream ede example.org\n}\n", true, "", nil, 0, options{}, "invalid CIDR"},
+		{"forward . 127.0.0.1 {\npprof_labels yes\n}\n", true, "", nil, 0, options{}, "Wrong argument count"},
+		{"forward . 127.0.0.1 {\ncapture 2\n}\n", true, "", nil, 0, options{}, "capture ratio"},
+		{"forward . 127.0.0.1 {\nmax_response_size 100\n}\n", true, "", nil, 0, options{}, "max_response_size must be between"},
+		{"forward . 127.0.0.1 {\nmax_response_size 1232 127.0.0.2\n}\n", true, "", nil, 0, options{}, "not a configured upstream"},
+		{"forward . 127.0.0.1 {\navoid_fragmentation 100\n}\n", true, "", nil, 0, options{}, "avoid_fragmentation size must be between"},
+		{"forward . 127.0.0.1 {\nalternate 127.0.0.1 127.0.0.2\n}\n", true, "", nil, 0, options{}, "same address family"},
+		{"forward . 127.0.0.1 {\nalternate 127.0.0.1 example.org\n}\n", true, "", nil, 0, options{}, "not an IP address"},
+		{"forward . 127.0.0.1 {\nalternate 127.0.0.2 ::1\n}\n", true, "", nil, 0, options{}, "not a configured upstream"},
+		{"forward . 127.0.0.1 {\nalternate ::1\n}\n", true, "", nil, 0, options{}, "Wrong argument count"},
+		{"forward . 127.0.0.1 127.0.0.2 {\nlabel az=eu1 127.0.0.1 127.0.0.2\nalternate label:az=eu1 ::1\n}\n", true, "", nil, 0, options{}, "not a single upstream"},
+		{"forward . 127.0.0.1 {\ncapture 0.1 100 localhost\n}\n", true, "", nil, 0, options{}, "missing port"},
 		{`forward . ::1
 		forward com ::2`, true, "", nil, 0, options{}, "plugin"},
 	}
@@ -60,8 +140,12 @@ func TestSetup(t *testing.T) {
 			t.Errorf("Test %d: expected: %s, got: %s", i, test.expectedFrom, f.from)
 		}
 		if !test.shouldErr && test.expectedIgnored != nil {
-			if !reflect.DeepEqual(f.ignored, test.expectedIgnored) {
-				t.Errorf("Test %d: expected: %q, actual: %q", i, test.expectedIgnored, f.ignored)
+			ignored := []string{}
+			for _, e := range f.except {
+				ignored = append(ignored, e.names...)
+			}
+			if !reflect.DeepEqual(ignored, test.expectedIgnored) {
+				t.Errorf("Test %d: expected: %q, actual: %q", i, test.expectedIgnored, ignored)
 			}
 		}
 		if !test.shouldErr && f.maxfails != test.expectedFails {
@@ -121,6 +205,66 @@ func TestSetupTLS(t *testing.T) {
 	}
 }
 
+func TestSetupTLSKeyLog(t *testing.T) {
+	c := caddy.NewTestController("dns", "forward . tls://127.0.0.1 127.0.0.2 {\ntls_keylog /tmp/keys\n}\n")
+	f, err := parseForward(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := f.proxies[0].transport.(*persistentTransport).tlsConfig.KeyLogWriter; w != f.keyLog {
+		t.Errorf("Expected the TLS upstream to write to the key log, got %v", w)
+	}
+	if _, ok := f.shareKey(f.proxies[0]); ok {
+		t.Errorf("Expected a TLS upstream with a key log not to be shared")
+	}
+}
+
+func TestSetupTLSOptions(t *testing.T) {
+	tests := []struct {
+		input       string
+		shouldErr   bool
+		expectedErr string
+		expected    []tlsOptions // per upstream
+	}{
+		// positive
+		{"forward . tls://127.0.0.1 tls://127.0.0.2 {\ntls_alpn dot,h2\n}\n", false, "",
+			[]tlsOptions{{alpn: []string{"dot", "h2"}}, {alpn: []string{"dot", "h2"}}}},
+		{"forward . tls://127.0.0.1 tls://127.0.0.2 {\ntls_version 1.3 tls://127.0.0.2\n}\n", false, "",
+			[]tlsOptions{{}, {minVersion: tls.VersionTLS13}}},
+		{"forward . tls://127.0.0.1 {\ntls_version 1.2 1.2\ntls_alpn dot\n}\n", false, "",
+			[]tlsOptions{{alpn: []string{"dot"}, minVersion: tls.VersionTLS12, maxVersion: tls.VersionTLS12}}},
+		// negative
+		{"forward . tls://127.0.0.1 {\ntls_alpn\n}\n", true, "at least one protocol", nil},
+		{"forward . tls://127.0.0.1 {\ntls_alpn dot,\n}\n", true, "empty ALPN protocol", nil},
+		{"forward . tls://127.0.0.1 {\ntls_version 2.0\n}\n", true, "unknown TLS version", nil},
+		{"forward . tls://127.0.0.1 {\ntls_version 1.3 1.2\n}\n", true, "lower than the minimum", nil},
+		{"forward . tls://127.0.0.1 {\ntls_version 1.2 127.0.0.3\n}\n", true, "not a configured upstream", nil},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		f, err := parseForward(c)
+
+		if test.shouldErr {
+			if err == nil || !strings.Contains(err.Error(), test.expectedErr) {
+				t.Errorf("Test %d: expected error to contain: %v, found error: %v, input: %s", i, test.expectedErr, err, test.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: expected no error but found one for input %s, got: %v", i, test.input, err)
+			continue
+		}
+		for j, p := range f.proxies {
+			cfg := p.transport.(*persistentTransport).tlsConfig
+			o := test.expected[j]
+			if !reflect.DeepEqual(cfg.NextProtos, o.alpn) || cfg.MinVersion != o.minVersion || cfg.MaxVersion != o.maxVersion {
+				t.Errorf("Test %d: expected %+v for %s, got ALPN %v and versions %x to %x", i, o, p.addr, cfg.NextProtos, cfg.MinVersion, cfg.MaxVersion)
+			}
+		}
+	}
+}
+
 func TestSetupResolvconf(t *testing.T) {
 	const resolv = "resolv.conf"
 	if err := ioutil.WriteFile(resolv,
@@ -172,3 +316,155 @@ nameserver 10.10.255.253`), 0666); err != nil {
 		}
 	}
 }
+
+func TestSetupHealthCheck(t *testing.T) {
+	tests := []struct {
+		input         string
+		shouldErr     bool
+		expectedProbe HealthProbe
+		expectedErr   string
+	}{
+		// positive
+		{"forward . 127.0.0.1\n", false, HealthProbe{Domain: ".", RecursionDesired: true}, ""},
+		{"forward . 127.0.0.1 {\nhealth_check 0.5s\n}\n", false, HealthProbe{Domain: ".", RecursionDesired: true}, ""},
+		{"forward . 127.0.0.1 {\nhealth_check 0.5s no_rec\n}\n", false, HealthProbe{Domain: "."}, ""},
+		{"forward . 127.0.0.1 {\nhealth_check 0.5s domain Example.ORG minimize\n}\n", false, HealthProbe{Domain: "example.org.", Minimize: true, RecursionDesired: true}, ""},
+		{"forward . 127.0.0.1 {\nhealth_check 0.5s dnssec cd\n}\n", false, HealthProbe{Domain: ".", RecursionDesired: true, DNSSECOK: true, CheckingDisabled: true}, ""},
+		// negative
+		{"forward . 127.0.0.1 {\nhealth_check 0.5s domain\n}\n", true, HealthProbe{}, "Wrong argument count"},
+		{"forward . 127.0.0.1 {\nhealth_check 0.5s bogus\n}\n", true, HealthProbe{}, "unknown option"},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		f, err := parseForward(c)
+
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: expected error but found %s for input %s", i, err, test.input)
+		}
+
+		if err != nil {
+			if !test.shouldErr {
+				t.Errorf("Test %d: expected no error but found one for input %s, got: %v", i, test.input, err)
+			}
+
+			if !strings.Contains(err.Error(), test.expectedErr) {
+				t.Errorf("Test %d: expected error to contain: %v, found error: %v, input: %s", i, test.expectedErr, err, test.input)
+			}
+		}
+
+		if !test.shouldErr {
+			if f.hcProbe != test.expectedProbe {
+				t.Errorf("Test %d: expected: %+v, got: %+v", i, test.expectedProbe, f.hcProbe)
+			}
+			if probe := f.proxies[0].health.(*dnsHc).probe; probe != test.expectedProbe {
+				t.Errorf("Test %d: expected healthchecker probe: %+v, got: %+v", i, test.expectedProbe, probe)
+			}
+		}
+	}
+}
+
+func TestSetupClearAD(t *testing.T) {
+	c := caddy.NewTestController("dns", "forward . 127.0.0.1 {\nclear_ad\n}\n")
+	f, err := parseForward(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if !f.clearAD {
+		t.Errorf("Expected clearAD to be set")
+	}
+
+	c = caddy.NewTestController("dns", "forward . 127.0.0.1 {\nclear_ad yes\n}\n")
+	if _, err := parseForward(c); err == nil {
+		t.Errorf("Expected error for clear_ad with an argument")
+	}
+}
+
+func TestSetupFault(t *testing.T) {
+	tests := []struct {
+		input          string
+		shouldErr      bool
+		expectedFaults randomFaults
+		expectedErr    string
+	}{
+		// positive
+		{"forward . 127.0.0.1 {\nfault 10 drop\n}\n", false, randomFaults{{10, Fault{Kind: FaultDrop}}}, ""},
+		{"forward . 127.0.0.1 {\nfault 5 delay 100ms\nfault 1 rcode servfail\n}\n", false,
+			randomFaults{{5, Fault{Delay: 100 * time.Millisecond}}, {1, Fault{Kind: FaultRcode, Rcode: dns.RcodeServerFailure}}}, ""},
+		// negative
+		{"forward . 127.0.0.1 {\nfault 10\n}\n", true, nil, "Wrong argument count"},
+		{"forward . 127.0.0.1 {\nfault 0 drop\n}\n", true, nil, "fault percentage"},
+		{"forward . 127.0.0.1 {\nfault 10 delay -1s\n}\n", true, nil, "negative or zero"},
+		{"forward . 127.0.0.1 {\nfault 10 rcode bogus\n}\n", true, nil, "unknown rcode"},
+		{"forward . 127.0.0.1 {\nfault 10 explode\n}\n", true, nil, "unknown fault"},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		f, err := parseForward(c)
+
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: expected error but found %s for input %s", i, err, test.input)
+		}
+
+		if err != nil {
+			if !test.shouldErr {
+				t.Errorf("Test %d: expected no error but found one for input %s, got: %v", i, test.input, err)
+			}
+
+			if !strings.Contains(err.Error(), test.expectedErr) {
+				t.Errorf("Test %d: expected error to contain: %v, found error: %v, input: %s", i, test.expectedErr, err, test.input)
+			}
+		}
+
+		if !test.shouldErr && !reflect.DeepEqual(f.faults, test.expectedFaults) {
+			t.Errorf("Test %d: expected faults %v, got: %v", i, test.expectedFaults, f.faults)
+		}
+	}
+}
+
+func TestSetupMirror(t *testing.T) {
+	tests := []struct {
+		input           string
+		shouldErr       bool
+		expectedPercent float64
+		expectedMirrors int
+		expectedErr     string
+	}{
+		// positive
+		{"forward . 127.0.0.1 {\nmirror 10 127.0.0.2\n}\n", false, 10, 1, ""},
+		{"forward . 127.0.0.1 {\nmirror 0.5 127.0.0.2 127.0.0.3:5353\n}\n", false, 0.5, 2, ""},
+		// negative
+		{"forward . 127.0.0.1 {\nmirror 10\n}\n", true, 0, 0, "Wrong argument count"},
+		{"forward . 127.0.0.1 {\nmirror 101 127.0.0.2\n}\n", true, 0, 0, "mirror percentage"},
+		{"forward . 127.0.0.1 {\nmirror 10 a27.0.0.2\n}\n", true, 0, 0, "not an IP"},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		f, err := parseForward(c)
+
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: expected error but found %s for input %s", i, err, test.input)
+		}
+
+		if err != nil {
+			if !test.shouldErr {
+				t.Errorf("Test %d: expected no error but found one for input %s, got: %v", i, test.input, err)
+			}
+
+			if !strings.Contains(err.Error(), test.expectedErr) {
+				t.Errorf("Test %d: expected error to contain: %v, found error: %v, input: %s", i, test.expectedErr, err, test.input)
+			}
+		}
+
+		if !test.shouldErr {
+			if f.mirrorPercent != test.expectedPercent {
+				t.Errorf("Test %d: expected: %f, got: %f", i, test.expectedPercent, f.mirrorPercent)
+			}
+			if len(f.mirror) != test.expectedMirrors {
+				t.Errorf("Test %d: expected %d mirrors, got: %d", i, test.expectedMirrors, len(f.mirror))
+			}
+		}
+	}
+}
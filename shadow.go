@@ -0,0 +1,31 @@
+package forward
+
+import (
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// shadowKey returns the key compareShadow compares the shadow's response against. It must be called
+// before ret is handed to the client, as ret may be modified on the way out.
+func shadowKey(ret *dns.Msg) string {
+	if ret == nil {
+		return ""
+	}
+	return rrsetKey(ret)
+}
+
+// compareShadow waits for the shadow upstream's response and compares it against key, the shadowKey
+// of the message served to the client. The outcome is only logged and counted.
+func (f *Forward) compareShadow(state request.Request, key string, shadow <-chan fwdResp) {
+	resp := <-shadow
+	switch {
+	case resp.ret == nil:
+		ShadowCount.WithLabelValues("error").Add(1)
+	case key != "" && rrsetKey(resp.ret) == key:
+		ShadowCount.WithLabelValues("match").Add(1)
+	default:
+		ShadowCount.WithLabelValues("mismatch").Add(1)
+		log.Infof("Shadow upstream %s disagrees for %s %s", resp.proxy.addr, displayName(state.QName(), f.idnDisplay), state.Type())
+	}
+}
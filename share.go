@@ -0,0 +1,108 @@
+package forward
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/coredns/coredns/plugin/pkg/transport"
+)
+
+// sharedUpstreams is the process wide registry of upstreams used by Forwards with share_upstreams. Forwards
+// whose upstream has the same address, transport and settings use one Proxy for it, so one connection cache
+// and one health checker, e.g. the blocks of a split-zone config that forward to the same resolvers.
+var sharedUpstreams = struct {
+	sync.Mutex
+	m map[string]*sharedUpstream
+}{m: map[string]*sharedUpstream{}}
+
+// sharedUpstream is a Proxy in use by several Forwards. It's started by the first of them and stopped by
+// the last.
+type sharedUpstream struct {
+	key      string
+	p        *Proxy
+	maxfails uint32
+	users    []*Forward
+}
+
+// shareKey returns the key of p in sharedUpstreams: everything about p that configures its connections and
+// health checks. Ok is false for upstreams with client certificates or a tls_keylog, those aren't shared.
+func (f *Forward) shareKey(p *Proxy) (key string, ok bool) {
+	if (f.tlsSet || f.keyLog != nil) && (p.trans == transport.TLS || p.trans == transport.GRPC) {
+		return "", false
+	}
+	alt := ""
+	if t, ok := p.transport.(*persistentTransport); ok {
+		alt = t.altAddr
+	}
+	return fmt.Sprintf("%s|%s|%s|%d|%+v|%d|%s|%s|%+v|%s|%v|%d|%d|%+v|%t|%d|%s|%s|%d|%t|%s|%s|%d|%d", p.trans, p.addr, f.tlsServerName, f.tlsSessions,
+		f.tlsOpts[p], f.maxfails, f.failDecay, f.hcInterval, f.hcProbe, f.expire, f.protoExpire, f.udpPool, f.prewarm, f.rotate, f.dontFrag, p.maxSize, alt,
+		p.labelString(), p.rd, p.needRA, p.qtypes, p.hcSrc, p.mark, p.dscp), true
+}
+
+// shareUpstreams replaces the proxies of f by the shared ones of sharedUpstreams, registering and starting
+// those that aren't shared yet. The proxies in f.shared are started and stopped through sharedUpstreams.
+func (f *Forward) shareUpstreams() {
+	sharedUpstreams.Lock()
+	defer sharedUpstreams.Unlock()
+
+	replaced := map[*Proxy]*Proxy{}
+	f.shared = map[*Proxy]bool{}
+	for i, p := range f.proxies {
+		key, ok := f.shareKey(p)
+		if !ok {
+			continue
+		}
+		s := sharedUpstreams.m[key]
+		if s == nil {
+			s = &sharedUpstream{key: key, p: p, maxfails: f.maxfails}
+			p.onChange = s.checkState
+			p.start(f.hcInterval)
+			sharedUpstreams.m[key] = s
+		}
+		s.users = append(s.users, f)
+		replaced[p] = s.p
+		f.proxies[i] = s.p
+		f.shared[s.p] = true
+	}
+	for i := range f.authorities {
+		for j, p := range f.authorities[i].proxies {
+			if s, ok := replaced[p]; ok {
+				f.authorities[i].proxies[j] = s
+			}
+		}
+	}
+}
+
+// unshareUpstreams removes f as a user of its shared proxies, and stops those f was the last user of.
+func (f *Forward) unshareUpstreams() {
+	sharedUpstreams.Lock()
+	defer sharedUpstreams.Unlock()
+
+	for _, s := range sharedUpstreams.m {
+		for i, u := range s.users {
+			if u == f {
+				s.users = append(s.users[:i], s.users[i+1:]...)
+				break
+			}
+		}
+		if len(s.users) == 0 {
+			s.p.stop()
+			delete(sharedUpstreams.m, s.key)
+		}
+	}
+	f.shared = nil
+}
+
+// checkState calls the hooks of all users of s if its state changed since the last call.
+func (s *sharedUpstream) checkState(p *Proxy) {
+	up, changed := p.stateChange(s.maxfails)
+	if !changed {
+		return
+	}
+	sharedUpstreams.Lock()
+	users := append([]*Forward(nil), s.users...)
+	sharedUpstreams.Unlock()
+	for _, f := range users {
+		f.callHooks(p.addr, up)
+	}
+}
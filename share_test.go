@@ -0,0 +1,53 @@
+package forward
+
+import (
+	"testing"
+
+	"github.com/caddyserver/caddy"
+)
+
+func TestShareUpstreams(t *testing.T) {
+	forward := func(input string) *Forward {
+		f, err := parseForward(caddy.NewTestController("dns", input))
+		if err != nil {
+			t.Fatalf("Failed to create forwarder: %s", err)
+		}
+		if err := f.OnStartup(); err != nil {
+			t.Fatalf("Failed to start: %s", err)
+		}
+		return f
+	}
+	f1 := forward("forward example.org 127.0.0.1 127.0.0.2 {\nshare_upstreams\nauthoritative example.org from 127.0.0.1\n}")
+	f2 := forward("forward example.net 127.0.0.1 {\nshare_upstreams\n}")
+	f3 := forward("forward example.com 127.0.0.1 {\nshare_upstreams\nmax_fails 5\n}")
+	f4 := forward("forward example.info 127.0.0.1")
+	defer f3.OnShutdown()
+	defer f4.OnShutdown()
+
+	if f1.proxies[0] != f2.proxies[0] {
+		t.Errorf("Expected 127.0.0.1 to be shared")
+	}
+	if f1.authorities[0].proxies[0] != f1.proxies[0] {
+		t.Errorf("Expected authoritative to use the shared proxy")
+	}
+	if f3.proxies[0] == f1.proxies[0] || f4.proxies[0] == f1.proxies[0] {
+		t.Errorf("Expected upstreams with other settings or without share_upstreams not to be shared")
+	}
+
+	key, _ := f1.shareKey(f1.proxies[0])
+	f1.OnShutdown()
+	sharedUpstreams.Lock()
+	s := sharedUpstreams.m[key]
+	sharedUpstreams.Unlock()
+	if s == nil || len(s.users) != 1 || s.users[0] != f2 {
+		t.Fatalf("Expected the shared upstream to stay registered for its other user")
+	}
+
+	f2.OnShutdown()
+	sharedUpstreams.Lock()
+	_, ok := sharedUpstreams.m[key]
+	sharedUpstreams.Unlock()
+	if ok {
+		t.Errorf("Expected the shared upstream to be removed with its last user")
+	}
+}
@@ -0,0 +1,70 @@
+package forward
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Socket tuning is platform specific. sockopt_linux.go implements it, sockopt_other.go degrades every feature
+// to a no-op, so forward builds and runs on any platform Go supports, just with less tuning. Another platform
+// gets its own file by providing sockFeatures, udpControl, streamControl and unreachableReason.
+
+// sockFeature is a socket tuning feature that isn't available on every platform.
+type sockFeature int
+
+const (
+	featErrQueue     sockFeature = iota // ICMP errors are read from the UDP socket error queue
+	featDontFragment                    // UDP datagrams are sent with DF set
+	featMark                            // sockets get a firewall mark, see so_mark
+	featDSCP                            // packets get a DSCP, see dscp
+)
+
+func (s sockFeature) String() string {
+	switch s {
+	case featErrQueue:
+		return "error queue"
+	case featDontFragment:
+		return "dont fragment"
+	case featMark:
+		return "mark"
+	case featDSCP:
+		return "dscp"
+	}
+	return "unknown"
+}
+
+// supported reports if s is available on this platform.
+func (s sockFeature) supported() bool { return sockFeatures[s] }
+
+// setOptional applies a socket option of s with set. Options are tuning, a socket works without them, so a
+// failure, e.g. by an old kernel, is logged and otherwise ignored.
+func setOptional(s sockFeature, set func() error) {
+	if err := set(); err != nil {
+		log.Debugf("Failed to set socket option for %s: %s", s, err)
+	}
+}
+
+// dscpClasses are the names of the common DSCP values, RFC 2474, RFC 2597 and RFC 3246.
+var dscpClasses = map[string]uint8{
+	"CS0": 0, "CS1": 8, "CS2": 16, "CS3": 24, "CS4": 32, "CS5": 40, "CS6": 48, "CS7": 56,
+	"AF11": 10, "AF12": 12, "AF13": 14, "AF21": 18, "AF22": 20, "AF23": 22,
+	"AF31": 26, "AF32": 28, "AF33": 30, "AF41": 34, "AF42": 36, "AF43": 38,
+	"EF": 46,
+}
+
+// parseDSCP parses a DSCP given as a class name, e.g. AF41, or as a number between 0 and 63.
+func parseDSCP(s string) (uint8, error) {
+	if d, ok := dscpClasses[strings.ToUpper(s)]; ok {
+		return d, nil
+	}
+	d, err := strconv.ParseUint(s, 0, 8)
+	if err != nil || d > 63 {
+		return 0, fmt.Errorf("invalid DSCP: %s", s)
+	}
+	return uint8(d), nil
+}
+
+// controlFunc is the type of net.Dialer's Control.
+type controlFunc func(network, address string, c syscall.RawConn) error
@@ -0,0 +1,144 @@
+package forward
+
+import (
+	"net"
+	"syscall"
+)
+
+var sockFeatures = map[sockFeature]bool{featErrQueue: true, featDontFragment: true, featMark: true, featDSCP: true}
+
+// udpControl returns the control function for dialing UDP sockets. It sets IP_RECVERR, so every ICMP error
+// for the upstream fails the next read and is queued on the socket's error queue. Without it Linux only
+// reports port unreachable. With df, it also sets IP_PMTUDISC_DO, which sets DF on every datagram. A mark and
+// a DSCP other than 0 are set as by streamControl.
+func udpControl(df bool, mark uint32, dscp uint8) controlFunc {
+	return func(network, address string, c syscall.RawConn) error {
+		return c.Control(func(fd uintptr) {
+			setMark(fd, mark)
+			setDSCP(fd, network, dscp)
+			level, recvErr, mtuDiscover, pmtuDo := syscall.SOL_IP, syscall.IP_RECVERR, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO
+			if network == "udp6" {
+				level, recvErr, mtuDiscover, pmtuDo = syscall.SOL_IPV6, syscall.IPV6_RECVERR, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_DO
+			}
+			setOptional(featErrQueue, func() error { return syscall.SetsockoptInt(int(fd), level, recvErr, 1) })
+			if df {
+				setOptional(featDontFragment, func() error { return syscall.SetsockoptInt(int(fd), level, mtuDiscover, pmtuDo) })
+			}
+		})
+	}
+}
+
+// streamControl returns the control function for dialing TCP sockets, nil if there's nothing to set. A mark
+// other than 0 is set as SO_MARK, a DSCP other than 0 as IP_TOS or IPV6_TCLASS.
+func streamControl(mark uint32, dscp uint8) controlFunc {
+	if mark == 0 && dscp == 0 {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		return c.Control(func(fd uintptr) {
+			setMark(fd, mark)
+			setDSCP(fd, network, dscp)
+		})
+	}
+}
+
+// setMark sets SO_MARK, for policy routing and firewall rules. That needs CAP_NET_ADMIN.
+func setMark(fd uintptr, mark uint32) {
+	if mark != 0 {
+		setOptional(featMark, func() error { return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, int(mark)) })
+	}
+}
+
+// setDSCP sets the DSCP of the packets sent on fd, the upper six bits of the TOS or traffic class. ECN, the
+// lower two, is left to the kernel.
+func setDSCP(fd uintptr, network string, dscp uint8) {
+	if dscp == 0 {
+		return
+	}
+	level, opt := syscall.IPPROTO_IP, syscall.IP_TOS
+	if network == "udp6" || network == "tcp6" {
+		level, opt = syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS
+	}
+	setOptional(featDSCP, func() error { return syscall.SetsockoptInt(int(fd), level, opt, int(dscp)<<2) })
+}
+
+// Origins of a sock_extended_err, see linux/errqueue.h.
+const (
+	eeOriginICMP  = 2
+	eeOriginICMP6 = 3
+)
+
+// unreachableReason reads the ICMP error that failed a read on c from the socket's error queue, and returns it
+// as a label for FastFailCount. It falls back to the reason of err if the queue is empty.
+func unreachableReason(c net.Conn, err error) string {
+	uc, ok := c.(*net.UDPConn)
+	if !ok {
+		return errnoReason(err)
+	}
+	rc, rerr := uc.SyscallConn()
+	if rerr != nil {
+		return errnoReason(err)
+	}
+	oob := make([]byte, 512)
+	n := 0
+	rc.Read(func(fd uintptr) bool {
+		_, n, _, _, rerr = syscall.Recvmsg(int(fd), nil, oob, syscall.MSG_ERRQUEUE|syscall.MSG_DONTWAIT)
+		return true
+	})
+	if rerr != nil {
+		return errnoReason(err)
+	}
+	msgs, rerr := syscall.ParseSocketControlMessage(oob[:n])
+	if rerr != nil {
+		return errnoReason(err)
+	}
+	for _, m := range msgs {
+		// struct sock_extended_err: u32 ee_errno, u8 ee_origin, u8 ee_type, u8 ee_code, ...
+		if len(m.Data) < 7 {
+			continue
+		}
+		switch m.Data[4] {
+		case eeOriginICMP:
+			return icmpReason(m.Data[5], m.Data[6])
+		case eeOriginICMP6:
+			return icmp6Reason(m.Data[5], m.Data[6])
+		}
+	}
+	return errnoReason(err)
+}
+
+// icmpReason returns the label for an ICMP destination unreachable of code.
+func icmpReason(typ, code uint8) string {
+	if typ != 3 {
+		return "other"
+	}
+	switch code {
+	case 0:
+		return "net"
+	case 1:
+		return "host"
+	case 3:
+		return "port"
+	case 9, 10, 13:
+		return "prohibited"
+	}
+	return "other"
+}
+
+// icmp6Reason returns the label for an ICMPv6 destination unreachable of code.
+func icmp6Reason(typ, code uint8) string {
+	if typ != 1 {
+		return "other"
+	}
+	switch code {
+	case 0:
+		return "net"
+	case 3:
+		return "host"
+	case 4:
+		return "port"
+	case 1:
+		return "prohibited"
+	}
+	return "other"
+}
@@ -0,0 +1,82 @@
+package forward
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestMark(t *testing.T) {
+	for _, network := range []string{"udp", "tcp"} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+
+		d := net.Dialer{Control: streamControl(42, 0)}
+		if network == "udp" {
+			d.Control = udpControl(false, 42, 0)
+		}
+		c, err := d.Dial(network, l.Addr().String())
+		if err != nil {
+			t.Fatalf("Expected socket options to never fail a dial, got %s", err)
+		}
+		defer c.Close()
+
+		rc, err := c.(syscall.Conn).SyscallConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var mark int
+		rc.Control(func(fd uintptr) { mark, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mark != 42 && mark != 0 {
+			t.Errorf("%s: expected mark 42, got %d", network, mark)
+		}
+		if mark == 0 {
+			t.Logf("%s: mark not set, no CAP_NET_ADMIN", network)
+		}
+	}
+}
+
+func TestDSCP(t *testing.T) {
+	for _, network := range []string{"udp4", "tcp4", "udp6", "tcp6"} {
+		addr := "127.0.0.1:0"
+		level, opt := syscall.IPPROTO_IP, syscall.IP_TOS
+		if network[3] == '6' {
+			addr = "[::1]:0"
+			level, opt = syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS
+		}
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			continue // no IPv6
+		}
+		defer l.Close()
+
+		d := net.Dialer{Control: streamControl(0, 46)}
+		if network[:3] == "udp" {
+			d.Control = udpControl(false, 0, 46)
+		}
+		c, err := d.Dial(network, l.Addr().String())
+		if err != nil {
+			t.Fatalf("Expected socket options to never fail a dial, got %s", err)
+		}
+		defer c.Close()
+
+		rc, err := c.(syscall.Conn).SyscallConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var tos int
+		rc.Control(func(fd uintptr) { tos, err = syscall.GetsockoptInt(int(fd), level, opt) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tos != 46<<2 {
+			t.Errorf("%s: expected TOS %d, got %d", network, 46<<2, tos)
+		}
+	}
+}
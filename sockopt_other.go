@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package forward
+
+import "net"
+
+// No socket tuning on this platform. A connected UDP socket still reports port unreachable as a refused read,
+// and avoid_fragmentation still caps the payload, it just can't set DF. There are no marks or DSCPs.
+var sockFeatures = map[sockFeature]bool{}
+
+func udpControl(df bool, mark uint32, dscp uint8) controlFunc { return nil }
+
+func streamControl(mark uint32, dscp uint8) controlFunc { return nil }
+
+// unreachableReason returns the reason of err as a label for FastFailCount.
+func unreachableReason(c net.Conn, err error) string { return errnoReason(err) }
@@ -0,0 +1,20 @@
+package forward
+
+import (
+	"net"
+	"testing"
+)
+
+func TestUDPControl(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:53", "[::1]:53"} {
+		d := net.Dialer{Control: udpControl(true, 42, 46)}
+		c, err := d.Dial("udp", addr)
+		if err != nil {
+			if addr[0] == '[' {
+				continue // no IPv6
+			}
+			t.Fatalf("Expected socket options to never fail a dial, got %s", err)
+		}
+		c.Close()
+	}
+}
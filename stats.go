@@ -0,0 +1,59 @@
+package forward
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ProxyStats holds the statistics of a single upstream.
+type ProxyStats struct {
+	Addr        string
+	Queries     uint64        // exchanges with the upstream
+	Failures    uint64        // exchanges that returned an error
+	AvgRTT      time.Duration // moving average of the round trip time of successful exchanges
+	CachedConns int           // idle connections in the connection cache of the default transport
+	Fails       uint32        // current fail count, reset by a successful health check and decayed by fail_decay
+	Down        bool          // only set by Forward.Stats, as it depends on max_fails
+	Draining    bool          // see Forward.SetUpstreamDraining
+}
+
+// Stats returns the statistics of p.
+func (p *Proxy) Stats() ProxyStats {
+	ps := ProxyStats{
+		Addr:     p.addr,
+		Queries:  atomic.LoadUint64(&p.queries),
+		Failures: atomic.LoadUint64(&p.failures),
+		AvgRTT:   time.Duration(atomic.LoadInt64(&p.avgRtt)),
+		Fails:    p.failCount(),
+		Draining: atomic.LoadUint32(&p.drained) == 1,
+	}
+	if t, ok := p.transport.(*persistentTransport); ok {
+		ps.CachedConns = int(atomic.LoadInt64(&t.cached))
+	}
+	return ps
+}
+
+// ForwardStats holds the statistics of all upstreams of a Forward.
+type ForwardStats struct {
+	Queries  uint64
+	Failures uint64
+	Healthy  int // number of proxies that are not down
+	Proxies  []ProxyStats
+}
+
+// Stats returns the statistics of all configured proxies, in configuration order, and their totals.
+func (f *Forward) Stats() ForwardStats {
+	f = f.current()
+	fs := ForwardStats{Proxies: make([]ProxyStats, len(f.proxies))}
+	for i, p := range f.proxies {
+		ps := p.Stats()
+		ps.Down = p.Down(f.maxfails)
+		if !ps.Down {
+			fs.Healthy++
+		}
+		fs.Queries += ps.Queries
+		fs.Failures += ps.Failures
+		fs.Proxies[i] = ps
+	}
+	return fs
+}
@@ -0,0 +1,40 @@
+package forward
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+func TestStats(t *testing.T) {
+	s := newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	f := New()
+	f.SetProxy(NewProxy(s.Addr, transport.DNS))
+	defer f.OnShutdown()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	for i := 0; i < 3; i++ {
+		f.ServeDNS(context.TODO(), dnstest.NewRecorder(&test.ResponseWriter{}), m)
+	}
+
+	fs := f.Stats()
+	if fs.Queries != 3 || fs.Failures != 0 || fs.Healthy != 1 {
+		t.Errorf("Expected 3 queries, 0 failures and 1 healthy proxy, got %+v", fs)
+	}
+	ps := fs.Proxies[0]
+	if ps.Addr != s.Addr || ps.AvgRTT <= 0 || ps.Down {
+		t.Errorf("Unexpected proxy stats: %+v", ps)
+	}
+}
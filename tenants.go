@@ -0,0 +1,168 @@
+package forward
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/metadata"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// Tenants serves several Forward configurations, the tenants, as one plugin.Handler. A query is served by
+// the first tenant, in the order they were added, whose selector matches it; queries no tenant selects go
+// to Next, which must be set before tenants are added. Tenants that forward to the same upstream share its
+// connection cache, so adding tenants doesn't multiply the sockets to common upstreams.
+type Tenants struct {
+	mu      sync.RWMutex
+	tenants []*tenant
+
+	Next plugin.Handler
+}
+
+// TenantSelector selects the queries of a tenant. A zero field matches any query.
+type TenantSelector struct {
+	View string // value of the metadata label "view/name", as set by a view plugin earlier in the chain
+	Port string // local port the query was received on
+}
+
+type tenant struct {
+	name string
+	sel  TenantSelector
+	f    *Forward
+}
+
+// viewLabel is the metadata label TenantSelector.View is matched against.
+const viewLabel = "view/name"
+
+// NewTenants returns a Tenants without tenants.
+func NewTenants() *Tenants { return &Tenants{} }
+
+// Add sets up a tenant called name from c, and starts it. Upstreams it shares with other tenants reuse their
+// connection cache, with the connection settings of the tenant that added the upstream first.
+func (t *Tenants) Add(name string, sel TenantSelector, c Config) error {
+	f, err := FromConfig(c)
+	if err != nil {
+		return err
+	}
+	f.Next = t.Next
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, tn := range t.tenants {
+		if tn.name == name {
+			return fmt.Errorf("tenant already exists: %s", name)
+		}
+	}
+	for _, p := range f.upstreams() {
+		if shared := t.sharedTransport(f, p); shared != nil {
+			p.SetTransport(shared)
+		}
+	}
+	if err := f.OnStartup(); err != nil {
+		f.OnShutdown()
+		return err
+	}
+	t.tenants = append(t.tenants, &tenant{name: name, sel: sel, f: f})
+	return nil
+}
+
+// Remove stops the tenant called name and removes it. Shared connection caches stay open while other
+// tenants use them.
+func (t *Tenants) Remove(name string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, tn := range t.tenants {
+		if tn.name == name {
+			t.tenants = append(t.tenants[:i], t.tenants[i+1:]...)
+			return tn.f.OnShutdown()
+		}
+	}
+	return fmt.Errorf("no such tenant: %s", name)
+}
+
+// Get returns the Forward of the tenant called name, or nil.
+func (t *Tenants) Get(name string) *Forward {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, tn := range t.tenants {
+		if tn.name == name {
+			return tn.f
+		}
+	}
+	return nil
+}
+
+// OnShutdown stops all tenants.
+func (t *Tenants) OnShutdown() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, tn := range t.tenants {
+		tn.f.OnShutdown()
+	}
+	t.tenants = nil
+	return nil
+}
+
+// Name implements plugin.Handler.
+func (t *Tenants) Name() string { return "forward" }
+
+// ServeDNS implements plugin.Handler.
+func (t *Tenants) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	if f := t.selectTenant(ctx, request.Request{W: w, Req: r}); f != nil {
+		return f.ServeDNS(ctx, w, r)
+	}
+	return plugin.NextOrFailure(t.Name(), t.Next, ctx, w, r)
+}
+
+// selectTenant returns the Forward of the first tenant that selects state, or nil.
+func (t *Tenants) selectTenant(ctx context.Context, state request.Request) *Forward {
+	view := ""
+	if fn := metadata.ValueFunc(ctx, viewLabel); fn != nil {
+		view = fn()
+	}
+	_, port, _ := net.SplitHostPort(state.LocalAddr())
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, tn := range t.tenants {
+		if (tn.sel.View == "" || tn.sel.View == view) && (tn.sel.Port == "" || tn.sel.Port == port) {
+			return tn.f
+		}
+	}
+	return nil
+}
+
+// sharedTransport returns the transport another tenant uses for the upstream of p, or nil if there is none
+// or it can't be shared. Only plain DNS and unix socket upstreams, and TLS upstreams with the same server
+// name and tls_session_cache, no client certificate, no tls_keylog and no tls_alpn or tls_version are shared.
+// The mutex must be held.
+func (t *Tenants) sharedTransport(f *Forward, p *Proxy) *persistentTransport {
+	if _, ok := p.transport.(*persistentTransport); !ok || p.trans == transport.GRPC {
+		return nil
+	}
+	if p.trans == transport.TLS && (f.tlsSet || f.keyLog != nil) {
+		return nil
+	}
+	for _, tn := range t.tenants {
+		g := tn.f.current()
+		for _, q := range g.upstreams() {
+			if q.addr != p.addr || q.trans != p.trans {
+				continue
+			}
+			if q.trans == transport.TLS && (g.tlsSet || g.keyLog != nil || g.tlsSessions != f.tlsSessions ||
+				g.tlsConfig.ServerName != f.tlsConfig.ServerName || g.tlsOpts[q] != nil || f.tlsOpts[p] != nil) {
+				continue
+			}
+			if shared, ok := q.transport.(*persistentTransport); ok {
+				return shared
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package forward
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/metadata"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+// portWriter is a test.ResponseWriter that received the query on port.
+type portWriter struct {
+	test.ResponseWriter
+	port int
+}
+
+func (w *portWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: w.port}
+}
+
+func TestTenants(t *testing.T) {
+	s := newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A(r.Question[0].Name+" IN A 127.0.0.1"))
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	ts := NewTenants()
+	ts.Next = test.NextHandler(dns.RcodeRefused, nil)
+	defer ts.OnShutdown()
+
+	if err := ts.Add("internal", TenantSelector{View: "internal"}, Config{From: ".", To: []string{s.Addr}}); err != nil {
+		t.Fatalf("Failed to add tenant: %s", err)
+	}
+	if err := ts.Add("port1053", TenantSelector{Port: "1053"}, Config{From: "example.org", To: []string{s.Addr}}); err != nil {
+		t.Fatalf("Failed to add tenant: %s", err)
+	}
+	if err := ts.Add("internal", TenantSelector{}, Config{From: ".", To: []string{s.Addr}}); err == nil {
+		t.Errorf("Expected a duplicate tenant to be rejected")
+	}
+
+	p1, p2 := ts.Get("internal").proxies[0], ts.Get("port1053").proxies[0]
+	if p1 == p2 || p1.transport != p2.transport {
+		t.Errorf("Expected the tenants to share the transport of their common upstream")
+	}
+
+	tests := []struct {
+		view     string
+		port     int
+		qname    string
+		expected int
+	}{
+		{"internal", 53, "example.net.", dns.RcodeSuccess},
+		{"", 1053, "example.org.", dns.RcodeSuccess},
+		{"", 1053, "example.net.", dns.RcodeRefused}, // selected, but not forwarded by the tenant
+		{"external", 53, "example.org.", dns.RcodeRefused},
+	}
+	for i, tc := range tests {
+		ctx := metadata.ContextWithMetadata(context.TODO())
+		if tc.view != "" {
+			view := tc.view
+			metadata.SetValueFunc(ctx, viewLabel, func() string { return view })
+		}
+		m := new(dns.Msg)
+		m.SetQuestion(tc.qname, dns.TypeA)
+		rec := dnstest.NewRecorder(&portWriter{port: tc.port})
+		rcode, _ := ts.ServeDNS(ctx, rec, m)
+		if rec.Msg != nil {
+			rcode = rec.Msg.Rcode
+		}
+		if rcode != tc.expected {
+			t.Errorf("Test %d: expected rcode %d, got %d", i, tc.expected, rcode)
+		}
+	}
+
+	// The shared cache outlives the tenant that added it.
+	if err := ts.Remove("internal"); err != nil {
+		t.Fatalf("Failed to remove tenant: %s", err)
+	}
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&portWriter{port: 1053})
+	if _, err := ts.ServeDNS(context.TODO(), rec, m); err != nil || rec.Msg == nil || len(rec.Msg.Answer) != 1 {
+		t.Errorf("Expected an answer after removing the other tenant, got %v, %v", rec.Msg, err)
+	}
+}
+
+func TestTenantsShareTLS(t *testing.T) {
+	ts := NewTenants()
+	defer ts.OnShutdown()
+
+	keys := filepath.Join(t.TempDir(), "keys")
+	tenants := []struct {
+		name string
+		c    Config
+	}{
+		{"keylog", Config{From: ".", To: []string{"tls://127.0.0.1"}, TLSKeyLog: keys}},
+		{"plain", Config{From: ".", To: []string{"tls://127.0.0.1"}}},
+		{"plain2", Config{From: ".", To: []string{"tls://127.0.0.1"}}},
+		{"sessions", Config{From: ".", To: []string{"tls://127.0.0.1"}, TLSSessionCache: &TLSSessionCacheConfig{Size: 10}}},
+	}
+	for _, tn := range tenants {
+		if err := ts.Add(tn.name, TenantSelector{Port: tn.name}, tn.c); err != nil {
+			t.Fatalf("Failed to add tenant %s: %s", tn.name, err)
+		}
+	}
+
+	tr := func(name string) Transport { return ts.Get(name).proxies[0].transport }
+	if tr("plain") != tr("plain2") {
+		t.Errorf("Expected tenants with the same TLS settings to share the transport")
+	}
+	if tr("keylog") == tr("plain") {
+		t.Errorf("Expected a tenant with a tls_keylog not to share the transport")
+	}
+	if tr("sessions") == tr("plain") || tr("sessions") == tr("keylog") {
+		t.Errorf("Expected a tenant with another tls_session_cache not to share the transport")
+	}
+}
@@ -0,0 +1,215 @@
+// Package testutil has helpers to test code using the forward plugin without real resolvers.
+package testutil
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	forward "github.com/microdog/pforward"
+
+	"github.com/miekg/dns"
+)
+
+// Upstream is a scripted, in-memory DNS upstream. It answers the queries it has answers for and NXDOMAIN
+// otherwise, after an optional delay, and can drop or truncate replies. Upstream is a forward.Transport, so
+// it can be put behind a proxy with Proxy.SetTransport, and a dns.Handler, to be served by a dns.Server:
+//
+//	u := testutil.NewUpstream().Answer("example.org.", dns.TypeA, "example.org. 300 IN A 127.0.0.1")
+//	p := forward.NewProxy("fake", transport.DNS)
+//	p.SetTransport(u)
+//
+// All methods are safe for concurrent use, also while queries are answered.
+type Upstream struct {
+	mu       sync.Mutex
+	answers  map[question][]dns.RR
+	rcodes   map[question]int
+	delay    time.Duration
+	drop     int // next queries to drop, < 0 drops all
+	truncate bool
+	queries  []*dns.Msg
+}
+
+type question struct {
+	name  string
+	qtype uint16
+}
+
+// NewUpstream returns an Upstream without any answers.
+func NewUpstream() *Upstream {
+	return &Upstream{answers: map[question][]dns.RR{}, rcodes: map[question]int{}}
+}
+
+// Answer adds rrs, in zone file format, to the answer for name and qtype. It panics if an RR doesn't parse.
+func (u *Upstream) Answer(name string, qtype uint16, rrs ...string) *Upstream {
+	q := question{strings.ToLower(dns.Fqdn(name)), qtype}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, s := range rrs {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			panic(err)
+		}
+		u.answers[q] = append(u.answers[q], rr)
+	}
+	return u
+}
+
+// Rcode makes u answer queries for name and qtype with rcode, and the answers added for them if any.
+func (u *Upstream) Rcode(name string, qtype uint16, rcode int) *Upstream {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.rcodes[question{strings.ToLower(dns.Fqdn(name)), qtype}] = rcode
+	return u
+}
+
+// Delay makes u wait d before answering.
+func (u *Upstream) Delay(d time.Duration) *Upstream {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.delay = d
+	return u
+}
+
+// Drop makes u drop the next n queries, or all queries when n is negative. Dropped queries time out after
+// ReadTimeout, or when the exchange's context is done. Drop(0) stops dropping.
+func (u *Upstream) Drop(n int) *Upstream {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.drop = n
+	return u
+}
+
+// Truncate makes u answer queries received over UDP with an empty, truncated reply, so the client has to
+// retry over TCP.
+func (u *Upstream) Truncate(truncate bool) *Upstream {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.truncate = truncate
+	return u
+}
+
+// Queries returns the queries u received so far, dropped ones included.
+func (u *Upstream) Queries() []*dns.Msg {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	qs := make([]*dns.Msg, len(u.queries))
+	copy(qs, u.queries)
+	return qs
+}
+
+// reply returns the reply to m, received over proto, the delay to wait before sending it and whether it
+// should be dropped.
+func (u *Upstream) reply(m *dns.Msg, proto string) (*dns.Msg, time.Duration, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.queries = append(u.queries, m.Copy())
+
+	if u.drop != 0 {
+		if u.drop > 0 {
+			u.drop--
+		}
+		return nil, u.delay, true
+	}
+
+	ret := new(dns.Msg)
+	ret.SetReply(m)
+	if proto == "udp" && u.truncate {
+		ret.Truncated = true
+		return ret, u.delay, false
+	}
+	if len(m.Question) == 0 {
+		ret.Rcode = dns.RcodeFormatError
+		return ret, u.delay, false
+	}
+
+	q := question{strings.ToLower(m.Question[0].Name), m.Question[0].Qtype}
+	for _, rr := range u.answers[q] {
+		ret.Answer = append(ret.Answer, dns.Copy(rr))
+	}
+	rcode, ok := u.rcodes[q]
+	switch {
+	case ok:
+		ret.Rcode = rcode
+	case len(ret.Answer) == 0 && !u.known(q.name):
+		ret.Rcode = dns.RcodeNameError
+	}
+	return ret, u.delay, false
+}
+
+// known returns true if there are answers or an rcode for name, of any type.
+func (u *Upstream) known(name string) bool {
+	for q := range u.answers {
+		if q.name == name {
+			return true
+		}
+	}
+	for q := range u.rcodes {
+		if q.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Exchange implements forward.Transport.
+func (u *Upstream) Exchange(ctx context.Context, m *dns.Msg, proto string, udpSize uint16) (*dns.Msg, forward.ExchangeInfo, error) {
+	info := forward.ExchangeInfo{Proto: proto}
+	ret, delay, drop := u.reply(m, proto)
+	if drop {
+		delay = ReadTimeout
+	}
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return nil, info, ctx.Err()
+		}
+	}
+	if drop {
+		return nil, info, errTimeout{}
+	}
+	info.Size = ret.Len()
+	return ret, info, nil
+}
+
+// Start implements forward.Transport.
+func (u *Upstream) Start() {}
+
+// Close implements forward.Transport.
+func (u *Upstream) Close() {}
+
+// SetTLSConfig implements forward.Transport.
+func (u *Upstream) SetTLSConfig(*tls.Config) {}
+
+// SetExpire implements forward.Transport.
+func (u *Upstream) SetExpire(time.Duration) {}
+
+// ServeDNS implements dns.Handler.
+func (u *Upstream) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	proto := "udp"
+	if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+		proto = "tcp"
+	}
+	ret, delay, drop := u.reply(r, proto)
+	time.Sleep(delay)
+	if drop {
+		return
+	}
+	w.WriteMsg(ret)
+}
+
+// ReadTimeout is how long a dropped exchange takes to time out, like the read timeout of the default transport.
+var ReadTimeout = 2 * time.Second
+
+// errTimeout is returned by Exchange for dropped queries, it's a net.Error so it's classified as a timeout.
+type errTimeout struct{}
+
+func (errTimeout) Error() string   { return "testutil: i/o timeout" }
+func (errTimeout) Timeout() bool   { return true }
+func (errTimeout) Temporary() bool { return true }
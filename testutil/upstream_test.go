@@ -0,0 +1,103 @@
+package testutil_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+	forward "github.com/microdog/pforward"
+	"github.com/microdog/pforward/testutil"
+
+	"github.com/miekg/dns"
+)
+
+func TestUpstream(t *testing.T) {
+	testutil.ReadTimeout = 50 * time.Millisecond
+
+	u := testutil.NewUpstream().
+		Answer("example.org.", dns.TypeA, "example.org. 300 IN A 127.0.0.1", "example.org. 300 IN A 127.0.0.2").
+		Rcode("refused.example.org.", dns.TypeA, dns.RcodeRefused)
+
+	p := forward.NewProxy("fake", transport.DNS)
+	p.SetTransport(u)
+	f := forward.New()
+	f.SetProxy(p)
+	defer f.OnShutdown()
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		f.ServeDNS(context.TODO(), rec, m)
+		return rec.Msg
+	}
+
+	if ret := query("example.org.", dns.TypeA); ret == nil || len(ret.Answer) != 2 {
+		t.Errorf("Expected 2 answers, got %v", ret)
+	}
+	if ret := query("example.org.", dns.TypeAAAA); ret == nil || ret.Rcode != dns.RcodeSuccess || len(ret.Answer) != 0 {
+		t.Errorf("Expected NODATA for a known name, got %v", ret)
+	}
+	if ret := query("example.net.", dns.TypeA); ret == nil || ret.Rcode != dns.RcodeNameError {
+		t.Errorf("Expected NXDOMAIN for an unknown name, got %v", ret)
+	}
+	if ret := query("refused.example.org.", dns.TypeA); ret == nil || ret.Rcode != dns.RcodeRefused {
+		t.Errorf("Expected REFUSED, got %v", ret)
+	}
+
+	// Truncated over UDP, which the client has to retry over TCP.
+	u.Truncate(true)
+	if ret := query("example.org.", dns.TypeA); ret == nil || len(ret.Answer) != 0 || !ret.Truncated {
+		t.Errorf("Expected a truncated reply over UDP, got %v", ret)
+	}
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{TCP: true})
+	f.ServeDNS(context.TODO(), rec, m)
+	if rec.Msg == nil || len(rec.Msg.Answer) != 2 || rec.Msg.Truncated {
+		t.Errorf("Expected the full answer over TCP, got %v", rec.Msg)
+	}
+	u.Truncate(false)
+
+	// The first attempt is dropped, the retry answered.
+	u.Drop(1)
+	if ret := query("example.org.", dns.TypeA); ret == nil || len(ret.Answer) != 2 {
+		t.Errorf("Expected the retry to be answered, got %v", ret)
+	}
+
+	u.Drop(-1)
+	if ret := query("example.org.", dns.TypeA); ret != nil {
+		t.Errorf("Expected no reply when all queries are dropped, got %v", ret)
+	}
+}
+
+func TestUpstreamDelay(t *testing.T) {
+	u := testutil.NewUpstream().Delay(time.Second)
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, _, err := u.Exchange(ctx, m, "udp", 512); err != context.DeadlineExceeded {
+		t.Errorf("Expected %s, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestUpstreamServer(t *testing.T) {
+	u := testutil.NewUpstream().Answer("example.org.", dns.TypeA, "example.org. 300 IN A 127.0.0.1")
+	s := dnstest.NewServer(u.ServeDNS)
+	defer s.Close()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	ret, err := dns.Exchange(m, s.Addr)
+	if err != nil {
+		t.Fatalf("Expected a reply, got %s", err)
+	}
+	if len(ret.Answer) != 1 {
+		t.Errorf("Expected 1 answer, got %v", ret)
+	}
+}
@@ -0,0 +1,113 @@
+package forward
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// tlsOptions are the TLS settings of tls_alpn, tls_version and tls_ech for one upstream. Zero fields are
+// Go's defaults.
+type tlsOptions struct {
+	alpn       []string
+	minVersion uint16
+	maxVersion uint16
+	ech        []byte // ECHConfigList, of tls_ech or looked up at echFrom
+	echFrom    string
+}
+
+// tlsVersions are the versions tls_version accepts.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsOptionsFor returns the tlsOptions of p, creating them.
+func (f *Forward) tlsOptionsFor(p *Proxy) *tlsOptions {
+	if f.tlsOpts == nil {
+		f.tlsOpts = map[*Proxy]*tlsOptions{}
+	}
+	o := f.tlsOpts[p]
+	if o == nil {
+		o = &tlsOptions{}
+		f.tlsOpts[p] = o
+	}
+	return o
+}
+
+// parseALPN parses the arguments of tls_alpn: a comma separated list of protocols, e.g. dot,h2, and the
+// upstreams they're for.
+func (f *Forward) parseALPN(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("tls_alpn needs at least one protocol")
+	}
+	protos := strings.Split(args[0], ",")
+	for _, proto := range protos {
+		if proto == "" {
+			return fmt.Errorf("empty ALPN protocol in %s", args[0])
+		}
+	}
+	proxies, err := f.matchProxies(args[1:])
+	if err != nil {
+		return err
+	}
+	for _, p := range proxies {
+		f.tlsOptionsFor(p).alpn = protos
+	}
+	return nil
+}
+
+// parseTLSVersion parses the arguments of tls_version: a minimum version, an optional maximum and the
+// upstreams they're for.
+func (f *Forward) parseTLSVersion(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("tls_version needs a minimum version")
+	}
+	min, ok := tlsVersions[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown TLS version: %s", args[0])
+	}
+	args = args[1:]
+	var max uint16
+	if len(args) > 0 {
+		if v, ok := tlsVersions[args[0]]; ok {
+			if v < min {
+				return fmt.Errorf("maximum TLS version is lower than the minimum: %s", args[0])
+			}
+			max, args = v, args[1:]
+		}
+	}
+	proxies, err := f.matchProxies(args)
+	if err != nil {
+		return err
+	}
+	for _, p := range proxies {
+		o := f.tlsOptionsFor(p)
+		o.minVersion, o.maxVersion = min, max
+	}
+	return nil
+}
+
+// apply returns cfg with the options of o, cfg itself is left alone.
+func (o *tlsOptions) apply(cfg *tls.Config) *tls.Config {
+	cfg = cfg.Clone()
+	if len(o.alpn) > 0 {
+		cfg.NextProtos = o.alpn
+	}
+	if o.minVersion != 0 {
+		cfg.MinVersion = o.minVersion
+	}
+	if o.maxVersion != 0 {
+		cfg.MaxVersion = o.maxVersion
+	}
+	if o.ech != nil {
+		// ECH is TLS 1.3 only.
+		setECH(cfg, o.ech)
+		if cfg.MinVersion < tls.VersionTLS13 {
+			cfg.MinVersion = tls.VersionTLS13
+		}
+	}
+	return cfg
+}
@@ -0,0 +1,237 @@
+package forward
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/reuseport"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// tracer logs the decisions made for queries matching one of its rules. Rules are managed over HTTP on
+// /debug/forward/trace, so tracing can be switched on and off at runtime:
+//
+//	POST   ?name=DOMAIN    trace queries for DOMAIN (a plain name, wildcard or regex: pattern)
+//	POST   ?client=CIDR    trace queries from clients in CIDR, a single address works too
+//	DELETE                 remove all rules
+//	GET                    list the rules as JSON
+type tracer struct {
+	addr    string
+	unicode bool // show names in Unicode, see idn_display
+
+	mu      sync.RWMutex
+	names   []string
+	pattern []*regexp.Regexp // compiled names, nil for plain ones
+	clients []*net.IPNet
+
+	ln  net.Listener
+	srv *http.Server
+}
+
+// queryTrace is the trace of a single query, its methods are noops on a nil queryTrace.
+type queryTrace struct {
+	prefix string
+}
+
+type traceKey struct{}
+
+// begin returns the trace for state, or nil if it shouldn't be traced.
+func (t *tracer) begin(state request.Request) *queryTrace {
+	if t == nil || !t.match(state) {
+		return nil
+	}
+	return &queryTrace{prefix: fmt.Sprintf("Trace %d %s %s from %s: ", state.Req.Id, displayName(state.QName(), t.unicode), state.Type(), state.IP())}
+}
+
+func (t *tracer) match(state request.Request) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if len(t.names) == 0 && len(t.clients) == 0 {
+		return false
+	}
+	name := state.Name()
+	for i := range t.names {
+		if t.pattern[i] != nil {
+			if matchPattern(t.pattern[i], name) {
+				return true
+			}
+			continue
+		}
+		if plugin.Name(t.names[i]).Matches(name) {
+			return true
+		}
+	}
+	ip := net.ParseIP(state.IP())
+	for _, n := range t.clients {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (q *queryTrace) logf(format string, v ...interface{}) {
+	if q == nil {
+		return
+	}
+	log.Infof(q.prefix+format, v...)
+}
+
+func withTrace(ctx context.Context, q *queryTrace) context.Context {
+	if q == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, traceKey{}, q)
+}
+
+func traceFrom(ctx context.Context) *queryTrace {
+	q, _ := ctx.Value(traceKey{}).(*queryTrace)
+	return q
+}
+
+func (t *tracer) addName(name string) error {
+	re, ok, err := compilePattern(name)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		name = normalizeHost(name)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.names = append(t.names, name)
+	t.pattern = append(t.pattern, re)
+	return nil
+}
+
+func (t *tracer) addClient(s string) error {
+	n, err := parseCIDR(s)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.clients = append(t.clients, n)
+	return nil
+}
+
+func (t *tracer) clear() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.names, t.pattern, t.clients = nil, nil, nil
+}
+
+// ServeHTTP implements http.Handler.
+func (t *tracer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		q := r.URL.Query()
+		for _, name := range q["name"] {
+			if err := t.addName(name); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		for _, client := range q["client"] {
+			if err := t.addClient(client); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	case http.MethodDelete:
+		t.clear()
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	t.mu.RLock()
+	rules := struct {
+		Names   []string `json:"names"`
+		Clients []string `json:"clients"`
+	}{Names: []string{}, Clients: []string{}}
+	for _, n := range t.names {
+		rules.Names = append(rules.Names, displayName(n, t.unicode))
+	}
+	for _, n := range t.clients {
+		rules.Clients = append(rules.Clients, n.String())
+	}
+	t.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules)
+}
+
+// start starts the HTTP endpoint.
+func (t *tracer) start() error {
+	ln, err := reuseport.Listen("tcp", t.addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/debug/forward/trace", t)
+
+	t.ln = ln
+	t.srv = &http.Server{Handler: mux}
+	go t.srv.Serve(ln)
+	return nil
+}
+
+// stop stops the HTTP endpoint.
+func (t *tracer) stop() error {
+	if t.srv == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return t.srv.Shutdown(ctx)
+}
+
+const defaultTraceAddr = "localhost:9156"
+
+func (r fwdResp) String() string {
+	switch {
+	case r.ret != nil:
+		return fmt.Sprintf("rcode %s with %d answers in %s over %s (reused %t, %d retries)",
+			dns.RcodeToString[r.ret.Rcode], len(r.ret.Answer), r.info.RTT, r.info.Proto, r.info.Reused, r.info.Retries)
+	case r.mismatch:
+		return "mismatched reply"
+	case r.upstreamErr != nil:
+		return r.upstreamErr.Error()
+	}
+	return "no reply"
+}
+
+// parseCIDR parses s as a CIDR, a single address is taken as a /32 or /128.
+func parseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		if strings.Contains(s, ":") {
+			s += "/128"
+		} else {
+			s += "/32"
+		}
+	}
+	_, n, err := net.ParseCIDR(s)
+	return n, err
+}
+
+// proxyAddrs returns the addresses of proxies, for logging.
+func proxyAddrs(proxies []*Proxy) string {
+	addrs := make([]string, len(proxies))
+	for i, p := range proxies {
+		addrs[i] = p.addr
+	}
+	return strings.Join(addrs, ", ")
+}
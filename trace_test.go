@@ -0,0 +1,58 @@
+package forward
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+func TestTracer(t *testing.T) {
+	tr := &tracer{}
+
+	state := func(qname string) request.Request {
+		m := new(dns.Msg)
+		m.SetQuestion(qname, dns.TypeA)
+		return request.Request{W: &test.ResponseWriter{}, Req: m} // client is 10.240.0.1
+	}
+
+	if tr.begin(state("example.org.")) != nil {
+		t.Fatalf("Expected no trace without rules")
+	}
+
+	tests := []struct {
+		method   string
+		query    string
+		qname    string
+		expected bool
+	}{
+		{"POST", "name=example.org", "a.example.org.", true},
+		{"POST", "name=example.org", "example.com.", false},
+		{"POST", "name=*.example.com", "a.example.com.", true},
+		{"DELETE", "", "a.example.org.", false},
+		{"POST", "client=10.240.0.0/16", "example.net.", true},
+		{"DELETE", "", "example.net.", false},
+		{"POST", "client=10.240.0.1", "example.net.", true},
+		{"DELETE", "", "example.net.", false},
+	}
+	for i, tc := range tests {
+		rec := httptest.NewRecorder()
+		tr.ServeHTTP(rec, httptest.NewRequest(tc.method, "/debug/forward/trace?"+tc.query, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Test %d: expected status 200, got %d", i, rec.Code)
+		}
+		if x := tr.begin(state(tc.qname)) != nil; x != tc.expected {
+			t.Errorf("Test %d: expected tracing %s to be %t, got %t", i, tc.qname, tc.expected, x)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	tr.ServeHTTP(rec, httptest.NewRequest("POST", "/debug/forward/trace?client=example.org", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a bad client, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,38 @@
+package forward
+
+import (
+	"context"
+	"crypto/tls"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Transport is used by a Proxy to exchange messages with its upstream. The default transport, used by
+// NewProxy, speaks DNS over UDP, TCP and TLS and caches connections; others can be set with
+// Proxy.SetTransport.
+type Transport interface {
+	// Exchange sends m to the upstream and returns the reply carrying m's ID, together with the reply's
+	// size on the wire, the protocol used and whether a cached connection was used. Proto is the
+	// protocol preferred for this exchange, "udp" or "tcp", udpSize the buffer size to use for UDP.
+	// Exchange must return as soon as ctx is done. ErrCachedClosed may be returned to signal the exchange
+	// should be retried.
+	Exchange(ctx context.Context, m *dns.Msg, proto string, udpSize uint16) (*dns.Msg, ExchangeInfo, error)
+	// Start is called when the proxy is started, before the first Exchange.
+	Start()
+	// Close releases all resources held by the transport.
+	Close()
+
+	SetTLSConfig(*tls.Config)
+	SetExpire(time.Duration)
+}
+
+// ExchangeInfo describes how a message was exchanged with an upstream. The transport fills in Size, Proto
+// and Reused, the proxy the RTT and the forwarder the number of Retries.
+type ExchangeInfo struct {
+	Size    int           // size of the reply on the wire
+	Proto   string        // protocol used, e.g. "udp", "tcp", "tcp-tls" or "grpc"
+	Reused  bool          // a cached connection was used
+	RTT     time.Duration // time the exchange took
+	Retries int           // exchanges retried before this one, e.g. after a truncated reply
+}
@@ -11,6 +11,16 @@ const (
 	typeTotalCount // keep this last
 )
 
+func (t transportType) String() string {
+	switch t {
+	case typeTcp:
+		return "tcp"
+	case typeTls:
+		return "tcp-tls"
+	}
+	return "udp"
+}
+
 func stringToTransportType(s string) transportType {
 	switch s {
 	case "udp":
@@ -24,7 +34,7 @@ func stringToTransportType(s string) transportType {
 	return typeUdp
 }
 
-func (t *Transport) transportTypeFromConn(pc *persistConn) transportType {
+func (t *persistentTransport) transportTypeFromConn(pc *persistConn) transportType {
 	if _, ok := pc.c.Conn.(*net.UDPConn); ok {
 		return typeUdp
 	}
@@ -0,0 +1,68 @@
+package forward
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Transports for upstreams on a unix domain socket. These are not in plugin/pkg/transport, as CoreDNS
+// itself doesn't know about them.
+const (
+	transportUnix     = "unix"     // stream socket, messages are framed as on TCP
+	transportUnixgram = "unixgram" // datagram socket, messages are sent as on UDP
+)
+
+// parseUnix returns the transport and path of a unix:// or unixgram:// upstream. Ok is false when host
+// isn't one.
+func parseUnix(host string) (trans, path string, ok bool) {
+	for _, trans := range []string{transportUnix, transportUnixgram} {
+		if strings.HasPrefix(host, trans+"://") {
+			return trans, host[len(trans)+3:], true
+		}
+	}
+	return "", "", false
+}
+
+// streamConn hides that a unix stream socket is a net.PacketConn, which would make dns.Conn treat it as a
+// datagram socket and drop the length prefix.
+type streamConn struct{ net.Conn }
+
+// gramConn removes the socket file it is bound to on close.
+type gramConn struct {
+	*net.UnixConn
+	path string
+}
+
+func (c *gramConn) Close() error {
+	err := c.UnixConn.Close()
+	os.Remove(c.path)
+	return err
+}
+
+var gramSeq uint32
+
+// dialUnix dials the socket at path. A datagram socket needs a name of its own for the reply to be sent
+// to, so we bind one in the temp directory.
+func dialUnix(network, path string, timeout time.Duration) (*dns.Conn, error) {
+	if network == transportUnix {
+		conn, err := net.DialTimeout("unix", path, timeout)
+		if err != nil {
+			return nil, err
+		}
+		return &dns.Conn{Conn: streamConn{conn}}, nil
+	}
+
+	local := filepath.Join(os.TempDir(), fmt.Sprintf("pforward-%d-%d.sock", os.Getpid(), atomic.AddUint32(&gramSeq, 1)))
+	conn, err := net.DialUnix("unixgram", &net.UnixAddr{Name: local, Net: "unixgram"}, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &dns.Conn{Conn: &gramConn{UnixConn: conn, path: local}}, nil
+}
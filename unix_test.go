@@ -0,0 +1,92 @@
+package forward
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/caddyserver/caddy"
+	"github.com/miekg/dns"
+)
+
+func unixAnswer(buf []byte) []byte {
+	r := new(dns.Msg)
+	if err := r.Unpack(buf); err != nil {
+		return nil
+	}
+	ret := new(dns.Msg)
+	ret.SetReply(r)
+	ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"))
+	out, _ := ret.Pack()
+	return out
+}
+
+func TestUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pforward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// stream
+	stream := filepath.Join(dir, "stream.sock")
+	l, err := net.Listen("unix", stream)
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	s := &dns.Server{Listener: l, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		buf, _ := r.Pack()
+		w.Write(unixAnswer(buf))
+	})}
+	go s.ActivateAndServe()
+	defer s.Shutdown()
+
+	// datagram
+	gram := filepath.Join(dir, "gram.sock")
+	pc, err := net.ListenPacket("unixgram", gram)
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, dns.MaxMsgSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(unixAnswer(buf[:n]), addr)
+		}
+	}()
+
+	for _, to := range []string{"unix://" + stream, "unixgram://" + gram} {
+		c := caddy.NewTestController("dns", "forward . "+to)
+		f, err := parseForward(c)
+		if err != nil {
+			t.Fatalf("Failed to create forwarder for %s: %s", to, err)
+		}
+		f.OnStartup()
+
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", dns.TypeA)
+		for i := 0; i < 2; i++ { // second time over a cached connection
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+			if _, err := f.ServeDNS(context.TODO(), rec, m); err != nil {
+				t.Fatalf("Expected to receive reply from %s, but got: %s", to, err)
+			}
+			if len(rec.Msg.Answer) != 1 {
+				t.Errorf("Expected 1 answer from %s, got %d", to, len(rec.Msg.Answer))
+			}
+		}
+		if err := f.proxies[0].health.Check(f.proxies[0]); err != nil {
+			t.Errorf("Expected health check of %s to pass, got: %s", to, err)
+		}
+		f.OnShutdown()
+	}
+}
@@ -0,0 +1,89 @@
+package forward
+
+import (
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// asyncWriter writes responses to clients from a pool of goroutines, which bounds the writes in progress.
+// ServeDNS waits for its response to be written: the plugins in front of forward read it from the writer
+// they wrapped around w once ServeDNS returns, and the server may close a TCP connection then. When the
+// queue is full ServeDNS blocks until there is room again.
+type asyncWriter struct {
+	workers int
+	queue   chan asyncWrite
+	done    chan struct{}
+	wg      sync.WaitGroup
+
+	mu      sync.RWMutex
+	stopped bool
+}
+
+type asyncWrite struct {
+	w    dns.ResponseWriter
+	m    *dns.Msg
+	done chan struct{} // closed once m is written
+}
+
+func (x asyncWrite) write() {
+	x.w.WriteMsg(x.m)
+	close(x.done)
+}
+
+func newAsyncWriter(workers, queue int) *asyncWriter {
+	return &asyncWriter{workers: workers, queue: make(chan asyncWrite, queue), done: make(chan struct{})}
+}
+
+// write queues m to be written to w and waits until it is. Once the writer is stopped m is written right
+// away.
+func (a *asyncWriter) write(w dns.ResponseWriter, m *dns.Msg) {
+	a.mu.RLock()
+	if a.stopped {
+		a.mu.RUnlock()
+		w.WriteMsg(m)
+		return
+	}
+	x := asyncWrite{w, m, make(chan struct{})}
+	a.queue <- x
+	a.mu.RUnlock()
+	<-x.done
+}
+
+func (a *asyncWriter) start() {
+	for i := 0; i < a.workers; i++ {
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+			for {
+				select {
+				case x := <-a.queue:
+					x.write()
+				case <-a.done:
+					// Flush what's still queued.
+					for {
+						select {
+						case x := <-a.queue:
+							x.write()
+						default:
+							return
+						}
+					}
+				}
+			}
+		}()
+	}
+}
+
+// stop stops the workers once the queue is flushed.
+func (a *asyncWriter) stop() {
+	// Once stopped is set nothing is queued anymore, so the workers can flush the queue and exit.
+	a.mu.Lock()
+	a.stopped = true
+	a.mu.Unlock()
+
+	close(a.done)
+	a.wg.Wait()
+}
+
+const defaultQueuePerWorker = 64
@@ -0,0 +1,67 @@
+package forward
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+// syncRecorder records the written message and signals it was written.
+type syncRecorder struct {
+	test.ResponseWriter
+	mu      sync.Mutex
+	msg     *dns.Msg
+	written chan struct{}
+}
+
+func (r *syncRecorder) WriteMsg(m *dns.Msg) error {
+	r.mu.Lock()
+	r.msg = m
+	r.mu.Unlock()
+	close(r.written)
+	return nil
+}
+
+func TestAsyncWrite(t *testing.T) {
+	s := newTestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = append(ret.Answer, test.A("example.org. IN A 127.0.0.1"))
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	f := New()
+	f.writer = newAsyncWriter(1, 0)
+	f.SetProxy(NewProxy(s.Addr, transport.DNS))
+	defer f.OnShutdown()
+	f.writer.start()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	// Written by the time ServeDNS returns, for the plugins in front to see.
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := f.ServeDNS(context.TODO(), rec, m); err != nil {
+		t.Fatalf("Expected to receive reply, but got: %s", err)
+	}
+	if rec.Msg == nil || len(rec.Msg.Answer) != 1 {
+		t.Errorf("Expected 1 answer written, got %v", rec.Msg)
+	}
+}
+
+func TestAsyncWriteStopped(t *testing.T) {
+	a := newAsyncWriter(1, 1)
+	a.start()
+	a.stop()
+
+	// A stopped writer writes right away.
+	rec := &syncRecorder{written: make(chan struct{})}
+	a.write(rec, new(dns.Msg))
+	<-rec.written
+}